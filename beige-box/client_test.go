@@ -346,13 +346,13 @@ func TestClientInteractions(t *testing.T) {
 	var port0 uint16 = 3499
 	port0Str := strconv.FormatInt(int64(port0), 10)
 	dir0 := filepath.Join(os.TempDir(), "partytest.dir0")
-	wb0 := whitebox.New(dir0, "127.0.0.1", port0Str, self0)
+	wb0 := whitebox.New(dir0, "127.0.0.1", port0Str, self0, whitebox.DefaultConfig())
 	wb0.Run(port0)
 
 	var port1 uint16 = 4919
 	port1Str := strconv.FormatInt(int64(port1), 10)
 	dir1 := filepath.Join(os.TempDir(), "partytest.dir1")
-	wb1 := whitebox.New(dir1, "127.0.0.1", port1Str, self1)
+	wb1 := whitebox.New(dir1, "127.0.0.1", port1Str, self1, whitebox.DefaultConfig())
 	wb1.Run(port1)
 
 	err = testBootstrap(wb0, wb1, port1Str)
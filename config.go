@@ -0,0 +1,236 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/TACIXAT/party-line/white-box"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var configFlag *string
+
+// durations are written as "30s", "2ms" etc in the config file
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// [tuning] section, maps onto whitebox.Config
+type tuningConfig struct {
+	PingInterval              duration `toml:"ping_interval"`
+	StalePeerTimeout          duration `toml:"stale_peer_timeout"`
+	AdvertiseInterval         duration `toml:"advertise_interval"`
+	FileRequestInterval       duration `toml:"file_request_interval"`
+	RequestThrottle           duration `toml:"request_throttle"`
+	PendingCheckpointInterval duration `toml:"pending_checkpoint_interval"`
+	StateSaveInterval         duration `toml:"state_save_interval"`
+	BootstrapWait             duration `toml:"bootstrap_wait"`
+	BucketSize                int      `toml:"bucket_size"`
+	BucketRefresh             duration `toml:"bucket_refresh"`
+	SubnetLimit               int      `toml:"subnet_limit"`
+	MinPeerWork               int      `toml:"min_peer_work"`
+	IdWork                    int      `toml:"id_work"`
+	AckTimeout                duration `toml:"ack_timeout"`
+	AckRetries                int      `toml:"ack_retries"`
+	AddressRate               int      `toml:"address_rate"`
+	AddressBurst              int      `toml:"address_burst"`
+	BanStrikes                int      `toml:"ban_strikes"`
+	BanDuration               duration `toml:"ban_duration"`
+	MessageWindow             duration `toml:"message_window"`
+	PartyKeyRotation          duration `toml:"party_key_rotation"`
+	StrictSignatures          bool     `toml:"strict_signatures"`
+}
+
+// top level keys share names with the flags they set
+type fileConfig struct {
+	Debug     bool         `toml:"debug"`
+	Port      uint         `toml:"port"`
+	IP        string       `toml:"ip"`
+	NoNat     bool         `toml:"nonat"`
+	Share     string       `toml:"share"`
+	Perm      bool         `toml:"perm"`
+	Keyfile   string       `toml:"keyfile"`
+	Identity  string       `toml:"identity"`
+	Daemon    bool         `toml:"daemon"`
+	Control   string       `toml:"control"`
+	Bootstrap []string     `toml:"bootstrap"`
+	Join      []string     `toml:"join"`
+	Tuning    tuningConfig `toml:"tuning"`
+}
+
+func configPath() string {
+	return filepath.Join(baseDir(), "config.toml")
+}
+
+// Read the config file and apply it to every flag not given on the command
+// line. A missing file is only an error if -config was given.
+func loadConfig() whitebox.Config {
+	path := *configFlag
+	if path == "" {
+		path = configPath()
+	}
+
+	config, err := readConfig(flag.CommandLine, path, *configFlag != "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return config
+}
+
+// Apply the config file at path to the flags that weren't set on the
+// command line and build the whitebox.Config from its [tuning] section.
+func readConfig(flags *flag.FlagSet, path string,
+	required bool) (whitebox.Config, error) {
+	config := whitebox.DefaultConfig()
+
+	// flags given on the command line win over the config file
+	flagsSet := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		flagsSet[f.Name] = true
+	})
+
+	var file fileConfig
+	meta, err := toml.DecodeFile(path, &file)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return config, nil
+		}
+		return config, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	undecoded := meta.Undecoded()
+	if len(undecoded) > 0 {
+		return config, fmt.Errorf(
+			"unknown key %s in %s", undecoded[0].String(), path)
+	}
+
+	values := map[string]interface{}{
+		"debug":     file.Debug,
+		"port":      file.Port,
+		"ip":        file.IP,
+		"nonat":     file.NoNat,
+		"share":     file.Share,
+		"perm":      file.Perm,
+		"keyfile":   file.Keyfile,
+		"identity":  file.Identity,
+		"daemon":    file.Daemon,
+		"control":   file.Control,
+		"bootstrap": strings.Join(file.Bootstrap, ","),
+		"join":      strings.Join(file.Join, ","),
+	}
+
+	for name, value := range values {
+		if !meta.IsDefined(name) || flagsSet[name] {
+			continue
+		}
+
+		err = flags.Set(name, fmt.Sprint(value))
+		if err != nil {
+			return config, fmt.Errorf(
+				"bad value for %s in %s: %v", name, path, err)
+		}
+	}
+
+	tuning := file.Tuning
+	if meta.IsDefined("tuning", "ping_interval") {
+		config.PingInterval = tuning.PingInterval.Duration
+	}
+
+	if meta.IsDefined("tuning", "stale_peer_timeout") {
+		config.StalePeerTimeout = tuning.StalePeerTimeout.Duration
+	}
+
+	if meta.IsDefined("tuning", "advertise_interval") {
+		config.AdvertiseInterval = tuning.AdvertiseInterval.Duration
+	}
+
+	if meta.IsDefined("tuning", "file_request_interval") {
+		config.FileRequestInterval = tuning.FileRequestInterval.Duration
+	}
+
+	if meta.IsDefined("tuning", "request_throttle") {
+		config.RequestThrottle = tuning.RequestThrottle.Duration
+	}
+
+	if meta.IsDefined("tuning", "pending_checkpoint_interval") {
+		config.PendingCheckpointInterval =
+			tuning.PendingCheckpointInterval.Duration
+	}
+
+	if meta.IsDefined("tuning", "state_save_interval") {
+		config.StateSaveInterval = tuning.StateSaveInterval.Duration
+	}
+
+	if meta.IsDefined("tuning", "bootstrap_wait") {
+		config.BootstrapWait = tuning.BootstrapWait.Duration
+	}
+
+	if meta.IsDefined("tuning", "bucket_size") {
+		config.BucketSize = tuning.BucketSize
+	}
+
+	if meta.IsDefined("tuning", "bucket_refresh") {
+		config.BucketRefresh = tuning.BucketRefresh.Duration
+	}
+
+	if meta.IsDefined("tuning", "subnet_limit") {
+		config.SubnetLimit = tuning.SubnetLimit
+	}
+
+	if meta.IsDefined("tuning", "min_peer_work") {
+		config.MinPeerWork = tuning.MinPeerWork
+	}
+
+	if meta.IsDefined("tuning", "id_work") {
+		config.IdWork = tuning.IdWork
+	}
+
+	if meta.IsDefined("tuning", "ack_timeout") {
+		config.AckTimeout = tuning.AckTimeout.Duration
+	}
+
+	if meta.IsDefined("tuning", "ack_retries") {
+		config.AckRetries = tuning.AckRetries
+	}
+
+	if meta.IsDefined("tuning", "address_rate") {
+		config.AddressRate = tuning.AddressRate
+	}
+
+	if meta.IsDefined("tuning", "address_burst") {
+		config.AddressBurst = tuning.AddressBurst
+	}
+
+	if meta.IsDefined("tuning", "ban_strikes") {
+		config.BanStrikes = tuning.BanStrikes
+	}
+
+	if meta.IsDefined("tuning", "ban_duration") {
+		config.BanDuration = tuning.BanDuration.Duration
+	}
+
+	if meta.IsDefined("tuning", "message_window") {
+		config.MessageWindow = tuning.MessageWindow.Duration
+	}
+
+	if meta.IsDefined("tuning", "party_key_rotation") {
+		config.PartyKeyRotation = tuning.PartyKeyRotation.Duration
+	}
+
+	if meta.IsDefined("tuning", "strict_signatures") {
+		config.StrictSignatures = tuning.StrictSignatures
+	}
+
+	return config, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"github.com/TACIXAT/party-line/white-box"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fresh flags parsed from args, as main would have them.
+func configTestFlags(t *testing.T, args []string) *flag.FlagSet {
+	bootstrapFlag = nil
+	joinFlag = nil
+
+	flags := flag.NewFlagSet("party-line", flag.ContinueOnError)
+	defineFlags(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		t.Fatalf("Error parsing flags: %v", err)
+	}
+
+	return flags
+}
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.config")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tuned := whitebox.DefaultConfig()
+	tuned.PingInterval = 5 * time.Second
+	tuned.BucketSize = 8
+	tuned.StrictSignatures = true
+
+	tables := []struct {
+		name      string
+		contents  string
+		args      []string
+		config    whitebox.Config
+		port      uint
+		bootstrap []string
+	}{
+		{"defaults", "", nil, whitebox.DefaultConfig(), 3499, nil},
+		{"file values", strings.Join([]string{
+			`port = 4000`,
+			`bootstrap = ["1.2.3.4/3499/aa", "5.6.7.8/3499/bb"]`,
+			`[tuning]`,
+			`ping_interval = "5s"`,
+			`bucket_size = 8`,
+			`strict_signatures = true`,
+		}, "\n"), nil, tuned, 4000, []string{"1.2.3.4/3499/aa", "5.6.7.8/3499/bb"}},
+		{"flag over file", strings.Join([]string{
+			`port = 4000`,
+			`bootstrap = ["1.2.3.4/3499/aa"]`,
+		}, "\n"), []string{"-port", "5000", "-bootstrap", "9.9.9.9/3499/cc"},
+			whitebox.DefaultConfig(), 5000, []string{"9.9.9.9/3499/cc"}},
+	}
+
+	for _, table := range tables {
+		path := filepath.Join(dir, "config.toml")
+		err = ioutil.WriteFile(path, []byte(table.contents), 0600)
+		if err != nil {
+			t.Fatalf("Error writing config: %v", err)
+		}
+
+		flags := configTestFlags(t, table.args)
+		config, err := readConfig(flags, path, true)
+		if err != nil {
+			t.Errorf("Error reading %s config: %v", table.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(config, table.config) {
+			t.Errorf("Config from %s does not match:", table.name)
+			t.Errorf("Got: %+v", config)
+			t.Errorf("Expecting: %+v", table.config)
+		}
+
+		if *portFlag != table.port {
+			t.Errorf("Port from %s does not match:", table.name)
+			t.Errorf("Got: %d", *portFlag)
+			t.Errorf("Expecting: %d", table.port)
+		}
+
+		if !reflect.DeepEqual([]string(bootstrapFlag), table.bootstrap) {
+			t.Errorf("Bootstrap nodes from %s do not match:", table.name)
+			t.Errorf("Got: %v", bootstrapFlag)
+			t.Errorf("Expecting: %v", table.bootstrap)
+		}
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.config")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tables := []struct {
+		name     string
+		contents string
+	}{
+		{"unknown key", `colour = "blue"`},
+		{"unknown tuning key", "[tuning]\nping_intreval = \"5s\""},
+		{"bad duration", "[tuning]\nping_interval = \"soon\""},
+		{"wrong type", `port = "high"`},
+	}
+
+	for _, table := range tables {
+		path := filepath.Join(dir, "config.toml")
+		err = ioutil.WriteFile(path, []byte(table.contents), 0600)
+		if err != nil {
+			t.Fatalf("Error writing config: %v", err)
+		}
+
+		_, err := readConfig(configTestFlags(t, nil), path, false)
+		if err == nil {
+			t.Errorf("Config with %s read without an error.", table.name)
+		}
+	}
+
+	// only a file asked for with -config has to exist
+	missing := filepath.Join(dir, "missing.toml")
+	_, err = readConfig(configTestFlags(t, nil), missing, false)
+	if err != nil {
+		t.Errorf("Missing default config is an error: %v", err)
+	}
+
+	_, err = readConfig(configTestFlags(t, nil), missing, true)
+	if err == nil {
+		t.Errorf("Missing -config file read without an error.")
+	}
+}
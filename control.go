@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TACIXAT/party-line/white-box"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Local control socket. Clients send newline delimited JSON-RPC 2.0 requests
+with named params and get one response line per request that has an id.
+
+	{"jsonrpc":"2.0","id":1,"method":"send","params":{"party":"cool","message":"hi"}}
+	{"jsonrpc":"2.0","id":1,"result":"coolname6b1a2c3d4e5f60718293a4b5"}
+
+After "subscribe" the connection also gets "chat" and "status" notifications.
+*/
+
+const CONTROL_DISABLED = "off"
+
+// events buffered per subscriber before new ones are dropped
+const SUBSCRIBER_BUFFER = 100
+
+// JSON-RPC error codes
+const (
+	RPC_PARSE_ERROR      = -32700
+	RPC_INVALID_REQUEST  = -32600
+	RPC_METHOD_NOT_FOUND = -32601
+	RPC_INVALID_PARAMS   = -32602
+	RPC_COMMAND_ERROR    = -32000
+)
+
+var controlFlag *string
+
+type rpcRequest struct {
+	JsonRpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *rpcError) Error() string {
+	return err.Message
+}
+
+type rpcResponse struct {
+	JsonRpc string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *rpcError        `json:"error,omitempty"`
+}
+
+type rpcNotification struct {
+	JsonRpc string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// every method takes a subset of these
+type rpcParams struct {
+	Info    string `json:"info"`
+	Name    string `json:"name"`
+	Party   string `json:"party"`
+	Peer    string `json:"peer"`
+	Pack    string `json:"pack"`
+	Message string `json:"message"`
+	Chat    bool   `json:"chat"`
+	Status  bool   `json:"status"`
+}
+
+type controlList struct {
+	Parties []string `json:"parties"`
+	Invites []string `json:"invites"`
+}
+
+type controlFile struct {
+	Hash string `json:"hash"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+type controlPack struct {
+	Party string        `json:"party"`
+	Hash  string        `json:"hash"`
+	Name  string        `json:"name"`
+	Peers int           `json:"peers"`
+	State string        `json:"state"`
+	Files []controlFile `json:"files"`
+}
+
+// receive path counters, see TransportStats and RateStats
+type controlStats struct {
+	Received      uint64 `json:"received"`
+	ReadErrors    uint64 `json:"read_errors"`
+	Oversized     uint64 `json:"oversized"`
+	Malformed     uint64 `json:"malformed"`
+	SendErrors    uint64 `json:"send_errors"`
+	Fragments     uint64 `json:"fragments"`
+	Reassembled   uint64 `json:"reassembled"`
+	Limited       uint64 `json:"limited"`
+	TypeLimited   uint64 `json:"type_limited"`
+	SenderLimited uint64 `json:"sender_limited"`
+	Bans          uint64 `json:"bans"`
+	BannedDrops   uint64 `json:"banned_drops"`
+}
+
+type controlChat struct {
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	Id      string    `json:"id"`
+	Message string    `json:"message"`
+}
+
+type controlStatus struct {
+	Priority string `json:"priority"`
+	Message  string `json:"message"`
+}
+
+type subscriber struct {
+	Chats    bool
+	Statuses bool
+	Events   chan rpcNotification
+}
+
+type lockingSubscribers struct {
+	Map   map[*subscriber]bool
+	Mutex *sync.Mutex
+}
+
+var subscribers = lockingSubscribers{
+	Map:   make(map[*subscriber]bool),
+	Mutex: new(sync.Mutex)}
+
+func publish(event rpcNotification, wantChat bool) {
+	subscribers.Mutex.Lock()
+	defer subscribers.Mutex.Unlock()
+	for sub, _ := range subscribers.Map {
+		if (wantChat && !sub.Chats) || (!wantChat && !sub.Statuses) {
+			continue
+		}
+
+		// drop events for subscribers that aren't keeping up
+		select {
+		case sub.Events <- event:
+		default:
+		}
+	}
+}
+
+// Forward a chat from ChatChannel to control subscribers.
+func publishChat(chat whitebox.Chat) {
+	channel := chat.Channel
+	if channel == "" {
+		channel = "mainline"
+	}
+
+	publish(rpcNotification{
+		JsonRpc: "2.0",
+		Method:  "chat",
+		Params: controlChat{
+			Time:    chat.Time,
+			Channel: channel,
+			Id:      chat.Id,
+			Message: chat.Message}}, true)
+}
+
+// Forward a status from StatusChannel to control subscribers.
+func publishStatus(status whitebox.Status) {
+	priority := "low"
+	if status.Priority == whitebox.TONE_HIGH {
+		priority = "high"
+	}
+
+	publish(rpcNotification{
+		JsonRpc: "2.0",
+		Method:  "status",
+		Params: controlStatus{
+			Priority: priority,
+			Message:  status.Message}}, false)
+}
+
+func subscribe(chats, statuses bool) *subscriber {
+	sub := new(subscriber)
+	sub.Chats = chats
+	sub.Statuses = statuses
+	sub.Events = make(chan rpcNotification, SUBSCRIBER_BUFFER)
+
+	subscribers.Mutex.Lock()
+	subscribers.Map[sub] = true
+	subscribers.Mutex.Unlock()
+	return sub
+}
+
+func unsubscribe(sub *subscriber) {
+	subscribers.Mutex.Lock()
+	delete(subscribers.Map, sub)
+	subscribers.Mutex.Unlock()
+	close(sub.Events)
+}
+
+func controlPath() string {
+	return filepath.Join(baseDir(), "control.sock")
+}
+
+// Open the control socket. The returned listener removes the socket file when
+// closed.
+func startControl(wb *whitebox.WhiteBox, path string) (net.Listener, error) {
+	if path == "" {
+		path = controlPath()
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// a socket file nobody answers on is left over from a crash
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another node is using %s", path)
+	}
+	os.Remove(path)
+
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	go acceptControl(wb, listener)
+	return listener, nil
+}
+
+// A unix listener that removes its socket file at path when closed.
+type controlListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (listener *controlListener) Close() error {
+	err := listener.UnixListener.Close()
+	os.Remove(listener.path)
+	return err
+}
+
+// Listen in a fresh 0700 dir and only move the socket to path once it is
+// 0600, so nobody else can connect while the mode is being set.
+func listenPrivate(path string) (net.Listener, error) {
+	tmpDir, err := ioutil.TempDir(filepath.Dir(path), ".control")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpPath := filepath.Join(tmpDir, filepath.Base(path))
+	listener, err := net.ListenUnix(
+		"unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmpPath, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return &controlListener{listener, path}, nil
+}
+
+func acceptControl(wb *whitebox.WhiteBox, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println(err)
+			}
+			return
+		}
+
+		go serveControl(wb, conn)
+	}
+}
+
+func serveControl(wb *whitebox.WhiteBox, conn net.Conn) {
+	defer conn.Close()
+
+	writeMutex := new(sync.Mutex)
+	encoder := json.NewEncoder(conn)
+	write := func(value interface{}) {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		err := encoder.Encode(value)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	var sub *subscriber
+	defer func() {
+		if sub != nil {
+			unsubscribe(sub)
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		request := new(rpcRequest)
+		err := json.Unmarshal([]byte(line), request)
+		if err != nil {
+			write(rpcResponse{
+				JsonRpc: "2.0",
+				Error:   &rpcError{RPC_PARSE_ERROR, "parse error"}})
+			continue
+		}
+
+		var result interface{}
+		var rpcErr *rpcError
+		if request.JsonRpc != "2.0" || request.Method == "" {
+			rpcErr = &rpcError{RPC_INVALID_REQUEST, "invalid request"}
+		} else if request.Method == "subscribe" {
+			result, rpcErr = controlSubscribe(request, sub != nil)
+			if rpcErr == nil {
+				params := result.(rpcParams)
+				sub = subscribe(params.Chat, params.Status)
+				go forwardEvents(sub, write)
+				result = "subscribed"
+			}
+		} else {
+			result, rpcErr = handleControl(wb, request)
+		}
+
+		// no id means a notification, nothing to send back
+		if request.Id == nil && rpcErr == nil {
+			continue
+		}
+
+		response := rpcResponse{JsonRpc: "2.0", Id: request.Id}
+		if rpcErr != nil {
+			response.Error = rpcErr
+		} else {
+			response.Result = result
+		}
+		write(response)
+	}
+}
+
+func forwardEvents(sub *subscriber, write func(interface{})) {
+	for event := range sub.Events {
+		write(event)
+	}
+}
+
+func controlSubscribe(
+	request *rpcRequest, subscribed bool) (interface{}, *rpcError) {
+	if subscribed {
+		return nil, &rpcError{RPC_COMMAND_ERROR, "error already subscribed"}
+	}
+
+	params, rpcErr := parseParams(request)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	// neither means both
+	if !params.Chat && !params.Status {
+		params.Chat = true
+		params.Status = true
+	}
+
+	return params, nil
+}
+
+func parseParams(request *rpcRequest) (rpcParams, *rpcError) {
+	var params rpcParams
+	if len(request.Params) == 0 || string(request.Params) == "null" {
+		return params, nil
+	}
+
+	err := json.Unmarshal(request.Params, &params)
+	if err != nil {
+		return params, &rpcError{
+			RPC_INVALID_PARAMS, "params must be an object"}
+	}
+
+	return params, nil
+}
+
+func requireParam(value, name string) *rpcError {
+	if value == "" {
+		return &rpcError{RPC_INVALID_PARAMS, "missing param " + name}
+	}
+	return nil
+}
+
+func commandError(err error) *rpcError {
+	return &rpcError{RPC_COMMAND_ERROR, err.Error()}
+}
+
+// Run one control method, mirrors handleUserInput.
+func handleControl(
+	wb *whitebox.WhiteBox, request *rpcRequest) (interface{}, *rpcError) {
+	params, rpcErr := parseParams(request)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	switch request.Method {
+	case "bootstrap":
+		return controlBootstrap(wb, params)
+	case "start":
+		return controlStart(wb, params)
+	case "invite":
+		return controlInvite(wb, params)
+	case "accept":
+		return controlAccept(wb, params)
+	case "list":
+		return controlListParties(wb), nil
+	case "send":
+		return controlSend(wb, params)
+	case "leave":
+		return controlLeave(wb, params)
+	case "packs":
+		return controlPacks(wb, params)
+	case "get":
+		return controlGet(wb, params)
+	case "rescan":
+		wb.RescanPacks()
+		return "rescanned", nil
+	case "stats":
+		return controlGetStats(wb), nil
+	}
+
+	return nil, &rpcError{
+		RPC_METHOD_NOT_FOUND, "unknown method " + request.Method}
+}
+
+// no info returns our own bootstrap info
+func controlBootstrap(
+	wb *whitebox.WhiteBox, params rpcParams) (interface{}, *rpcError) {
+	if params.Info == "" {
+		return wb.BsId, nil
+	}
+
+	node, err := whitebox.ParseBootstrap(params.Info)
+	if err != nil {
+		return nil, &rpcError{RPC_INVALID_PARAMS, err.Error()}
+	}
+
+	wb.SendBootstrap(node.Address, node.Id)
+	return "bs sent", nil
+}
+
+func controlStart(
+	wb *whitebox.WhiteBox, params rpcParams) (interface{}, *rpcError) {
+	rpcErr := requireParam(params.Name, "name")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	partyId := wb.PartyStart(params.Name)
+	if partyId == "" {
+		return nil, commandError(errors.New("error starting party"))
+	}
+
+	return partyId, nil
+}
+
+func controlInvite(
+	wb *whitebox.WhiteBox, params rpcParams) (interface{}, *rpcError) {
+	rpcErr := requireParam(params.Party, "party")
+	if rpcErr == nil {
+		rpcErr = requireParam(params.Peer, "peer")
+	}
+
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	party, err := getParty(wb, params.Party)
+	if err != nil {
+		return nil, commandError(err)
+	}
+
+	min, err := findPeer(wb, params.Peer)
+	if err != nil {
+		return nil, commandError(err)
+	}
+
+	party.SendInvite(min)
+	return min.Id(), nil
+}
+
+func controlAccept(
+	wb *whitebox.WhiteBox, params rpcParams) (interface{}, *rpcError) {
+	rpcErr := requireParam(params.Party, "party")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	partyId, err := findInvite(wb, params.Party)
+	if err != nil {
+		return nil, commandError(err)
+	}
+
+	wb.AcceptInvite(partyId)
+	return partyId, nil
+}
+
+func sortedPartyIds(parties whitebox.LockingPartyMap) []string {
+	ids := make([]string, 0)
+	parties.Mutex.Lock()
+	for id, _ := range parties.Map {
+		ids = append(ids, id)
+	}
+	parties.Mutex.Unlock()
+
+	sort.Strings(ids)
+	return ids
+}
+
+func controlListParties(wb *whitebox.WhiteBox) controlList {
+	return controlList{
+		Parties: sortedPartyIds(wb.Parties),
+		Invites: sortedPartyIds(wb.PendingInvites)}
+}
+
+// party "mainline" (or none) sends to main line
+func controlSend(
+	wb *whitebox.WhiteBox, params rpcParams) (interface{}, *rpcError) {
+	rpcErr := requireParam(params.Message, "message")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	if params.Party == "" || params.Party == "mainline" {
+		wb.SendChat(params.Message)
+		return "mainline", nil
+	}
+
+	party, err := getParty(wb, params.Party)
+	if err != nil {
+		return nil, commandError(err)
+	}
+
+	party.SendChat(params.Message)
+	return party.Id, nil
+}
+
+func controlLeave(
+	wb *whitebox.WhiteBox, params rpcParams) (interface{}, *rpcError) {
+	rpcErr := requireParam(params.Party, "party")
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	partyId, err := leaveParty(wb, params.Party)
+	if err != nil {
+		return nil, commandError(err)
+	}
+
+	return partyId, nil
+}
+
+func packState(state int) string {
+	switch state {
+	case whitebox.AVAILABLE:
+		return "available"
+	case whitebox.ACTIVE:
+		return "active"
+	case whitebox.COMPLETE:
+		return "complete"
+	}
+	return "unknown"
+}
+
+// packs in every party, or just the one matching params.Party
+func controlPacks(
+	wb *whitebox.WhiteBox, params rpcParams) (interface{}, *rpcError) {
+	partyId := ""
+	if params.Party != "" {
+		var err error
+		partyId, err = findParty(wb, params.Party)
+		if err != nil {
+			return nil, commandError(err)
+		}
+	}
+
+	packs := make([]controlPack, 0)
+	wb.Parties.Mutex.Lock()
+	for id, party := range wb.Parties.Map {
+		if partyId != "" && id != partyId {
+			continue
+		}
+
+		party.PacksLock.Lock()
+		for packHash, lockingPack := range party.Packs {
+			lockingPack.Mutex.Lock()
+			pack := lockingPack.Pack
+
+			info := controlPack{
+				Party: id,
+				Hash:  packHash,
+				Name:  pack.Name,
+				Peers: len(pack.Peers),
+				State: packState(pack.State),
+				Files: make([]controlFile, 0)}
+
+			pack.FileLock.Lock()
+			for _, packFileInfo := range pack.Files {
+				info.Files = append(info.Files, controlFile{
+					Hash: packFileInfo.Hash,
+					Name: packFileInfo.Name,
+					Size: packFileInfo.Size})
+			}
+			pack.FileLock.Unlock()
+			lockingPack.Mutex.Unlock()
+
+			packs = append(packs, info)
+		}
+		party.PacksLock.Unlock()
+	}
+	wb.Parties.Mutex.Unlock()
+
+	sort.Slice(packs, func(i, j int) bool {
+		if packs[i].Party != packs[j].Party {
+			return packs[i].Party < packs[j].Party
+		}
+		return packs[i].Hash < packs[j].Hash
+	})
+
+	return packs, nil
+}
+
+func controlGet(
+	wb *whitebox.WhiteBox, params rpcParams) (interface{}, *rpcError) {
+	rpcErr := requireParam(params.Party, "party")
+	if rpcErr == nil {
+		rpcErr = requireParam(params.Pack, "pack")
+	}
+
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	party, err := getParty(wb, params.Party)
+	if err != nil {
+		return nil, commandError(err)
+	}
+
+	packHash, err := findPack(party, params.Pack)
+	if err != nil {
+		return nil, commandError(err)
+	}
+
+	party.StartPack(packHash)
+	return packHash, nil
+}
+
+// counters since the node started
+func controlGetStats(wb *whitebox.WhiteBox) controlStats {
+	transport := wb.TransportStats
+	rate := wb.RateStats
+	return controlStats{
+		Received:      atomic.LoadUint64(&transport.Received),
+		ReadErrors:    atomic.LoadUint64(&transport.ReadErrors),
+		Oversized:     atomic.LoadUint64(&transport.Oversized),
+		Malformed:     atomic.LoadUint64(&transport.Malformed),
+		SendErrors:    atomic.LoadUint64(&transport.SendErrors),
+		Fragments:     atomic.LoadUint64(&transport.Fragments),
+		Reassembled:   atomic.LoadUint64(&transport.Reassembled),
+		Limited:       atomic.LoadUint64(&rate.Limited),
+		TypeLimited:   atomic.LoadUint64(&rate.TypeLimited),
+		SenderLimited: atomic.LoadUint64(&rate.SenderLimited),
+		Bans:          atomic.LoadUint64(&rate.Bans),
+		BannedDrops:   atomic.LoadUint64(&rate.BannedDrops)}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/TACIXAT/party-line/white-box"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func controlTestBox(t *testing.T) (*whitebox.WhiteBox, string) {
+	dir, err := ioutil.TempDir("", "partytest.control")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+
+	self := generateSelf(t)
+	wb := whitebox.New(dir, "127.0.0.1", "3499", self, whitebox.DefaultConfig())
+	return wb, dir
+}
+
+// A control connection served over a pipe.
+type controlClient struct {
+	Conn   net.Conn
+	Reader *bufio.Reader
+}
+
+func dialControl(wb *whitebox.WhiteBox) *controlClient {
+	client, server := net.Pipe()
+	go serveControl(wb, server)
+	return &controlClient{client, bufio.NewReader(client)}
+}
+
+func (client *controlClient) send(t *testing.T, line string) {
+	client.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := client.Conn.Write([]byte(line + "\n"))
+	if err != nil {
+		t.Fatalf("Error writing request: %v", err)
+	}
+}
+
+// Next line from the node, a response or a notification.
+func (client *controlClient) read(t *testing.T) map[string]json.RawMessage {
+	client.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := client.Reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("Error reading response: %v", err)
+	}
+
+	message := make(map[string]json.RawMessage)
+	err = json.Unmarshal(line, &message)
+	if err != nil {
+		t.Fatalf("Error parsing response %s: %v", line, err)
+	}
+
+	return message
+}
+
+func rpcErrorCode(t *testing.T, message map[string]json.RawMessage) int {
+	raw, ok := message["error"]
+	if !ok {
+		return 0
+	}
+
+	var rpcErr rpcError
+	err := json.Unmarshal(raw, &rpcErr)
+	if err != nil {
+		t.Fatalf("Error parsing error %s: %v", raw, err)
+	}
+
+	return rpcErr.Code
+}
+
+func TestControlDispatch(t *testing.T) {
+	wb, dir := controlTestBox(t)
+	defer os.RemoveAll(dir)
+
+	client := dialControl(wb)
+	defer client.Conn.Close()
+
+	tables := []struct {
+		request string
+		id      string
+		code    int
+		result  string
+	}{
+		{`not json`, `null`, RPC_PARSE_ERROR, ``},
+		{`{"jsonrpc":"1.0","id":1,"method":"list"}`, `1`, RPC_INVALID_REQUEST, ``},
+		{`{"jsonrpc":"2.0","id":2}`, `2`, RPC_INVALID_REQUEST, ``},
+		{`{"jsonrpc":"2.0","id":3,"method":"dance"}`, `3`, RPC_METHOD_NOT_FOUND, ``},
+		{`{"jsonrpc":"2.0","id":4,"method":"start","params":["cool"]}`, `4`, RPC_INVALID_PARAMS, ``},
+		{`{"jsonrpc":"2.0","id":5,"method":"start"}`, `5`, RPC_INVALID_PARAMS, ``},
+		{`{"jsonrpc":"2.0","id":6,"method":"leave","params":{"party":"nope"}}`, `6`, RPC_COMMAND_ERROR, ``},
+		{`{"jsonrpc":"2.0","id":"seven","method":"list"}`, `"seven"`, 0, `{"parties":[],"invites":[]}`},
+		{`{"jsonrpc":"2.0","id":8,"method":"packs"}`, `8`, 0, `[]`},
+	}
+
+	for _, table := range tables {
+		client.send(t, table.request)
+		response := client.read(t)
+
+		if string(response["id"]) != table.id {
+			t.Errorf("Response to %s has unexpected id:", table.request)
+			t.Errorf("Got: %s", response["id"])
+			t.Errorf("Expecting: %s", table.id)
+		}
+
+		code := rpcErrorCode(t, response)
+		if code != table.code {
+			t.Errorf("Response to %s has unexpected error:", table.request)
+			t.Errorf("Got: %d", code)
+			t.Errorf("Expecting: %d", table.code)
+		}
+
+		if table.result != "" && string(response["result"]) != table.result {
+			t.Errorf("Response to %s has unexpected result:", table.request)
+			t.Errorf("Got: %s", response["result"])
+			t.Errorf("Expecting: %s", table.result)
+		}
+	}
+
+	// a notification gets no response, the next line answers id 10
+	client.send(t, `{"jsonrpc":"2.0","method":"start","params":{"name":"cool"}}`)
+	client.send(t, `{"jsonrpc":"2.0","id":10,"method":"list"}`)
+	response := client.read(t)
+	if string(response["id"]) != `10` {
+		t.Fatalf("Notification got a response: %v", response)
+	}
+
+	var list controlList
+	err := json.Unmarshal(response["result"], &list)
+	if err != nil {
+		t.Fatalf("Error parsing list: %v", err)
+	}
+
+	if len(list.Parties) != 1 || !strings.HasPrefix(list.Parties[0], "cool") {
+		t.Errorf("Party started by notification not listed:")
+		t.Errorf("Got: %v", list.Parties)
+		t.Errorf("Expecting: one party starting with cool")
+	}
+}
+
+func TestControlSubscribe(t *testing.T) {
+	wb, dir := controlTestBox(t)
+	defer os.RemoveAll(dir)
+
+	client := dialControl(wb)
+	defer client.Conn.Close()
+
+	client.send(t, `{"jsonrpc":"2.0","id":1,"method":"subscribe","params":{"chat":true}}`)
+	response := client.read(t)
+	if string(response["result"]) != `"subscribed"` {
+		t.Fatalf("Error subscribing: %v", response)
+	}
+
+	client.send(t, `{"jsonrpc":"2.0","id":2,"method":"subscribe"}`)
+	response = client.read(t)
+	if rpcErrorCode(t, response) != RPC_COMMAND_ERROR {
+		t.Errorf("Second subscribe did not fail:")
+		t.Errorf("Got: %v", response)
+		t.Errorf("Expecting: error %d", RPC_COMMAND_ERROR)
+	}
+
+	// statuses were not asked for, only the chat comes through
+	publishStatus(whitebox.Status{Message: "hidden"})
+	publishChat(whitebox.Chat{Id: "abc", Message: "hello"})
+
+	notification := client.read(t)
+	if string(notification["method"]) != `"chat"` {
+		t.Fatalf("Unexpected notification: %v", notification)
+	}
+
+	var chat controlChat
+	err := json.Unmarshal(notification["params"], &chat)
+	if err != nil {
+		t.Fatalf("Error parsing chat: %v", err)
+	}
+
+	if chat.Channel != "mainline" || chat.Message != "hello" {
+		t.Errorf("Chat notification does not match:")
+		t.Errorf("Got: %+v", chat)
+		t.Errorf("Expecting: hello on mainline")
+	}
+
+	// closing the connection drops the subscriber
+	client.Conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		subscribers.Mutex.Lock()
+		count := len(subscribers.Map)
+		subscribers.Mutex.Unlock()
+		if count == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Errorf("Subscriber left behind after the connection closed.")
+}
+
+func TestStartControl(t *testing.T) {
+	wb, dir := controlTestBox(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "control.sock")
+	listener, err := startControl(wb, path)
+	if err != nil {
+		t.Fatalf("Error starting control socket: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Error reading socket: %v", err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Socket has unexpected mode:")
+		t.Errorf("Got: %o", info.Mode().Perm())
+		t.Errorf("Expecting: %o", 0600)
+	}
+
+	// nothing but the socket is left next to it
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error reading dir: %v", err)
+	}
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".control") {
+			t.Errorf("Temp dir %s left behind.", entry.Name())
+		}
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Error connecting to socket: %v", err)
+	}
+
+	client := &controlClient{conn, bufio.NewReader(conn)}
+	client.send(t, `{"jsonrpc":"2.0","id":1,"method":"list"}`)
+	response := client.read(t)
+	if string(response["id"]) != `1` || rpcErrorCode(t, response) != 0 {
+		t.Errorf("Unexpected response over socket: %v", response)
+	}
+	conn.Close()
+
+	_, err = startControl(wb, path)
+	if err == nil {
+		t.Errorf("Second node started on a socket in use.")
+	}
+
+	listener.Close()
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Errorf("Socket file left behind after closing.")
+	}
+}
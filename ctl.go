@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+func ctlUsage() {
+	fmt.Fprintln(os.Stderr, "usage: party-line ctl <command> [-json] [-control path] [args]")
+	fmt.Fprintln(os.Stderr, "  bs [bootstrap info]")
+	fmt.Fprintln(os.Stderr, "      show bs info (no arg) or bootstrap to a peer")
+	fmt.Fprintln(os.Stderr, "  start <party_name>")
+	fmt.Fprintln(os.Stderr, "      start a party")
+	fmt.Fprintln(os.Stderr, "  invite <party_id> <user_id>")
+	fmt.Fprintln(os.Stderr, "      invite a user to a party")
+	fmt.Fprintln(os.Stderr, "  accept <party_id>")
+	fmt.Fprintln(os.Stderr, "      accept an invite")
+	fmt.Fprintln(os.Stderr, "  list")
+	fmt.Fprintln(os.Stderr, "      list parties and invites")
+	fmt.Fprintln(os.Stderr, "  send <party_id|mainline> msg")
+	fmt.Fprintln(os.Stderr, "      send a message")
+	fmt.Fprintln(os.Stderr, "  leave <party_id>")
+	fmt.Fprintln(os.Stderr, "      leave a party")
+	fmt.Fprintln(os.Stderr, "  packs [party_id]")
+	fmt.Fprintln(os.Stderr, "      list available packs")
+	fmt.Fprintln(os.Stderr, "  get <party_id> <pack_id>")
+	fmt.Fprintln(os.Stderr, "      get a pack from a party")
+	fmt.Fprintln(os.Stderr, "  rescan")
+	fmt.Fprintln(os.Stderr, "      rescan share dir for new packs")
+	fmt.Fprintln(os.Stderr, "  stats")
+	fmt.Fprintln(os.Stderr, "      show receive and rate limit counters")
+	fmt.Fprintln(os.Stderr, "  tail [chat|status]")
+	fmt.Fprintln(os.Stderr, "      stream chat and status (default both)")
+	fmt.Fprintln(os.Stderr, "partial ids ok")
+}
+
+// connection to a running node's control socket
+type ctlClient struct {
+	Conn   net.Conn
+	Reader *bufio.Reader
+	NextId int
+}
+
+func ctlDial(path string) *ctlClient {
+	if path == "" {
+		path = controlPath()
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		log.Fatalf("could not reach a running node at %s: %v", path, err)
+	}
+
+	client := new(ctlClient)
+	client.Conn = conn
+	client.Reader = bufio.NewReader(conn)
+	client.NextId = 1
+	return client
+}
+
+// Send a request and wait for its response, exiting on errors.
+func (client *ctlClient) call(method string, params rpcParams) json.RawMessage {
+	rawId := json.RawMessage(fmt.Sprintf("%d", client.NextId))
+	client.NextId++
+
+	jsonParams, err := json.Marshal(params)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	request := rpcRequest{
+		JsonRpc: "2.0",
+		Id:      &rawId,
+		Method:  method,
+		Params:  jsonParams}
+
+	jsonRequest, err := json.Marshal(request)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = client.Conn.Write(append(jsonRequest, '\n'))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		line, err := client.Reader.ReadBytes('\n')
+		if err != nil {
+			log.Fatal("connection to node closed")
+		}
+
+		response := new(struct {
+			Id     *json.RawMessage `json:"id"`
+			Result json.RawMessage  `json:"result"`
+			Error  *rpcError        `json:"error"`
+		})
+		err = json.Unmarshal(line, response)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// skip notifications
+		if response.Id == nil || string(*response.Id) != string(rawId) {
+			continue
+		}
+
+		if response.Error != nil {
+			log.Fatal(response.Error.Message)
+		}
+
+		return response.Result
+	}
+}
+
+// Streams a tail argument asks for, a prefix of chat or status. Not ok when
+// it names neither, subscribing with neither set would tail both.
+func ctlTailStreams(arg string) (bool, bool, bool) {
+	chat := arg != "" && strings.HasPrefix("chat", arg)
+	status := arg != "" && strings.HasPrefix("status", arg)
+	return chat, status, chat || status
+}
+
+func ctlNeedArgs(args []string, count int) {
+	if len(args) < count {
+		ctlUsage()
+		os.Exit(2)
+	}
+}
+
+func ctlCommand(args []string) {
+	log.SetFlags(0)
+
+	if len(args) < 1 {
+		ctlUsage()
+		os.Exit(2)
+	}
+
+	command := args[0]
+	flags := flag.NewFlagSet("ctl "+command, flag.ExitOnError)
+	jsonFlag := flags.Bool("json", false, "Print raw JSON results.")
+	pathFlag := flags.String("control", "", "Control socket of the node.")
+	flags.Parse(args[1:])
+	args = flags.Args()
+
+	var method string
+	var params rpcParams
+	switch command {
+	case "bs":
+		method = "bootstrap"
+		if len(args) > 0 {
+			params.Info = args[0]
+		}
+	case "start":
+		ctlNeedArgs(args, 1)
+		method = "start"
+		params.Name = args[0]
+	case "invite":
+		ctlNeedArgs(args, 2)
+		method = "invite"
+		params.Party = args[0]
+		params.Peer = args[1]
+	case "accept":
+		ctlNeedArgs(args, 1)
+		method = "accept"
+		params.Party = args[0]
+	case "list":
+		method = "list"
+	case "send":
+		ctlNeedArgs(args, 2)
+		method = "send"
+		params.Party = args[0]
+		params.Message = strings.Join(args[1:], " ")
+	case "leave":
+		ctlNeedArgs(args, 1)
+		method = "leave"
+		params.Party = args[0]
+	case "packs":
+		method = "packs"
+		if len(args) > 0 {
+			params.Party = args[0]
+		}
+	case "get":
+		ctlNeedArgs(args, 2)
+		method = "get"
+		params.Party = args[0]
+		params.Pack = args[1]
+	case "rescan":
+		method = "rescan"
+	case "stats":
+		method = "stats"
+	case "tail":
+		if len(args) > 0 {
+			var ok bool
+			params.Chat, params.Status, ok = ctlTailStreams(args[0])
+			if !ok {
+				ctlUsage()
+				os.Exit(2)
+			}
+		}
+		ctlTail(ctlDial(*pathFlag), params, *jsonFlag)
+		return
+	default:
+		ctlUsage()
+		os.Exit(2)
+	}
+
+	client := ctlDial(*pathFlag)
+	defer client.Conn.Close()
+	result := client.call(method, params)
+
+	if *jsonFlag {
+		fmt.Println(string(result))
+		return
+	}
+
+	switch method {
+	case "list":
+		ctlPrintList(result)
+	case "packs":
+		ctlPrintPacks(result)
+	case "stats":
+		ctlPrintStats(result)
+	default:
+		var message string
+		err := json.Unmarshal(result, &message)
+		if err != nil {
+			message = string(result)
+		}
+		fmt.Println(message)
+	}
+}
+
+func ctlPrintList(result json.RawMessage) {
+	var list controlList
+	err := json.Unmarshal(result, &list)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("      ==== PARTY LIST ====      ")
+	for _, id := range list.Parties {
+		fmt.Println(id)
+	}
+
+	fmt.Println("  ==== ACCEPTANCE PENDING ====  ")
+	for _, id := range list.Invites {
+		fmt.Println(id)
+	}
+}
+
+func ctlPrintStats(result json.RawMessage) {
+	var stats controlStats
+	err := json.Unmarshal(result, &stats)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("received:       %d\n", stats.Received)
+	fmt.Printf("read errors:    %d\n", stats.ReadErrors)
+	fmt.Printf("oversized:      %d\n", stats.Oversized)
+	fmt.Printf("malformed:      %d\n", stats.Malformed)
+	fmt.Printf("send errors:    %d\n", stats.SendErrors)
+	fmt.Printf("fragments:      %d\n", stats.Fragments)
+	fmt.Printf("reassembled:    %d\n", stats.Reassembled)
+	fmt.Printf("limited:        %d\n", stats.Limited)
+	fmt.Printf("type limited:   %d\n", stats.TypeLimited)
+	fmt.Printf("sender limited: %d\n", stats.SenderLimited)
+	fmt.Printf("bans:           %d\n", stats.Bans)
+	fmt.Printf("banned drops:   %d\n", stats.BannedDrops)
+}
+
+// same layout as /packs
+func ctlPrintPacks(result json.RawMessage) {
+	var packs []controlPack
+	err := json.Unmarshal(result, &packs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	partyId := ""
+	for _, pack := range packs {
+		if pack.Party != partyId {
+			partyId = pack.Party
+			fmt.Println("== " + partyId + " ==")
+		}
+
+		line := fmt.Sprintf("%q (%d)", pack.Name, pack.Peers)
+		if pack.State == "complete" {
+			line += "*"
+		}
+
+		fmt.Println("PACK: " + pack.Hash)
+		fmt.Println(line)
+		for _, file := range pack.Files {
+			fmt.Println("  FILE: " + file.Hash)
+			fmt.Printf("  %q\n", file.Name)
+		}
+	}
+}
+
+// Print chat and status notifications until the node goes away.
+func ctlTail(client *ctlClient, params rpcParams, raw bool) {
+	defer client.Conn.Close()
+	client.call("subscribe", params)
+
+	for {
+		line, err := client.Reader.ReadBytes('\n')
+		if err != nil {
+			log.Fatal("connection to node closed")
+		}
+
+		notification := new(struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		})
+		err = json.Unmarshal(line, notification)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if raw {
+			os.Stdout.Write(line)
+			continue
+		}
+
+		switch notification.Method {
+		case "chat":
+			var chat controlChat
+			err = json.Unmarshal(notification.Params, &chat)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			fmt.Printf("%s (%s) %s %s\n",
+				chat.Time.Local().Format("15:04:05"),
+				displayChannel(chat.Channel), displayId(chat.Id), chat.Message)
+		case "status":
+			var status controlStatus
+			err = json.Unmarshal(notification.Params, &status)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			fmt.Println("* " + status.Message)
+		}
+	}
+}
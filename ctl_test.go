@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCtlTailStreams(t *testing.T) {
+	tables := []struct {
+		arg    string
+		chat   bool
+		status bool
+		ok     bool
+	}{
+		{"chat", true, false, true},
+		{"c", true, false, true},
+		{"status", false, true, true},
+		{"stat", false, true, true},
+		{"chta", false, false, false},
+		{"chats", false, false, false},
+		{"", false, false, false},
+	}
+
+	for _, table := range tables {
+		chat, status, ok := ctlTailStreams(table.arg)
+		if chat != table.chat || status != table.status || ok != table.ok {
+			t.Errorf("Streams for tail %q do not match:", table.arg)
+			t.Errorf("Got: chat %t, status %t, ok %t", chat, status, ok)
+			t.Errorf("Expecting: chat %t, status %t, ok %t",
+				table.chat, table.status, table.ok)
+		}
+	}
+}
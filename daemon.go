@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/TACIXAT/party-line/white-box"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// how often the daemon looks for invites to parties it should join
+const JOIN_INTERVAL = 5 * time.Second
+
+func daemonStatusReceiver(wb *whitebox.WhiteBox) {
+	for {
+		status := <-wb.StatusChannel
+		publishStatus(status)
+		switch status.Priority {
+		case whitebox.TONE_HIGH:
+			log.Printf("level=info type=status msg=%q", status.Message)
+		case whitebox.TONE_LOW:
+			log.Printf("level=debug type=status msg=%q", status.Message)
+		default:
+			log.Printf(
+				"level=warn type=status priority=%d msg=%q",
+				status.Priority, status.Message)
+		}
+	}
+}
+
+func daemonChatReceiver(wb *whitebox.WhiteBox) {
+	for {
+		chat := <-wb.ChatChannel
+		publishChat(chat)
+		channel := chat.Channel
+		if channel == "" {
+			channel = "mainline"
+		}
+
+		log.Printf(
+			"level=info type=chat time=%s channel=%s from=%s msg=%q",
+			chat.Time.Format(time.RFC3339), channel, chat.Id, chat.Message)
+	}
+}
+
+// accept pending invites for the parties in -join
+func autoJoin(wb *whitebox.WhiteBox, partyIds []string) {
+	if len(partyIds) == 0 {
+		return
+	}
+
+	for {
+		accept := make([]string, 0)
+		wb.PendingInvites.Mutex.Lock()
+		for _, partyId := range partyIds {
+			_, pending := wb.PendingInvites.Map[partyId]
+			if pending {
+				accept = append(accept, partyId)
+			}
+		}
+		wb.PendingInvites.Mutex.Unlock()
+
+		for _, partyId := range accept {
+			log.Printf("level=info type=join party=%s", partyId)
+			wb.AcceptInvite(partyId)
+		}
+
+		time.Sleep(JOIN_INTERVAL)
+	}
+}
+
+// Run without the terminal ui until SIGTERM or SIGINT. Chat and status go to
+// the log.
+func runDaemon(wb *whitebox.WhiteBox) {
+	go autoJoin(wb, []string(joinFlag))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	signal.Stop(signals)
+
+	log.Printf("level=info type=shutdown signal=%s", sig)
+	wb.SavePendingPacks()
+	wb.SavePeers()
+	wb.DisconnectParties()
+	wb.SendDisconnect()
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strings"
+)
+
+// flag that may be given more than once or as a comma separated list
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+	for _, info := range strings.Split(value, ",") {
+		if info != "" {
+			*list = append(*list, info)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/TACIXAT/party-line/white-box"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func identityUsage() {
+	fmt.Fprintln(os.Stderr, "usage: party-line identity <command> [args]")
+	fmt.Fprintln(os.Stderr, "  new [-work bits] <name>")
+	fmt.Fprintln(os.Stderr, "      create a permanent id")
+	fmt.Fprintln(os.Stderr, "  list")
+	fmt.Fprintln(os.Stderr, "      list permanent ids")
+	fmt.Fprintln(os.Stderr, "  export <name> [file]")
+	fmt.Fprintln(os.Stderr, "      write the (encrypted) key file to file or stdout")
+	fmt.Fprintln(os.Stderr, "  import <name> <file>")
+	fmt.Fprintln(os.Stderr, "      add a key file as a new permanent id")
+	fmt.Fprintln(os.Stderr, "  delete [-y] <name>")
+	fmt.Fprintln(os.Stderr, "      remove a permanent id, this can't be undone")
+	fmt.Fprintln(os.Stderr, "  show-id <name>")
+	fmt.Fprintln(os.Stderr, "      print the id others use to invite you")
+}
+
+func identityCommand(args []string) {
+	log.SetFlags(0)
+
+	if len(args) < 1 {
+		identityUsage()
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("identity "+args[0], flag.ExitOnError)
+	keyfileFlag = flags.String(
+		"keyfile", "", "File containing the passphrase for the permanent ID.")
+	yesFlag := flags.Bool("y", false, "Don't ask for confirmation.")
+	workFlag := flags.Int("work", 0, "Bits of proof of work in a new ID.")
+	flags.Parse(args[1:])
+
+	migrateLegacyPerm()
+
+	switch args[0] {
+	case "new":
+		identityNew(flags.Args(), *workFlag)
+	case "list":
+		identityList()
+	case "export":
+		identityExport(flags.Args())
+	case "import":
+		identityImport(flags.Args())
+	case "delete":
+		identityDelete(flags.Args(), *yesFlag)
+	case "show-id":
+		identityShowId(flags.Args())
+	default:
+		identityUsage()
+		os.Exit(2)
+	}
+}
+
+func requireName(args []string, count int) string {
+	if len(args) < count {
+		identityUsage()
+		os.Exit(2)
+	}
+
+	name := args[0]
+	if !validIdentityName(name) {
+		log.Fatalf("invalid identity name %q (letters, digits, - and _)", name)
+	}
+
+	return name
+}
+
+func requireExisting(name string) string {
+	path := permPath(name)
+	exists, err := pathExists(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !exists {
+		log.Fatalf("no identity named %s", name)
+	}
+
+	return path
+}
+
+func requireMissing(name string) string {
+	path := permPath(name)
+	exists, err := pathExists(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if exists {
+		log.Fatalf("identity %s already exists", name)
+	}
+
+	return path
+}
+
+func keyFileId(keyFile *KeyFile) string {
+	peer := whitebox.Peer{
+		SignPub: keyFile.SignPub,
+		EncPub:  keyFile.EncPub}
+	return peer.Id()
+}
+
+func identityNew(args []string, work int) {
+	name := requireName(args, 1)
+	path := requireMissing(name)
+
+	self, err := whitebox.GenerateSelfWork(work)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	writeKeyFile(path, self)
+
+	peer := whitebox.Peer{SignPub: self.SignPub, EncPub: self.EncPub}
+	fmt.Println(name, peer.Id())
+}
+
+func identityList() {
+	matches, err := filepath.Glob(filepath.Join(identityDir(), "*.self"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sort.Strings(matches)
+	for _, path := range matches {
+		name := strings.TrimSuffix(filepath.Base(path), ".self")
+		keyFile, _ := readKeyFile(path)
+
+		encrypted := ""
+		if keyFile.Version == 0 {
+			encrypted = " (plaintext)"
+		}
+
+		fmt.Printf("%s %s%s\n", name, keyFileId(keyFile), encrypted)
+	}
+}
+
+func identityExport(args []string) {
+	name := requireName(args, 1)
+	path := requireExisting(name)
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(args) < 2 || args[1] == "-" {
+		os.Stdout.Write(contents)
+		fmt.Println()
+		return
+	}
+
+	err = writeFileAtomic(args[1], contents)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func identityImport(args []string) {
+	name := requireName(args, 2)
+	path := requireMissing(name)
+
+	keyFile, err := importKeyFile(path, args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(name, keyFileId(keyFile))
+}
+
+// Copy the key file at src to path. It has to open with its passphrase and
+// its public keys have to match the sealed ones, the id shown for it comes
+// from the public keys alone.
+func importKeyFile(path string, src string) (*KeyFile, error) {
+	keyFile, contents := readKeyFile(src)
+	if keyFile.Version == 0 {
+		// plaintext export from an old version, encrypt on the way in
+		self, _ := openKeyFile(src)
+		writeKeyFile(path, self)
+		return keyFile, nil
+	}
+
+	if len(keyFile.SignPub) == 0 || keyFile.EncPub == nil ||
+		len(keyFile.Sealed) == 0 {
+		return nil, errors.New("key file is missing keys")
+	}
+
+	if permPassphrase == nil {
+		permPassphrase = readPassphrase(false)
+	}
+
+	_, err := openSelf(keyFile, permPassphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(identityDir(), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFileAtomic(path, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyFile, nil
+}
+
+func identityDelete(args []string, yes bool) {
+	name := requireName(args, 1)
+	path := requireExisting(name)
+
+	if !yes {
+		fmt.Fprintf(os.Stderr, "delete identity %s for good? [y/N] ", name)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Fprintln(os.Stderr, "not deleted")
+			return
+		}
+	}
+
+	err := os.Remove(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func identityShowId(args []string) {
+	name := requireName(args, 1)
+	path := requireExisting(name)
+
+	keyFile, _ := readKeyFile(path)
+	fmt.Println(keyFileId(keyFile))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/mitchellh/go-homedir"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Point the home dir at a temp dir so identities land there.
+func identityTestHome(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "partytest.identity")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+
+	homedir.DisableCache = true
+	t.Setenv("HOME", dir)
+	setPassphrase(t, dir, "hunter2")
+	return dir
+}
+
+func captureStdout(t *testing.T, run func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Error creating pipe: %v", err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	run()
+	os.Stdout = stdout
+	w.Close()
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error reading stdout: %v", err)
+	}
+
+	return string(out)
+}
+
+func TestValidIdentityName(t *testing.T) {
+	tables := []struct {
+		name  string
+		valid bool
+	}{
+		{"default", true},
+		{"work-2_b", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../default", false},
+		{"a/b", false},
+		{"a\\b", false},
+		{strings.Repeat("a", 33), false},
+	}
+
+	for _, table := range tables {
+		valid := validIdentityName(table.name)
+		if valid != table.valid {
+			t.Errorf("Identity name %q validity does not match:", table.name)
+			t.Errorf("Got: %t", valid)
+			t.Errorf("Expecting: %t", table.valid)
+		}
+	}
+}
+
+func TestIdentityCommands(t *testing.T) {
+	dir := identityTestHome(t)
+	defer os.RemoveAll(dir)
+
+	created := captureStdout(t, func() { identityNew([]string{"alice"}, 0) })
+	fields := strings.Fields(created)
+	if len(fields) != 2 || fields[0] != "alice" {
+		t.Fatalf("Unexpected output from new: %q", created)
+	}
+	id := fields[1]
+
+	shown := captureStdout(t, func() { identityShowId([]string{"alice"}) })
+	if strings.TrimSpace(shown) != id {
+		t.Errorf("Shown id does not match:")
+		t.Errorf("Got: %s", strings.TrimSpace(shown))
+		t.Errorf("Expecting: %s", id)
+	}
+
+	exported := filepath.Join(dir, "alice.export")
+	identityExport([]string{"alice", exported})
+
+	imported := captureStdout(t, func() {
+		identityImport([]string{"bob", exported})
+	})
+	if strings.TrimSpace(imported) != "bob "+id {
+		t.Errorf("Unexpected output from import: %q", imported)
+	}
+
+	listed := captureStdout(t, identityList)
+	expected := "alice " + id + "\nbob " + id + "\n"
+	if listed != expected {
+		t.Errorf("Listed identities do not match:")
+		t.Errorf("Got: %q", listed)
+		t.Errorf("Expecting: %q", expected)
+	}
+
+	identityDelete([]string{"bob"}, true)
+	_, err := os.Stat(permPath("bob"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Deleted identity still on disk.")
+	}
+
+	listed = captureStdout(t, identityList)
+	if listed != "alice "+id+"\n" {
+		t.Errorf("Deleted identity still listed: %q", listed)
+	}
+}
+
+func TestImportMismatchedKeys(t *testing.T) {
+	dir := identityTestHome(t)
+	defer os.RemoveAll(dir)
+
+	captureStdout(t, func() { identityNew([]string{"alice"}, 0) })
+	keyFile, _ := readKeyFile(permPath("alice"))
+
+	// someone else's public keys on alice's sealed private keys
+	other := generateSelf(t)
+	keyFile.SignPub = other.SignPub
+	keyFile.EncPub = other.EncPub
+
+	jsonKeyFile, err := json.Marshal(keyFile)
+	if err != nil {
+		t.Fatalf("Error marshalling key file: %v", err)
+	}
+
+	forged := filepath.Join(dir, "forged.self")
+	err = ioutil.WriteFile(forged, jsonKeyFile, 0600)
+	if err != nil {
+		t.Fatalf("Error writing key file: %v", err)
+	}
+
+	_, err = importKeyFile(permPath("mallory"), forged)
+	if err == nil {
+		t.Errorf("Key file with mismatched public keys imported.")
+	}
+
+	_, err = os.Stat(permPath("mallory"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Rejected key file written to the identity dir.")
+	}
+}
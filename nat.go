@@ -84,6 +84,12 @@ func pmpOpen(client *natpmp.Client, port uint16) error {
 		log.Println(err)
 		return err
 	}
+
+	// streams for bulk transfers, udp still works without them
+	_, err = client.AddPortMapping("tcp", int(port), int(port), 30*24*60*60)
+	if err != nil {
+		log.Println(err)
+	}
 	return nil
 }
 
@@ -93,6 +99,11 @@ func pmpClose(client *natpmp.Client, port uint16) error {
 		log.Println(err)
 		return err
 	}
+
+	_, err = client.AddPortMapping("tcp", int(port), 0, 0)
+	if err != nil {
+		log.Println(err)
+	}
 	return nil
 }
 
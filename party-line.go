@@ -1,12 +1,9 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/TACIXAT/party-line/white-box"
-	"github.com/mitchellh/go-homedir"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
@@ -17,7 +14,6 @@ import (
 
 /*
 TODO:
-	bs perm node, wait for correct signal (don't just sleep 1 second)
 	perm node connecting to self (why key not invalid?)
 	perm nodes reconnecting, figure out better mechanism (cache.Disconnected)
 	figure out smooth update process
@@ -31,7 +27,6 @@ TODO:
 	more statuses
 
 	check channel capcity before adding
-	partial packs (save / resume on exit)
 
 	measure block packet size
 	increase block size
@@ -48,12 +43,21 @@ var ipFlag *string
 var nonatFlag *bool
 var shareFlag *string
 var permFlag *bool
+var keyfileFlag *string
+var identityFlag *string
+var daemonFlag *bool
 
-var permParties []string
+var bootstrapFlag listFlag
+var joinFlag listFlag
+
+// used when neither -bootstrap nor the config file name a node
+const DEFAULT_BOOTSTRAP = "138.197.201.244/3499/" +
+	"3ce244e4426fd2cb1c41c5954c879ce0a3c19bf1452fb66be84de03825bc6f30"
 
 func statusReceiver(wb *whitebox.WhiteBox) {
 	for {
 		status := <-wb.StatusChannel
+		publishStatus(status)
 		switch status.Priority {
 		case whitebox.TONE_HIGH:
 			chatStatus(status.Message)
@@ -68,131 +72,90 @@ func statusReceiver(wb *whitebox.WhiteBox) {
 func chatReceiver(wb *whitebox.WhiteBox) {
 	for {
 		chat := <-wb.ChatChannel
+		publishChat(chat)
 		addChat(chat)
 	}
 }
 
-// TODO: make this not a race condition
-// TODO: flag to not do this
-// TODO: select peer that isn't self
-func bsInASecond(wb *whitebox.WhiteBox) {
-	front, err := wb.IdFront(wb.PeerSelf.Id())
-	if err != nil || permParties[1] == front {
-		return
+// seed nodes from -bootstrap or the config file, tried in order after known
+// peers
+func bootstrapNodes() []whitebox.BootstrapNode {
+	infos := []string(bootstrapFlag)
+	if len(infos) == 0 {
+		infos = append(infos, DEFAULT_BOOTSTRAP)
 	}
 
-	select {
-	case <-time.After(1 * time.Second):
-		wb.SendBootstrap(permParties[0], permParties[1])
+	nodes := make([]whitebox.BootstrapNode, 0, len(infos))
+	for _, info := range infos {
+		node, err := whitebox.ParseBootstrap(info)
+		if err != nil {
+			log.Fatalf("%s: %s", err.Error(), info)
+		}
+		nodes = append(nodes, node)
 	}
-}
 
-func pathExists(path string) (bool, error) {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true, nil
-	}
-	if os.IsNotExist(err) {
-		return false, nil
-	}
-	return true, err
+	return nodes
 }
 
-func savePerm(self whitebox.Self) {
-	home, err := homedir.Dir()
-	if err != nil {
-		log.Fatal("could not get home dir")
-	}
-
-	basePath := filepath.Join(home, "party-line")
-	err = os.MkdirAll(basePath, 0700)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// marshal json
-	jsonSelf, err := json.Marshal(self)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	log.Println("self size:", len(jsonSelf))
-	path := filepath.Join(basePath, "perm.self")
-
-	// write file
-	selfFile, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	n, err := selfFile.Write([]byte(jsonSelf))
-	if err != nil || n != len(jsonSelf) {
-		log.Fatal(err)
-	}
-
-	err = selfFile.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
+func defineFlags(flags *flag.FlagSet) {
+	debugFlag = flags.Bool("debug", false, "Debug.")
+	portFlag = flags.Uint("port", 3499, "Port.")
+	ipFlag = flags.String("ip", "", "Manually set external IP.")
+	nonatFlag = flags.Bool("nonat", false, "Disable UPNP and PMP.")
+	shareFlag = flags.String("share", "", "Base directory to share from.")
+	permFlag = flags.Bool("perm", false, "Use a permanent ID (keys).")
+	keyfileFlag = flags.String(
+		"keyfile", "", "File containing the passphrase for the permanent ID.")
+	identityFlag = flags.String(
+		"identity", "", "Name of the permanent ID to use (implies -perm).")
+	flags.Var(
+		&bootstrapFlag, "bootstrap", "Seed node ip/port/id, may be repeated.")
+	daemonFlag = flags.Bool("daemon", false, "Run without the terminal UI.")
+	flags.Var(
+		&joinFlag, "join", "Party ID to accept invites for, may be repeated.")
+	controlFlag = flags.String("control", "", "Control socket "+
+		"(default ~/party-line/control.sock, \"off\" to disable).")
+	configFlag = flags.String(
+		"config", "", "Config file (default ~/party-line/config.toml).")
 }
 
-func fetchPerm(self whitebox.Self) whitebox.Self {
-	home, err := homedir.Dir()
-	if err != nil {
-		log.Fatal("could not get home dir")
-	}
-	path := filepath.Join(home, "party-line", "perm.self")
-
-	exists, err := pathExists(path)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if !exists {
-		return self
-	}
-
-	// read file
-	selfFile, err := os.Open(path)
-	defer selfFile.Close()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	contents, err := ioutil.ReadAll(selfFile)
-	if err != nil {
-		log.Fatal(err)
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "identity" {
+		identityCommand(os.Args[2:])
+		return
 	}
 
-	// unmarshal json
-	err = json.Unmarshal(contents, &self)
-	if err != nil {
-		log.Fatal(err)
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		ctlCommand(os.Args[2:])
+		return
 	}
 
-	return self
-}
-
-func main() {
-	debugFlag = flag.Bool("debug", false, "Debug.")
-	portFlag = flag.Uint("port", 3499, "Port.")
-	ipFlag = flag.String("ip", "", "Manually set external IP.")
-	nonatFlag = flag.Bool("nonat", false, "Disable UPNP and PMP.")
-	shareFlag = flag.String("share", "", "Base directory to share from.")
-	permFlag = flag.Bool("perm", false, "Use a permanent ID (keys).")
+	defineFlags(flag.CommandLine)
 	flag.Parse()
 
-	permParties = make([]string, 0)
-	permParties = append(permParties, "138.197.201.244:3499")
-	permParties = append(
-		permParties,
-		"3ce244e4426fd2cb1c41c5954c879ce0a3c19bf1452fb66be84de03825bc6f30")
+	config := loadConfig()
+
+	// TODO: flag to not bootstrap
+	nodes := bootstrapNodes()
 
 	dir := ""
 	if shareFlag != nil {
 		dir = *shareFlag
 	}
 
+	// unlock the permanent id before nat discovery so the passphrase
+	// prompt doesn't wait on the router
+	identity := *identityFlag
+	if identity == "" && *permFlag {
+		identity = DEFAULT_IDENTITY
+	}
+
+	var self whitebox.Self
+	needSave := false
+	if identity != "" {
+		self, needSave = fetchPerm(identity, self)
+	}
+
 	// get port
 	var port uint16 = uint16(*portFlag)
 
@@ -212,15 +175,33 @@ func main() {
 	// build self info (addr, keys, id)
 	portStr := strconv.FormatUint(uint64(port), 10)
 
-	var self whitebox.Self
-	if *permFlag {
-		self = fetchPerm(self)
+	wb := whitebox.New(dir, extIP.String(), portStr, self, config)
+
+	if identity != "" && needSave {
+		savePerm(identity, wb.Self)
+	}
+
+	if *controlFlag != CONTROL_DISABLED {
+		listener, err := startControl(wb, *controlFlag)
+		if err != nil {
+			log.Println("control socket disabled:", err)
+		} else {
+			defer listener.Close()
+		}
 	}
 
-	wb := whitebox.New(dir, extIP.String(), portStr, self)
+	if *daemonFlag {
+		log.SetFlags(log.LstdFlags)
+		go daemonStatusReceiver(wb)
+		go daemonChatReceiver(wb)
+
+		wb.Run(port)
+		go wb.Bootstrap(nodes)
+		runDaemon(wb)
 
-	if *permFlag {
-		savePerm(wb.Self)
+		// let the disconnects go out before nat cleanup
+		time.Sleep(1 * time.Second)
+		return
 	}
 
 	// log to file
@@ -245,7 +226,7 @@ func main() {
 	// start network receiver
 	wb.Run(port)
 
-	bsInASecond(wb)
+	go wb.Bootstrap(nodes)
 	userInterface(wb)
 	log.SetOutput(os.Stderr)
 	log.Println("Shutting down...")
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/TACIXAT/party-line/white-box"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/secretbox"
+	"github.com/kevinburke/nacl/sign"
+	"github.com/mitchellh/go-homedir"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+const KEY_FILE_VERSION = 1
+
+// scrypt cost parameters for new key files
+const (
+	SCRYPT_N = 1 << 15
+	SCRYPT_R = 8
+	SCRYPT_P = 1
+)
+
+const PASSPHRASE_ENV = "PARTY_LINE_PASSPHRASE"
+
+// On disk identity. Public keys are in the clear so the id can be shown
+// without a passphrase, private keys are sealed with a key derived from it.
+type KeyFile struct {
+	Version int
+	SignPub sign.PublicKey
+	EncPub  nacl.Key
+	Salt    []byte
+	ScryptN int
+	ScryptR int
+	ScryptP int
+	Sealed  []byte
+}
+
+// The part of whitebox.Self that gets sealed.
+type privateKeys struct {
+	SignPrv sign.PrivateKey
+	EncPrv  nacl.Key
+}
+
+// passphrase used to open the key file, reused when writing it back out
+var permPassphrase []byte
+
+const DEFAULT_IDENTITY = "default"
+
+var identityNameRegexp = regexp.MustCompile("^[a-zA-Z0-9_-]{1,32}$")
+
+func baseDir() string {
+	home, err := homedir.Dir()
+	if err != nil {
+		log.Fatal("could not get home dir")
+	}
+
+	return filepath.Join(home, "party-line")
+}
+
+func identityDir() string {
+	return filepath.Join(baseDir(), "identities")
+}
+
+func validIdentityName(name string) bool {
+	return identityNameRegexp.MatchString(name)
+}
+
+// key file for a named identity
+func permPath(name string) string {
+	if !validIdentityName(name) {
+		log.Fatalf("invalid identity name %q (letters, digits, - and _)", name)
+	}
+
+	return filepath.Join(identityDir(), name+".self")
+}
+
+// perm.self from before named identities becomes the default identity
+func migrateLegacyPerm() {
+	legacyPath := filepath.Join(baseDir(), "perm.self")
+	path := permPath(DEFAULT_IDENTITY)
+
+	legacyExists, err := pathExists(legacyPath)
+	if err != nil || !legacyExists {
+		return
+	}
+
+	exists, err := pathExists(path)
+	if err != nil || exists {
+		return
+	}
+
+	err = os.MkdirAll(identityDir(), 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = os.Rename(legacyPath, path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "moved %s to %s\n", legacyPath, path)
+}
+
+func pathExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, err
+}
+
+func readPassphrase(confirm bool) []byte {
+	if *keyfileFlag != "" {
+		contents, err := ioutil.ReadFile(*keyfileFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return bytes.TrimRight(contents, "\r\n")
+	}
+
+	env := os.Getenv(PASSPHRASE_ENV)
+	if env != "" {
+		return []byte(env)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		log.Fatalf("no passphrase, use -keyfile or set %s", PASSPHRASE_ENV)
+	}
+
+	fmt.Fprint(os.Stderr, "passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "again: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if !bytes.Equal(passphrase, again) {
+			log.Fatal("passphrases do not match")
+		}
+	}
+
+	if len(passphrase) == 0 {
+		log.Fatal("empty passphrase")
+	}
+
+	return passphrase
+}
+
+func deriveKey(passphrase, salt []byte, n, r, p int) (nacl.Key, error) {
+	derived, err := scrypt.Key(passphrase, salt, n, r, p, nacl.KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	key := new([nacl.KeySize]byte)
+	copy(key[:], derived)
+	return key, nil
+}
+
+func sealSelf(self whitebox.Self, passphrase []byte) (*KeyFile, error) {
+	keyFile := new(KeyFile)
+	keyFile.Version = KEY_FILE_VERSION
+	keyFile.SignPub = self.SignPub
+	keyFile.EncPub = self.EncPub
+	keyFile.ScryptN = SCRYPT_N
+	keyFile.ScryptR = SCRYPT_R
+	keyFile.ScryptP = SCRYPT_P
+
+	keyFile.Salt = make([]byte, 32)
+	_, err := rand.Read(keyFile.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := deriveKey(
+		passphrase, keyFile.Salt, keyFile.ScryptN, keyFile.ScryptR, keyFile.ScryptP)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonKeys, err := json.Marshal(privateKeys{self.SignPrv, self.EncPrv})
+	if err != nil {
+		return nil, err
+	}
+
+	keyFile.Sealed = secretbox.EasySeal(jsonKeys, key)
+	return keyFile, nil
+}
+
+func openSelf(keyFile *KeyFile, passphrase []byte) (whitebox.Self, error) {
+	var self whitebox.Self
+	key, err := deriveKey(
+		passphrase, keyFile.Salt, keyFile.ScryptN, keyFile.ScryptR, keyFile.ScryptP)
+	if err != nil {
+		return self, err
+	}
+
+	jsonKeys, err := secretbox.EasyOpen(keyFile.Sealed, key)
+	if err != nil {
+		return self, errors.New("could not open key file (wrong passphrase?)")
+	}
+
+	var keys privateKeys
+	err = json.Unmarshal(jsonKeys, &keys)
+	if err != nil {
+		return self, err
+	}
+
+	self.SignPub = keyFile.SignPub
+	self.EncPub = keyFile.EncPub
+	self.SignPrv = keys.SignPrv
+	self.EncPrv = keys.EncPrv
+
+	err = checkKeys(self)
+	if err != nil {
+		return whitebox.Self{}, err
+	}
+
+	return self, nil
+}
+
+// The public keys are stored in the clear next to the sealed private keys, so
+// make sure they still belong together before the id gets used.
+func checkKeys(self whitebox.Self) error {
+	if len(self.SignPrv) != ed25519.PrivateKeySize || self.EncPrv == nil ||
+		self.EncPub == nil {
+		return errors.New("key file is missing keys")
+	}
+
+	seed := self.SignPrv[:ed25519.SeedSize]
+	signPub := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	if !bytes.Equal(signPub, self.SignPub) ||
+		!bytes.Equal(self.SignPrv[ed25519.SeedSize:], signPub) {
+		return errors.New("key file signing keys do not match")
+	}
+
+	encPub, err := curve25519.X25519(self.EncPrv[:], curve25519.Basepoint)
+	if err != nil || !bytes.Equal(encPub, self.EncPub[:]) {
+		return errors.New("key file encryption keys do not match")
+	}
+
+	return nil
+}
+
+// write to a temp file and rename so a shorter file can't leave garbage
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	tmpFile, err := os.OpenFile(
+		tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	n, err := tmpFile.Write(data)
+	if err == nil && n != len(data) {
+		err = errors.New("short write")
+	}
+
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func writeKeyFile(path string, self whitebox.Self) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if permPassphrase == nil {
+		fmt.Fprintln(os.Stderr, "choose a passphrase for your permanent id")
+		permPassphrase = readPassphrase(true)
+	}
+
+	keyFile, err := sealSelf(self, permPassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	jsonKeyFile, err := json.Marshal(keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = writeFileAtomic(path, jsonKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Parse a key file. Plaintext whitebox.Self files from before key files were
+// versioned come back as version 0.
+func readKeyFile(path string) (*KeyFile, []byte) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keyFile := new(KeyFile)
+	err = json.Unmarshal(contents, keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if keyFile.Version > KEY_FILE_VERSION {
+		log.Fatalf("unsupported key file version %d", keyFile.Version)
+	}
+
+	return keyFile, contents
+}
+
+// Decrypt a key file, prompting for the passphrase. The returned bool is
+// true for plaintext files that should be written back encrypted.
+func openKeyFile(path string) (whitebox.Self, bool) {
+	var self whitebox.Self
+	keyFile, contents := readKeyFile(path)
+	if keyFile.Version == 0 {
+		err := json.Unmarshal(contents, &self)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = checkKeys(self)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Fprintln(os.Stderr, "encrypting existing permanent id")
+		return self, true
+	}
+
+	permPassphrase = readPassphrase(false)
+	self, err := openSelf(keyFile, permPassphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return self, false
+}
+
+func savePerm(name string, self whitebox.Self) {
+	writeKeyFile(permPath(name), self)
+}
+
+// Load a permanent id by name. The returned bool is true when the file needs
+// to be written (new id or plaintext file from an old version).
+func fetchPerm(name string, self whitebox.Self) (whitebox.Self, bool) {
+	if name == DEFAULT_IDENTITY {
+		migrateLegacyPerm()
+	}
+
+	path := permPath(name)
+	exists, err := pathExists(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !exists {
+		return self, true
+	}
+
+	return openKeyFile(path)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/TACIXAT/party-line/white-box"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func generateSelf(t *testing.T) whitebox.Self {
+	self, err := whitebox.GenerateSelf()
+	if err != nil {
+		t.Fatalf("Error generating keys: %v", err)
+	}
+
+	return self
+}
+
+// Passphrases come from -keyfile, point it at a file for the test.
+func setPassphrase(t *testing.T, dir string, passphrase string) {
+	path := filepath.Join(dir, "passphrase")
+	err := ioutil.WriteFile(path, []byte(passphrase+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing passphrase: %v", err)
+	}
+
+	keyfileFlag = &path
+	permPassphrase = nil
+}
+
+func TestSealOpenSelf(t *testing.T) {
+	self := generateSelf(t)
+	keyFile, err := sealSelf(self, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("Error sealing keys: %v", err)
+	}
+
+	if keyFile.Version != KEY_FILE_VERSION {
+		t.Errorf("Sealed key file has unexpected version:")
+		t.Errorf("Got: %d", keyFile.Version)
+		t.Errorf("Expecting: %d", KEY_FILE_VERSION)
+	}
+
+	opened, err := openSelf(keyFile, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("Error opening keys: %v", err)
+	}
+
+	if !reflect.DeepEqual(opened, self) {
+		t.Errorf("Opened keys do not match the sealed keys.")
+	}
+
+	_, err = openSelf(keyFile, []byte("hunter3"))
+	if err == nil {
+		t.Errorf("Keys opened with the wrong passphrase.")
+	}
+}
+
+func TestOpenSelfMismatched(t *testing.T) {
+	self := generateSelf(t)
+	other := generateSelf(t)
+
+	tables := []struct {
+		name   string
+		modify func(keyFile *KeyFile)
+	}{
+		{"signing", func(keyFile *KeyFile) { keyFile.SignPub = other.SignPub }},
+		{"encryption", func(keyFile *KeyFile) { keyFile.EncPub = other.EncPub }},
+	}
+
+	for _, table := range tables {
+		keyFile, err := sealSelf(self, []byte("hunter2"))
+		if err != nil {
+			t.Fatalf("Error sealing keys: %v", err)
+		}
+
+		table.modify(keyFile)
+		_, err = openSelf(keyFile, []byte("hunter2"))
+		if err == nil {
+			t.Errorf("Key file with swapped %s key opened.", table.name)
+		}
+	}
+}
+
+func TestKeyFileMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.perm")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	setPassphrase(t, dir, "hunter2")
+	self := generateSelf(t)
+	path := filepath.Join(dir, "identities", "default.self")
+
+	// plaintext whitebox.Self from before key files were versioned
+	jsonSelf, err := json.Marshal(self)
+	if err != nil {
+		t.Fatalf("Error marshalling keys: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		t.Fatalf("Error creating identity dir: %v", err)
+	}
+
+	err = ioutil.WriteFile(path, jsonSelf, 0600)
+	if err != nil {
+		t.Fatalf("Error writing key file: %v", err)
+	}
+
+	opened, write := openKeyFile(path)
+	if !write {
+		t.Errorf("Plaintext key file not flagged to be encrypted.")
+	}
+
+	if !reflect.DeepEqual(opened, self) {
+		t.Errorf("Plaintext keys do not match.")
+	}
+
+	writeKeyFile(path, opened)
+
+	keyFile, _ := readKeyFile(path)
+	if keyFile.Version != KEY_FILE_VERSION || len(keyFile.Sealed) == 0 {
+		t.Errorf("Migrated key file is not sealed:")
+		t.Errorf("Got: version %d", keyFile.Version)
+		t.Errorf("Expecting: version %d", KEY_FILE_VERSION)
+	}
+
+	permPassphrase = nil
+	reopened, write := openKeyFile(path)
+	if write {
+		t.Errorf("Sealed key file flagged to be written again.")
+	}
+
+	if !reflect.DeepEqual(reopened, self) {
+		t.Errorf("Migrated keys do not match.")
+	}
+}
+
+func TestKeyFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.perm")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	setPassphrase(t, dir, "hunter2")
+	path := filepath.Join(dir, "identities", "default.self")
+
+	// an existing file with loose permissions is replaced, not rewritten
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		t.Fatalf("Error creating identity dir: %v", err)
+	}
+
+	err = ioutil.WriteFile(path, []byte("{}"), 0644)
+	if err != nil {
+		t.Fatalf("Error writing key file: %v", err)
+	}
+
+	writeKeyFile(path, generateSelf(t))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Error reading key file: %v", err)
+	}
+
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Key file has unexpected mode:")
+		t.Errorf("Got: %o", info.Mode().Perm())
+		t.Errorf("Expecting: %o", 0600)
+	}
+
+	_, err = os.Stat(path + ".tmp")
+	if !os.IsNotExist(err) {
+		t.Errorf("Temp file left behind after writing the key file.")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/TACIXAT/party-line/white-box"
+	"log"
+	"strings"
+)
+
+// Partial id lookups shared by the tui commands and the control socket. Each
+// prefix has to match exactly one id.
+
+func findPartyIn(parties whitebox.LockingPartyMap,
+	prefix, kind, kinds string) (string, error) {
+	partyId := ""
+	parties.Mutex.Lock()
+	defer parties.Mutex.Unlock()
+	for id, _ := range parties.Map {
+		if strings.HasPrefix(id, prefix) {
+			if partyId != "" {
+				return "", fmt.Errorf(
+					"error multiple %s found for %s", kinds, prefix)
+			}
+			partyId = id
+		}
+	}
+
+	if partyId == "" {
+		return "", fmt.Errorf("error %s not found for %s", kind, prefix)
+	}
+
+	return partyId, nil
+}
+
+func findParty(wb *whitebox.WhiteBox, prefix string) (string, error) {
+	return findPartyIn(wb.Parties, prefix, "party", "parties")
+}
+
+func findInvite(wb *whitebox.WhiteBox, prefix string) (string, error) {
+	return findPartyIn(wb.PendingInvites, prefix, "invite", "invites")
+}
+
+func findPeer(wb *whitebox.WhiteBox, prefix string) (*whitebox.MinPeer, error) {
+	var min *whitebox.MinPeer
+	wb.PeerCache.Mutex.Lock()
+	defer wb.PeerCache.Mutex.Unlock()
+	for id, _ := range wb.PeerCache.Map {
+		front, err := wb.IdFront(id)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if strings.HasPrefix(front, prefix) {
+			if min != nil {
+				return nil, fmt.Errorf(
+					"error multiple peers found for %s", prefix)
+			}
+
+			min, err = wb.IdToMin(id)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+		}
+	}
+
+	if min == nil {
+		return nil, fmt.Errorf("error peer not found for %s", prefix)
+	}
+
+	return min, nil
+}
+
+func findPack(party *whitebox.PartyLine, prefix string) (string, error) {
+	packHash := ""
+	party.PacksLock.Lock()
+	defer party.PacksLock.Unlock()
+	for hash, _ := range party.Packs {
+		if strings.HasPrefix(hash, prefix) {
+			if packHash != "" {
+				return "", fmt.Errorf(
+					"error multiple packs found for %s", prefix)
+			}
+			packHash = hash
+		}
+	}
+
+	if packHash == "" {
+		return "", fmt.Errorf("error pack not found for %s", prefix)
+	}
+
+	return packHash, nil
+}
+
+// party by partial id, nil if it left since the lookup
+func getParty(wb *whitebox.WhiteBox, prefix string) (
+	*whitebox.PartyLine, error) {
+	partyId, err := findParty(wb, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	wb.Parties.Mutex.Lock()
+	party, ok := wb.Parties.Map[partyId]
+	wb.Parties.Mutex.Unlock()
+	if !ok {
+		return nil, errors.New("error party left " + partyId)
+	}
+
+	return party, nil
+}
+
+func leaveParty(wb *whitebox.WhiteBox, prefix string) (string, error) {
+	partyId, err := findParty(wb, prefix)
+	if err != nil {
+		return "", err
+	}
+
+	// SendDisconnect removes the party from the map, so hold the lock
+	wb.Parties.Mutex.Lock()
+	party, ok := wb.Parties.Map[partyId]
+	if ok {
+		party.SendDisconnect()
+	}
+	wb.Parties.Mutex.Unlock()
+
+	if !ok {
+		return "", errors.New("error party left " + partyId)
+	}
+
+	return partyId, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/TACIXAT/party-line/white-box"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type resolveTable struct {
+	prefix string
+	match  string
+	err    string
+}
+
+func checkResolve(t *testing.T, kind string, table resolveTable,
+	match string, err error) {
+	if table.err != "" {
+		if err == nil || !strings.Contains(err.Error(), table.err) {
+			t.Errorf("Unexpected error resolving %s %q:", kind, table.prefix)
+			t.Errorf("Got: %v", err)
+			t.Errorf("Expecting: %s", table.err)
+		}
+		return
+	}
+
+	if err != nil || match != table.match {
+		t.Errorf("Unexpected match resolving %s %q:", kind, table.prefix)
+		t.Errorf("Got: %s (%v)", match, err)
+		t.Errorf("Expecting: %s", table.match)
+	}
+}
+
+func TestFindParty(t *testing.T) {
+	parties := whitebox.LockingPartyMap{
+		Map: map[string]*whitebox.PartyLine{
+			"coolabc": nil,
+			"cooldef": nil,
+			"neat123": nil},
+		Mutex: new(sync.Mutex)}
+
+	tables := []resolveTable{
+		{"coola", "coolabc", ""},
+		{"neat", "neat123", ""},
+		{"neat123", "neat123", ""},
+		{"cool", "", "multiple parties"},
+		{"", "", "multiple parties"},
+		{"nope", "", "party not found"},
+		{"coolabcd", "", "party not found"},
+	}
+
+	for _, table := range tables {
+		match, err := findPartyIn(parties, table.prefix, "party", "parties")
+		checkResolve(t, "party", table, match, err)
+	}
+}
+
+func TestFindPack(t *testing.T) {
+	party := &whitebox.PartyLine{
+		Packs: map[string]whitebox.LockingPack{
+			"aa11": {},
+			"aa22": {},
+			"bb33": {}},
+		PacksLock: new(sync.Mutex)}
+
+	tables := []resolveTable{
+		{"aa1", "aa11", ""},
+		{"b", "bb33", ""},
+		{"aa", "", "multiple packs"},
+		{"cc", "", "pack not found"},
+	}
+
+	for _, table := range tables {
+		match, err := findPack(party, table.prefix)
+		checkResolve(t, "pack", table, match, err)
+	}
+}
+
+func TestFindPeer(t *testing.T) {
+	wb, dir := controlTestBox(t)
+	defer os.RemoveAll(dir)
+
+	ids := make([]string, 0)
+	for i := 0; i < 2; i++ {
+		self := generateSelf(t)
+		min := whitebox.MinPeer{EncPub: self.EncPub, SignPub: self.SignPub}
+		ids = append(ids, min.Id())
+
+		wb.PeerCache.Mutex.Lock()
+		wb.PeerCache.Map[min.Id()] = whitebox.PeerCache{Time: time.Now()}
+		wb.PeerCache.Mutex.Unlock()
+	}
+
+	tables := []resolveTable{
+		{ids[0][:16], ids[0], ""},
+		{ids[1][:16], ids[1], ""},
+		{"", "", "multiple peers"},
+		{"zz", "", "peer not found"},
+	}
+
+	for _, table := range tables {
+		match := ""
+		min, err := findPeer(wb, table.prefix)
+		if err == nil {
+			match = min.Id()
+		}
+		checkResolve(t, "peer", table, match, err)
+	}
+}
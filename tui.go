@@ -122,19 +122,13 @@ func handleBootstrap(wb *whitebox.WhiteBox, toks []string) {
 		return
 	}
 
-	bs := toks[1]
-	bsToks := strings.Split(bs, "/")
-	if len(bsToks) != 3 {
-		setStatus("error processing bootstrap command")
+	node, err := whitebox.ParseBootstrap(toks[1])
+	if err != nil {
+		setStatus(err.Error())
 		return
 	}
 
-	ip := bsToks[0]
-	port := bsToks[1]
-	id := bsToks[2]
-	addr := ip + ":" + port
-
-	wb.SendBootstrap(addr, id)
+	wb.SendBootstrap(node.Address, node.Id)
 }
 
 func chatStatus(status string) {
@@ -222,61 +216,15 @@ func handleInvite(wb *whitebox.WhiteBox, toks []string) {
 		return
 	}
 
-	partyPrefix := toks[1]
-	userPrefix := toks[2]
-
-	// iterate parties
-	var party *whitebox.PartyLine
-	wb.Parties.Mutex.Lock()
-	for id, p := range wb.Parties.Map {
-		if strings.HasPrefix(id, partyPrefix) {
-			if party != nil {
-				setStatus(fmt.Sprintf(
-					"error multiple parties found for %s", partyPrefix))
-				wb.Parties.Mutex.Unlock()
-				return
-			}
-			party = p
-		}
-	}
-	wb.Parties.Mutex.Unlock()
-
-	if party == nil {
-		setStatus(fmt.Sprintf("error party not found for %s", partyPrefix))
+	party, err := getParty(wb, toks[1])
+	if err != nil {
+		setStatus(err.Error())
 		return
 	}
 
-	// iterate peers
-	var min *whitebox.MinPeer
-	wb.PeerCache.Mutex.Lock()
-	for id, _ := range wb.PeerCache.Map {
-		front, err := wb.IdFront(id)
-		if err != nil {
-			setStatus("error decoding peer id")
-			log.Println(err)
-			continue
-		}
-
-		if strings.HasPrefix(front, userPrefix) {
-			if min != nil {
-				setStatus(fmt.Sprintf(
-					"error multiple peers found for %s", userPrefix))
-				wb.PeerCache.Mutex.Unlock()
-				return
-			}
-
-			min, err = wb.IdToMin(id)
-			if err != nil {
-				setStatus("error decoding peer")
-				log.Println(err)
-				continue
-			}
-		}
-	}
-	wb.PeerCache.Mutex.Unlock()
-
-	if min == nil {
-		setStatus(fmt.Sprintf("error peer not found for %s", userPrefix))
+	min, err := findPeer(wb, toks[2])
+	if err != nil {
+		setStatus(err.Error())
 		return
 	}
 
@@ -303,25 +251,9 @@ func handleShow(wb *whitebox.WhiteBox, toks []string) {
 		return
 	}
 
-	partyPrefix := toks[1]
-
-	var partyId string
-	wb.Parties.Mutex.Lock()
-	for id, _ := range wb.Parties.Map {
-		if strings.HasPrefix(id, partyPrefix) {
-			if partyId != "" {
-				setStatus(fmt.Sprintf(
-					"error multiple parties found for %s", partyPrefix))
-				wb.Parties.Mutex.Unlock()
-				return
-			}
-			partyId = id
-		}
-	}
-	wb.Parties.Mutex.Unlock()
-
-	if partyId == "" {
-		setStatus(fmt.Sprintf("error party not found for %s", partyPrefix))
+	partyId, err := findParty(wb, toks[1])
+	if err != nil {
+		setStatus(err.Error())
 		return
 	}
 
@@ -356,34 +288,13 @@ func handleSend(wb *whitebox.WhiteBox, toks []string) {
 		return
 	}
 
-	partyPrefix := toks[1]
-	message := strings.Join(toks[2:], " ")
-
-	// iterate parties
-	partyId := ""
-	wb.Parties.Mutex.Lock()
-	for id, _ := range wb.Parties.Map {
-		if strings.HasPrefix(id, partyPrefix) {
-			if partyId != "" {
-				setStatus(fmt.Sprintf(
-					"error multiple parties found for %s", partyPrefix))
-				wb.Parties.Mutex.Unlock()
-				return
-			}
-			partyId = id
-		}
-	}
-	wb.Parties.Mutex.Unlock()
-
-	if partyId == "" {
-		setStatus(fmt.Sprintf("error party not found for %s", partyPrefix))
+	party, err := getParty(wb, toks[1])
+	if err != nil {
+		setStatus(err.Error())
 		return
 	}
 
-	wb.Parties.Mutex.Lock()
-	wb.Parties.Map[partyId].SendChat(message)
-	wb.Parties.Mutex.Unlock()
-	return
+	party.SendChat(strings.Join(toks[2:], " "))
 }
 
 // clear messages
@@ -435,25 +346,9 @@ func handleAccept(wb *whitebox.WhiteBox, toks []string) {
 		return
 	}
 
-	partyPrefix := toks[1]
-
-	// iterate pending
-	partyId := ""
-	wb.PendingInvites.Mutex.Lock()
-	for id, _ := range wb.PendingInvites.Map {
-		if strings.HasPrefix(id, partyPrefix) {
-			if partyId != "" {
-				setStatus(fmt.Sprintf(
-					"error multiple invites found for %s", partyPrefix))
-				return
-			}
-			partyId = id
-		}
-	}
-	wb.PendingInvites.Mutex.Unlock()
-
-	if partyId == "" {
-		setStatus(fmt.Sprintf("error invite not found for %s", partyPrefix))
+	partyId, err := findInvite(wb, toks[1])
+	if err != nil {
+		setStatus(err.Error())
 		return
 	}
 
@@ -466,32 +361,12 @@ func handleLeave(wb *whitebox.WhiteBox, toks []string) {
 		return
 	}
 
-	partyPrefix := toks[1]
-
-	// iterate parties
-	partyId := ""
-	wb.Parties.Mutex.Lock()
-	for id, _ := range wb.Parties.Map {
-		if strings.HasPrefix(id, partyPrefix) {
-			if partyId != "" {
-				setStatus(fmt.Sprintf(
-					"error multiple parties found for %s", partyPrefix))
-				wb.Parties.Mutex.Unlock()
-				return
-			}
-			partyId = id
-		}
-	}
-	wb.Parties.Mutex.Unlock()
-
-	if partyId == "" {
-		setStatus(fmt.Sprintf("error party not found for %s", partyPrefix))
+	partyId, err := leaveParty(wb, toks[1])
+	if err != nil {
+		setStatus(err.Error())
 		return
 	}
 
-	wb.Parties.Mutex.Lock()
-	wb.Parties.Map[partyId].SendDisconnect()
-	wb.Parties.Mutex.Unlock()
 	setStatus("left the party " + partyId)
 }
 
@@ -529,59 +404,20 @@ func handlePacks(wb *whitebox.WhiteBox, toks []string) {
 }
 
 func handleGet(wb *whitebox.WhiteBox, toks []string) {
-	// find party
 	if len(toks) < 3 {
 		setStatus("error insufficient args to get command")
 		return
 	}
 
-	partyPrefix := toks[1]
-
-	// iterate parties
-	partyId := ""
-	wb.Parties.Mutex.Lock()
-	for id, _ := range wb.Parties.Map {
-		if strings.HasPrefix(id, partyPrefix) {
-			if partyId != "" {
-				setStatus(fmt.Sprintf(
-					"error multiple parties found for %s", partyPrefix))
-				wb.Parties.Mutex.Unlock()
-				return
-			}
-			partyId = id
-		}
-	}
-	wb.Parties.Mutex.Unlock()
-
-	if partyId == "" {
-		setStatus(fmt.Sprintf("error party not found for %s", partyPrefix))
+	party, err := getParty(wb, toks[1])
+	if err != nil {
+		setStatus(err.Error())
 		return
 	}
 
-	hashPrefix := toks[2]
-
-	// find pack
-	packHash := ""
-	wb.Parties.Mutex.Lock()
-	party := wb.Parties.Map[partyId]
-	wb.Parties.Mutex.Unlock()
-
-	party.PacksLock.Lock()
-	for hash, _ := range party.Packs {
-		if strings.HasPrefix(hash, hashPrefix) {
-			if packHash != "" {
-				setStatus(fmt.Sprintf(
-					"error multiple packs found for %s", hashPrefix))
-				party.PacksLock.Unlock()
-				return
-			}
-			packHash = hash
-		}
-	}
-	party.PacksLock.Unlock()
-
-	if packHash == "" {
-		setStatus(fmt.Sprintf("error pack not found for %s", hashPrefix))
+	packHash, err := findPack(party, toks[2])
+	if err != nil {
+		setStatus(err.Error())
 		return
 	}
 
@@ -659,6 +495,8 @@ func handleUserInput(wb *whitebox.WhiteBox, buf string) {
 	case "/help":
 		handleHelp()
 	case "/quit":
+		wb.SavePendingPacks()
+		wb.SavePeers()
 		wb.DisconnectParties()
 		wb.SendDisconnect()
 		termui.StopLoop()
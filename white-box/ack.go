@@ -0,0 +1,240 @@
+package whitebox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// How often AckRetrier looks for envelopes due a retry.
+const ACK_CHECK_INTERVAL = 500 * time.Millisecond
+
+// How long ids of handled envelopes are kept to drop retransmits. Longer than
+// a sender keeps retrying with the default config.
+const ACK_SEEN_TIMEOUT = 5 * time.Minute
+
+// A directed envelope waiting on an ack from its recipient.
+type PendingAck struct {
+	Env   Envelope
+	Label string
+	Quiet bool
+	Tries int
+	Next  time.Time
+}
+
+type LockingAcks struct {
+	Map   map[string]*PendingAck
+	Mutex *sync.Mutex
+}
+
+// Reliable envelopes we've handled, by sender and id.
+type LockingSeenAcks struct {
+	Map   map[string]time.Time
+	Mutex *sync.Mutex
+}
+
+type MessageAck struct {
+	Id   string
+	Time time.Time
+}
+
+// Random id for matching replies to what we sent.
+func newMessageId() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// Route an envelope to env.To and retry with backoff until the recipient
+// acks it. The outcome goes to the status channel as "<label> delivered" or
+// "<label> failed after n tries". Quiet skips the delivered status for high
+// volume messages. Peers known to not ack get a single send.
+func (wb *WhiteBox) routeReliable(env *Envelope, label string, quiet bool) {
+	_, _, known := wb.PeerProtocol(env.To)
+	if known && !wb.peerHas(env.To, CAP_ACK) {
+		wb.route(env)
+		if !quiet {
+			wb.setStatus(label + " sent")
+		}
+		return
+	}
+
+	id, err := newMessageId()
+	if err != nil {
+		log.Println(err)
+		wb.route(env)
+		return
+	}
+
+	pending := new(PendingAck)
+	pending.Env = *env
+	pending.Env.Id = id
+	pending.Label = label
+	pending.Quiet = quiet
+	pending.Tries = 1
+	pending.Next = time.Now().Add(wb.Config.AckTimeout)
+
+	sendEnv := pending.Env
+
+	wb.Acks.Mutex.Lock()
+	wb.Acks.Map[id] = pending
+	wb.Acks.Mutex.Unlock()
+
+	wb.route(&sendEnv)
+}
+
+// Resend envelopes that haven't been acked, doubling the wait each time, and
+// give up after Config.AckRetries tries.
+func (wb *WhiteBox) AckRetrier() {
+	for {
+		time.Sleep(ACK_CHECK_INTERVAL)
+		now := time.Now()
+
+		retries := make([]Envelope, 0)
+		failed := make([]*PendingAck, 0)
+		wb.Acks.Mutex.Lock()
+		for id, pending := range wb.Acks.Map {
+			if now.Before(pending.Next) {
+				continue
+			}
+
+			if pending.Tries >= wb.Config.AckRetries {
+				delete(wb.Acks.Map, id)
+				failed = append(failed, pending)
+				continue
+			}
+
+			backoff := wb.Config.AckTimeout << uint(pending.Tries)
+			pending.Tries++
+			pending.Next = now.Add(backoff)
+
+			// fresh time so hops don't drop it as already routed
+			pending.Env.Time = now.UTC()
+			retries = append(retries, pending.Env)
+		}
+		wb.Acks.Mutex.Unlock()
+
+		for idx := range retries {
+			wb.route(&retries[idx])
+		}
+
+		for _, pending := range failed {
+			wb.setStatus(fmt.Sprintf(
+				"%s failed after %d tries", pending.Label, pending.Tries))
+		}
+
+		wb.SeenAcks.Mutex.Lock()
+		for key, seen := range wb.SeenAcks.Map {
+			if now.Sub(seen) > ACK_SEEN_TIMEOUT {
+				delete(wb.SeenAcks.Map, key)
+			}
+		}
+		wb.SeenAcks.Mutex.Unlock()
+	}
+}
+
+// Ack a reliable envelope addressed to us. Ids aren't signed, so this is only
+// called once the envelope has been opened with its sender's key, otherwise
+// anyone could have us ack for a peer or spend their id ahead of the real
+// message. Returns true if it was handled before and should be dropped.
+func (wb *WhiteBox) ackEnvelope(env *Envelope) bool {
+	if env.Id == "" || env.To != wb.PeerSelf.Id() {
+		return false
+	}
+
+	wb.sendAck(env)
+
+	key := env.From + "/" + env.Id
+	wb.SeenAcks.Mutex.Lock()
+	_, seen := wb.SeenAcks.Map[key]
+	wb.SeenAcks.Map[key] = time.Now()
+	wb.SeenAcks.Mutex.Unlock()
+
+	if seen {
+		log.Println("dropping retransmit", env.Type, env.Id)
+	}
+
+	return seen
+}
+
+func (wb *WhiteBox) sendAck(ackedEnv *Envelope) {
+	env := Envelope{
+		Type: "ack",
+		From: wb.PeerSelf.Id(),
+		To:   ackedEnv.From}
+
+	ack := MessageAck{
+		Id:   ackedEnv.Id,
+		Time: time.Now().UTC()}
+
+	jsonAck, err := json.Marshal(ack)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	env.Data, err = wb.signPayload(env.Type, env.To, "", jsonAck)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	wb.route(&env)
+}
+
+func (wb *WhiteBox) processAck(env *Envelope) {
+	header, jsonData, err := wb.openEnvelope(env, "ack")
+	if err != nil {
+		wb.setStatus(err.Error())
+		return
+	}
+
+	if !wb.allowSender(env) {
+		log.Println("rate limited", env.Type, "from", env.From)
+		return
+	}
+
+	ack := new(MessageAck)
+	err = json.Unmarshal(jsonData, ack)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error invalid json (ack)")
+		return
+	}
+
+	// ack ids are used once, a replayed ack has nothing left to clear, so
+	// acks skip the replay cache they'd fill up during transfers
+	if !wb.recentMessage(header.Time, "ack") {
+		return
+	}
+
+	wb.noteSender(env)
+
+	wb.Acks.Mutex.Lock()
+	pending, exists := wb.Acks.Map[ack.Id]
+	if exists && pending.Env.To == env.From {
+		delete(wb.Acks.Map, ack.Id)
+	}
+	wb.Acks.Mutex.Unlock()
+
+	// late acks for retries are expected
+	if !exists {
+		return
+	}
+
+	if pending.Env.To != env.From {
+		wb.setStatus("error ack from wrong peer (ack)")
+		return
+	}
+
+	if !pending.Quiet {
+		wb.setStatus(pending.Label + " delivered")
+	}
+}
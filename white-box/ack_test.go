@@ -0,0 +1,155 @@
+package whitebox
+
+import (
+	"encoding/json"
+	"github.com/kevinburke/nacl/box"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func signedAck(wb *WhiteBox, to, id string) *Envelope {
+	ack := MessageAck{Id: id, Time: time.Now().UTC()}
+	jsonAck, _ := json.Marshal(ack)
+	signed, _ := wb.signPayload("ack", to, "", jsonAck)
+	return &Envelope{
+		Type: "ack",
+		From: wb.PeerSelf.Id(),
+		To:   to,
+		Data: signed}
+}
+
+func drainStatus(wb *WhiteBox) []string {
+	messages := make([]string, 0)
+	for {
+		select {
+		case status := <-wb.StatusChannel:
+			messages = append(messages, status.Message)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestReliableAck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.ack")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self, otherSelf, strangerSelf Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	other := New(dir, "127.0.0.1", "3500", otherSelf, DefaultConfig())
+	stranger := New(dir, "127.0.0.1", "3501", strangerSelf, DefaultConfig())
+
+	env := Envelope{
+		Type: "invite",
+		From: wb.PeerSelf.Id(),
+		To:   other.PeerSelf.Id()}
+	wb.routeReliable(&env, "invite", false)
+
+	if len(wb.Acks.Map) != 1 {
+		t.Fatalf("Unexpected number of pending acks: %d", len(wb.Acks.Map))
+	}
+
+	var sent Envelope
+	for _, pending := range wb.Acks.Map {
+		sent = pending.Env
+	}
+
+	// the recipient acks every copy but only handles the first
+	if other.ackEnvelope(&sent) {
+		t.Errorf("First copy dropped as a retransmit.")
+	}
+
+	if !other.ackEnvelope(&sent) {
+		t.Errorf("Retransmit not dropped.")
+	}
+
+	drainStatus(wb)
+	wb.processAck(signedAck(stranger, wb.PeerSelf.Id(), sent.Id))
+	if len(wb.Acks.Map) != 1 {
+		t.Errorf("Ack from the wrong peer was accepted.")
+	}
+
+	wb.processAck(signedAck(other, wb.PeerSelf.Id(), sent.Id))
+	if len(wb.Acks.Map) != 0 {
+		t.Errorf("Ack did not clear the pending message.")
+	}
+
+	delivered := false
+	for _, message := range drainStatus(wb) {
+		if message == "invite delivered" {
+			delivered = true
+		}
+	}
+
+	if !delivered {
+		t.Errorf("Delivery was not reported.")
+	}
+
+	// peers known to not ack get one send
+	oldPeer := MessageTimePeer{Peer: other.PeerSelf, Time: time.Now().UTC()}
+	wb.recordProtocol(other.PeerSelf.Id(), &oldPeer)
+	wb.routeReliable(&env, "invite", false)
+	if len(wb.Acks.Map) != 0 {
+		t.Errorf("Waiting on an ack from a peer that doesn't send them.")
+	}
+}
+
+func TestForgedAckId(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.ack")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self, otherSelf Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	other := New(dir, "127.0.0.1", "3500", otherSelf, DefaultConfig())
+
+	partyId := "coolname6b1a2c3d4e5f60718293a4b5"
+	jsonParty, err := json.Marshal(PartyLine{Id: partyId})
+	if err != nil {
+		t.Fatalf("Error marshalling party: %v", err)
+	}
+
+	invite := Envelope{
+		Type: "invite",
+		From: wb.PeerSelf.Id(),
+		To:   other.PeerSelf.Id(),
+		Id:   "0123456789abcdef",
+		Data: box.EasySeal(jsonParty, other.PeerSelf.EncPub, wb.Self.EncPrv)}
+
+	// same sender and id, sealed by someone without the sender's key
+	forged := invite
+	forged.Data = box.EasySeal(
+		jsonParty, other.PeerSelf.EncPub, other.Self.EncPrv)
+
+	deliver := func(env *Envelope) {
+		payload, err := marshalEnvelope(env, WIRE_VERSION)
+		if err != nil {
+			t.Fatalf("Error marshalling envelope: %v", err)
+		}
+		other.processMessage("127.0.0.1:3499", WIRE_VERSION, payload)
+	}
+
+	deliver(&forged)
+	if len(other.SeenAcks.Map) != 0 {
+		t.Errorf("Forged envelope recorded as handled.")
+	}
+
+	deliver(&invite)
+	other.PendingInvites.Mutex.Lock()
+	_, pending := other.PendingInvites.Map[partyId]
+	other.PendingInvites.Mutex.Unlock()
+	if !pending {
+		t.Errorf("Invite after a forged copy was dropped.")
+	}
+
+	if len(other.SeenAcks.Map) != 1 {
+		t.Errorf("Invite not recorded as handled.")
+	}
+}
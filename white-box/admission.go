@@ -0,0 +1,99 @@
+package whitebox
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+	"net"
+)
+
+// Admission to the peer table. Ids cost nothing to make, so one host could
+// otherwise fill our buckets with ids it controls and cut us off from
+// everyone else. Peers need Config.MinPeerWork bits of work on their id, a
+// bucket takes at most Config.SubnetLimit peers from one /24 (/64 for ipv6),
+// and full buckets keep the peers they have.
+
+var errIdWork = errors.New("error peer id has too little work")
+var errSubnetFull = errors.New("error too many peers from subnet")
+
+// Leading zero bits of the double sha256 of a signing key. An id with n bits
+// takes about 2^n keypairs to find.
+func IdWork(signPub []byte) int {
+	first := sha256.Sum256(signPub)
+	hash := sha256.Sum256(first[:])
+
+	work := 0
+	for _, b := range hash {
+		work += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+
+	return work
+}
+
+// Generate keys until the signing key has at least the given bits of work.
+func GenerateSelfWork(work int) (Self, error) {
+	for {
+		self, err := GenerateSelf()
+		if err != nil || IdWork(self.SignPub) >= work {
+			return self, err
+		}
+	}
+}
+
+// Subnet an address counts against, empty for loopback and private addresses
+// which aren't limited.
+func subnetKey(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() {
+		return ""
+	}
+
+	ip4 := ip.To4()
+	if ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// Whether a peer may join entries, a bucket or its replacements. Caller holds
+// the table lock.
+func (wb *WhiteBox) admitPeer(peer *Peer, entries []*PeerEntry) error {
+	if IdWork(peer.SignPub) < wb.Config.MinPeerWork {
+		return errIdWork
+	}
+
+	subnet := subnetKey(peer.Address)
+	if subnet == "" {
+		return nil
+	}
+
+	count := 0
+	for _, entry := range entries {
+		if entry.Peer == nil || entry.Peer.Id() == peer.Id() {
+			continue
+		}
+
+		if subnetKey(entry.Peer.Address) == subnet {
+			count++
+		}
+	}
+
+	if count >= wb.Config.SubnetLimit {
+		return errSubnetFull
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package whitebox
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSubnetKey(t *testing.T) {
+	tables := []struct {
+		address string
+		subnet  string
+	}{
+		{"203.0.113.7:3499", "203.0.113.0/24"},
+		{"203.0.113.200:1", "203.0.113.0/24"},
+		{"198.51.100.7:3499", "198.51.100.0/24"},
+		{"[2001:db8:1:2:3:4:5:6]:3499", "2001:db8:1:2::/64"},
+		{"127.0.0.1:3499", ""},
+		{"192.168.1.20:3499", ""},
+		{"10.0.0.1:3499", ""},
+		{"[::1]:3499", ""},
+	}
+
+	for _, table := range tables {
+		subnet := subnetKey(table.address)
+		if subnet != table.subnet {
+			t.Errorf("Subnet of %s does not match:", table.address)
+			t.Errorf("Got: %s", subnet)
+			t.Errorf("Expecting: %s", table.subnet)
+		}
+	}
+}
+
+func TestIdWork(t *testing.T) {
+	self, err := GenerateSelfWork(8)
+	if err != nil {
+		t.Fatalf("Error generating keys: %v", err)
+	}
+
+	if IdWork(self.SignPub) < 8 {
+		t.Errorf("Generated id is short on work:")
+		t.Errorf("Got: %d", IdWork(self.SignPub))
+		t.Errorf("Expecting: at least %d", 8)
+	}
+}
+
+// A peer at a public address in bucket 255, the far half of the id space.
+func publicPeer(t *testing.T, wb *WhiteBox, address string, work int) *Peer {
+	for {
+		self, err := GenerateSelfWork(work)
+		if err != nil {
+			t.Fatalf("Error generating keys: %v", err)
+		}
+
+		peer := &Peer{
+			SignPub: self.SignPub,
+			EncPub:  self.EncPub,
+			Address: address}
+		if wb.bucketIndex(peer.SignPub) == BUCKET_COUNT-1 {
+			return peer
+		}
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.admission")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig()
+	config.BucketSize = 4
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, config)
+	go discardStatus(wb)
+
+	// one subnet can't take over a bucket
+	subnetPeers := make([]*Peer, 3)
+	for idx := range subnetPeers {
+		subnetPeers[idx] = publicPeer(t, wb, "203.0.113.9:3499", 0)
+		wb.addPeer(subnetPeers[idx], time.Now().UTC())
+	}
+
+	if wb.tablePeer(subnetPeers[2].Id()) != nil {
+		t.Errorf("Bucket took more peers than the subnet limit.")
+	}
+
+	other := publicPeer(t, wb, "198.51.100.9:3499", 0)
+	if !wb.wouldAddPeer(other) {
+		t.Errorf("Peer from another subnet would not be added.")
+	}
+	wb.addPeer(other, time.Now().UTC())
+
+	// full buckets keep the peers they have, however close a newcomer is
+	last := publicPeer(t, wb, "192.0.2.9:3499", 0)
+	wb.addPeer(last, time.Now().UTC())
+	if wb.tablePeer(last.Id()) == nil {
+		t.Errorf("Peer not added to a bucket with room.")
+	}
+
+	newcomer := publicPeer(t, wb, "192.0.2.10:3499", 0)
+	if wb.wouldAddPeer(newcomer) {
+		t.Errorf("Full bucket would take a newcomer.")
+	}
+
+	wb.addPeer(newcomer, time.Now().UTC())
+	if wb.tablePeer(newcomer.Id()) != nil ||
+		len(wb.PeerTable.Buckets[BUCKET_COUNT-1].Replacements) != 1 {
+		t.Errorf("Newcomer to a full bucket was not made a replacement.")
+	}
+
+	// ids without enough work stay out
+	wb.Config.MinPeerWork = 4
+	lazy := publicPeer(t, wb, "100.64.0.1:3499", 0)
+	for IdWork(lazy.SignPub) >= 4 {
+		lazy = publicPeer(t, wb, "100.64.0.1:3499", 0)
+	}
+
+	if wb.wouldAddPeer(lazy) {
+		t.Errorf("Peer without work would be added.")
+	}
+
+	wb.removePeer(other.ShortId())
+	wb.removePeer(last.ShortId())
+	wb.addPeer(lazy, time.Now().UTC())
+	if wb.tablePeer(lazy.Id()) != nil {
+		t.Errorf("Peer without work was added.")
+	}
+
+	worked := publicPeer(t, wb, "100.64.0.2:3499", 4)
+	wb.addPeer(worked, time.Now().UTC())
+	if wb.tablePeer(worked.Id()) == nil {
+		t.Errorf("Peer with work was not added.")
+	}
+}
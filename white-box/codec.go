@@ -0,0 +1,360 @@
+package whitebox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Wire versions. The frame header version says how the envelope in it is
+// encoded, Envelope.Version says what the sender can decode. Peers that
+// predate framing send and expect bare JSON and show up as version 0.
+const (
+	WIRE_VERSION_LEGACY = 0
+	WIRE_VERSION_JSON   = 1
+	WIRE_VERSION_BINARY = 2
+	WIRE_VERSION        = WIRE_VERSION_BINARY
+)
+
+// First byte of binary payloads nested in sealed or signed data. JSON always
+// starts with '{' so the two can't be confused.
+const BINARY_MARKER = 0x01
+
+// How a string is packed. Hex hashes and peer ids go out as raw bytes at half
+// the size.
+const (
+	STRING_RAW = iota
+	STRING_HEX
+	STRING_ID
+)
+
+var errBinaryShort = errors.New("error binary message truncated")
+var errBinaryTrailing = errors.New("error binary message has trailing bytes")
+var errBinaryString = errors.New("error binary message bad string")
+
+// Highest wire version seen from each peer id.
+type LockingVersionMap struct {
+	Map   map[string]int
+	Mutex *sync.Mutex
+}
+
+func (lvm LockingVersionMap) Get(key string) int {
+	lvm.Mutex.Lock()
+	defer lvm.Mutex.Unlock()
+	return lvm.Map[key]
+}
+
+func (lvm LockingVersionMap) Set(key string, value int) {
+	lvm.Mutex.Lock()
+	defer lvm.Mutex.Unlock()
+	lvm.Map[key] = value
+}
+
+func (wb *WhiteBox) peerVersion(peerId string) int {
+	return wb.PeerVersions.Get(peerId)
+}
+
+// Remember what a peer can decode, from an envelope it signed or sealed.
+func (wb *WhiteBox) notePeerVersion(peerId string, version int) {
+	if version > WIRE_VERSION {
+		version = WIRE_VERSION
+	}
+
+	if wb.PeerVersions.Get(peerId) != version {
+		wb.PeerVersions.Set(peerId, version)
+	}
+}
+
+func (wb *WhiteBox) peerDecodesBinary(peerId string) bool {
+	return wb.peerVersion(peerId) >= WIRE_VERSION_BINARY
+}
+
+type binaryWriter struct {
+	bytes.Buffer
+}
+
+func (w *binaryWriter) writeUvarint(value uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], value)
+	w.Write(buf[:n])
+}
+
+func (w *binaryWriter) writeBytes(data []byte) {
+	w.writeUvarint(uint64(len(data)))
+	w.Write(data)
+}
+
+func canonicalHex(s string) ([]byte, bool) {
+	if len(s) == 0 || len(s)%2 != 0 {
+		return nil, false
+	}
+
+	decoded, err := hex.DecodeString(s)
+	if err != nil || hex.EncodeToString(decoded) != s {
+		return nil, false
+	}
+
+	return decoded, true
+}
+
+func (w *binaryWriter) writeString(s string) {
+	parts := strings.Split(s, ".")
+	if len(parts) == 2 {
+		signBytes, signOk := canonicalHex(parts[0])
+		encBytes, encOk := canonicalHex(parts[1])
+		if signOk && encOk {
+			w.WriteByte(STRING_ID)
+			w.writeBytes(signBytes)
+			w.writeBytes(encBytes)
+			return
+		}
+	}
+
+	decoded, ok := canonicalHex(s)
+	if ok {
+		w.WriteByte(STRING_HEX)
+		w.writeBytes(decoded)
+		return
+	}
+
+	w.WriteByte(STRING_RAW)
+	w.writeBytes([]byte(s))
+}
+
+// zero times stay zero, they mean something for envelopes
+func (w *binaryWriter) writeTime(t time.Time) {
+	if t.IsZero() {
+		w.WriteByte(0)
+		return
+	}
+
+	w.WriteByte(1)
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], t.UnixNano())
+	w.Write(buf[:n])
+}
+
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.data = nil
+}
+
+func (r *binaryReader) readByte() byte {
+	if len(r.data) < 1 {
+		r.fail(errBinaryShort)
+		return 0
+	}
+
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *binaryReader) readUvarint() uint64 {
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail(errBinaryShort)
+		return 0
+	}
+
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *binaryReader) readBytes() []byte {
+	length := r.readUvarint()
+	if r.err != nil {
+		return nil
+	}
+
+	if length > uint64(len(r.data)) {
+		r.fail(errBinaryShort)
+		return nil
+	}
+
+	// nil like json gives us for a missing field
+	if length == 0 {
+		return nil
+	}
+
+	data := make([]byte, length)
+	copy(data, r.data[:length])
+	r.data = r.data[length:]
+	return data
+}
+
+func (r *binaryReader) readString() string {
+	switch r.readByte() {
+	case STRING_RAW:
+		return string(r.readBytes())
+	case STRING_HEX:
+		return hex.EncodeToString(r.readBytes())
+	case STRING_ID:
+		signBytes := r.readBytes()
+		encBytes := r.readBytes()
+		return hex.EncodeToString(signBytes) + "." + hex.EncodeToString(encBytes)
+	}
+
+	r.fail(errBinaryString)
+	return ""
+}
+
+func (r *binaryReader) readTime() time.Time {
+	if r.readByte() == 0 {
+		return time.Time{}
+	}
+
+	nanos, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail(errBinaryShort)
+		return time.Time{}
+	}
+
+	r.data = r.data[n:]
+	return time.Unix(0, nanos).UTC()
+}
+
+// error for anything left over or broken along the way
+func (r *binaryReader) finish() error {
+	if r.err != nil {
+		return r.err
+	}
+
+	if len(r.data) != 0 {
+		return errBinaryTrailing
+	}
+
+	return nil
+}
+
+func encodeEnvelopeBinary(env *Envelope) []byte {
+	w := new(binaryWriter)
+	w.writeString(env.Type)
+	w.writeString(env.From)
+	w.writeString(env.To)
+	w.writeBytes(env.Data)
+	w.writeTime(env.Time)
+	w.writeUvarint(uint64(env.Version))
+	w.writeString(env.Id)
+	w.writeUvarint(uint64(env.Hops))
+	return w.Bytes()
+}
+
+func decodeEnvelopeBinary(data []byte) (*Envelope, error) {
+	r := &binaryReader{data: data}
+	env := new(Envelope)
+	env.Type = r.readString()
+	env.From = r.readString()
+	env.To = r.readString()
+	env.Data = r.readBytes()
+	env.Time = r.readTime()
+	env.Version = int(r.readUvarint())
+	env.Id = r.readString()
+	env.Hops = int(r.readUvarint())
+	return env, r.finish()
+}
+
+// Encode an envelope for the given wire version.
+func marshalEnvelope(env *Envelope, version int) ([]byte, error) {
+	if version >= WIRE_VERSION_BINARY {
+		return encodeEnvelopeBinary(env), nil
+	}
+
+	return json.Marshal(env)
+}
+
+func unmarshalEnvelope(data []byte, version int) (*Envelope, error) {
+	if version >= WIRE_VERSION_BINARY {
+		return decodeEnvelopeBinary(data)
+	}
+
+	env := new(Envelope)
+	err := json.Unmarshal(data, env)
+	return env, err
+}
+
+func marshalPartyEnvelope(
+	partyEnv *PartyEnvelope, binary bool) ([]byte, error) {
+	if !binary {
+		return json.Marshal(partyEnv)
+	}
+
+	w := new(binaryWriter)
+	w.WriteByte(BINARY_MARKER)
+	w.writeString(partyEnv.Type)
+	w.writeString(partyEnv.From)
+	w.writeString(partyEnv.PartyId)
+	w.writeBytes(partyEnv.Data)
+	return w.Bytes(), nil
+}
+
+func unmarshalPartyEnvelope(data []byte) (*PartyEnvelope, error) {
+	partyEnv := new(PartyEnvelope)
+	if len(data) == 0 || data[0] != BINARY_MARKER {
+		err := json.Unmarshal(data, partyEnv)
+		return partyEnv, err
+	}
+
+	r := &binaryReader{data: data[1:]}
+	partyEnv.Type = r.readString()
+	partyEnv.From = r.readString()
+	partyEnv.PartyId = r.readString()
+	partyEnv.Data = r.readBytes()
+	return partyEnv, r.finish()
+}
+
+func marshalPartyFulfillment(
+	partyFulfillment *PartyFulfillment, binary bool) ([]byte, error) {
+	if !binary {
+		return json.Marshal(partyFulfillment)
+	}
+
+	block := &partyFulfillment.Block
+	w := new(binaryWriter)
+	w.WriteByte(BINARY_MARKER)
+	w.writeString(partyFulfillment.PeerId)
+	w.writeString(partyFulfillment.PackHash)
+	w.writeString(partyFulfillment.FileHash)
+	w.writeString(partyFulfillment.PartyId)
+	w.writeUvarint(block.Index)
+	w.writeString(block.NextBlockHash)
+	w.writeString(block.LeftBlockHash)
+	w.writeString(block.RightBlockHash)
+	w.writeBytes(block.Data)
+	w.writeString(block.DataHash)
+	return w.Bytes(), nil
+}
+
+func unmarshalPartyFulfillment(data []byte) (*PartyFulfillment, error) {
+	partyFulfillment := new(PartyFulfillment)
+	if len(data) == 0 || data[0] != BINARY_MARKER {
+		err := json.Unmarshal(data, partyFulfillment)
+		return partyFulfillment, err
+	}
+
+	block := &partyFulfillment.Block
+	r := &binaryReader{data: data[1:]}
+	partyFulfillment.PeerId = r.readString()
+	partyFulfillment.PackHash = r.readString()
+	partyFulfillment.FileHash = r.readString()
+	partyFulfillment.PartyId = r.readString()
+	block.Index = r.readUvarint()
+	block.NextBlockHash = r.readString()
+	block.LeftBlockHash = r.readString()
+	block.RightBlockHash = r.readString()
+	block.Data = r.readBytes()
+	block.DataHash = r.readString()
+	return partyFulfillment, r.finish()
+}
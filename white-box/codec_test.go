@@ -0,0 +1,135 @@
+package whitebox
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPeerId = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef." +
+	"fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	tables := []Envelope{
+		{Type: "ping", From: testPeerId, Data: []byte("signed")},
+		{
+			Type:    "party",
+			From:    testPeerId,
+			To:      testPeerId,
+			Data:    bytes.Repeat([]byte{0xff}, 1024),
+			Time:    time.Unix(1600000000, 123456789).UTC(),
+			Version: WIRE_VERSION},
+		{Type: "chat", From: "not.an id", To: "ABCDEF"},
+	}
+
+	for _, env := range tables {
+		for _, version := range []int{WIRE_VERSION_JSON, WIRE_VERSION_BINARY} {
+			encoded, err := marshalEnvelope(&env, version)
+			if err != nil {
+				t.Fatalf("Error encoding %s: %v", env.Type, err)
+			}
+
+			decoded, err := unmarshalEnvelope(encoded, version)
+			if err != nil {
+				t.Fatalf("Error decoding %s: %v", env.Type, err)
+			}
+
+			if !reflect.DeepEqual(*decoded, env) {
+				t.Errorf("Envelope (v%d) does not match:", version)
+				t.Errorf("Got: %+v", *decoded)
+				t.Errorf("Expecting: %+v", env)
+			}
+		}
+	}
+}
+
+func TestEnvelopeBinarySize(t *testing.T) {
+	env := Envelope{
+		Type: "party",
+		From: testPeerId,
+		To:   testPeerId,
+		Data: make([]byte, BUFFER_SIZE),
+		Time: time.Now().UTC()}
+
+	jsonEnv, _ := json.Marshal(env)
+	binaryEnv := encodeEnvelopeBinary(&env)
+	if len(binaryEnv) >= len(jsonEnv)*4/5 {
+		t.Errorf("Binary envelope is not much smaller than json:")
+		t.Errorf("Got: %d", len(binaryEnv))
+		t.Errorf("Expecting less than: %d", len(jsonEnv)*4/5)
+	}
+}
+
+func TestDecodeEnvelopeBinary(t *testing.T) {
+	good := encodeEnvelopeBinary(&Envelope{Type: "ping", From: testPeerId})
+
+	tables := []struct {
+		name string
+		in   []byte
+		out  error
+	}{
+		{"good", good, nil},
+		{"empty", []byte{}, errBinaryShort},
+		{"truncated", good[:len(good)-1], errBinaryShort},
+		{"trailing", append(append([]byte{}, good...), 0), errBinaryTrailing},
+		{"string", []byte{0x7f}, errBinaryString},
+		{"length", []byte{STRING_RAW, 0xff, 0xff, 0x03}, errBinaryShort},
+	}
+
+	for _, table := range tables {
+		_, err := decodeEnvelopeBinary(table.in)
+		if err != table.out {
+			t.Errorf("Unexpected error for decodeEnvelopeBinary(%s):", table.name)
+			t.Errorf("Got: %v", err)
+			t.Errorf("Expecting: %v", table.out)
+		}
+	}
+}
+
+func TestPartyRoundTrip(t *testing.T) {
+	partyEnv := PartyEnvelope{
+		Type:    "fulfillment",
+		From:    testPeerId,
+		PartyId: strings.Repeat("ab", 32),
+		Data:    []byte("signed")}
+
+	partyFulfillment := PartyFulfillment{
+		PeerId:   testPeerId,
+		PackHash: strings.Repeat("01", 32),
+		FileHash: strings.Repeat("23", 32),
+		PartyId:  strings.Repeat("ab", 32),
+		Block: Block{
+			Index:         7,
+			NextBlockHash: strings.Repeat("45", 32),
+			Data:          []byte("block data"),
+			DataHash:      strings.Repeat("67", 32)}}
+
+	for _, binary := range []bool{false, true} {
+		encodedEnv, err := marshalPartyEnvelope(&partyEnv, binary)
+		if err != nil {
+			t.Fatalf("Error encoding party envelope: %v", err)
+		}
+
+		decodedEnv, err := unmarshalPartyEnvelope(encodedEnv)
+		if err != nil || !reflect.DeepEqual(*decodedEnv, partyEnv) {
+			t.Errorf("Party envelope (binary %t) does not match:", binary)
+			t.Errorf("Got: %+v %v", *decodedEnv, err)
+			t.Errorf("Expecting: %+v", partyEnv)
+		}
+
+		encoded, err := marshalPartyFulfillment(&partyFulfillment, binary)
+		if err != nil {
+			t.Fatalf("Error encoding fulfillment: %v", err)
+		}
+
+		decoded, err := unmarshalPartyFulfillment(encoded)
+		if err != nil || !reflect.DeepEqual(*decoded, partyFulfillment) {
+			t.Errorf("Fulfillment (binary %t) does not match:", binary)
+			t.Errorf("Got: %+v %v", *decoded, err)
+			t.Errorf("Expecting: %+v", partyFulfillment)
+		}
+	}
+}
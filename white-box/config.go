@@ -0,0 +1,171 @@
+package whitebox
+
+import (
+	"time"
+)
+
+// Runtime tuning for a WhiteBox, see DefaultConfig for the defaults.
+type Config struct {
+	// How often pings go out to every peer in the table.
+	PingInterval time.Duration
+	// Peers not heard from in this long are dropped from the table.
+	StalePeerTimeout time.Duration
+	// How often packs are advertised to party members.
+	AdvertiseInterval time.Duration
+	// How often FileRequester checks active packs for missing blocks.
+	FileRequestInterval time.Duration
+	// Pause between block requests sent by RequestSender.
+	RequestThrottle time.Duration
+	// How often in progress downloads are checkpointed to .pending files.
+	PendingCheckpointInterval time.Duration
+	// How often party state and known peers are saved.
+	StateSaveInterval time.Duration
+	// How long to wait for a verifybs before trying the next seed node.
+	BootstrapWait time.Duration
+	// Peers kept per k-bucket.
+	BucketSize int
+	// Buckets that go this long without a new peer get a refresh lookup.
+	BucketRefresh time.Duration
+	// Peers a bucket takes from one /24 or /64, loopback and private
+	// addresses aren't limited.
+	SubnetLimit int
+	// Bits of work a peer's id needs to get in the table, see IdWork.
+	MinPeerWork int
+	// Bits of work put into ids we generate.
+	IdWork int
+	// Wait for an ack before the first retry, doubled on each retry after.
+	AckTimeout time.Duration
+	// Sends of a reliable message before giving up.
+	AckRetries int
+	// Datagrams per second taken from one address, and the burst on top.
+	AddressRate  int
+	AddressBurst int
+	// Rate limited drops from one address in a minute before it's banned.
+	BanStrikes int
+	// How long banned addresses are ignored.
+	BanDuration time.Duration
+	// Signed messages sent further than this from our clock, either way, are
+	// rejected as stale.
+	MessageWindow time.Duration
+	// How long we keep a party key when members don't come or go.
+	PartyKeyRotation time.Duration
+	// Only sign and accept payloads with a SignedHeader, once every peer
+	// advertises CAP_SIGNED.
+	StrictSignatures bool
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PingInterval:              30 * time.Second,
+		StalePeerTimeout:          60 * time.Second,
+		AdvertiseInterval:         60 * time.Second,
+		FileRequestInterval:       5 * time.Second,
+		RequestThrottle:           2 * time.Millisecond,
+		PendingCheckpointInterval: 10 * time.Second,
+		StateSaveInterval:         30 * time.Second,
+		BootstrapWait:             3 * time.Second,
+		BucketSize:                20,
+		BucketRefresh:             15 * time.Minute,
+		SubnetLimit:               2,
+		MinPeerWork:               0,
+		IdWork:                    0,
+		AckTimeout:                2 * time.Second,
+		AckRetries:                5,
+		AddressRate:               2000,
+		AddressBurst:              4000,
+		BanStrikes:                500,
+		BanDuration:               10 * time.Minute,
+		MessageWindow:             200 * time.Second,
+		PartyKeyRotation:          10 * time.Minute,
+	}
+}
+
+// Fill zero fields with defaults so a partial config still works.
+func (config Config) withDefaults() Config {
+	defaults := DefaultConfig()
+	if config.PingInterval <= 0 {
+		config.PingInterval = defaults.PingInterval
+	}
+
+	if config.StalePeerTimeout <= 0 {
+		config.StalePeerTimeout = defaults.StalePeerTimeout
+	}
+
+	if config.AdvertiseInterval <= 0 {
+		config.AdvertiseInterval = defaults.AdvertiseInterval
+	}
+
+	if config.FileRequestInterval <= 0 {
+		config.FileRequestInterval = defaults.FileRequestInterval
+	}
+
+	if config.RequestThrottle <= 0 {
+		config.RequestThrottle = defaults.RequestThrottle
+	}
+
+	if config.PendingCheckpointInterval <= 0 {
+		config.PendingCheckpointInterval = defaults.PendingCheckpointInterval
+	}
+
+	if config.StateSaveInterval <= 0 {
+		config.StateSaveInterval = defaults.StateSaveInterval
+	}
+
+	if config.BootstrapWait <= 0 {
+		config.BootstrapWait = defaults.BootstrapWait
+	}
+
+	if config.BucketSize <= 0 {
+		config.BucketSize = defaults.BucketSize
+	}
+
+	if config.BucketRefresh <= 0 {
+		config.BucketRefresh = defaults.BucketRefresh
+	}
+
+	if config.SubnetLimit <= 0 {
+		config.SubnetLimit = defaults.SubnetLimit
+	}
+
+	if config.MinPeerWork < 0 {
+		config.MinPeerWork = defaults.MinPeerWork
+	}
+
+	if config.IdWork < 0 {
+		config.IdWork = defaults.IdWork
+	}
+
+	if config.AckTimeout <= 0 {
+		config.AckTimeout = defaults.AckTimeout
+	}
+
+	if config.AckRetries <= 0 {
+		config.AckRetries = defaults.AckRetries
+	}
+
+	if config.AddressRate <= 0 {
+		config.AddressRate = defaults.AddressRate
+	}
+
+	if config.AddressBurst <= 0 {
+		config.AddressBurst = defaults.AddressBurst
+	}
+
+	if config.BanStrikes <= 0 {
+		config.BanStrikes = defaults.BanStrikes
+	}
+
+	if config.BanDuration <= 0 {
+		config.BanDuration = defaults.BanDuration
+	}
+
+	if config.MessageWindow <= 0 {
+		config.MessageWindow = defaults.MessageWindow
+	}
+
+	if config.PartyKeyRotation <= 0 {
+		config.PartyKeyRotation = defaults.PartyKeyRotation
+	}
+
+	return config
+}
@@ -0,0 +1,143 @@
+package whitebox
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Bounds for the chat and routing dedup caches.
+const (
+	DEDUP_SIZE = 4096
+	DEDUP_TTL  = 10 * time.Minute
+)
+
+// Signatures remembered per sender for replay checks, and how often senders
+// with nothing left in their cache are forgotten. A sender with this many
+// signatures inside the window gets nothing new through until some expire.
+const (
+	REPLAY_SIZE           = 4096
+	REPLAY_SWEEP_INTERVAL = time.Minute
+)
+
+// Remembers keys for DEDUP_TTL, up to a fixed count, dropping the oldest
+// first so memory stays flat however much traffic goes by.
+type DedupCache struct {
+	Map   map[string]*list.Element
+	List  *list.List
+	Size  int
+	TTL   time.Duration
+	Mutex *sync.Mutex
+}
+
+// Signed messages seen from each sender, see freshMessage.
+type LockingReplays struct {
+	Map   map[string]*DedupCache
+	Swept time.Time
+	Mutex *sync.Mutex
+}
+
+var errDedupSeen = errors.New("error key already seen")
+var errDedupFull = errors.New("error dedup cache full")
+
+type dedupEntry struct {
+	Key   string
+	Added time.Time
+}
+
+func NewDedupCache(size int, ttl time.Duration) *DedupCache {
+	cache := new(DedupCache)
+	cache.Map = make(map[string]*list.Element)
+	cache.List = list.New()
+	cache.Size = size
+	cache.TTL = ttl
+	cache.Mutex = new(sync.Mutex)
+	return cache
+}
+
+// Record a key. Returns true if it was already there.
+func (cache *DedupCache) Seen(key string) bool {
+	cache.Mutex.Lock()
+	defer cache.Mutex.Unlock()
+
+	now := time.Now()
+	cache.expire(now)
+
+	_, seen := cache.Map[key]
+	if seen {
+		return true
+	}
+
+	cache.Map[key] = cache.List.PushBack(&dedupEntry{Key: key, Added: now})
+	return false
+}
+
+// Record a key without dropping any before their TTL, for caches where a
+// forgotten key could be let in again. Returns errDedupSeen if it's there
+// already and errDedupFull if there's no room for it.
+func (cache *DedupCache) Add(key string) error {
+	cache.Mutex.Lock()
+	defer cache.Mutex.Unlock()
+
+	now := time.Now()
+	for front := cache.List.Front(); front != nil; front = cache.List.Front() {
+		entry := front.Value.(*dedupEntry)
+		if now.Sub(entry.Added) < cache.TTL {
+			break
+		}
+
+		cache.List.Remove(front)
+		delete(cache.Map, entry.Key)
+	}
+
+	_, seen := cache.Map[key]
+	if seen {
+		return errDedupSeen
+	}
+
+	if cache.List.Len() >= cache.Size {
+		return errDedupFull
+	}
+
+	cache.Map[key] = cache.List.PushBack(&dedupEntry{Key: key, Added: now})
+	return nil
+}
+
+// Drop keys past the TTL, and the oldest over the size, leaving room for one
+// more. Caller holds the lock.
+func (cache *DedupCache) expire(now time.Time) {
+	for front := cache.List.Front(); front != nil; front = cache.List.Front() {
+		entry := front.Value.(*dedupEntry)
+		if cache.List.Len() < cache.Size && now.Sub(entry.Added) < cache.TTL {
+			break
+		}
+
+		cache.List.Remove(front)
+		delete(cache.Map, entry.Key)
+	}
+}
+
+// Drop expired keys. Returns how many are left.
+func (cache *DedupCache) Expire() int {
+	cache.Mutex.Lock()
+	defer cache.Mutex.Unlock()
+	cache.expire(time.Now())
+	return cache.List.Len()
+}
+
+func (cache *DedupCache) Len() int {
+	cache.Mutex.Lock()
+	defer cache.Mutex.Unlock()
+	return cache.List.Len()
+}
+
+// Identifies a routed envelope by sender, send time and a hash of its data.
+func routeId(env *Envelope) string {
+	hash := sha256.Sum256(env.Data)
+	nanos := strconv.FormatInt(env.Time.UnixNano(), 16)
+	return env.From + "/" + nanos + "/" + hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,165 @@
+package whitebox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	cache := NewDedupCache(3, time.Minute)
+	if cache.Seen("a") {
+		t.Errorf("New key reported as seen.")
+	}
+
+	if !cache.Seen("a") {
+		t.Errorf("Repeated key not reported as seen.")
+	}
+
+	for idx := 0; idx < 10; idx++ {
+		cache.Seen(fmt.Sprintf("key%d", idx))
+	}
+
+	if cache.Len() != 3 {
+		t.Errorf("Cache grew past its size:")
+		t.Errorf("Got: %d", cache.Len())
+		t.Errorf("Expecting: %d", 3)
+	}
+
+	if cache.Seen("key9") != true || cache.Seen("a") != false {
+		t.Errorf("Cache did not drop the oldest keys first.")
+	}
+
+	expiring := NewDedupCache(10, time.Millisecond)
+	expiring.Seen("a")
+	time.Sleep(5 * time.Millisecond)
+	if expiring.Seen("a") {
+		t.Errorf("Expired key reported as seen.")
+	}
+}
+
+func TestRouteId(t *testing.T) {
+	now := time.Now().UTC()
+	env := Envelope{From: "a", Time: now, Data: []byte("data")}
+	later := Envelope{From: "a", Time: now.Add(time.Nanosecond), Data: []byte("data")}
+	other := Envelope{From: "a", Time: now, Data: []byte("other")}
+
+	if routeId(&env) != routeId(&Envelope{From: "a", Time: now, Data: []byte("data")}) {
+		t.Errorf("Same envelope got different ids.")
+	}
+
+	if routeId(&env) == routeId(&later) || routeId(&env) == routeId(&other) {
+		t.Errorf("Different envelopes share an id.")
+	}
+}
+
+func TestForwardHops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.hops")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+
+	tables := []struct {
+		in  int
+		out int
+	}{
+		{HOP_LIMIT, HOP_LIMIT - 1},
+		{2, 1},
+		{1, 0},
+		{0, HOP_LIMIT - 1},
+		{HOP_LIMIT * 4, HOP_LIMIT - 1},
+	}
+
+	for _, table := range tables {
+		env := Envelope{
+			Type: "pulse",
+			From: wb.PeerSelf.Id(),
+			To:   wb.PeerSelf.Id(),
+			Time: time.Now().UTC(),
+			Hops: table.in}
+		wb.forward(&env)
+		if env.Hops != table.out {
+			t.Errorf("Unexpected hops forwarding with %d:", table.in)
+			t.Errorf("Got: %d", env.Hops)
+			t.Errorf("Expecting: %d", table.out)
+		}
+	}
+}
+
+func TestForwardable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.forward")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	strict := DefaultConfig()
+	strict.StrictSignatures = true
+
+	var self0, self1, self2 Self
+	wb0 := New(dir, "127.0.0.1", "3499", self0, strict)
+	relay := New(dir, "127.0.0.1", "3500", self1, strict)
+	wb2 := New(dir, "127.0.0.1", "3501", self2, strict)
+	id0 := wb0.PeerSelf.Id()
+	id2 := wb2.PeerSelf.Id()
+
+	signed, err := wb0.signPayload("pulse", id2, "", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("Error signing payload: %v", err)
+	}
+
+	tampered := append([]byte{}, signed...)
+	tampered[len(tampered)-1] ^= 1
+
+	routed := func(
+		msgType, from, to string, sent time.Time, data []byte) Envelope {
+		return Envelope{
+			Type: msgType, From: from, To: to, Time: sent, Data: data}
+	}
+
+	now := time.Now().UTC()
+	stale := now.Add(-2 * relay.Config.MessageWindow)
+	other := relay.PeerSelf.Id()
+	tables := []struct {
+		name  string
+		env   Envelope
+		allow bool
+	}{
+		{"signed", routed("pulse", id0, id2, now, signed), true},
+		{"tampered", routed("pulse", id0, id2, now, tampered), false},
+		{"retyped", routed("ack", id0, id2, now, signed), false},
+		{"redirected", routed("pulse", id0, other, now, signed), false},
+		{"forged from", routed("pulse", other, id2, now, signed), false},
+		{"stale", routed("pulse", id0, id2, stale, signed), false},
+		{"boxed", routed("party", id0, id2, now, []byte("box")), true},
+		{"bad id", routed("party", "junk", id2, now, []byte("box")), false},
+		{"short from", routed("pulse", "aa.bb", id2, now, signed), false},
+		{"short to", routed("party", id0, "aa.bb", now, []byte("box")), false},
+	}
+
+	for _, table := range tables {
+		if relay.forwardable(&table.env) != table.allow {
+			t.Errorf("Forwarding %s envelope does not match:", table.name)
+			t.Errorf("Got: %t", !table.allow)
+			t.Errorf("Expecting: %t", table.allow)
+		}
+	}
+
+	// junk doesn't take room in the routed cache
+	junk := routed("pulse", other, id2, now, signed)
+	payload, err := marshalEnvelope(&junk, WIRE_VERSION)
+	if err != nil {
+		t.Fatalf("Error marshalling envelope: %v", err)
+	}
+
+	relay.processMessage("127.0.0.1:3499", WIRE_VERSION, payload)
+	if relay.Routed.Len() != 0 {
+		t.Errorf("Unverified envelope went in the routed cache.")
+	}
+}
@@ -104,6 +104,30 @@ func (pack *Pack) ToPendingPack() *PendingPack {
 	return pendingPack
 }
 
+// inverse of ToPendingPack, used when resuming a download from disk
+func (pendingPack *PendingPack) ToPack() *Pack {
+	pack := new(Pack)
+	pack.Name = pendingPack.Name
+	pack.Files = make([]*PackFileInfo, 0, len(pendingPack.Files))
+	pack.Peers = make(map[string]time.Time)
+	pack.FileLock = new(sync.Mutex)
+
+	for _, pendingFile := range pendingPack.Files {
+		packFileInfo := new(PackFileInfo)
+		packFileInfo.Name = pendingFile.Name
+		packFileInfo.Hash = pendingFile.Hash
+		packFileInfo.Size = pendingFile.Size
+		packFileInfo.FirstBlockHash = pendingFile.FirstBlockHash
+		packFileInfo.BlockMap = pendingFile.BlockMap
+		packFileInfo.BlockLookup = pendingFile.BlockLookup
+		packFileInfo.Coverage = pendingFile.Coverage
+		packFileInfo.Path = pendingFile.Path
+		pack.Files = append(pack.Files, packFileInfo)
+	}
+
+	return pack
+}
+
 func (pack *Pack) GetFileInfo(fileHash string) *PackFileInfo {
 	for _, packFileInfo := range pack.Files {
 		if packFileInfo.Hash == fileHash {
@@ -615,6 +639,11 @@ func (wb *WhiteBox) walker(path string, info os.FileInfo, err error) error {
 
 		defer targetFile.Close()
 
+		if strings.HasSuffix(path, ".pending") {
+			wb.resumePack(partyId, path)
+			return nil
+		}
+
 		if !strings.HasSuffix(path, ".pack") {
 			return nil
 		}
@@ -624,10 +653,186 @@ func (wb *WhiteBox) walker(path string, info os.FileInfo, err error) error {
 	return nil
 }
 
+func pendingPackPath(partyDir string, pack *Pack) string {
+	return filepath.Join(partyDir, pack.Name+".pending")
+}
+
+// write to a temp file and rename it over the old one so a crash mid write
+// doesn't leave us with half a json file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath := path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, data, perm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func (wb *WhiteBox) writePendingPack(partyId string, pack *Pack) error {
+	partyDir := filepath.Join(wb.SharedDir, partyId)
+	partyDirAbs, err := filepath.Abs(partyDir)
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not get absolute path for party dir")
+	}
+
+	pendingPack := pack.ToPendingPack()
+	jsonPendingPack, err := json.Marshal(pendingPack)
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not marshal pending pack to json")
+	}
+
+	pendingFileName := pendingPackPath(partyDirAbs, pack)
+	err = writeFileAtomic(pendingFileName, jsonPendingPack, 0600)
+	if err != nil {
+		log.Println(err)
+		return errors.New("could not write pending pack to file")
+	}
+
+	return nil
+}
+
+func (wb *WhiteBox) removePendingPack(partyId string, pack *Pack) {
+	partyDir := filepath.Join(wb.SharedDir, partyId)
+	err := os.Remove(pendingPackPath(partyDir, pack))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+		wb.setStatus("error removing pending pack file")
+	}
+}
+
+// Whether path is somewhere below dir. Both are cleaned first so ../ can't
+// climb out, and a sibling sharing dir's name as a prefix doesn't count.
+func insideDir(dir string, path string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(path))
+	if err != nil || rel == "." || rel == ".." {
+		return false
+	}
+
+	return !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// rebuild an active download from the .pending file written by StartPack
+func (wb *WhiteBox) resumePack(partyId string, path string) {
+	partyDir := filepath.Join(wb.SharedDir, partyId)
+	partyDirAbs, err := filepath.Abs(partyDir)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not get absolute path for party dir")
+		return
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not read pending pack")
+		return
+	}
+
+	pendingPack := new(PendingPack)
+	err = json.Unmarshal(contents, pendingPack)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not unmarshal pending pack")
+		return
+	}
+
+	pack := pendingPack.ToPack()
+	if len(pack.Files) == 0 || sha256Pack(pack) != pendingPack.Hash {
+		wb.setStatus("error bad pack hash for pending pack " + pack.Name)
+		return
+	}
+
+	for _, file := range pack.Files {
+		file.Path = filepath.Clean(file.Path)
+		if !insideDir(partyDirAbs, file.Path) {
+			wb.setStatus("error pending pack file outside of channel dir")
+			return
+		}
+
+		if file.BlockMap == nil || file.BlockLookup == nil {
+			file.BlockMap = make(map[string]BlockInfo)
+			file.BlockLookup = make(map[uint64]string)
+		}
+
+		fileInfo, err := os.Stat(file.Path)
+		coverageLen := len(emptyCoverage(file.Size))
+		if err != nil || fileInfo.Size() != file.Size ||
+			len(file.Coverage) != coverageLen {
+			// partial file is gone or mangled, start this one over
+			wb.writeZeroFile(file.Path, file.Size)
+			file.Coverage = emptyCoverage(file.Size)
+			file.BlockMap = make(map[string]BlockInfo)
+			file.BlockLookup = make(map[uint64]string)
+		}
+	}
+
+	pack.State = ACTIVE
+
+	party := wb.Parties.Map[partyId]
+
+	party.PacksLock.Lock()
+	lockingPack, ok := party.Packs[pendingPack.Hash]
+	if ok && lockingPack.State() != AVAILABLE {
+		party.PacksLock.Unlock()
+		return
+	}
+
+	// an advertised pack keeps its lock, someone may be holding it
+	if ok {
+		lockingPack.Mutex.Lock()
+		pack.Peers = lockingPack.Pack.Peers
+		lockingPack.Mutex.Unlock()
+	} else {
+		lockingPack.Mutex = new(sync.Mutex)
+	}
+
+	lockingPack.Pack = pack
+	party.Packs[pendingPack.Hash] = lockingPack
+	party.PacksLock.Unlock()
+
+	wb.setStatus("resumed pack " + pack.Name)
+}
+
+// Pick up downloads left in a party dir by a previous run.
+func (wb *WhiteBox) resumePendingPacks(partyId string) {
+	targetDir := filepath.Join(wb.SharedDir, partyId)
+	_, err := os.Stat(targetDir)
+	if err != nil {
+		return
+	}
+
+	filepath.Walk(targetDir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() && strings.HasSuffix(path, ".pending") {
+				wb.resumePack(partyId, path)
+			}
+			return nil
+		})
+}
+
+// Checkpoint every active download to disk.
+func (wb *WhiteBox) SavePendingPacks() {
+	wb.Parties.Mutex.Lock()
+	for _, party := range wb.Parties.Map {
+		party.SavePendingPacks()
+	}
+	wb.Parties.Mutex.Unlock()
+}
+
 func (wb *WhiteBox) RescanPacks() {
 	// check for new and changed packs
 	wb.Parties.Mutex.Lock()
 	for partyId, party := range wb.Parties.Map {
+		// clearing drops in progress downloads, so save them to get
+		// picked back up from their .pending file by the walk
+		party.SavePendingPacks()
 		party.ClearPacks()
 		targetDir := filepath.Join(wb.SharedDir, partyId)
 
@@ -1,6 +1,15 @@
 package whitebox
 
-import "testing"
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestSha256Bytes(t *testing.T) {
 	data := []byte("party line!")
@@ -143,3 +152,233 @@ func TestFullCoverage(t *testing.T) {
 		t.Errorf("isFullCoverage returned true on non-full coverage!")
 	}
 }
+
+func TestPendingPackRoundTrip(t *testing.T) {
+	pack := new(Pack)
+	pack.Name = "Test Pack"
+	pack.FileLock = new(sync.Mutex)
+
+	packFileInfo := new(PackFileInfo)
+	packFileInfo.Name = "Test File"
+	packFileInfo.Hash =
+		"b36189cbfe6157aa35416783786b8fefb5eb5c9994f44b9267a519d813a5a15e"
+	packFileInfo.FirstBlockHash =
+		"1d0fea39ec33ff7543f345be85d1ccd34d6d864297d4151b737802cb294a338c"
+	packFileInfo.Size = BUFFER_SIZE * 65
+	packFileInfo.Coverage = []uint64{5, 1}
+	packFileInfo.BlockMap = make(map[string]BlockInfo)
+	packFileInfo.BlockLookup = map[uint64]string{0: packFileInfo.FirstBlockHash}
+	packFileInfo.Path = "/tmp/party-line/Test File"
+	pack.Files = append(pack.Files, packFileInfo)
+
+	pendingPack := pack.ToPendingPack()
+	resumed := pendingPack.ToPack()
+
+	if sha256Pack(resumed) != pendingPack.Hash {
+		t.Errorf("Resumed pack hash does not match pending pack hash.")
+	}
+
+	resumedFile := resumed.GetFileInfo(packFileInfo.Hash)
+	if resumedFile == nil {
+		t.Fatalf("Resumed pack is missing file %s", packFileInfo.Hash)
+	}
+
+	if resumedFile.Path != packFileInfo.Path {
+		t.Errorf("Resumed file has unexpected path:")
+		t.Errorf("Got: %s", resumedFile.Path)
+		t.Errorf("Expecting: %s", packFileInfo.Path)
+	}
+
+	for idx, ea := range packFileInfo.Coverage {
+		if resumedFile.Coverage[idx] != ea {
+			t.Errorf("Resumed coverage has unexpected value at idx: %d", idx)
+			t.Errorf("Got: %d", resumedFile.Coverage[idx])
+			t.Errorf("Expecting: %d", ea)
+		}
+	}
+
+	if resumedFile.BlockLookup[0] != packFileInfo.FirstBlockHash {
+		t.Errorf("Resumed block lookup missing first block.")
+	}
+}
+
+func TestInsideDir(t *testing.T) {
+	tables := []struct {
+		path   string
+		inside bool
+	}{
+		{"/tmp/party-x/file", true},
+		{"/tmp/party-x/sub/../file", true},
+		{"/tmp/party-x", false},
+		{"/tmp/party-x/../party-y/file", false},
+		{"/tmp/party-xy/file", false},
+		{"/tmp/party-x/../../etc/passwd", false},
+		{"party-x/file", false},
+	}
+
+	for _, table := range tables {
+		inside := insideDir("/tmp/party-x", table.path)
+		if inside != table.inside {
+			t.Errorf("insideDir unexpected for %s:", table.path)
+			t.Errorf("Got: %t", inside)
+			t.Errorf("Expecting: %t", table.inside)
+		}
+	}
+}
+
+func TestResumePack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.resume")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	partyId := wb.PartyStart("coolname")
+	party := wb.Parties.Map[partyId]
+	partyDir, err := filepath.Abs(filepath.Join(wb.SharedDir, partyId))
+	if err != nil {
+		t.Fatalf("Error getting party dir: %v", err)
+	}
+
+	err = os.MkdirAll(partyDir, 0700)
+	if err != nil {
+		t.Fatalf("Error creating party dir: %v", err)
+	}
+
+	newPack := func(name string, path string) *Pack {
+		pack := new(Pack)
+		pack.Name = name
+		pack.FileLock = new(sync.Mutex)
+
+		packFileInfo := new(PackFileInfo)
+		packFileInfo.Name = "Test File"
+		packFileInfo.Hash =
+			"b36189cbfe6157aa35416783786b8fefb5eb5c9994f44b9267a519d813a5a15e"
+		packFileInfo.FirstBlockHash =
+			"1d0fea39ec33ff7543f345be85d1ccd34d6d864297d4151b737802cb294a338c"
+		packFileInfo.Size = BUFFER_SIZE * 65
+		packFileInfo.Coverage = emptyCoverage(packFileInfo.Size)
+		packFileInfo.Path = path
+		pack.Files = append(pack.Files, packFileInfo)
+		return pack
+	}
+
+	// an advertised pack resumes under the lock others already hold copies of
+	pack := newPack("Test Pack", filepath.Join(partyDir, "Test File"))
+	hash := sha256Pack(pack)
+	lock := new(sync.Mutex)
+	party.Packs[hash] = LockingPack{
+		Pack: &Pack{
+			State: AVAILABLE,
+			Peers: map[string]time.Time{"peer": time.Now().UTC()}},
+		Mutex: lock}
+
+	err = wb.writePendingPack(partyId, pack)
+	if err != nil {
+		t.Fatalf("Error writing pending pack: %v", err)
+	}
+
+	wb.resumePack(partyId, pendingPackPath(partyDir, pack))
+	resumed := party.Packs[hash]
+	if resumed.Mutex != lock {
+		t.Errorf("Resumed pack replaced the advertised pack's lock.")
+	}
+
+	if resumed.State() != ACTIVE || len(resumed.Pack.Peers) != 1 {
+		t.Errorf("Advertised pack not resumed with its peers.")
+	}
+
+	// a sibling dir sharing the party dir as a prefix is outside it
+	sibling := newPack("Sibling Pack", partyDir+"y/Test File")
+	err = wb.writePendingPack(partyId, sibling)
+	if err != nil {
+		t.Fatalf("Error writing pending pack: %v", err)
+	}
+
+	wb.resumePack(partyId, pendingPackPath(partyDir, sibling))
+	_, exists := party.Packs[sha256Pack(sibling)]
+	if exists {
+		t.Errorf("Pending pack outside the party dir was resumed.")
+	}
+}
+
+func TestSavePendingWhileWriting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.writing")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	partyId := wb.PartyStart("coolname")
+	party := wb.Parties.Map[partyId]
+	partyDir := filepath.Join(wb.SharedDir, partyId)
+	err = os.MkdirAll(partyDir, 0700)
+	if err != nil {
+		t.Fatalf("Error creating party dir: %v", err)
+	}
+
+	packFileInfo := new(PackFileInfo)
+	packFileInfo.Name = "Test File"
+	packFileInfo.Size = BUFFER_SIZE * 256
+	packFileInfo.Coverage = emptyCoverage(packFileInfo.Size)
+	packFileInfo.BlockMap = make(map[string]BlockInfo)
+	packFileInfo.BlockLookup = make(map[uint64]string)
+	packFileInfo.Path = filepath.Join(partyDir, "Test File")
+
+	pack := new(Pack)
+	pack.Name = "Test Pack"
+	pack.State = ACTIVE
+	pack.FileLock = new(sync.Mutex)
+	pack.Files = []*PackFileInfo{packFileInfo}
+	hash := sha256Pack(pack)
+	party.Packs[hash] = LockingPack{Pack: pack, Mutex: new(sync.Mutex)}
+
+	// checkpoints from rescans and shutdown run beside the writer
+	done := make(chan bool)
+	go func() {
+		for index := uint64(0); index < 256; index++ {
+			data := []byte{byte(index)}
+			wb.writeVerifiedBlock(&VerifiedBlock{
+				Block: &Block{
+					Index:    index,
+					Data:     data,
+					DataHash: sha256Bytes(data)},
+				PackFileInfo: packFileInfo,
+				Hash:         fmt.Sprintf("block%d", index),
+				Party:        party,
+				PackHash:     hash})
+		}
+		close(done)
+	}()
+
+	for saving := true; saving; {
+		select {
+		case <-done:
+			saving = false
+		default:
+			wb.SavePendingPacks()
+		}
+	}
+
+	party.SavePendingPack(hash)
+	contents, err := ioutil.ReadFile(pendingPackPath(partyDir, pack))
+	if err != nil {
+		t.Fatalf("Error reading pending pack: %v", err)
+	}
+
+	pendingPack := new(PendingPack)
+	err = json.Unmarshal(contents, pendingPack)
+	if err != nil {
+		t.Fatalf("Error parsing pending pack: %v", err)
+	}
+
+	if len(pendingPack.Files[0].BlockLookup) != 256 {
+		t.Errorf("Pending pack missing written blocks:")
+		t.Errorf("Got: %d", len(pendingPack.Files[0].BlockLookup))
+		t.Errorf("Expecting: %d", 256)
+	}
+}
@@ -0,0 +1,222 @@
+package whitebox
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Envelopes bigger than one datagram go out as fragments, each in its own
+// frame with FRAME_FLAG_FRAGMENT set. The fragment payload starts with:
+//
+//	message id (8 bytes) | index (2 bytes, BE) | count (2 bytes, BE)
+//
+// followed by up to FRAGMENT_SIZE bytes of the encoded envelope.
+const (
+	FRAGMENT_HEADER_SIZE = 12
+	FRAGMENT_SIZE        = 16384
+	MAX_FRAGMENTS        = 64
+	MAX_MESSAGE_SIZE     = FRAGMENT_SIZE * MAX_FRAGMENTS
+)
+
+// Limits on partially received messages. Messages that don't complete in
+// time are dropped, as are new ones once the buffered fragments hit the cap.
+// One source only gets a share of the buffer so it can't crowd out the rest.
+// Each message is charged FRAGMENT_SLOT_SIZE per fragment up front for its
+// chunk list, so a flood of first fragments counts against the cap too.
+const (
+	REASSEMBLY_TIMEOUT   = 10 * time.Second
+	MAX_REASSEMBLY_BYTES = 4 * MAX_MESSAGE_SIZE
+	MAX_PARTIAL_MESSAGES = 64
+	MAX_SOURCE_BYTES     = MAX_REASSEMBLY_BYTES / 2
+	MAX_SOURCE_PARTIALS  = MAX_PARTIAL_MESSAGES / 4
+	FRAGMENT_SLOT_SIZE   = 24
+)
+
+var errMessageTooLarge = errors.New("error message too large to fragment")
+var errFragmentHeader = errors.New("error fragment header")
+var errFragmentMismatch = errors.New("error fragment does not match message")
+var errReassemblyFull = errors.New("error reassembly buffer full")
+
+// A message with some of its fragments received. Size includes the chunk
+// list.
+type PartialMessage struct {
+	Source   string
+	Version  int
+	Chunks   [][]byte
+	Received int
+	Size     int
+	Started  time.Time
+}
+
+// What one source has buffered.
+type FragmentSource struct {
+	Partials int
+	Bytes    int
+}
+
+// Partial messages keyed by sender address and message id.
+type LockingFragments struct {
+	Map     map[string]*PartialMessage
+	Sources map[string]*FragmentSource
+	Bytes   int
+	Mutex   *sync.Mutex
+}
+
+// Split an encoded envelope into framed fragments.
+func fragmentPayload(payload []byte, version int) ([][]byte, error) {
+	count := (len(payload) + FRAGMENT_SIZE - 1) / FRAGMENT_SIZE
+	if count > MAX_FRAGMENTS {
+		return nil, errMessageTooLarge
+	}
+
+	messageId := make([]byte, 8)
+	_, err := rand.Read(messageId)
+	if err != nil {
+		return nil, err
+	}
+
+	datagrams := make([][]byte, 0, count)
+	for idx := 0; idx < count; idx++ {
+		end := (idx + 1) * FRAGMENT_SIZE
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunk := payload[idx*FRAGMENT_SIZE : end]
+
+		fragment := make([]byte, FRAGMENT_HEADER_SIZE+len(chunk))
+		copy(fragment, messageId)
+		binary.BigEndian.PutUint16(fragment[8:10], uint16(idx))
+		binary.BigEndian.PutUint16(fragment[10:12], uint16(count))
+		copy(fragment[FRAGMENT_HEADER_SIZE:], chunk)
+
+		datagram, err := frame(fragment, version, FRAME_FLAG_FRAGMENT)
+		if err != nil {
+			return nil, err
+		}
+
+		datagrams = append(datagrams, datagram)
+	}
+
+	return datagrams, nil
+}
+
+// Whether size more bytes from source fit in the buffer.
+func (lf *LockingFragments) fits(usage *FragmentSource, size int) bool {
+	return lf.Bytes+size <= MAX_REASSEMBLY_BYTES &&
+		usage.Bytes+size <= MAX_SOURCE_BYTES
+}
+
+func (lf *LockingFragments) add(
+	usage *FragmentSource, partial *PartialMessage, size int) {
+	partial.Size += size
+	usage.Bytes += size
+	lf.Bytes += size
+}
+
+// Caller holds the lock.
+func (lf *LockingFragments) remove(key string, partial *PartialMessage) {
+	lf.Bytes -= partial.Size
+	delete(lf.Map, key)
+
+	usage := lf.Sources[partial.Source]
+	usage.Bytes -= partial.Size
+	usage.Partials--
+	if usage.Partials == 0 {
+		delete(lf.Sources, partial.Source)
+	}
+}
+
+// Drop messages that have been waiting too long. Caller holds the lock.
+func (lf *LockingFragments) expire(now time.Time) {
+	for key, partial := range lf.Map {
+		if now.Sub(partial.Started) > REASSEMBLY_TIMEOUT {
+			lf.remove(key, partial)
+		}
+	}
+}
+
+// Add a fragment from source. Returns the encoded envelope once every
+// fragment of it is in, nil until then.
+func (wb *WhiteBox) reassemble(
+	source string, version int, fragment []byte) ([]byte, error) {
+	if len(fragment) <= FRAGMENT_HEADER_SIZE {
+		return nil, errFragmentHeader
+	}
+
+	idx := int(binary.BigEndian.Uint16(fragment[8:10]))
+	count := int(binary.BigEndian.Uint16(fragment[10:12]))
+	chunk := fragment[FRAGMENT_HEADER_SIZE:]
+	if count < 2 || count > MAX_FRAGMENTS || idx >= count ||
+		len(chunk) > FRAGMENT_SIZE {
+		return nil, errFragmentHeader
+	}
+
+	key := source + "/" + hex.EncodeToString(fragment[:8])
+	now := time.Now()
+
+	lf := &wb.Fragments
+	lf.Mutex.Lock()
+	defer lf.Mutex.Unlock()
+
+	lf.expire(now)
+
+	usage, ok := lf.Sources[source]
+	if !ok {
+		usage = new(FragmentSource)
+	}
+
+	partial, exists := lf.Map[key]
+	if !exists {
+		slots := count * FRAGMENT_SLOT_SIZE
+		if len(lf.Map) >= MAX_PARTIAL_MESSAGES ||
+			usage.Partials >= MAX_SOURCE_PARTIALS ||
+			!lf.fits(usage, slots+len(chunk)) {
+			return nil, errReassemblyFull
+		}
+
+		partial = new(PartialMessage)
+		partial.Source = source
+		partial.Version = version
+		partial.Chunks = make([][]byte, count)
+		partial.Started = now
+		lf.Map[key] = partial
+
+		usage.Partials++
+		lf.Sources[source] = usage
+		lf.add(usage, partial, slots)
+	}
+
+	if partial.Version != version || len(partial.Chunks) != count {
+		return nil, errFragmentMismatch
+	}
+
+	// duplicates are ignored
+	if partial.Chunks[idx] != nil {
+		return nil, nil
+	}
+
+	if !lf.fits(usage, len(chunk)) {
+		return nil, errReassemblyFull
+	}
+
+	partial.Chunks[idx] = append([]byte{}, chunk...)
+	partial.Received++
+	lf.add(usage, partial, len(chunk))
+
+	if partial.Received < count {
+		return nil, nil
+	}
+
+	lf.remove(key, partial)
+
+	payload := make([]byte, 0, partial.Size)
+	for _, chunk := range partial.Chunks {
+		payload = append(payload, chunk...)
+	}
+
+	return payload, nil
+}
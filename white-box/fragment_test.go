@@ -0,0 +1,194 @@
+package whitebox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newFragmentsBox() *WhiteBox {
+	wb := new(WhiteBox)
+	wb.Fragments.Map = make(map[string]*PartialMessage)
+	wb.Fragments.Sources = make(map[string]*FragmentSource)
+	wb.Fragments.Mutex = new(sync.Mutex)
+	return wb
+}
+
+func TestFragmentRoundTrip(t *testing.T) {
+	wb := newFragmentsBox()
+
+	payload := make([]byte, MAX_PAYLOAD_SIZE*2)
+	rand.Read(payload)
+
+	datagrams, err := fragmentPayload(payload, WIRE_VERSION_BINARY)
+	if err != nil {
+		t.Fatalf("Error fragmenting payload: %v", err)
+	}
+
+	// out of order with a duplicate
+	rand.Shuffle(len(datagrams), func(i, j int) {
+		datagrams[i], datagrams[j] = datagrams[j], datagrams[i]
+	})
+	datagrams = append(datagrams[:1], datagrams...)
+
+	var reassembled []byte
+	for _, datagram := range datagrams {
+		header, fragment, err := unframe(datagram)
+		if err != nil || header.Flags&FRAME_FLAG_FRAGMENT == 0 {
+			t.Fatalf("Bad fragment frame: %v", err)
+		}
+
+		out, err := wb.reassemble("peer", header.Version, fragment)
+		if err != nil {
+			t.Fatalf("Error reassembling: %v", err)
+		}
+
+		if out != nil {
+			if reassembled != nil {
+				t.Errorf("Message reassembled twice.")
+			}
+			reassembled = out
+		}
+	}
+
+	if !bytes.Equal(reassembled, payload) {
+		t.Errorf("Reassembled payload does not match:")
+		t.Errorf("Got: %d bytes", len(reassembled))
+		t.Errorf("Expecting: %d bytes", len(payload))
+	}
+
+	if len(wb.Fragments.Map) != 0 || len(wb.Fragments.Sources) != 0 ||
+		wb.Fragments.Bytes != 0 {
+		t.Errorf("Reassembly state left behind.")
+	}
+
+	_, err = fragmentPayload(make([]byte, MAX_MESSAGE_SIZE+1), WIRE_VERSION_JSON)
+	if err != errMessageTooLarge {
+		t.Errorf("Oversized message was fragmented.")
+	}
+}
+
+func TestReassembleLimits(t *testing.T) {
+	wb := newFragmentsBox()
+
+	datagrams, _ := fragmentPayload(make([]byte, FRAGMENT_SIZE*3), WIRE_VERSION_JSON)
+	_, first, _ := unframe(datagrams[0])
+
+	badCount := append([]byte{}, first...)
+	badCount[11] = 1
+
+	badIndex := append([]byte{}, first...)
+	badIndex[9] = 3
+
+	tables := []struct {
+		name string
+		in   []byte
+		out  error
+	}{
+		{"short", first[:FRAGMENT_HEADER_SIZE], errFragmentHeader},
+		{"count", badCount, errFragmentHeader},
+		{"index", badIndex, errFragmentHeader},
+		{"good", first, nil},
+	}
+
+	for _, table := range tables {
+		_, err := wb.reassemble("peer", WIRE_VERSION_JSON, table.in)
+		if err != table.out {
+			t.Errorf("Unexpected error for reassemble(%s):", table.name)
+			t.Errorf("Got: %v", err)
+			t.Errorf("Expecting: %v", table.out)
+		}
+	}
+
+	_, err := wb.reassemble("peer", WIRE_VERSION_BINARY, first)
+	if err != errFragmentMismatch {
+		t.Errorf("Fragment with another version was accepted.")
+	}
+
+	// stale messages are dropped on the next fragment
+	for _, partial := range wb.Fragments.Map {
+		partial.Started = time.Now().Add(-2 * REASSEMBLY_TIMEOUT)
+	}
+
+	_, second, _ := unframe(datagrams[1])
+	wb.reassemble("other", WIRE_VERSION_JSON, second)
+	size := FRAGMENT_SIZE + 3*FRAGMENT_SLOT_SIZE
+	if len(wb.Fragments.Map) != 1 || wb.Fragments.Bytes != size {
+		t.Errorf("Stale message was not expired.")
+	}
+
+	if _, ok := wb.Fragments.Sources["peer"]; ok {
+		t.Errorf("Stale message still counted against its source.")
+	}
+
+	wb.Fragments.Bytes = MAX_REASSEMBLY_BYTES
+	_, err = wb.reassemble("another", WIRE_VERSION_JSON, first)
+	if err != errReassemblyFull {
+		t.Errorf("Fragment accepted over the memory cap.")
+	}
+}
+
+// First fragment of a new message, the smallest one that reserves count slots.
+func firstFragment(count int) []byte {
+	fragment := make([]byte, FRAGMENT_HEADER_SIZE+1)
+	rand.Read(fragment[:8])
+	binary.BigEndian.PutUint16(fragment[10:12], uint16(count))
+	return fragment
+}
+
+func TestReassembleCaps(t *testing.T) {
+	wb := newFragmentsBox()
+
+	// one source only gets its share of the partial messages
+	for i := 0; i < MAX_SOURCE_PARTIALS; i++ {
+		_, err := wb.reassemble("greedy", WIRE_VERSION_JSON, firstFragment(2))
+		if err != nil {
+			t.Fatalf("Error reassembling: %v", err)
+		}
+	}
+
+	_, err := wb.reassemble("greedy", WIRE_VERSION_JSON, firstFragment(2))
+	if err != errReassemblyFull {
+		t.Errorf("Source went over its share of partial messages.")
+	}
+
+	// the chunk list counts, not just the chunks
+	usage := wb.Fragments.Sources["greedy"]
+	size := MAX_SOURCE_PARTIALS * (1 + 2*FRAGMENT_SLOT_SIZE)
+	if usage.Bytes != size || wb.Fragments.Bytes != size {
+		t.Errorf("Unexpected bytes charged for partial messages:")
+		t.Errorf("Got: %d source, %d total", usage.Bytes, wb.Fragments.Bytes)
+		t.Errorf("Expecting: %d", size)
+	}
+
+	// other sources fill up to the overall cap
+	for i := MAX_SOURCE_PARTIALS; i < MAX_PARTIAL_MESSAGES; i++ {
+		source := fmt.Sprintf("peer%d", i)
+		_, err := wb.reassemble(source, WIRE_VERSION_JSON, firstFragment(2))
+		if err != nil {
+			t.Fatalf("Error reassembling: %v", err)
+		}
+	}
+
+	_, err = wb.reassemble("late", WIRE_VERSION_JSON, firstFragment(2))
+	if err != errReassemblyFull {
+		t.Errorf("Partial message accepted over the overall cap.")
+	}
+
+	// and a source can't hold more than its share of the bytes
+	wb = newFragmentsBox()
+	wb.Fragments.Sources["greedy"] = &FragmentSource{Bytes: MAX_SOURCE_BYTES}
+	_, err = wb.reassemble("greedy", WIRE_VERSION_JSON, firstFragment(2))
+	if err != errReassemblyFull {
+		t.Errorf("Source went over its share of the buffer.")
+	}
+
+	_, err = wb.reassemble("other", WIRE_VERSION_JSON, firstFragment(2))
+	if err != nil {
+		t.Errorf("Other source was crowded out: %v", err)
+	}
+}
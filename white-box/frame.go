@@ -0,0 +1,235 @@
+package whitebox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+// Every datagram carries one envelope, or one fragment of an envelope, behind
+// a fixed header:
+//
+//	magic "PL" | version (1 byte) | flags (1 byte) | length (4 bytes, BE)
+//
+// The version is the wire version the envelope is encoded with. The length
+// covers the payload only and has to match the datagram, so a truncated or
+// padded datagram is rejected instead of misparsed.
+//
+// Peers from before framing send newline terminated JSON and drop anything
+// else, so they keep getting that until they send us a versioned envelope.
+const (
+	FRAME_MAGIC       = "PL"
+	FRAME_HEADER_SIZE = 8
+)
+
+// Frame flags.
+const (
+	FRAME_FLAG_FRAGMENT = 0x01
+	FRAME_FLAGS         = FRAME_FLAG_FRAGMENT
+)
+
+// Largest UDP payload over IPv4.
+const MAX_DATAGRAM_SIZE = 65507
+
+const MAX_PAYLOAD_SIZE = MAX_DATAGRAM_SIZE - FRAME_HEADER_SIZE
+
+var errFrameTooLarge = errors.New("error frame too large")
+var errFrameShort = errors.New("error frame shorter than header")
+var errFrameMagic = errors.New("error frame magic")
+var errFrameVersion = errors.New("error frame version")
+var errFrameLength = errors.New("error frame length does not match")
+var errFrameFlags = errors.New("error frame flags")
+
+// Counters for datagrams dropped by Recv, read with atomic.LoadUint64.
+type TransportStats struct {
+	Received   uint64
+	ReadErrors uint64
+	Oversized  uint64
+	Malformed  uint64
+	SendErrors uint64
+	// fragments received and messages rebuilt from them
+	Fragments   uint64
+	Reassembled uint64
+}
+
+type frameHeader struct {
+	Version int
+	Flags   byte
+}
+
+func frame(payload []byte, version int, flags byte) ([]byte, error) {
+	if len(payload) > MAX_PAYLOAD_SIZE {
+		return nil, errFrameTooLarge
+	}
+
+	datagram := make([]byte, FRAME_HEADER_SIZE+len(payload))
+	copy(datagram, FRAME_MAGIC)
+	datagram[2] = byte(version)
+	datagram[3] = flags
+	binary.BigEndian.PutUint32(datagram[4:8], uint32(len(payload)))
+	copy(datagram[FRAME_HEADER_SIZE:], payload)
+	return datagram, nil
+}
+
+// Strip and check the frame header. Bare JSON datagrams from clients that
+// predate framing are passed through.
+func unframe(datagram []byte) (frameHeader, []byte, error) {
+	var header frameHeader
+	if len(datagram) > MAX_DATAGRAM_SIZE {
+		return header, nil, errFrameTooLarge
+	}
+
+	if len(datagram) > 0 && datagram[0] == '{' {
+		header.Version = WIRE_VERSION_LEGACY
+		return header, bytes.TrimRight(datagram, "\r\n"), nil
+	}
+
+	if len(datagram) < FRAME_HEADER_SIZE {
+		return header, nil, errFrameShort
+	}
+
+	if string(datagram[:2]) != FRAME_MAGIC {
+		return header, nil, errFrameMagic
+	}
+
+	header.Version = int(datagram[2])
+	if header.Version < WIRE_VERSION_JSON || header.Version > WIRE_VERSION {
+		return header, nil, errFrameVersion
+	}
+
+	header.Flags = datagram[3]
+	if header.Flags&^FRAME_FLAGS != 0 {
+		return header, nil, errFrameFlags
+	}
+
+	length := binary.BigEndian.Uint32(datagram[4:8])
+	if uint64(length) != uint64(len(datagram)-FRAME_HEADER_SIZE) {
+		return header, nil, errFrameLength
+	}
+
+	return header, datagram[FRAME_HEADER_SIZE:], nil
+}
+
+// Marshal and frame an envelope for a wire version, ready for writeDatagram.
+// Envelopes too large for one datagram are split into fragments if the peer
+// can put them back together. The legacy version is bare JSON and a newline.
+func (wb *WhiteBox) encodeEnvelope(
+	env *Envelope, version int, fragment bool) ([][]byte, error) {
+	payload, err := marshalEnvelope(env, version)
+	if err != nil {
+		return nil, err
+	}
+
+	var datagrams [][]byte
+	if version == WIRE_VERSION_LEGACY {
+		datagrams = [][]byte{append(payload, '\n')}
+		if len(datagrams[0]) > MAX_DATAGRAM_SIZE {
+			err = errFrameTooLarge
+		}
+	} else if len(payload) > MAX_PAYLOAD_SIZE && fragment {
+		datagrams, err = fragmentPayload(payload, version)
+	} else {
+		var datagram []byte
+		datagram, err = frame(payload, version, 0)
+		datagrams = [][]byte{datagram}
+	}
+
+	if err != nil {
+		atomic.AddUint64(&wb.TransportStats.SendErrors, 1)
+		wb.setStatus("error message too large (" + env.Type + ")")
+		return nil, err
+	}
+
+	return datagrams, nil
+}
+
+func (wb *WhiteBox) writeDatagram(conn Transport, datagram []byte) {
+	if conn == nil {
+		return
+	}
+
+	err := conn.Send(datagram)
+	if err != nil {
+		atomic.AddUint64(&wb.TransportStats.SendErrors, 1)
+		log.Println(err)
+	}
+}
+
+// How an envelope goes out to a particular peer.
+type envelopeEncoding struct {
+	Version  int
+	Fragment bool
+}
+
+// Encodes an envelope at most once per encoding when it goes out to several
+// peers.
+type envelopeEncoder struct {
+	WhiteBox  *WhiteBox
+	Env       *Envelope
+	Datagrams map[envelopeEncoding][][]byte
+	Failed    map[envelopeEncoding]bool
+}
+
+// Envelopes we originate advertise our wire version, forwarded ones keep the
+// sender's.
+func (wb *WhiteBox) newEncoder(env *Envelope) *envelopeEncoder {
+	if env.From == wb.PeerSelf.Id() && env.Version == 0 {
+		env.Version = WIRE_VERSION
+	}
+
+	enc := new(envelopeEncoder)
+	enc.WhiteBox = wb
+	enc.Env = env
+	enc.Datagrams = make(map[envelopeEncoding][][]byte)
+	enc.Failed = make(map[envelopeEncoding]bool)
+	return enc
+}
+
+func (enc *envelopeEncoder) datagrams(encoding envelopeEncoding) [][]byte {
+	datagrams, encoded := enc.Datagrams[encoding]
+	if encoded || enc.Failed[encoding] {
+		return datagrams
+	}
+
+	datagrams, err := enc.WhiteBox.encodeEnvelope(
+		enc.Env, encoding.Version, encoding.Fragment)
+	if err != nil {
+		log.Println(err)
+		enc.Failed[encoding] = true
+		return nil
+	}
+
+	enc.Datagrams[encoding] = datagrams
+	return datagrams
+}
+
+// Peers we haven't heard a version from might predate framing, they get bare
+// JSON in a single datagram.
+func (enc *envelopeEncoder) sendTo(peer *Peer) {
+	wb := enc.WhiteBox
+	encoding := envelopeEncoding{
+		Version:  WIRE_VERSION_JSON,
+		Fragment: wb.peerHas(peer.Id(), CAP_FRAGMENT)}
+
+	switch version := wb.peerVersion(peer.Id()); {
+	case version == WIRE_VERSION_LEGACY:
+		encoding = envelopeEncoding{Version: WIRE_VERSION_LEGACY}
+	case version >= WIRE_VERSION_BINARY:
+		encoding.Version = WIRE_VERSION_BINARY
+	}
+
+	enc.send(peer.Conn, encoding)
+}
+
+func (enc *envelopeEncoder) send(conn Transport, encoding envelopeEncoding) {
+	for _, datagram := range enc.datagrams(encoding) {
+		enc.WhiteBox.writeDatagram(conn, datagram)
+	}
+}
+
+// Encode an envelope and send it to one peer.
+func (wb *WhiteBox) sendEnvelope(peer *Peer, env *Envelope) {
+	wb.newEncoder(env).sendTo(peer)
+}
@@ -0,0 +1,165 @@
+package whitebox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	payload := []byte("{\"Type\":\"ping\"}")
+	datagram, err := frame(payload, WIRE_VERSION_BINARY, 0)
+	if err != nil {
+		t.Fatalf("Error framing payload: %v", err)
+	}
+
+	if len(datagram) != FRAME_HEADER_SIZE+len(payload) {
+		t.Errorf("Framed datagram has unexpected length:")
+		t.Errorf("Got: %d", len(datagram))
+		t.Errorf("Expecting: %d", FRAME_HEADER_SIZE+len(payload))
+	}
+
+	header, unframed, err := unframe(datagram)
+	if err != nil {
+		t.Fatalf("Error unframing datagram: %v", err)
+	}
+
+	if header.Version != WIRE_VERSION_BINARY {
+		t.Errorf("Unframed version does not match:")
+		t.Errorf("Got: %d", header.Version)
+		t.Errorf("Expecting: %d", WIRE_VERSION_BINARY)
+	}
+
+	if !bytes.Equal(unframed, payload) {
+		t.Errorf("Unframed payload does not match:")
+		t.Errorf("Got: %s", unframed)
+		t.Errorf("Expecting: %s", payload)
+	}
+
+	_, err = frame(make([]byte, MAX_PAYLOAD_SIZE+1), WIRE_VERSION_JSON, 0)
+	if err != errFrameTooLarge {
+		t.Errorf("Oversized payload was framed.")
+	}
+}
+
+func TestUnframe(t *testing.T) {
+	good, _ := frame([]byte("{}"), WIRE_VERSION_JSON, 0)
+
+	badMagic := append([]byte{}, good...)
+	badMagic[0] = 'X'
+
+	badVersion := append([]byte{}, good...)
+	badVersion[2] = WIRE_VERSION + 1
+
+	badFlags := append([]byte{}, good...)
+	badFlags[3] = 0x80
+
+	tables := []struct {
+		name string
+		in   []byte
+		out  error
+	}{
+		{"good", good, nil},
+		{"legacy json", []byte("{\"Type\":\"ping\"}\n"), nil},
+		{"empty", []byte{}, errFrameShort},
+		{"short", good[:FRAME_HEADER_SIZE-1], errFrameShort},
+		{"magic", badMagic, errFrameMagic},
+		{"version", badVersion, errFrameVersion},
+		{"flags", badFlags, errFrameFlags},
+		{"truncated", good[:len(good)-1], errFrameLength},
+		{"padded", append(append([]byte{}, good...), 0), errFrameLength},
+		{"oversized", make([]byte, MAX_DATAGRAM_SIZE+1), errFrameTooLarge},
+	}
+
+	for _, table := range tables {
+		_, _, err := unframe(table.in)
+		if err != table.out {
+			t.Errorf("Unexpected error for unframe(%s):", table.name)
+			t.Errorf("Got: %v", err)
+			t.Errorf("Expecting: %v", table.out)
+		}
+	}
+}
+
+// Keeps what was sent instead of writing it anywhere.
+type recordTransport struct {
+	Datagrams [][]byte
+}
+
+func (transport *recordTransport) Send(datagram []byte) error {
+	transport.Datagrams = append(transport.Datagrams, datagram)
+	return nil
+}
+
+func (transport *recordTransport) Close() error {
+	return nil
+}
+
+func TestSendToLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.frame")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self, otherSelf Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	other := New(dir, "127.0.0.1", "3500", otherSelf, DefaultConfig())
+
+	transport := new(recordTransport)
+	peer := other.PeerSelf
+	peer.Conn = transport
+
+	tables := []struct {
+		name    string
+		version int
+		out     int
+	}{
+		{"unknown", WIRE_VERSION_LEGACY, WIRE_VERSION_LEGACY},
+		{"json", WIRE_VERSION_JSON, WIRE_VERSION_JSON},
+		{"binary", WIRE_VERSION_BINARY, WIRE_VERSION_BINARY},
+	}
+
+	for _, table := range tables {
+		wb.notePeerVersion(peer.Id(), table.version)
+		transport.Datagrams = nil
+
+		env := Envelope{Type: "ping", From: wb.PeerSelf.Id(), To: peer.Id()}
+		wb.sendEnvelope(&peer, &env)
+		if len(transport.Datagrams) != 1 {
+			t.Fatalf("Unexpected number of datagrams to %s peer: %d",
+				table.name, len(transport.Datagrams))
+		}
+
+		datagram := transport.Datagrams[0]
+		framed := bytes.HasPrefix(datagram, []byte(FRAME_MAGIC))
+		legacy := table.out == WIRE_VERSION_LEGACY
+		if framed == legacy {
+			t.Errorf("Unexpected framing to %s peer:", table.name)
+			t.Errorf("Got: %q", datagram)
+			t.Errorf("Expecting: framed %v", !legacy)
+		}
+
+		if legacy && datagram[len(datagram)-1] != '\n' {
+			t.Errorf("Bare JSON to %s peer is not newline terminated.",
+				table.name)
+		}
+
+		header, payload, err := unframe(datagram)
+		if err != nil {
+			t.Fatalf("Error unframing datagram to %s peer: %v", table.name, err)
+		}
+
+		if header.Version != table.out {
+			t.Errorf("Unexpected version to %s peer:", table.name)
+			t.Errorf("Got: %d", header.Version)
+			t.Errorf("Expecting: %d", table.out)
+		}
+
+		received, err := unmarshalEnvelope(payload, header.Version)
+		if err != nil || received.Type != "ping" {
+			t.Errorf("Envelope to %s peer does not decode: %v", table.name, err)
+		}
+	}
+}
@@ -0,0 +1,627 @@
+package whitebox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/kevinburke/nacl"
+	"github.com/kevinburke/nacl/box"
+	"github.com/kevinburke/nacl/secretbox"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Party traffic is sealed with sender keys. Each member picks a random key
+// for the party and hands it to the members it sends to in a key message,
+// sealed between throwaway box keys, then seals each message once with it
+// rather than once per neighbor. Our key is replaced when someone joins or
+// leaves and after Config.PartyKeyRotation, and an epoch's keys are forgotten
+// when the next one ends, so captured traffic can't be opened later with our
+// long-term keys. Members that don't hold our current key get the old per-peer
+// box until they do.
+const (
+	GROUP_KEY_ID_SIZE = 8
+	// unsolicited key offers to one member at most this often
+	KEY_OFFER_INTERVAL = 5 * time.Second
+	// keys kept per member, their newest and the one before
+	MEMBER_KEYS = 2
+)
+
+// Body of a key message.
+type PartyKeyMessage struct {
+	// sender's epoch box key, keys for the sender get sealed to it
+	EpochPub []byte
+	// sender's key, sealed to the recipient's epoch box key in For, empty
+	// until the sender knows it
+	KeyId string
+	Key   []byte `json:",omitempty"`
+	For   []byte `json:",omitempty"`
+	// newest of the recipient's key ids the sender holds
+	Have string
+}
+
+// Our key for a party and the box keys it's sealed with.
+type PartyEpoch struct {
+	KeyId string
+	Key   nacl.Key
+	Pub   nacl.Key
+	Prv   nacl.Key
+	Start time.Time
+	// kept for keys sealed to it that are still on the way
+	Previous *PartyEpoch
+}
+
+// A member's sender key.
+type GroupKey struct {
+	PartyId string
+	PeerId  string
+	KeyId   string
+	Key     nacl.Key
+}
+
+// Key state for one party.
+type PartyKeys struct {
+	Epoch *PartyEpoch
+	// members' epoch box keys
+	MemberPubs map[string][]byte
+	// our key id each member holds
+	Holders map[string]string
+	// last unsolicited offer to each member, kept across epochs
+	Offered map[string]time.Time
+	// members' key ids, newest last
+	MemberKeys map[string][]string
+}
+
+type LockingGroupKeys struct {
+	Parties map[string]*PartyKeys
+	// members' keys by peer and key id
+	Keys map[string]*GroupKey
+	// members who sent group data with a key we don't hold
+	Lost  map[string]bool
+	Mutex *sync.Mutex
+}
+
+var errGroupShort = errors.New("error group message too short")
+var errGroupKeyUnknown = errors.New("error unknown group key")
+
+func newPartyEpoch() (*PartyEpoch, error) {
+	pub, prv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, GROUP_KEY_ID_SIZE)
+	_, err = io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return nil, err
+	}
+
+	epoch := PartyEpoch{
+		KeyId: hex.EncodeToString(id),
+		Key:   nacl.NewKey(),
+		Pub:   pub,
+		Prv:   prv,
+		Start: time.Now()}
+
+	return &epoch, nil
+}
+
+// Replace our key, keeping the current one as the previous. Nobody holds the
+// new one yet.
+func (keys *PartyKeys) rotate() error {
+	epoch, err := newPartyEpoch()
+	if err != nil {
+		return err
+	}
+
+	if keys.Epoch != nil {
+		keys.Epoch.Previous = nil
+		epoch.Previous = keys.Epoch
+	}
+
+	keys.Epoch = epoch
+	keys.Holders = make(map[string]string)
+	return nil
+}
+
+// Key state for a party, with a current epoch. Caller holds the group key
+// lock.
+func (wb *WhiteBox) partyKeys(partyId string) (*PartyKeys, error) {
+	keys, exists := wb.GroupKeys.Parties[partyId]
+	if !exists {
+		keys = &PartyKeys{
+			MemberPubs: make(map[string][]byte),
+			Holders:    make(map[string]string),
+			Offered:    make(map[string]time.Time),
+			MemberKeys: make(map[string][]string)}
+		wb.GroupKeys.Parties[partyId] = keys
+	}
+
+	if keys.Epoch == nil ||
+		time.Since(keys.Epoch.Start) > wb.Config.PartyKeyRotation {
+		err := keys.rotate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// Add or refresh a member, starting a new epoch if they're new. Returns
+// whether they were.
+func (party *PartyLine) addMember(peerId string) bool {
+	party.MinList.Mutex.Lock()
+	_, seen := party.MinList.Map[peerId]
+	party.MinList.Map[peerId] = 0
+	party.MinList.Mutex.Unlock()
+
+	if !seen {
+		party.rotateKey()
+	}
+
+	return !seen
+}
+
+// Start a new epoch when the party's members change.
+func (party *PartyLine) rotateKey() {
+	wb := party.WhiteBox
+	wb.GroupKeys.Mutex.Lock()
+	defer wb.GroupKeys.Mutex.Unlock()
+
+	// the first message makes one
+	keys, exists := wb.GroupKeys.Parties[party.Id]
+	if !exists {
+		return
+	}
+
+	err := keys.rotate()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Drop a member's keys when they leave.
+func (party *PartyLine) forgetMemberKeys(peerId string) {
+	wb := party.WhiteBox
+	wb.GroupKeys.Mutex.Lock()
+	defer wb.GroupKeys.Mutex.Unlock()
+
+	keys, exists := wb.GroupKeys.Parties[party.Id]
+	if !exists {
+		return
+	}
+
+	for _, keyId := range keys.MemberKeys[peerId] {
+		delete(wb.GroupKeys.Keys, peerId+"/"+keyId)
+	}
+
+	delete(keys.MemberKeys, peerId)
+	delete(keys.MemberPubs, peerId)
+	delete(keys.Holders, peerId)
+	delete(keys.Offered, peerId)
+	delete(wb.GroupKeys.Lost, peerId)
+}
+
+// Drop all keys for a party we left.
+func (wb *WhiteBox) forgetPartyKeys(partyId string) {
+	wb.GroupKeys.Mutex.Lock()
+	defer wb.GroupKeys.Mutex.Unlock()
+
+	keys, exists := wb.GroupKeys.Parties[partyId]
+	if !exists {
+		return
+	}
+
+	for peerId, keyIds := range keys.MemberKeys {
+		for _, keyId := range keyIds {
+			delete(wb.GroupKeys.Keys, peerId+"/"+keyId)
+		}
+	}
+
+	delete(wb.GroupKeys.Parties, partyId)
+}
+
+func keyFromBytes(raw []byte) (nacl.Key, bool) {
+	if len(raw) != nacl.KeySize {
+		return nil, false
+	}
+
+	key := new([nacl.KeySize]byte)
+	copy(key[:], raw)
+	return key, true
+}
+
+// Our key message for a member, the key is left out until we know their
+// epoch box key.
+func (party *PartyLine) keyMessage(peerId string) (*PartyKeyMessage, error) {
+	wb := party.WhiteBox
+	wb.GroupKeys.Mutex.Lock()
+	defer wb.GroupKeys.Mutex.Unlock()
+
+	keys, err := wb.partyKeys(party.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	epoch := keys.Epoch
+	msg := PartyKeyMessage{
+		EpochPub: epoch.Pub[:],
+		KeyId:    epoch.KeyId}
+
+	memberKeys := keys.MemberKeys[peerId]
+	if len(memberKeys) > 0 {
+		msg.Have = memberKeys[len(memberKeys)-1]
+	}
+
+	memberPub, known := keyFromBytes(keys.MemberPubs[peerId])
+	if known {
+		msg.Key = box.EasySeal(epoch.Key[:], memberPub, epoch.Prv)
+		msg.For = memberPub[:]
+	}
+
+	return &msg, nil
+}
+
+// Send our key to a member.
+func (party *PartyLine) sendKey(peerId string) {
+	msg, err := party.keyMessage(peerId)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	signedMsg, err := party.WhiteBox.signPayload(
+		"key", peerId, party.Id, jsonMsg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	partyEnv := PartyEnvelope{
+		Type:    "key",
+		From:    party.WhiteBox.PeerSelf.Id(),
+		PartyId: party.Id,
+		Data:    signedMsg}
+
+	// keys always go in the member's own box
+	env, err := party.boxEnvelope(peerId, &partyEnv)
+	if err != nil {
+		party.WhiteBox.setStatus(err.Error())
+		return
+	}
+
+	party.WhiteBox.routeReliable(env, "party key", true)
+}
+
+// Send our key to a member unless we did recently.
+func (party *PartyLine) offerKey(peerId string) {
+	wb := party.WhiteBox
+	wb.GroupKeys.Mutex.Lock()
+	keys, err := wb.partyKeys(party.Id)
+	if err != nil {
+		wb.GroupKeys.Mutex.Unlock()
+		log.Println(err)
+		return
+	}
+
+	if time.Since(keys.Offered[peerId]) < KEY_OFFER_INTERVAL {
+		wb.GroupKeys.Mutex.Unlock()
+		return
+	}
+
+	keys.Offered[peerId] = time.Now()
+	wb.GroupKeys.Mutex.Unlock()
+
+	party.sendKey(peerId)
+}
+
+// Parties we share with a peer.
+func (wb *WhiteBox) memberParties(peerId string) []*PartyLine {
+	wb.Parties.Mutex.Lock()
+	parties := make([]*PartyLine, 0, len(wb.Parties.Map))
+	for _, party := range wb.Parties.Map {
+		parties = append(parties, party)
+	}
+	wb.Parties.Mutex.Unlock()
+
+	shared := make([]*PartyLine, 0, len(parties))
+	for _, party := range parties {
+		_, member := party.MinList.Get(peerId)
+		if member {
+			shared = append(shared, party)
+		}
+	}
+
+	return shared
+}
+
+// Note a member sealed data with a key we don't hold, likely lost to a
+// restart. Nothing in the envelope can be checked without that key, so our
+// keys wait for something from them that can, see offerLostKeys.
+func (wb *WhiteBox) noteLostKey(peerId string) {
+	if len(wb.memberParties(peerId)) == 0 {
+		return
+	}
+
+	wb.GroupKeys.Mutex.Lock()
+	wb.GroupKeys.Lost[peerId] = true
+	wb.GroupKeys.Mutex.Unlock()
+}
+
+// Offer our keys to a peer whose key we lost, once an envelope from them has
+// been authenticated. Hearing from us they don't hold theirs, they box for
+// us again until we do.
+func (wb *WhiteBox) offerLostKeys(peerId string) {
+	wb.GroupKeys.Mutex.Lock()
+	lost := wb.GroupKeys.Lost[peerId]
+	delete(wb.GroupKeys.Lost, peerId)
+	wb.GroupKeys.Mutex.Unlock()
+
+	if !lost {
+		return
+	}
+
+	for _, party := range wb.memberParties(peerId) {
+		party.offerKey(peerId)
+	}
+}
+
+// Take what a member's key message tells us. Returns whether to answer with
+// our own, when they don't hold our current key or need to hear we got theirs.
+func (party *PartyLine) storeKey(
+	peerId string, msg *PartyKeyMessage) (bool, error) {
+	wb := party.WhiteBox
+	wb.GroupKeys.Mutex.Lock()
+	defer wb.GroupKeys.Mutex.Unlock()
+
+	keys, err := wb.partyKeys(party.Id)
+	if err != nil {
+		return false, err
+	}
+
+	memberPub, valid := keyFromBytes(msg.EpochPub)
+	keyId, err := hex.DecodeString(msg.KeyId)
+	if !valid || err != nil || len(keyId) != GROUP_KEY_ID_SIZE {
+		return false, errors.New("error invalid key (party:key)")
+	}
+
+	keys.MemberPubs[peerId] = msg.EpochPub
+	keys.Holders[peerId] = msg.Have
+	reply := msg.Have != keys.Epoch.KeyId
+
+	_, stored := wb.GroupKeys.Keys[peerId+"/"+msg.KeyId]
+	if len(msg.Key) == 0 || stored {
+		return reply, nil
+	}
+
+	// sealed to one of our last two epochs, or one we've forgotten
+	epoch := keys.Epoch
+	if epoch.Previous != nil && !bytes.Equal(msg.For, epoch.Pub[:]) {
+		epoch = epoch.Previous
+	}
+
+	opened, err := box.EasyOpen(msg.Key, memberPub, epoch.Prv)
+	if err != nil {
+		log.Println("stale key from", peerId)
+		return true, nil
+	}
+
+	key, valid := keyFromBytes(opened)
+	if !valid {
+		return false, errors.New("error invalid key (party:key)")
+	}
+
+	wb.GroupKeys.Keys[peerId+"/"+msg.KeyId] = &GroupKey{
+		PartyId: party.Id,
+		PeerId:  peerId,
+		KeyId:   msg.KeyId,
+		Key:     key}
+
+	memberKeys := append(keys.MemberKeys[peerId], msg.KeyId)
+	for len(memberKeys) > MEMBER_KEYS {
+		delete(wb.GroupKeys.Keys, peerId+"/"+memberKeys[0])
+		memberKeys = memberKeys[1:]
+	}
+	keys.MemberKeys[peerId] = memberKeys
+
+	return true, nil
+}
+
+// Process a member's key.
+func (party *PartyLine) ProcessKey(partyEnv *PartyEnvelope) bool {
+	signedMsg := partyEnv.Data
+	header, jsonMsg, err := party.openPayload(partyEnv, "party:key")
+	if err != nil {
+		party.WhiteBox.setStatus(err.Error())
+		return false
+	}
+
+	if !party.WhiteBox.freshMessage(
+		header.From, signedMsg, header.Time, "party:key") {
+		return false
+	}
+
+	// only members get our key
+	_, member := party.MinList.Get(header.From)
+	if !member {
+		party.WhiteBox.setStatus("error key from non member (party:key)")
+		return false
+	}
+
+	msg := new(PartyKeyMessage)
+	err = json.Unmarshal(jsonMsg, msg)
+	if err != nil {
+		log.Println(err)
+		party.WhiteBox.setStatus("error invalid json (party:key)")
+		return false
+	}
+
+	reply, err := party.storeKey(header.From, msg)
+	if err != nil {
+		party.WhiteBox.setStatus(err.Error())
+		return false
+	}
+
+	if reply {
+		party.sendKey(header.From)
+	}
+
+	return true
+}
+
+// Party envelope boxed for one member with our long-term key.
+func (party *PartyLine) boxEnvelope(
+	peerId string, partyEnv *PartyEnvelope) (*Envelope, error) {
+	min, err := party.WhiteBox.IdToMin(peerId)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedPartyEnv, err := marshalPartyEnvelope(
+		partyEnv, party.WhiteBox.peerDecodesBinary(peerId))
+	if err != nil {
+		return nil, err
+	}
+
+	env := Envelope{
+		Type: "party",
+		From: party.WhiteBox.PeerSelf.Id(),
+		To:   peerId,
+		Data: box.EasySeal(
+			encodedPartyEnv, min.EncPub, party.WhiteBox.Self.EncPrv)}
+
+	return &env, nil
+}
+
+// Envelope carrying partyEnv to a member, sealed with our key if they hold it
+// and boxed for them if not. sealed keeps what's been sealed with our key by
+// key id and encoding, so a message sent to several members is sealed once.
+func (party *PartyLine) sealFor(peerId string, partyEnv *PartyEnvelope,
+	sealed map[string][]byte) (*Envelope, error) {
+	wb := party.WhiteBox
+	wb.GroupKeys.Mutex.Lock()
+	keys, err := wb.partyKeys(party.Id)
+	if err != nil {
+		wb.GroupKeys.Mutex.Unlock()
+		return nil, err
+	}
+
+	epoch := keys.Epoch
+	holds := keys.Holders[peerId] == epoch.KeyId
+	wb.GroupKeys.Mutex.Unlock()
+
+	if !holds {
+		if wb.peerHas(peerId, CAP_GROUP) {
+			party.offerKey(peerId)
+		}
+
+		return party.boxEnvelope(peerId, partyEnv)
+	}
+
+	binary := wb.peerDecodesBinary(peerId)
+	sealedKey := epoch.KeyId
+	if binary {
+		sealedKey += "/binary"
+	}
+
+	data, exists := sealed[sealedKey]
+	if !exists {
+		encodedPartyEnv, err := marshalPartyEnvelope(partyEnv, binary)
+		if err != nil {
+			return nil, err
+		}
+
+		data = groupSeal(epoch, encodedPartyEnv)
+		sealed[sealedKey] = data
+	}
+
+	env := Envelope{
+		Type: "group",
+		From: wb.PeerSelf.Id(),
+		To:   peerId,
+		Data: data}
+
+	return &env, nil
+}
+
+// Seal with our key, as key id | secretbox.
+func groupSeal(epoch *PartyEpoch, data []byte) []byte {
+	keyId, _ := hex.DecodeString(epoch.KeyId)
+	return append(keyId, secretbox.EasySeal(data, epoch.Key)...)
+}
+
+// Open a message sealed with a member's key.
+func (wb *WhiteBox) groupOpen(
+	peerId string, data []byte) (*GroupKey, []byte, error) {
+	if len(data) < GROUP_KEY_ID_SIZE {
+		return nil, nil, errGroupShort
+	}
+
+	keyId := hex.EncodeToString(data[:GROUP_KEY_ID_SIZE])
+	wb.GroupKeys.Mutex.Lock()
+	groupKey, exists := wb.GroupKeys.Keys[peerId+"/"+keyId]
+	wb.GroupKeys.Mutex.Unlock()
+
+	if !exists {
+		return nil, nil, errGroupKeyUnknown
+	}
+
+	opened, err := secretbox.EasyOpen(data[GROUP_KEY_ID_SIZE:], groupKey.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return groupKey, opened, nil
+}
+
+// Entry point for party messages sealed with a member's key.
+func (wb *WhiteBox) processGroup(env *Envelope) {
+	groupKey, opened, err := wb.groupOpen(env.From, env.Data)
+	if err == errGroupKeyUnknown {
+		// they think we hold a key we lost to a restart or rotation
+		log.Println("unknown group key from", env.From)
+		wb.noteLostKey(env.From)
+		return
+	}
+
+	if err != nil {
+		wb.setStatus("error invalid crypto (group)")
+		return
+	}
+
+	if !wb.allowSender(env) {
+		log.Println("rate limited", env.Type, "from", env.From)
+		return
+	}
+
+	if wb.ackEnvelope(env) {
+		return
+	}
+
+	wb.notePeerVersion(env.From, env.Version)
+
+	partyEnv, err := unmarshalPartyEnvelope(opened)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error invalid encoding (group)")
+		return
+	}
+
+	if partyEnv.PartyId != groupKey.PartyId {
+		wb.setStatus("error invalid party (group)")
+		return
+	}
+
+	wb.dispatchParty(env, partyEnv)
+}
@@ -0,0 +1,258 @@
+package whitebox
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Hand p0's key message to p1, returning whether p1 would answer.
+func passKey(t *testing.T, p0, p1 *PartyLine) bool {
+	msg, err := p0.keyMessage(p1.WhiteBox.PeerSelf.Id())
+	if err != nil {
+		t.Fatalf("Error making key message: %v", err)
+	}
+
+	reply, err := p1.storeKey(p0.WhiteBox.PeerSelf.Id(), msg)
+	if err != nil {
+		t.Fatalf("Error storing key: %v", err)
+	}
+
+	return reply
+}
+
+func TestGroupKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.groupkey")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self0, self1 Self
+	wb0 := New(dir, "127.0.0.1", "3499", self0, DefaultConfig())
+	wb1 := New(dir, "127.0.0.1", "4919", self1, DefaultConfig())
+	id0 := wb0.PeerSelf.Id()
+	id1 := wb1.PeerSelf.Id()
+
+	parties := make([]*PartyLine, 2)
+	for i, wb := range []*WhiteBox{wb0, wb1} {
+		party := new(PartyLine)
+		party.Id = "coolparty"
+		party.WhiteBox = wb
+		party.MinList.Map = map[string]int{id0: 0, id1: 0}
+		party.MinList.Mutex = new(sync.Mutex)
+		parties[i] = party
+	}
+	p0, p1 := parties[0], parties[1]
+
+	// epoch keys first, then the sealed keys, then word they arrived
+	replies := []bool{
+		passKey(t, p0, p1),
+		passKey(t, p1, p0),
+		passKey(t, p0, p1),
+		passKey(t, p1, p0)}
+	expected := []bool{true, true, true, false}
+	for i := range replies {
+		if replies[i] != expected[i] {
+			t.Errorf("Key exchange does not match:")
+			t.Errorf("Got: %v", replies)
+			t.Errorf("Expecting: %v", expected)
+			break
+		}
+	}
+
+	partyEnv := &PartyEnvelope{
+		Type:    "chat",
+		From:    id0,
+		PartyId: "coolparty",
+		Data:    []byte("hello")}
+
+	sealed := make(map[string][]byte)
+	env, err := p0.sealFor(id1, partyEnv, sealed)
+	if err != nil || env.Type != "group" {
+		t.Fatalf("Message for a holder not group sealed: %v", err)
+	}
+
+	again, _ := p0.sealFor(id1, partyEnv, sealed)
+	if !bytes.Equal(env.Data, again.Data) {
+		t.Errorf("Message sealed twice.")
+	}
+
+	groupKey, opened, err := wb1.groupOpen(id0, env.Data)
+	if err != nil || groupKey.PartyId != "coolparty" {
+		t.Fatalf("Error opening group message: %v", err)
+	}
+
+	openedEnv, err := unmarshalPartyEnvelope(opened)
+	if err != nil || !bytes.Equal(openedEnv.Data, partyEnv.Data) {
+		t.Errorf("Group message does not match:")
+		t.Errorf("Got: %v (%v)", openedEnv, err)
+		t.Errorf("Expecting: %v", partyEnv)
+	}
+
+	groupData := env.Data
+
+	// nobody holds a new key, members get the per-peer box until they do
+	p0.rotateKey()
+	env, err = p0.sealFor(id1, partyEnv, make(map[string][]byte))
+	if err != nil || env.Type != "party" {
+		t.Errorf("Message after rotation not boxed: %v", err)
+	}
+
+	// keys sealed to an epoch two back can't be opened
+	msg, err := p0.keyMessage(id1)
+	if err != nil {
+		t.Fatalf("Error making key message: %v", err)
+	}
+
+	p1.rotateKey()
+	p1.rotateKey()
+	reply, err := p1.storeKey(id0, msg)
+	if err != nil || !reply {
+		t.Errorf("Stale key not answered: %v", err)
+	}
+
+	_, stored := wb1.GroupKeys.Keys[id0+"/"+msg.KeyId]
+	if stored {
+		t.Errorf("Key sealed to a forgotten epoch opened.")
+	}
+
+	p1.forgetMemberKeys(id0)
+	_, _, err = wb1.groupOpen(id0, groupData)
+	if err != errGroupKeyUnknown {
+		t.Errorf("Left member's key not forgotten:")
+		t.Errorf("Got: %v", err)
+		t.Errorf("Expecting: %v", errGroupKeyUnknown)
+	}
+}
+
+func TestKeyMembership(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.groupmember")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self0, self1, self2 Self
+	wb0 := New(dir, "127.0.0.1", "3499", self0, DefaultConfig())
+	wb1 := New(dir, "127.0.0.1", "4919", self1, DefaultConfig())
+	wb2 := New(dir, "127.0.0.1", "5003", self2, DefaultConfig())
+	id0 := wb0.PeerSelf.Id()
+	id1 := wb1.PeerSelf.Id()
+	id2 := wb2.PeerSelf.Id()
+
+	party := new(PartyLine)
+	party.Id = "coolparty"
+	party.WhiteBox = wb0
+	party.MinList.Map = map[string]int{id0: 0, id1: 0}
+	party.MinList.Mutex = new(sync.Mutex)
+	party.SeenChats = NewDedupCache(DEDUP_SIZE, DEDUP_TTL)
+	party.LastChats = make(map[string]time.Time)
+	party.SeenWatermarks = make(map[string]time.Time)
+	party.ChatLock = new(sync.Mutex)
+	wb0.Parties.Map[party.Id] = party
+
+	_, err = party.keyMessage(id1)
+	if err != nil {
+		t.Fatalf("Error making key message: %v", err)
+	}
+
+	keyId := func() string {
+		wb0.GroupKeys.Mutex.Lock()
+		defer wb0.GroupKeys.Mutex.Unlock()
+		return wb0.GroupKeys.Parties[party.Id].Epoch.KeyId
+	}
+
+	offered := func() time.Time {
+		wb0.GroupKeys.Mutex.Lock()
+		defer wb0.GroupKeys.Mutex.Unlock()
+		return wb0.GroupKeys.Parties[party.Id].Offered[id1]
+	}
+
+	// a chat from sender, as dispatched by wb0
+	chat := func(sender *WhiteBox) (*Envelope, *PartyEnvelope) {
+		jsonPartyChat, err := json.Marshal(PartyChat{
+			PeerId:  sender.PeerSelf.Id(),
+			PartyId: party.Id,
+			Message: "hello",
+			Time:    time.Now().UTC()})
+		if err != nil {
+			t.Fatalf("Error marshalling chat: %v", err)
+		}
+
+		signed, err := sender.signHeader("chat", "", party.Id, jsonPartyChat)
+		if err != nil {
+			t.Fatalf("Error signing chat: %v", err)
+		}
+
+		env := &Envelope{Type: "party", From: sender.PeerSelf.Id(), To: id0}
+		partyEnv := &PartyEnvelope{
+			Type:    "chat",
+			From:    sender.PeerSelf.Id(),
+			PartyId: party.Id,
+			Data:    signed}
+		return env, partyEnv
+	}
+
+	// messages that don't check out say nothing about membership
+	first := keyId()
+	env, partyEnv := chat(wb2)
+	partyEnv.Data = []byte("junk")
+	wb0.dispatchParty(env, partyEnv)
+	_, member := party.MinList.Get(id2)
+	if keyId() != first || member {
+		t.Errorf("Unsigned message made its sender a member.")
+	}
+
+	// members refreshed by their messages keep the epoch, new ones end it
+	wb0.dispatchParty(chat(wb1))
+	refreshed := keyId()
+
+	wb0.dispatchParty(chat(wb2))
+	joined := keyId()
+
+	_, member = party.MinList.Get(id2)
+	if refreshed != first || joined == first || !member {
+		t.Errorf("Epochs do not match membership:")
+		t.Errorf("Got: %s, %s, %s (member %t)", first, refreshed, joined,
+			member)
+		t.Errorf("Expecting: %s, %s, a new key (member true)", first, first)
+	}
+
+	// nothing in group data under a key we lost can be checked
+	groupData := append(make([]byte, GROUP_KEY_ID_SIZE), "junk"...)
+	wb0.processGroup(&Envelope{Type: "group", From: id1, To: id0,
+		Data: groupData})
+	if !offered().IsZero() {
+		t.Errorf("Key offered for an unauthenticated envelope.")
+	}
+
+	signed, err := wb1.signHeader("ping", id0, "", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("Error signing payload: %v", err)
+	}
+
+	ping := &Envelope{Type: "ping", From: id1, To: id0, Data: signed}
+	_, ok := wb0.verifyEnvelope(ping, "ping")
+	if !ok {
+		t.Fatalf("Error verifying ping.")
+	}
+
+	offer := offered()
+	if offer.IsZero() {
+		t.Errorf("Key not offered once the member was authenticated.")
+	}
+
+	// a new epoch doesn't reset the offer limit
+	party.rotateKey()
+	party.offerKey(id1)
+	if !offered().Equal(offer) {
+		t.Errorf("Key offers do not match:")
+		t.Errorf("Got: %v", offered())
+		t.Errorf("Expecting: %v", offer)
+	}
+}
@@ -2,21 +2,28 @@ package whitebox
 
 import (
 	"bytes"
-	"container/list"
+	"crypto/rand"
 	"encoding/hex"
 	// "fmt"
 	"github.com/kevinburke/nacl/sign"
 	"log"
-	"math/big"
+	"sort"
 	"sync"
 	"time"
 )
 
+// How often MaintainTable looks for buckets due a refresh.
+const TABLE_CHECK_INTERVAL = time.Minute
+
 type PeerEntry struct {
-	Id       sign.PublicKey
-	Distance *big.Int
+	Id sign.PublicKey
+	// from us, orders entries within a bucket
+	Distance Distance
 	Peer     *Peer
 	Seen     time.Time
+	// advertised by the peer, zero until it bootstraps or announces
+	Protocol     int
+	Capabilities Capabilities
 }
 
 type LockingPeerCacheMap struct {
@@ -48,70 +55,70 @@ type PeerCache struct {
 	Announced    bool
 	Disconnected bool
 	Time         time.Time
+	Protocol     int
+	Capabilities Capabilities
 }
 
-func (wb *WhiteBox) InitTable(idBytes []byte) {
-	idInt := new(big.Int)
-	idInt.SetBytes(idBytes)
-
+func (wb *WhiteBox) InitTable() {
 	wb.PeerTable.Mutex.Lock()
-	for i := 0; i < 256; i++ {
-		peerDist := new(big.Int)
-		peerDist.Xor(wb.IdealPeerIds[i], idInt)
-		wb.PeerTable.Table[i] = list.New()
+	wb.PeerTable.Index = make(map[string]int)
+	for i := 0; i < BUCKET_COUNT; i++ {
+		bucket := &wb.PeerTable.Buckets[i]
+		bucket.Entries = make([]*PeerEntry, 0, wb.Config.BucketSize)
+		bucket.Replacements = make([]*PeerEntry, 0, wb.Config.BucketSize)
+		bucket.Touched = time.Now()
 	}
 	wb.PeerTable.Mutex.Unlock()
 }
 
-func calculateIdealTable(idBytes []byte) [256]*big.Int {
-	var idealIds [256]*big.Int
-
-	idInt := new(big.Int)
-	idInt.SetBytes(idBytes)
-
-	mask := new(big.Int)
-	mask.SetUint64(1)
+// Bucket an id goes in, by how long a prefix it shares with ours.
+func (wb *WhiteBox) bucketIndex(id []byte) int {
+	return xorDistance(wb.PeerSelf.SignPub, id).Bucket()
+}
 
-	for i := 0; i < len(idBytes)*8; i++ {
-		idealPeerId := new(big.Int)
-		idealPeerId.Xor(idInt, mask)
-		idealIds[i] = idealPeerId
-		mask.Lsh(mask, 1)
+// The table entry for a full peer id, nil if we don't talk to it directly.
+func (wb *WhiteBox) tableEntry(peerId string) *PeerEntry {
+	min, err := wb.IdToMin(peerId)
+	if err != nil {
+		return nil
 	}
 
-	return idealIds
-}
+	wb.PeerTable.Mutex.Lock()
+	defer wb.PeerTable.Mutex.Unlock()
+	entry := wb.PeerTable.entry(min.SignPub)
+	if entry == nil || entry.Peer == nil || entry.Peer.Id() != peerId {
+		return nil
+	}
 
-func (wb *WhiteBox) CalculateIdealTableSelf(idBytes []byte) {
-	wb.IdealPeerIds = calculateIdealTable(idBytes)
+	return entry
 }
 
 func (wb *WhiteBox) removePeer(peerId string) {
-	// TODO: use closest index instead of exhaustive search
 	bytesId, err := hex.DecodeString(peerId)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	intId := new(big.Int)
-	intId.SetBytes(bytesId)
-	idx := wb.closestIndex(intId)
+	idx := wb.bucketIndex(bytesId)
 
-	removeList := make([]*list.Element, 0)
+	dropIds := make([]string, 0)
 	wb.PeerTable.Mutex.Lock()
-	for curr := wb.PeerTable.Table[idx].Front(); curr != nil; curr = curr.Next() {
-		entry := curr.Value.(*PeerEntry)
-		if bytes.Compare(entry.Id, bytesId) == 0 {
-			removeList = append(removeList, curr)
-		}
+	entry := wb.PeerTable.remove(bytesId)
+	if entry != nil && entry.Peer != nil {
+		dropIds = append(dropIds, entry.Peer.Id())
 	}
 
-	for _, element := range removeList {
-		wb.PeerTable.Table[idx].Remove(element)
+	wb.removeReplacement(idx, bytesId)
+	if entry != nil {
+		wb.promoteReplacement(idx)
 	}
 	wb.PeerTable.Mutex.Unlock()
 
+	for _, id := range dropIds {
+		wb.dropStream(id)
+	}
+
 	if !wb.EmptyList && !wb.havePeers() {
 		wb.chatStatus("all friends gone, bootstrap some new ones")
 		wb.EmptyList = true
@@ -120,32 +127,40 @@ func (wb *WhiteBox) removePeer(peerId string) {
 
 func (wb *WhiteBox) removeStalePeers() {
 	removed := false
+	dropIds := make([]string, 0)
 	wb.PeerTable.Mutex.Lock()
-	for i := 0; i < 256; i++ {
-		removeList := make([]*list.Element, 0)
-		for curr := wb.PeerTable.Table[i].Front(); curr != nil; curr = curr.Next() {
-			entry := curr.Value.(*PeerEntry)
-			if entry.Peer != nil && time.Now().Sub(entry.Seen) > 60*time.Second {
-				removeList = append(removeList, curr)
+	for i := 0; i < BUCKET_COUNT; i++ {
+		removeList := make([]*PeerEntry, 0)
+		for _, entry := range wb.PeerTable.Buckets[i].Entries {
+			if entry.Peer != nil && time.Now().Sub(entry.Seen) > wb.Config.StalePeerTimeout {
+				removeList = append(removeList, entry)
 			}
 		}
 
-		for _, element := range removeList {
-			wb.PeerTable.Table[i].Remove(element)
+		for _, entry := range removeList {
+			wb.PeerTable.remove(entry.Id)
 			removed = true
 
-			entry := element.Value.(*PeerEntry)
 			cache, seen := wb.PeerCache.Get(entry.Peer.Id())
 			if !seen || !cache.Disconnected {
 				cache.Disconnected = true
 				wb.PeerCache.Set(entry.Peer.Id(), cache)
 			}
 
+			dropIds = append(dropIds, entry.Peer.Id())
 			wb.setStatus("removed stale peer " + entry.Peer.Id()[:6])
 		}
+
+		if len(removeList) > 0 {
+			wb.promoteReplacement(i)
+		}
 	}
 	wb.PeerTable.Mutex.Unlock()
 
+	for _, id := range dropIds {
+		wb.dropStream(id)
+	}
+
 	if removed && !wb.havePeers() && !wb.EmptyList {
 		wb.chatStatus("all friends gone, bootstrap some new ones")
 		wb.EmptyList = true
@@ -155,14 +170,8 @@ func (wb *WhiteBox) removeStalePeers() {
 func (wb *WhiteBox) havePeers() bool {
 	wb.PeerTable.Mutex.Lock()
 	defer wb.PeerTable.Mutex.Unlock()
-	for i := 0; i < 256; i++ {
-		if wb.PeerTable.Table[i].Len() > 1 {
-			return true
-		}
-
-		element := wb.PeerTable.Table[i].Front()
-		if element != nil {
-			entry := element.Value.(*PeerEntry)
+	for i := 0; i < BUCKET_COUNT; i++ {
+		for _, entry := range wb.PeerTable.Buckets[i].Entries {
 			if entry.Peer != nil {
 				return true
 			}
@@ -183,39 +192,53 @@ func (wb *WhiteBox) addPeer(peer *Peer, seenTime time.Time) {
 		return
 	}
 
-	cache.Added = true
-	cache.Disconnected = false
-	cache.Time = seenTime
-	wb.PeerCache.Set(peer.Id(), cache)
-
 	idBytes := peer.SignPub
-	insertId := new(big.Int)
-	insertId.SetBytes(idBytes)
-
-	idx := wb.closestIndex(insertId)
-
-	wb.PeerTable.Mutex.Lock()
-	peerList := wb.PeerTable.Table[idx]
-
-	insertDist := new(big.Int)
-	insertDist.Xor(wb.IdealPeerIds[idx], insertId)
+	idx := wb.bucketIndex(idBytes)
 
 	insertEntry := new(PeerEntry)
 	insertEntry.Id = idBytes
-	insertEntry.Distance = insertDist
+	insertEntry.Distance = xorDistance(wb.PeerSelf.SignPub, idBytes)
 	insertEntry.Peer = peer
 	insertEntry.Seen = time.Now()
+	insertEntry.Protocol = cache.Protocol
+	insertEntry.Capabilities = cache.Capabilities
+
+	// full buckets keep the peers they have, as in kademlia, newcomers wait
+	// for one of them to go
+	wb.PeerTable.Mutex.Lock()
+	bucket := &wb.PeerTable.Buckets[idx]
+	existing := wb.PeerTable.entry(idBytes)
+	if existing == nil && len(bucket.Entries) >= wb.Config.BucketSize {
+		err := wb.admitPeer(peer, bucket.Replacements)
+		if err == nil {
+			wb.addReplacement(idx, insertEntry)
+		}
+		wb.PeerTable.Mutex.Unlock()
+
+		log.Println("bucket", idx, "full, peer", peer.Id()[:6], "waiting", err)
+		return
+	}
 
-	curr := peerList.Back()
-	for curr != nil && insertDist.Cmp(curr.Value.(*PeerEntry).Distance) < 0 {
-		curr = curr.Prev()
+	err := wb.admitPeer(peer, bucket.Entries)
+	if err != nil {
+		wb.PeerTable.Mutex.Unlock()
+		log.Println(err, peer.Id()[:6])
+		return
 	}
 
-	if curr == nil {
-		wb.PeerTable.Table[idx].PushFront(insertEntry)
-	} else {
-		wb.PeerTable.Table[idx].InsertAfter(insertEntry, curr)
+	cache.Added = true
+	cache.Disconnected = false
+	cache.Time = seenTime
+	wb.PeerCache.Set(peer.Id(), cache)
+
+	// a peer coming back before it went stale takes over its old entry
+	if existing != nil {
+		wb.PeerTable.remove(idBytes)
 	}
+
+	wb.removeReplacement(idx, idBytes)
+	wb.PeerTable.insert(idx, insertEntry)
+	bucket.Touched = time.Now()
 	wb.PeerTable.Mutex.Unlock()
 
 	log.Println("peer added", peer.Id()[:6], "to list", idx)
@@ -223,91 +246,125 @@ func (wb *WhiteBox) addPeer(peer *Peer, seenTime time.Time) {
 	if wb.EmptyList {
 		wb.chatStatus("peer added, happy chatting!")
 		wb.EmptyList = false
+		go wb.rejoinParties()
 	}
 }
 
-func (wb *WhiteBox) wouldAddPeer(peer *Peer) bool {
-	idBytes := peer.SignPub
-	insertId := new(big.Int)
-	insertId.SetBytes(idBytes)
-
-	idx := wb.closestIndex(insertId)
+// Put a peer at the front of a bucket's replacement cache, dropping the
+// oldest once there are Config.BucketSize. Caller holds the table lock.
+func (wb *WhiteBox) addReplacement(idx int, entry *PeerEntry) {
+	wb.removeReplacement(idx, entry.Id)
+
+	bucket := &wb.PeerTable.Buckets[idx]
+	bucket.Replacements = append(bucket.Replacements, nil)
+	copy(bucket.Replacements[1:], bucket.Replacements)
+	bucket.Replacements[0] = entry
+
+	for len(bucket.Replacements) > wb.Config.BucketSize {
+		last := len(bucket.Replacements) - 1
+		oldest := bucket.Replacements[last]
+		bucket.Replacements[last] = nil
+		bucket.Replacements = bucket.Replacements[:last]
+		if oldest.Peer.Conn != nil {
+			oldest.Peer.Conn.Close()
+		}
+	}
+}
 
-	insertDist := new(big.Int)
-	insertDist.Xor(wb.IdealPeerIds[idx], insertId)
+// Caller holds the table lock.
+func (wb *WhiteBox) removeReplacement(idx int, idBytes []byte) {
+	bucket := &wb.PeerTable.Buckets[idx]
+	kept := bucket.Replacements[:0]
+	for _, entry := range bucket.Replacements {
+		if !bytes.Equal(entry.Id, idBytes) {
+			kept = append(kept, entry)
+			continue
+		}
 
-	wb.PeerTable.Mutex.Lock()
-	defer wb.PeerTable.Mutex.Unlock()
-	if wb.PeerTable.Table[idx].Len() < 20 {
-		return true
+		if entry.Peer.Conn != nil {
+			entry.Peer.Conn.Close()
+		}
 	}
 
-	last := wb.PeerTable.Table[idx].Back()
-	lastPeerEntry := last.Value.(*PeerEntry)
-	if insertDist.Cmp(lastPeerEntry.Distance) < 0 {
-		return true
+	for i := len(kept); i < len(bucket.Replacements); i++ {
+		bucket.Replacements[i] = nil
 	}
-
-	return false
+	bucket.Replacements = kept
 }
 
-func (wb *WhiteBox) closestIndex(idInt *big.Int) int {
-	// find lowest of ideal table
-	lowestIdealDist := new(big.Int)
-	lowestIdealIdx := 0
-	for i := 0; i < 256; i++ {
-		dist := new(big.Int)
-		dist.Xor(wb.IdealPeerIds[i], idInt)
-
-		if i == 0 {
-			lowestIdealDist = dist
-			lowestIdealIdx = i
+// Fill a bucket that lost a peer with the most recently seen replacement.
+// It has to answer pings like any other entry to stay. Caller holds the table
+// lock.
+func (wb *WhiteBox) promoteReplacement(idx int) {
+	bucket := &wb.PeerTable.Buckets[idx]
+	for len(bucket.Entries) < wb.Config.BucketSize {
+		if len(bucket.Replacements) == 0 {
+			return
 		}
 
-		if dist.Cmp(lowestIdealDist) < 0 {
-			lowestIdealDist = dist
-			lowestIdealIdx = i
+		entry := bucket.Replacements[0]
+		copy(bucket.Replacements, bucket.Replacements[1:])
+		bucket.Replacements[len(bucket.Replacements)-1] = nil
+		bucket.Replacements = bucket.Replacements[:len(bucket.Replacements)-1]
+
+		// the bucket may have filled up with its subnet since
+		err := wb.admitPeer(entry.Peer, bucket.Entries)
+		if err != nil {
+			log.Println(err, entry.Peer.Id()[:6])
+			if entry.Peer.Conn != nil {
+				entry.Peer.Conn.Close()
+			}
+			continue
 		}
+
+		entry.Seen = time.Now()
+		wb.PeerTable.insert(idx, entry)
+
+		cache, _ := wb.PeerCache.Get(entry.Peer.Id())
+		cache.Added = true
+		cache.Disconnected = false
+		wb.PeerCache.Set(entry.Peer.Id(), cache)
+
+		log.Println("replacement", entry.Peer.Id()[:6], "promoted to list", idx)
+	}
+}
+
+// Whether a peer would go straight into the table. Full buckets keep their
+// long lived peers rather than making room for closer newcomers, who could
+// be anyone's freshly made ids.
+func (wb *WhiteBox) wouldAddPeer(peer *Peer) bool {
+	idx := wb.bucketIndex(peer.SignPub)
+
+	wb.PeerTable.Mutex.Lock()
+	defer wb.PeerTable.Mutex.Unlock()
+	entries := wb.PeerTable.Buckets[idx].Entries
+	if len(entries) >= wb.Config.BucketSize {
+		return false
 	}
 
-	return lowestIdealIdx
+	return wb.admitPeer(peer, entries) == nil
 }
 
+// The n entries closest to an id from the bucket it would go in.
 func (wb *WhiteBox) findClosestN(idBytes []byte, n int) []*PeerEntry {
-	idInt := new(big.Int)
-	idInt.SetBytes(idBytes)
+	idx := wb.bucketIndex(idBytes)
 
-	closestIdx := wb.closestIndex(idInt)
+	wb.PeerTable.Mutex.Lock()
+	closest := append([]*PeerEntry{}, wb.PeerTable.Buckets[idx].Entries...)
+	wb.PeerTable.Mutex.Unlock()
 
-	closest := make([]*PeerEntry, 0)
-	dists := make([]*big.Int, 0)
+	dists := make(map[*PeerEntry]Distance, len(closest))
+	for _, entry := range closest {
+		dists[entry] = xorDistance(entry.Id, idBytes)
+	}
 
-	// find lowest entry in bucket
-	wb.PeerTable.Mutex.Lock()
-	peerList := wb.PeerTable.Table[closestIdx]
-	for curr := peerList.Front(); curr != nil; curr = curr.Next() {
-		entry := curr.Value.(*PeerEntry)
-		entryDist := new(big.Int)
-		entryDist.SetBytes(entry.Id)
-		entryDist.Xor(entryDist, idInt)
-
-		i := 0
-		for i = 0; i < len(closest); i++ {
-			if entryDist.Cmp(dists[i]) < 0 {
-				break
-			}
-		}
+	sort.Slice(closest, func(i, j int) bool {
+		return dists[closest[i]].Less(dists[closest[j]])
+	})
 
-		// lol wut
-		closest = append(
-			closest[:i], append([]*PeerEntry{entry}, closest[i:]...)...)
-		dists = append(
-			dists[:i], append([]*big.Int{entryDist}, dists[i:]...)...)
-		if len(closest) > n {
-			closest = closest[:n]
-		}
+	if len(closest) > n {
+		closest = closest[:n]
 	}
-	wb.PeerTable.Mutex.Unlock()
 
 	return closest
 }
@@ -322,6 +379,34 @@ func (wb *WhiteBox) findClosest(idBytes []byte) *PeerEntry {
 	return closest[0]
 }
 
+// The n peers in the whole table closest to target, nearest first.
+func (wb *WhiteBox) closestPeers(target []byte, n int) []*Peer {
+	peers := make([]*Peer, 0)
+	dists := make(map[*Peer]Distance)
+	wb.PeerTable.Mutex.Lock()
+	for i := 0; i < BUCKET_COUNT; i++ {
+		for _, entry := range wb.PeerTable.Buckets[i].Entries {
+			if entry.Peer == nil {
+				continue
+			}
+
+			dists[entry.Peer] = xorDistance(entry.Id, target)
+			peers = append(peers, entry.Peer)
+		}
+	}
+	wb.PeerTable.Mutex.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return dists[peers[i]].Less(dists[peers[j]])
+	})
+
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+
+	return peers
+}
+
 func (wb *WhiteBox) refreshPeer(peerId string) {
 	bytesId, err := hex.DecodeString(peerId)
 	if err != nil {
@@ -330,13 +415,98 @@ func (wb *WhiteBox) refreshPeer(peerId string) {
 	}
 
 	wb.PeerTable.Mutex.Lock()
-	for i := 0; i < 256; i++ {
-		for curr := wb.PeerTable.Table[i].Front(); curr != nil; curr = curr.Next() {
-			entry := curr.Value.(*PeerEntry)
-			if bytes.Compare(entry.Id, bytesId) == 0 {
-				entry.Seen = time.Now()
+	entry := wb.PeerTable.entry(bytesId)
+	if entry != nil {
+		entry.Seen = time.Now()
+	}
+	wb.PeerTable.Mutex.Unlock()
+}
+
+// A random id that lands in bucket idx, the same as ours above bit idx and
+// different at it.
+func randomIdInBucket(idBytes []byte, idx int) ([]byte, error) {
+	randBytes := make([]byte, ID_SIZE)
+	_, err := rand.Read(randBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	id := idealId(idBytes, idx)
+	for i := range id {
+		// bit number of the low bit of byte i
+		low := (ID_SIZE - 1 - i) * 8
+		if low+8 <= idx {
+			id[i] = randBytes[i]
+		} else if low < idx {
+			mask := byte(1<<uint(idx-low)) - 1
+			id[i] = id[i]&^mask | randBytes[i]&mask
+		}
+	}
+
+	return id, nil
+}
+
+// Buckets not touched in Config.BucketRefresh, and the lowest bucket with a
+// peer in it. Buckets below that are closer to us than any peer we know.
+func (wb *WhiteBox) staleBuckets(now time.Time) ([]int, int) {
+	stale := make([]int, 0)
+	nearest := BUCKET_COUNT
+
+	wb.PeerTable.Mutex.Lock()
+	defer wb.PeerTable.Mutex.Unlock()
+	for i := 0; i < BUCKET_COUNT; i++ {
+		bucket := &wb.PeerTable.Buckets[i]
+		if len(bucket.Entries) > 0 && i < nearest {
+			nearest = i
+		}
+
+		if now.Sub(bucket.Touched) > wb.Config.BucketRefresh {
+			stale = append(stale, i)
+			bucket.Touched = now
+		}
+	}
+
+	return stale, nearest
+}
+
+// Keep long running nodes from drifting into a sparse table. Stale buckets
+// get a lookup for a random id in their range and the peers found are added.
+// Buckets closer than our nearest peer share one lookup for our own id.
+func (wb *WhiteBox) MaintainTable() {
+	for {
+		time.Sleep(TABLE_CHECK_INTERVAL)
+		if !wb.havePeers() {
+			continue
+		}
+
+		stale, nearest := wb.staleBuckets(time.Now())
+		fill := false
+		for _, idx := range stale {
+			if idx < nearest {
+				fill = true
+				continue
 			}
+
+			wb.refreshBucket(idx)
+		}
+
+		if fill {
+			wb.fillBuckets()
+		}
+	}
+}
+
+func (wb *WhiteBox) refreshBucket(idx int) {
+	target, err := randomIdInBucket(wb.PeerSelf.SignPub, idx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	log.Println("refreshing bucket", idx)
+	for _, peer := range wb.Lookup(target) {
+		if wb.wouldAddPeer(peer) {
+			wb.addFoundPeer(peer)
 		}
 	}
-	wb.PeerTable.Mutex.Unlock()
 }
@@ -0,0 +1,295 @@
+package whitebox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRandomIdInBucket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.kad")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+
+	for _, idx := range []int{0, 1, 7, 128, 254, 255} {
+		id, err := randomIdInBucket(wb.PeerSelf.SignPub, idx)
+		if err != nil {
+			t.Fatalf("Error making id: %v", err)
+		}
+
+		got := wb.bucketIndex(id)
+		if len(id) != len(wb.PeerSelf.SignPub) || got != idx {
+			t.Errorf("Random id landed in the wrong bucket:")
+			t.Errorf("Got: %d (%d bytes)", got, len(id))
+			t.Errorf("Expecting: %d", idx)
+		}
+	}
+}
+
+// A peer with a signing key in bucket idx of wb's table.
+func bucketPeer(t *testing.T, wb *WhiteBox, idx int) *Peer {
+	self, err := GenerateSelf()
+	if err != nil {
+		t.Fatalf("Error generating keys: %v", err)
+	}
+
+	id, err := randomIdInBucket(wb.PeerSelf.SignPub, idx)
+	if err != nil {
+		t.Fatalf("Error making id: %v", err)
+	}
+
+	peer := new(Peer)
+	peer.SignPub = id
+	peer.EncPub = self.EncPub
+	peer.Address = "127.0.0.1:3598"
+	return peer
+}
+
+func TestReplacementCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.kad")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := DefaultConfig()
+	config.BucketSize = 2
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, config)
+	go discardStatus(wb)
+
+	peers := make([]*Peer, 4)
+	for idx := range peers {
+		peers[idx] = bucketPeer(t, wb, 200)
+		wb.addPeer(peers[idx], time.Now().UTC())
+	}
+
+	bucket := &wb.PeerTable.Buckets[200]
+	if len(bucket.Entries) != 2 || len(bucket.Replacements) != 2 {
+		t.Errorf("Full bucket did not hold newcomers as replacements:")
+		t.Errorf("Got: %d in bucket, %d waiting",
+			len(bucket.Entries), len(bucket.Replacements))
+		t.Errorf("Expecting: 2 in bucket, 2 waiting")
+	}
+
+	cache, _ := wb.PeerCache.Get(peers[3].Id())
+	if cache.Added {
+		t.Errorf("Replacement marked as added.")
+	}
+
+	// the newest replacement takes the place of a peer that leaves
+	wb.removePeer(hex.EncodeToString(peers[0].SignPub))
+	if wb.tablePeer(peers[3].Id()) == nil {
+		t.Errorf("Newest replacement was not promoted.")
+	}
+
+	if wb.tablePeer(peers[2].Id()) != nil {
+		t.Errorf("Promoted more replacements than there was room for.")
+	}
+
+	cache, _ = wb.PeerCache.Get(peers[3].Id())
+	if !cache.Added {
+		t.Errorf("Promoted replacement not marked as added.")
+	}
+
+	// stale peers are replaced the same way
+	wb.PeerTable.Mutex.Lock()
+	for _, entry := range bucket.Entries {
+		entry.Seen = time.Now().Add(-2 * config.StalePeerTimeout)
+	}
+	wb.PeerTable.Mutex.Unlock()
+
+	wb.removeStalePeers()
+	if wb.tablePeer(peers[2].Id()) == nil ||
+		len(bucket.Replacements) != 0 {
+		t.Errorf("Stale peers were not replaced.")
+	}
+}
+
+// The ideal table bucket an id used to go in, the ideal id it's nearest to.
+func idealTableIndex(selfId, id []byte) int {
+	selfInt := new(big.Int)
+	selfInt.SetBytes(selfId)
+
+	idInt := new(big.Int)
+	idInt.SetBytes(id)
+
+	lowestDist := new(big.Int)
+	lowestIdx := 0
+	mask := big.NewInt(1)
+	for i := 0; i < BUCKET_COUNT; i++ {
+		dist := new(big.Int)
+		dist.Xor(selfInt, mask)
+		dist.Xor(dist, idInt)
+		if i == 0 || dist.Cmp(lowestDist) < 0 {
+			lowestDist = dist
+			lowestIdx = i
+		}
+		mask.Lsh(mask, 1)
+	}
+
+	return lowestIdx
+}
+
+func TestBucketIndex(t *testing.T) {
+	selfId := make([]byte, ID_SIZE)
+	rand.Read(selfId)
+
+	ids := [][]byte{selfId, idealId(selfId, 0), idealId(selfId, 255)}
+	for i := 0; i < 200; i++ {
+		id := make([]byte, ID_SIZE)
+		rand.Read(id)
+		// share a random length prefix with self
+		copy(id, selfId[:i%ID_SIZE])
+		ids = append(ids, id)
+	}
+
+	for _, id := range ids {
+		got := xorDistance(selfId, id).Bucket()
+		expected := idealTableIndex(selfId, id)
+		if got != expected {
+			t.Errorf("Bucket index does not match the ideal table:")
+			t.Errorf("Got: %d", got)
+			t.Errorf("Expecting: %d", expected)
+		}
+	}
+}
+
+func TestTableIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.kad")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	go discardStatus(wb)
+
+	peers := make([]*Peer, 8)
+	for idx := range peers {
+		peers[idx] = bucketPeer(t, wb, 250)
+		wb.addPeer(peers[idx], time.Now().UTC())
+	}
+
+	entries := wb.PeerTable.Buckets[250].Entries
+	for idx := 1; idx < len(entries); idx++ {
+		if !entries[idx-1].Distance.Less(entries[idx].Distance) {
+			t.Errorf("Bucket entries out of distance order at %d.", idx)
+		}
+	}
+
+	for _, peer := range peers {
+		if wb.tablePeer(peer.Id()) != peer {
+			t.Errorf("Peer missing from the index: %s", peer.ShortId())
+		}
+	}
+
+	wb.removePeer(peers[3].ShortId())
+	if wb.tablePeer(peers[3].Id()) != nil || len(wb.PeerTable.Index) != 7 {
+		t.Errorf("Removed peer still indexed.")
+	}
+
+	before := time.Now()
+	wb.refreshPeer(peers[5].ShortId())
+	if wb.tableEntry(peers[5].Id()).Seen.Before(before) {
+		t.Errorf("Refresh did not reach the entry.")
+	}
+}
+
+// A full table of random peers, a few in each of the top buckets.
+func benchTable(b *testing.B) (*WhiteBox, [][]byte) {
+	dir, err := ioutil.TempDir("", "partytest.kadbench")
+	if err != nil {
+		b.Fatalf("Error creating temp dir: %v", err)
+	}
+	b.Cleanup(func() { os.RemoveAll(dir) })
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	go discardStatus(wb)
+
+	keys, err := GenerateSelf()
+	if err != nil {
+		b.Fatalf("Error generating keys: %v", err)
+	}
+
+	ids := make([][]byte, 0)
+	for idx := BUCKET_COUNT - 1; idx >= BUCKET_COUNT-16; idx-- {
+		for i := 0; i < wb.Config.BucketSize; i++ {
+			id, _ := randomIdInBucket(wb.PeerSelf.SignPub, idx)
+			peer := &Peer{SignPub: id, EncPub: keys.EncPub}
+			wb.addPeer(peer, time.Now().UTC())
+			ids = append(ids, id)
+		}
+	}
+
+	return wb, ids
+}
+
+func BenchmarkBucketIndex(b *testing.B) {
+	wb, ids := benchTable(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wb.bucketIndex(ids[i%len(ids)])
+	}
+}
+
+func BenchmarkFindClosestN(b *testing.B) {
+	wb, ids := benchTable(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wb.findClosestN(ids[i%len(ids)], 3)
+	}
+}
+
+func BenchmarkRefreshPeer(b *testing.B) {
+	wb, ids := benchTable(b)
+	shortIds := make([]string, len(ids))
+	for i, id := range ids {
+		shortIds[i] = hex.EncodeToString(id)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wb.refreshPeer(shortIds[i%len(shortIds)])
+	}
+}
+
+func BenchmarkAddRemovePeer(b *testing.B) {
+	wb, _ := benchTable(b)
+	keys, err := GenerateSelf()
+	if err != nil {
+		b.Fatalf("Error generating keys: %v", err)
+	}
+
+	// a bucket with room, so every add lands in the table
+	id, _ := randomIdInBucket(wb.PeerSelf.SignPub, 100)
+	peer := &Peer{SignPub: id, EncPub: keys.EncPub}
+	shortId := hex.EncodeToString(id)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		wb.addPeer(peer, time.Now().UTC())
+		wb.removePeer(shortId)
+
+		// as a disconnect would, so the next add goes in
+		cache, _ := wb.PeerCache.Get(peer.Id())
+		cache.Disconnected = true
+		wb.PeerCache.Set(peer.Id(), cache)
+	}
+}
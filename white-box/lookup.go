@@ -0,0 +1,388 @@
+package whitebox
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Iterative lookups, Kademlia's FIND_NODE. Each round asks the LOOKUP_ALPHA
+// closest peers we haven't asked yet for the peers they know closest to the
+// target, until the closest Config.BucketSize have all been asked or
+// LOOKUP_MAX_ROUNDS have gone by.
+const (
+	LOOKUP_ALPHA      = 3
+	LOOKUP_TIMEOUT    = 2 * time.Second
+	LOOKUP_MAX_ROUNDS = 16
+)
+
+type MessageFindNode struct {
+	Peer   Peer
+	Nonce  string
+	Target []byte
+	Time   time.Time
+}
+
+type MessageNodes struct {
+	TimePeer MessageTimePeer
+	Nonce    string
+	Nodes    []Peer
+}
+
+// A running lookup, the peers it asked and where their answers go.
+type PendingLookup struct {
+	Queried map[string]bool
+	Replies chan *MessageNodes
+}
+
+// Running lookups by nonce.
+type LockingLookups struct {
+	Map   map[string]*PendingLookup
+	Mutex *sync.Mutex
+}
+
+type lookupCandidate struct {
+	Peer     Peer
+	Distance Distance
+	Queried  bool
+	Answered bool
+	Failed   bool
+}
+
+// Find the peers closest to target, a signing public key. Returns up to
+// Config.BucketSize peers that answered, nearest first. Blocks for a round
+// trip per round so it must not be called while processing a message.
+func (wb *WhiteBox) Lookup(target []byte) []*Peer {
+	nonce, err := newMessageId()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	candidates := make(map[string]*lookupCandidate)
+	consider := func(peer Peer) {
+		id := peer.Id()
+		_, exists := candidates[id]
+		if exists || id == wb.PeerSelf.Id() || len(peer.SignPub) == 0 {
+			return
+		}
+
+		// peers that told us they can't answer aren't asked
+		_, caps, known := wb.PeerProtocol(id)
+		if known && !caps.Has(CAP_FIND) {
+			return
+		}
+
+		candidates[id] = &lookupCandidate{
+			Peer:     peer,
+			Distance: xorDistance(peer.SignPub, target)}
+	}
+
+	k := wb.Config.BucketSize
+	for _, peer := range wb.closestPeers(target, k) {
+		consider(*peer)
+	}
+
+	pending := new(PendingLookup)
+	pending.Queried = make(map[string]bool)
+	pending.Replies = make(chan *MessageNodes, k)
+
+	wb.Lookups.Mutex.Lock()
+	wb.Lookups.Map[nonce] = pending
+	wb.Lookups.Mutex.Unlock()
+
+	defer func() {
+		wb.Lookups.Mutex.Lock()
+		delete(wb.Lookups.Map, nonce)
+		wb.Lookups.Mutex.Unlock()
+	}()
+
+	for round := 0; round < LOOKUP_MAX_ROUNDS; round++ {
+		batch := make([]*lookupCandidate, 0, LOOKUP_ALPHA)
+		for _, candidate := range closestCandidates(candidates, k) {
+			if !candidate.Queried {
+				batch = append(batch, candidate)
+			}
+
+			if len(batch) == LOOKUP_ALPHA {
+				break
+			}
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		waiting := make(map[string]*lookupCandidate)
+		wb.Lookups.Mutex.Lock()
+		for _, candidate := range batch {
+			pending.Queried[candidate.Peer.Id()] = true
+		}
+		wb.Lookups.Mutex.Unlock()
+
+		for _, candidate := range batch {
+			candidate.Queried = true
+			waiting[candidate.Peer.Id()] = candidate
+			wb.sendFindNode(&candidate.Peer, nonce, target)
+		}
+
+		timeout := time.After(LOOKUP_TIMEOUT)
+		for len(waiting) > 0 {
+			var nodes *MessageNodes
+			select {
+			case nodes = <-pending.Replies:
+			case <-timeout:
+			}
+
+			if nodes == nil {
+				break
+			}
+
+			// late answers from earlier rounds still count
+			answered, exists := candidates[nodes.TimePeer.Peer.Id()]
+			if exists {
+				answered.Peer = nodes.TimePeer.Peer
+				answered.Answered = true
+				answered.Failed = false
+			}
+			delete(waiting, nodes.TimePeer.Peer.Id())
+
+			for _, node := range nodes.Nodes {
+				consider(node)
+			}
+		}
+
+		for _, candidate := range waiting {
+			candidate.Failed = true
+		}
+	}
+
+	found := make([]*Peer, 0, k)
+	for _, candidate := range closestCandidates(candidates, k) {
+		if candidate.Answered {
+			peer := candidate.Peer
+			found = append(found, &peer)
+		}
+	}
+
+	log.Println("lookup found", len(found), "peers")
+	return found
+}
+
+// The n closest candidates that haven't failed to answer, nearest first.
+func closestCandidates(
+	candidates map[string]*lookupCandidate, n int) []*lookupCandidate {
+	closest := make([]*lookupCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if !candidate.Failed {
+			closest = append(closest, candidate)
+		}
+	}
+
+	sort.Slice(closest, func(i, j int) bool {
+		return closest[i].Distance.Less(closest[j].Distance)
+	})
+
+	if len(closest) > n {
+		closest = closest[:n]
+	}
+
+	return closest
+}
+
+// Look ourselves up and add the peers found that fit in the table. One fill
+// runs at a time.
+func (wb *WhiteBox) fillBuckets() {
+	if !atomic.CompareAndSwapInt32(&wb.Filling, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&wb.Filling, 0)
+
+	for _, peer := range wb.Lookup(wb.PeerSelf.SignPub) {
+		if wb.wouldAddPeer(peer) {
+			wb.addFoundPeer(peer)
+		}
+	}
+}
+
+// Make sure there's a path to a peer before routing to it, looking it up and
+// adding it to the table if we don't already talk to it directly.
+func (wb *WhiteBox) locate(min *MinPeer) {
+	if wb.tablePeer(min.Id()) != nil {
+		return
+	}
+
+	for _, peer := range wb.Lookup(min.SignPub) {
+		if peer.Id() == min.Id() {
+			wb.addFoundPeer(peer)
+			return
+		}
+	}
+
+	log.Println("lookup did not find", min.Id())
+}
+
+// Add a peer that answered a lookup and ask it for suggestions, which also
+// gets it to add us.
+func (wb *WhiteBox) addFoundPeer(peer *Peer) {
+	cache, seen := wb.PeerCache.Get(peer.Id())
+	if seen && cache.Added && !cache.Disconnected {
+		return
+	}
+
+	peerConn, err := DialUDP(peer.Address)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("could not connect to peer (lookup)")
+		return
+	}
+
+	peer.Conn = peerConn
+	wb.addPeer(peer, time.Now().UTC())
+	wb.sendSuggestionRequest(peer)
+}
+
+// Send to a peer whether or not it's in the table. Peers that aren't get a
+// connection for this one envelope.
+func (wb *WhiteBox) sendDirect(peer *Peer, env *Envelope) {
+	tabled := wb.tablePeer(peer.Id())
+	if tabled != nil {
+		wb.sendEnvelope(tabled, env)
+		return
+	}
+
+	conn, err := DialUDP(peer.Address)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	direct := *peer
+	direct.Conn = conn
+	wb.sendEnvelope(&direct, env)
+	conn.Close()
+}
+
+func (wb *WhiteBox) sendFindNode(peer *Peer, nonce string, target []byte) {
+	env := Envelope{
+		Type: "findnode",
+		From: wb.PeerSelf.Id(),
+		To:   peer.Id()}
+
+	findNode := MessageFindNode{
+		Peer:   wb.PeerSelf,
+		Nonce:  nonce,
+		Target: target,
+		Time:   time.Now().UTC()}
+
+	jsonFindNode, err := json.Marshal(findNode)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	env.Data, err = wb.signPayload(env.Type, env.To, "", jsonFindNode)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	wb.sendDirect(peer, &env)
+}
+
+func (wb *WhiteBox) processFindNode(env *Envelope) {
+	jsonData, ok := wb.verifyEnvelope(env, "findnode")
+	if !ok {
+		return
+	}
+
+	findNode := new(MessageFindNode)
+	err := json.Unmarshal(jsonData, findNode)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error invalid json (findnode)")
+		return
+	}
+
+	if env.From != findNode.Peer.Id() {
+		wb.setStatus("id does not match from (findnode)")
+		return
+	}
+
+	// the asker already knows itself
+	closest := wb.closestPeers(findNode.Target, wb.Config.BucketSize+1)
+	nodes := make([]Peer, 0, len(closest))
+	for _, peer := range closest {
+		if peer.Id() != env.From && len(nodes) < wb.Config.BucketSize {
+			nodes = append(nodes, *peer)
+		}
+	}
+
+	reply := Envelope{
+		Type: "nodes",
+		From: wb.PeerSelf.Id(),
+		To:   env.From}
+
+	msgNodes := MessageNodes{
+		TimePeer: wb.newTimePeer(),
+		Nonce:    findNode.Nonce,
+		Nodes:    nodes}
+
+	jsonNodes, err := json.Marshal(msgNodes)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	reply.Data, err = wb.signPayload(reply.Type, reply.To, "", jsonNodes)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	wb.sendDirect(&findNode.Peer, &reply)
+}
+
+func (wb *WhiteBox) processNodes(env *Envelope) {
+	jsonData, ok := wb.verifyEnvelope(env, "nodes")
+	if !ok {
+		return
+	}
+
+	nodes := new(MessageNodes)
+	err := json.Unmarshal(jsonData, nodes)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error invalid json (nodes)")
+		return
+	}
+
+	if env.From != nodes.TimePeer.Peer.Id() {
+		wb.setStatus("id does not match from (nodes)")
+		return
+	}
+
+	wb.recordProtocol(env.From, &nodes.TimePeer)
+
+	// we asked for a bucket's worth, anything past that is ignored
+	if len(nodes.Nodes) > wb.Config.BucketSize {
+		nodes.Nodes = nodes.Nodes[:wb.Config.BucketSize]
+	}
+
+	wb.Lookups.Mutex.Lock()
+	pending, exists := wb.Lookups.Map[nodes.Nonce]
+	asked := exists && pending.Queried[env.From]
+	wb.Lookups.Mutex.Unlock()
+
+	// lookups that are done or never asked this peer
+	if !asked {
+		return
+	}
+
+	select {
+	case pending.Replies <- nodes:
+	default:
+		log.Println("lookup replies full, dropping", env.From)
+	}
+}
@@ -0,0 +1,123 @@
+package whitebox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func discardStatus(wb *WhiteBox) {
+	for {
+		<-wb.StatusChannel
+	}
+}
+
+// Add other to wb's table the way a verified hello would.
+func linkPeers(t *testing.T, wb, other *WhiteBox) {
+	timePeer := other.newTimePeer()
+	peer := timePeer.Peer
+	conn, err := DialUDP(peer.Address)
+	if err != nil {
+		t.Fatalf("Error dialing peer: %v", err)
+	}
+
+	peer.Conn = conn
+	wb.recordProtocol(peer.Id(), &timePeer)
+	wb.addPeer(&peer, timePeer.Time)
+}
+
+func TestLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.lookup")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a line of peers that each only know the next one
+	wbs := make([]*WhiteBox, 4)
+	for idx := range wbs {
+		var self Self
+		port := 3521 + idx
+		portStr := strconv.Itoa(port)
+		wbDir := filepath.Join(dir, portStr)
+		wbs[idx] = New(wbDir, "127.0.0.1", portStr, self, DefaultConfig())
+		go discardStatus(wbs[idx])
+		go wbs[idx].Recv(wbs[idx].Listen("127.0.0.1", uint16(port)))
+	}
+
+	for idx := 0; idx < len(wbs)-1; idx++ {
+		linkPeers(t, wbs[idx], wbs[idx+1])
+	}
+
+	last := wbs[len(wbs)-1]
+	found := wbs[0].Lookup(last.PeerSelf.SignPub)
+	if len(found) == 0 || found[0].Id() != last.PeerSelf.Id() {
+		t.Errorf("Lookup did not find the end of the line:")
+		t.Errorf("Got: %d peers", len(found))
+		t.Errorf("Expecting: %s first", last.PeerSelf.ShortId())
+	}
+
+	if len(found) != len(wbs)-1 {
+		t.Errorf("Lookup did not reach every peer:")
+		t.Errorf("Got: %d", len(found))
+		t.Errorf("Expecting: %d", len(wbs)-1)
+	}
+
+	min := last.PeerSelf.Min()
+	wbs[0].locate(&min)
+	if wbs[0].tablePeer(min.Id()) == nil {
+		t.Errorf("Located peer was not added to the table.")
+	}
+}
+
+func TestNodesTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.lookup")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self, otherSelf Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	other := New(dir, "127.0.0.1", "3500", otherSelf, DefaultConfig())
+	go discardStatus(wb)
+
+	pending := &PendingLookup{
+		Queried: map[string]bool{other.PeerSelf.Id(): true},
+		Replies: make(chan *MessageNodes, 1)}
+	wb.Lookups.Map["nonce"] = pending
+
+	// a reply stuffed with far more peers than a bucket holds
+	k := wb.Config.BucketSize
+	nodes := make([]Peer, 0, 4*k)
+	for len(nodes) < cap(nodes) {
+		nodes = append(nodes, other.PeerSelf)
+	}
+
+	jsonNodes, _ := json.Marshal(MessageNodes{
+		TimePeer: other.newTimePeer(),
+		Nonce:    "nonce",
+		Nodes:    nodes})
+
+	env := Envelope{Type: "nodes", From: other.PeerSelf.Id(), To: wb.PeerSelf.Id()}
+	env.Data, err = other.signPayload(env.Type, env.To, "", jsonNodes)
+	if err != nil {
+		t.Fatalf("Error signing payload: %v", err)
+	}
+
+	wb.processNodes(&env)
+
+	select {
+	case reply := <-pending.Replies:
+		if len(reply.Nodes) != k {
+			t.Errorf("Nodes reply was not truncated:")
+			t.Errorf("Got: %d", len(reply.Nodes))
+			t.Errorf("Expecting: %d", k)
+		}
+	default:
+		t.Errorf("Nodes reply was not passed to the lookup.")
+	}
+}
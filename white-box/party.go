@@ -7,9 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/kevinburke/nacl/box"
-	"github.com/kevinburke/nacl/sign"
 	"io"
-	"io/ioutil"
 	"log"
 	mrand "math/rand"
 	"os"
@@ -26,11 +24,13 @@ func init() {
 }
 
 // Structure passed to VerifiedBlockWriter, used for writing blocks to disk.
-// Hash is SHA256.
+// Hash is SHA256. Party and PackHash identify the pack to checkpoint.
 type VerifiedBlock struct {
 	Block        *Block
 	PackFileInfo *PackFileInfo
 	Hash         string
+	Party        *PartyLine
+	PackHash     string
 }
 
 // MinList wrapper that includes a lock. MinList is a minimal list of peer
@@ -69,7 +69,15 @@ type PartyLine struct {
 	// The party's name.
 	Id string
 	// A map used to prevent reflooding messages.
-	SeenChats map[string]bool `json:"-"`
+	SeenChats *DedupCache `json:"-"`
+	// Newest chat time seen this run from each member, saved as their
+	// watermarks.
+	LastChats map[string]time.Time `json:"-"`
+	// A member's chats at or before their watermark were seen before a
+	// restart.
+	SeenWatermarks map[string]time.Time `json:"-"`
+	// Lock for the chat times.
+	ChatLock *sync.Mutex `json:"-"`
 	// Packs advertised in the party.
 	Packs map[string]LockingPack `json:"-"`
 	// Lock for the pack map.
@@ -90,6 +98,7 @@ type PartyEnvelope struct {
 type PartyAnnounce struct {
 	PeerId  string
 	PartyId string
+	Time    time.Time
 }
 
 // Party chat message.
@@ -182,6 +191,9 @@ func (party *PartyLine) getNeighbors() map[string]bool {
 	return neighbors
 }
 
+// Members sent in an invite to peers that can't reassemble fragments.
+const INVITE_MEMBERS = 20
+
 // Invite a peer to the party.
 func (party *PartyLine) SendInvite(min *MinPeer) {
 	env := Envelope{
@@ -189,18 +201,21 @@ func (party *PartyLine) SendInvite(min *MinPeer) {
 		From: party.WhiteBox.PeerSelf.Id(),
 		To:   min.Id()}
 
+	// peers that reassemble fragments get the whole member list, for the rest
 	// keep message small so we don't limit party size
-	// hopefully this doesn't fuck up delivery
 	var sendParty *PartyLine = party
-	if party.MinList.Len() > 20 {
+	fragment := party.WhiteBox.peerHas(min.Id(), CAP_FRAGMENT)
+	if !fragment && party.MinList.Len() > INVITE_MEMBERS {
 		sendParty = new(PartyLine)
 		sendParty.Id = party.Id
+		sendParty.MinList.Map = make(map[string]int)
+		sendParty.MinList.Mutex = new(sync.Mutex)
 		idx := 0
 		party.MinList.Mutex.Lock()
 		for id, _ := range party.MinList.Map {
 			sendParty.MinList.Set(id, 0)
 			idx++
-			if idx > 20 {
+			if idx >= INVITE_MEMBERS {
 				break
 			}
 		}
@@ -213,21 +228,29 @@ func (party *PartyLine) SendInvite(min *MinPeer) {
 		return
 	}
 
+	// only peers known not to check headers get the bare party
+	wb := party.WhiteBox
+	if !wb.peerLacks(min.Id(), CAP_SIGNED) || wb.Config.StrictSignatures {
+		jsonInvite, err = wb.signHeader("invite", min.Id(), "", jsonInvite)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
 	closed := box.EasySeal(
 		[]byte(jsonInvite), min.EncPub, party.WhiteBox.Self.EncPrv)
 	env.Data = closed
 
-	party.WhiteBox.route(&env)
-	party.WhiteBox.setStatus("invite sent")
+	// far away invitees may not be reachable through the table yet
+	go func() {
+		party.WhiteBox.locate(min)
+		party.WhiteBox.routeReliable(&env, "invite", false)
+	}()
 }
 
 // Announce self to a newly joined party.
 func (party *PartyLine) SendAnnounce() {
-	env := Envelope{
-		Type: "party",
-		From: party.WhiteBox.PeerSelf.Id(),
-		To:   ""}
-
 	partyEnv := PartyEnvelope{
 		Type:    "announce",
 		From:    party.WhiteBox.PeerSelf.Id(),
@@ -235,7 +258,8 @@ func (party *PartyLine) SendAnnounce() {
 
 	partyAnnounce := PartyAnnounce{
 		PeerId:  party.WhiteBox.PeerSelf.Id(),
-		PartyId: party.Id}
+		PartyId: party.Id,
+		Time:    time.Now().UTC()}
 
 	jsonPartyAnnounce, err := json.Marshal(partyAnnounce)
 	if err != nil {
@@ -243,42 +267,35 @@ func (party *PartyLine) SendAnnounce() {
 		return
 	}
 
-	signedPartyAnnounce := sign.Sign(
-		[]byte(jsonPartyAnnounce), party.WhiteBox.Self.SignPrv)
-	partyEnv.Data = signedPartyAnnounce
-
-	jsonPartyEnv, err := json.Marshal(partyEnv)
+	signedPartyAnnounce, err := party.signPayload("announce", jsonPartyAnnounce)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	partyEnv.Data = signedPartyAnnounce
 
 	party.MinList.Mutex.Lock()
 	defer party.MinList.Mutex.Unlock()
 	for idMin, _ := range party.MinList.Map {
-		min, err := party.WhiteBox.IdToMin(idMin)
+		// we're on our own list, nothing to announce there
+		if idMin == party.WhiteBox.PeerSelf.Id() {
+			continue
+		}
+
+		// a fresh envelope each, routing stamps its time and hops
+		env, err := party.boxEnvelope(idMin, &partyEnv)
 		if err != nil {
 			party.WhiteBox.setStatus(err.Error())
 			continue
 		}
 
-		closed := box.EasySeal(
-			[]byte(jsonPartyEnv), min.EncPub, party.WhiteBox.Self.EncPrv)
-		env.Data = closed
-		env.To = idMin
-
-		party.WhiteBox.route(&env)
+		party.WhiteBox.routeReliable(env, "party announce", false)
 	}
 }
 
 // Forward a message along to neighbors.
 func (party *PartyLine) sendToNeighbors(
 	msgType string, signedPartyData []byte) {
-	env := Envelope{
-		Type: "party",
-		From: party.WhiteBox.PeerSelf.Id(),
-		To:   ""}
-
 	partyEnv := PartyEnvelope{
 		Type:    msgType,
 		From:    party.WhiteBox.PeerSelf.Id(),
@@ -286,26 +303,16 @@ func (party *PartyLine) sendToNeighbors(
 
 	partyEnv.Data = signedPartyData
 
-	jsonPartyEnv, err := json.Marshal(partyEnv)
-	if err != nil {
-		log.Println(err)
-		return
-	}
-
+	sealed := make(map[string][]byte)
 	neighbors := party.getNeighbors()
 	for idMin, _ := range neighbors {
-		min, err := party.WhiteBox.IdToMin(idMin)
+		env, err := party.sealFor(idMin, &partyEnv, sealed)
 		if err != nil {
 			party.WhiteBox.setStatus(err.Error())
 			continue
 		}
 
-		closed := box.EasySeal(
-			[]byte(jsonPartyEnv), min.EncPub, party.WhiteBox.Self.EncPrv)
-		env.Data = closed
-		env.To = idMin
-
-		party.WhiteBox.route(&env)
+		party.WhiteBox.route(env)
 	}
 }
 
@@ -323,14 +330,25 @@ func (party *PartyLine) SendChat(message string) {
 		return
 	}
 
-	signedPartyChat := sign.Sign(
-		[]byte(jsonPartyChat), party.WhiteBox.Self.SignPrv)
+	signedPartyChat, err := party.signPayload("chat", jsonPartyChat)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
 	party.sendToNeighbors("chat", signedPartyChat)
 }
 
-// Let party peers know when you d/c.
+// Leave the party and let party peers know.
 func (party *PartyLine) SendDisconnect() {
+	delete(party.WhiteBox.Parties.Map, party.Id)
+	party.sendDisconnect()
+	party.WhiteBox.forgetPartyKeys(party.Id)
+	party.WhiteBox.stateChanged()
+}
+
+// Let party peers know when you d/c.
+func (party *PartyLine) sendDisconnect() {
 	partyDisconnect := PartyDisconnect{
 		PeerId:  party.WhiteBox.PeerSelf.Id(),
 		PartyId: party.Id,
@@ -342,10 +360,12 @@ func (party *PartyLine) SendDisconnect() {
 		return
 	}
 
-	delete(party.WhiteBox.Parties.Map, party.Id)
-
-	signedPartyDisconnect := sign.Sign(
-		[]byte(jsonPartyDisconnect), party.WhiteBox.Self.SignPrv)
+	signedPartyDisconnect, err := party.signPayload(
+		"disconnect", jsonPartyDisconnect)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	party.sendToNeighbors("disconnect", signedPartyDisconnect)
 }
 
@@ -364,41 +384,48 @@ func (party *PartyLine) SendAdvertisement(packSha256 string, pack *Pack) {
 		return
 	}
 
-	signedPartyAdvertisement := sign.Sign(
-		[]byte(jsonPartyAdvertisement), party.WhiteBox.Self.SignPrv)
+	signedPartyAdvertisement, err := party.signPayload(
+		"ad", jsonPartyAdvertisement)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
 	party.sendToNeighbors("ad", signedPartyAdvertisement)
 }
 
 // Process an advertisement.
-func (party *PartyLine) ProcessAdvertisement(partyEnv *PartyEnvelope) {
+func (party *PartyLine) ProcessAdvertisement(partyEnv *PartyEnvelope) bool {
 	signedPartyAdvertisement := partyEnv.Data
-	jsonPartyAdvertisement := signedPartyAdvertisement[sign.SignatureSize:]
+	header, jsonPartyAdvertisement, err :=
+		party.openPayload(partyEnv, "party:ad")
+	if err != nil {
+		party.WhiteBox.setStatus(err.Error())
+		return false
+	}
 
 	partyAdvertisement := new(PartyAdvertisement)
-	err := json.Unmarshal(jsonPartyAdvertisement, partyAdvertisement)
+	err = json.Unmarshal(jsonPartyAdvertisement, partyAdvertisement)
 	if err != nil {
 		log.Println(err)
 		party.WhiteBox.setStatus("error invalid json (party:ad)")
-		return
+		return false
 	}
 
 	if party.Id != partyAdvertisement.PartyId {
 		party.WhiteBox.setStatus("error invalid party id for (party:ad)")
-		return
+		return false
 	}
 
-	min, err := party.WhiteBox.IdToMin(partyAdvertisement.PeerId)
-	if err != nil {
-		party.WhiteBox.setStatus("error bad id (party:ad)")
-		return
+	if partyAdvertisement.PeerId != header.From {
+		party.WhiteBox.setStatus(
+			"error peer is not the signer (party:ad)")
+		return false
 	}
 
-	verified := sign.Verify(signedPartyAdvertisement, min.SignPub)
-	if !verified {
-		party.WhiteBox.setStatus(
-			"error questionable message integrity (party:ad)")
-		return
+	if !party.WhiteBox.freshMessage(
+		header.From, signedPartyAdvertisement, header.Time, "party:ad") {
+		return false
 	}
 
 	newPack := new(Pack)
@@ -409,7 +436,7 @@ func (party *PartyLine) ProcessAdvertisement(partyEnv *PartyEnvelope) {
 	hash := partyAdvertisement.Hash
 	if hash != sha256Pack(newPack) {
 		party.WhiteBox.setStatus("error bad pack hash (party:ad)")
-		return
+		return false
 	}
 
 	party.PacksLock.Lock()
@@ -439,51 +466,51 @@ func (party *PartyLine) ProcessAdvertisement(partyEnv *PartyEnvelope) {
 	}
 
 	adTime := partyAdvertisement.Time
-	peerTime, ok := lockingPack.Pack.Peers[min.Id()]
+	peerTime, ok := lockingPack.Pack.Peers[header.From]
 	if !ok || peerTime.Before(adTime) {
 		if adTime.Sub(peerTime) > 30*time.Second {
 			party.sendToNeighbors("ad", signedPartyAdvertisement)
 		}
-		lockingPack.Pack.Peers[min.Id()] = adTime
+		lockingPack.Pack.Peers[header.From] = adTime
 	}
+
+	return true
 }
 
 // Process a party chat.
-func (party *PartyLine) ProcessChat(partyEnv *PartyEnvelope) {
+func (party *PartyLine) ProcessChat(partyEnv *PartyEnvelope) bool {
 	signedPartyChat := partyEnv.Data
-	jsonPartyChat := signedPartyChat[sign.SignatureSize:]
+	header, jsonPartyChat, err := party.openPayload(partyEnv, "party:chat")
+	if err != nil {
+		party.WhiteBox.setStatus(err.Error())
+		return false
+	}
 
 	partyChat := new(PartyChat)
-	err := json.Unmarshal(jsonPartyChat, partyChat)
+	err = json.Unmarshal(jsonPartyChat, partyChat)
 	if err != nil {
 		log.Println(err)
 		party.WhiteBox.setStatus("error invalid json (party:chat)")
-		return
+		return false
 	}
 
 	if partyChat.PartyId != party.Id {
 		party.WhiteBox.setStatus("error invalid party (party:chat)")
-		return
+		return false
 	}
 
-	min, err := party.WhiteBox.IdToMin(partyChat.PeerId)
-	if err != nil {
-		party.WhiteBox.setStatus("error bad id (party:chat)")
-		return
-	}
-
-	verified := sign.Verify(signedPartyChat, min.SignPub)
-	if !verified {
+	if partyChat.PeerId != header.From {
 		party.WhiteBox.setStatus(
-			"error questionable message integrity (party:chat)")
-		return
+			"error peer is not the signer (party:chat)")
+		return false
 	}
 
-	chatId := fmt.Sprintf("%s.%s", partyChat.PeerId, partyChat.Time.String())
-	_, seen := party.SeenChats[chatId]
-	if !seen {
-		party.SeenChats[chatId] = true
+	if !party.WhiteBox.freshMessage(
+		header.From, signedPartyChat, header.Time, "party:chat") {
+		return false
+	}
 
+	if party.newChat(partyChat.PeerId, partyChat.Time) {
 		chat := Chat{
 			Time:    time.Now().UTC(),
 			Id:      partyChat.PeerId,
@@ -494,43 +521,72 @@ func (party *PartyLine) ProcessChat(partyEnv *PartyEnvelope) {
 
 		party.sendToNeighbors("chat", signedPartyChat)
 	}
+
+	return true
+}
+
+// Whether a chat from peerId sent at sent hasn't been shown yet, noting it
+// for the watermark if so. Senders pick the time, so it counts no further
+// ahead than the clock skew we accept and only against their own chats.
+func (party *PartyLine) newChat(peerId string, sent time.Time) bool {
+	chatId := fmt.Sprintf("%s.%s", peerId, sent.String())
+
+	party.ChatLock.Lock()
+	defer party.ChatLock.Unlock()
+
+	if party.SeenChats.Seen(chatId) {
+		return false
+	}
+
+	// shown before we restarted
+	if !sent.After(party.SeenWatermarks[peerId]) {
+		return false
+	}
+
+	latest := time.Now().UTC().Add(party.WhiteBox.Config.MessageWindow)
+	if sent.After(latest) {
+		sent = latest
+	}
+
+	if sent.After(party.LastChats[peerId]) {
+		party.LastChats[peerId] = sent
+	}
+
+	return true
 }
 
 // Process a peer's disconnect
-func (party *PartyLine) ProcessDisconnect(partyEnv *PartyEnvelope) {
+func (party *PartyLine) ProcessDisconnect(partyEnv *PartyEnvelope) bool {
 	signedPartyDisconnect := partyEnv.Data
-	jsonPartyDisconnect := signedPartyDisconnect[sign.SignatureSize:]
+	header, jsonPartyDisconnect, err :=
+		party.openPayload(partyEnv, "party:disconnect")
+	if err != nil {
+		party.WhiteBox.setStatus(err.Error())
+		return false
+	}
 
 	partyDisconnect := new(PartyDisconnect)
-	err := json.Unmarshal(jsonPartyDisconnect, partyDisconnect)
+	err = json.Unmarshal(jsonPartyDisconnect, partyDisconnect)
 	if err != nil {
 		log.Println(err)
 		party.WhiteBox.setStatus("error invalid json (party:disconnect)")
-		return
+		return false
 	}
 
 	if partyDisconnect.PartyId != party.Id {
 		party.WhiteBox.setStatus("error invalid party (party:disconnect)")
-		return
-	}
-
-	min, err := party.WhiteBox.IdToMin(partyDisconnect.PeerId)
-	if err != nil {
-		party.WhiteBox.setStatus("error bad id (party:disconnect)")
-		return
+		return false
 	}
 
-	verified := sign.Verify(signedPartyDisconnect, min.SignPub)
-	if !verified {
+	if partyDisconnect.PeerId != header.From {
 		party.WhiteBox.setStatus(
-			"error questionable message integrity (party:disconnect)")
-		return
+			"error peer is not the signer (party:disconnect)")
+		return false
 	}
 
-	if time.Since(partyDisconnect.Time) > 200*time.Second {
-		party.WhiteBox.setStatus(
-			"error time exceeds max allowable (party:disconnect)")
-		return
+	if !party.WhiteBox.freshMessage(
+		header.From, signedPartyDisconnect, header.Time, "party:disconnect") {
+		return false
 	}
 
 	_, seen := party.MinList.Get(partyDisconnect.PeerId)
@@ -539,47 +595,55 @@ func (party *PartyLine) ProcessDisconnect(partyEnv *PartyEnvelope) {
 		party.MinList.Mutex.Lock()
 		delete(party.MinList.Map, partyDisconnect.PeerId)
 		party.MinList.Mutex.Unlock()
+		party.forgetMemberKeys(partyDisconnect.PeerId)
+		party.rotateKey()
 		party.sendToNeighbors("disconnect", signedPartyDisconnect)
+		party.WhiteBox.stateChanged()
 	}
+
+	return true
 }
 
 // Process a peer's annoucnement.
-func (party *PartyLine) ProcessAnnounce(partyEnv *PartyEnvelope) {
+func (party *PartyLine) ProcessAnnounce(partyEnv *PartyEnvelope) bool {
 	signedPartyAnnounce := partyEnv.Data
-	jsonPartyAnnounce := signedPartyAnnounce[sign.SignatureSize:]
+	header, jsonPartyAnnounce, err :=
+		party.openPayload(partyEnv, "party:announce")
+	if err != nil {
+		party.WhiteBox.setStatus(err.Error())
+		return false
+	}
 
 	partyAnnounce := new(PartyAnnounce)
-	err := json.Unmarshal(jsonPartyAnnounce, partyAnnounce)
+	err = json.Unmarshal(jsonPartyAnnounce, partyAnnounce)
 	if err != nil {
 		log.Println(err)
 		party.WhiteBox.setStatus("error invalid json (party:announce)")
-		return
+		return false
 	}
 
 	if partyAnnounce.PartyId != party.Id {
 		party.WhiteBox.setStatus("error invalid party (party:announce)")
-		return
+		return false
 	}
 
-	min, err := party.WhiteBox.IdToMin(partyAnnounce.PeerId)
-	if err != nil {
-		party.WhiteBox.setStatus("error bad id (party:announce)")
-		return
-	}
-
-	verified := sign.Verify(signedPartyAnnounce, min.SignPub)
-	if !verified {
+	if partyAnnounce.PeerId != header.From {
 		party.WhiteBox.setStatus(
-			"error questionable message integrity (party:announce)")
-		return
+			"error peer is not the signer (party:announce)")
+		return false
 	}
 
-	_, seen := party.MinList.Get(partyAnnounce.PeerId)
+	if !party.WhiteBox.freshMessage(
+		header.From, signedPartyAnnounce, header.Time, "party:announce") {
+		return false
+	}
 
-	if !seen {
-		party.MinList.Set(partyAnnounce.PeerId, 0)
+	if party.addMember(partyAnnounce.PeerId) {
 		party.sendToNeighbors("announce", signedPartyAnnounce)
+		party.WhiteBox.stateChanged()
 	}
+
+	return true
 }
 
 // Entry point for party messages.
@@ -590,20 +654,36 @@ func (wb *WhiteBox) processParty(env *Envelope) {
 		return
 	}
 
-	jsonData, err := box.EasyOpen(env.Data, min.EncPub, wb.Self.EncPrv)
+	openedData, err := box.EasyOpen(env.Data, min.EncPub, wb.Self.EncPrv)
 	if err != nil {
 		wb.setStatus("error invalid crypto (party)")
 		return
 	}
 
-	partyEnv := new(PartyEnvelope)
-	err = json.Unmarshal(jsonData, partyEnv)
+	if !wb.allowSender(env) {
+		log.Println("rate limited", env.Type, "from", env.From)
+		return
+	}
+
+	if wb.ackEnvelope(env) {
+		return
+	}
+
+	wb.notePeerVersion(env.From, env.Version)
+	wb.offerLostKeys(env.From)
+
+	partyEnv, err := unmarshalPartyEnvelope(openedData)
 	if err != nil {
 		log.Println(err)
-		wb.setStatus("error invalid json (party)")
+		wb.setStatus("error invalid encoding (party)")
 		return
 	}
 
+	wb.dispatchParty(env, partyEnv)
+}
+
+// Hand an opened party message to its party.
+func (wb *WhiteBox) dispatchParty(env *Envelope, partyEnv *PartyEnvelope) {
 	wb.Parties.Mutex.Lock()
 	party, exists := wb.Parties.Map[partyEnv.PartyId]
 	wb.Parties.Mutex.Unlock()
@@ -613,19 +693,24 @@ func (wb *WhiteBox) processParty(env *Envelope) {
 		return
 	}
 
+	// handlers report whether the message was signed, fresh and for this
+	// party, only then does its sender count as a member
+	accepted := false
 	switch partyEnv.Type {
 	case "ad":
-		party.ProcessAdvertisement(partyEnv)
+		accepted = party.ProcessAdvertisement(partyEnv)
 	case "announce":
-		party.ProcessAnnounce(partyEnv)
+		accepted = party.ProcessAnnounce(partyEnv)
 	case "chat":
-		party.ProcessChat(partyEnv)
+		accepted = party.ProcessChat(partyEnv)
 	case "disconnect":
 		party.ProcessDisconnect(partyEnv)
 	case "request":
-		party.ProcessRequest(partyEnv)
+		accepted = party.ProcessRequest(partyEnv)
 	case "fulfillment":
 		party.ProcessFulfillment(partyEnv)
+	case "key":
+		party.ProcessKey(partyEnv)
 	default:
 		wb.setStatus(
 			fmt.Sprintf("unknown message type %s (party)", partyEnv.Type))
@@ -633,8 +718,11 @@ func (wb *WhiteBox) processParty(env *Envelope) {
 
 	// chatStatus(fmt.Sprintf("got %s", partyEnv.Type))
 
-	if env.From == partyEnv.From && partyEnv.Type != "disconnect" {
-		party.MinList.Set(partyEnv.From, 0)
+	// fulfillments can come in over a stream after a disconnect sent over udp,
+	// keys are only taken from members, neither says anything about
+	// membership
+	if accepted && env.From == partyEnv.From {
+		party.addMember(partyEnv.From)
 	}
 }
 
@@ -653,6 +741,37 @@ func (wb *WhiteBox) processInvite(env *Envelope) {
 		return
 	}
 
+	if !wb.allowSender(env) {
+		log.Println("rate limited", env.Type, "from", env.From)
+		return
+	}
+
+	if wb.ackEnvelope(env) {
+		return
+	}
+
+	// peers from before signed headers seal the bare party
+	if len(jsonData) > 0 && jsonData[0] == '{' {
+		if !wb.acceptsLegacy(env.From, env.To) {
+			wb.setStatus("error invite signed without a header")
+			return
+		}
+	} else {
+		signed := jsonData
+		header, body, err := wb.openPayload(
+			signed, min, "invite", env.To, "", "invite")
+		if err != nil {
+			wb.setStatus(err.Error())
+			return
+		}
+
+		if !wb.freshMessage(env.From, signed, header.Time, "invite") {
+			return
+		}
+
+		jsonData = body
+	}
+
 	party := new(PartyLine)
 	err = json.Unmarshal(jsonData, party)
 	if err != nil {
@@ -668,7 +787,10 @@ func (wb *WhiteBox) processInvite(env *Envelope) {
 	}
 
 	party.WhiteBox = wb
-	party.SeenChats = make(map[string]bool)
+	party.SeenChats = NewDedupCache(DEDUP_SIZE, DEDUP_TTL)
+	party.LastChats = make(map[string]time.Time)
+	party.SeenWatermarks = make(map[string]time.Time)
+	party.ChatLock = new(sync.Mutex)
 	party.Packs = make(map[string]LockingPack)
 	party.PacksLock = new(sync.Mutex)
 
@@ -688,6 +810,7 @@ func (wb *WhiteBox) processInvite(env *Envelope) {
 	wb.PendingInvites.Mutex.Lock()
 	wb.PendingInvites.Map[party.Id] = party
 	wb.PendingInvites.Mutex.Unlock()
+	wb.stateChanged()
 
 	party.WhiteBox.setStatus(fmt.Sprintf("invite received for %s", party.Id))
 }
@@ -716,7 +839,9 @@ func (wb *WhiteBox) AcceptInvite(partyId string) {
 
 	wb.Parties.Mutex.Lock()
 	wb.Parties.Map[party.Id] = party
+	wb.resumePendingPacks(party.Id)
 	wb.Parties.Mutex.Unlock()
+	wb.stateChanged()
 
 	party.WhiteBox.setStatus(fmt.Sprintf("accepted invite %s", party.Id))
 }
@@ -774,22 +899,6 @@ func (party *PartyLine) StartPack(packHash string) {
 		return
 	}
 
-	pendingPack := pack.ToPendingPack()
-	jsonPendingPack, err := json.Marshal(pendingPack)
-	if err != nil {
-		log.Println(err)
-		party.WhiteBox.setStatus("error marshalling pending pack to json")
-		return
-	}
-
-	pendingFileName := filepath.Join(partyDirAbs, pack.Name+".pending")
-	err = ioutil.WriteFile(pendingFileName, []byte(jsonPendingPack), 0644)
-	if err != nil {
-		log.Println(err)
-		party.WhiteBox.setStatus("error writing pending pack to file")
-		return
-	}
-
 	pack.SetPaths(partyDirAbs)
 
 	pack.FileLock.Lock()
@@ -800,42 +909,88 @@ func (party *PartyLine) StartPack(packHash string) {
 	}
 	pack.FileLock.Unlock()
 
+	// written after paths and coverage are set so it can be resumed
+	err = party.WhiteBox.writePendingPack(party.Id, pack)
+	if err != nil {
+		party.WhiteBox.setStatus("error " + err.Error())
+		return
+	}
+
 	pack.State = ACTIVE
 }
 
+// Checkpoint a single active download to its .pending file.
+func (party *PartyLine) SavePendingPack(packHash string) {
+	party.PacksLock.Lock()
+	lockingPack, ok := party.Packs[packHash]
+	party.PacksLock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	lockingPack.Mutex.Lock()
+	defer lockingPack.Mutex.Unlock()
+	if lockingPack.Pack.State != ACTIVE {
+		return
+	}
+
+	err := party.WhiteBox.writePendingPack(party.Id, lockingPack.Pack)
+	if err != nil {
+		party.WhiteBox.setStatus("error " + err.Error())
+	}
+}
+
+// Checkpoint all active downloads in the party.
+func (party *PartyLine) SavePendingPacks() {
+	party.PacksLock.Lock()
+	packHashes := make([]string, 0, len(party.Packs))
+	for packHash, _ := range party.Packs {
+		packHashes = append(packHashes, packHash)
+	}
+	party.PacksLock.Unlock()
+
+	for _, packHash := range packHashes {
+		party.SavePendingPack(packHash)
+	}
+}
+
 // Process a file request from another peer.
-func (party *PartyLine) ProcessRequest(partyEnv *PartyEnvelope) {
+func (party *PartyLine) ProcessRequest(partyEnv *PartyEnvelope) bool {
 	signedPartyRequest := partyEnv.Data
-	jsonPartyRequest := signedPartyRequest[sign.SignatureSize:]
+	header, jsonPartyRequest, err :=
+		party.openPayload(partyEnv, "party:request")
+	if err != nil {
+		party.WhiteBox.setStatus(err.Error())
+		return false
+	}
 
 	partyRequest := new(PartyRequest)
-	err := json.Unmarshal(jsonPartyRequest, partyRequest)
+	err = json.Unmarshal(jsonPartyRequest, partyRequest)
 	if err != nil {
 		log.Println(err)
 		party.WhiteBox.setStatus("error invalid json (party:request)")
-		return
+		return false
 	}
 
-	min, err := party.WhiteBox.IdToMin(partyRequest.PeerId)
-	if err != nil {
-		party.WhiteBox.setStatus("error bad id (party:request)")
-		return
-	}
-
-	verified := sign.Verify(signedPartyRequest, min.SignPub)
-	if !verified {
+	if partyRequest.PeerId != header.From {
 		party.WhiteBox.setStatus(
-			"error questionable message integrity (party:request)")
-		return
+			"error peer is not the signer (party:request)")
+		return false
 	}
 
 	if partyRequest.PartyId != party.Id {
 		party.WhiteBox.setStatus("error invalid party id (party:request)")
-		return
+		return false
+	}
+
+	if !party.WhiteBox.freshMessage(
+		header.From, signedPartyRequest, header.Time, "party:request") {
+		return false
 	}
 
 	// check seen hash + time
-	uniqueId := min.Id() + party.Id
+	uniqueId := header.From + party.Id
 	uniqueId += partyRequest.PackHash + partyRequest.FileHash
 	idBytes := []byte(uniqueId)
 	id := sha256Bytes(idBytes)
@@ -844,7 +999,7 @@ func (party *PartyLine) ProcessRequest(partyEnv *PartyEnvelope) {
 		time.Now().UTC().Sub(since.Received) < 5*time.Second) {
 		// request is stale ||
 		// we've seen this peer in the last 5 seconds
-		return
+		return true
 	}
 
 	// forward
@@ -866,18 +1021,20 @@ func (party *PartyLine) ProcessRequest(partyEnv *PartyEnvelope) {
 	pack := lockingPack.Pack
 	if !ok || pack.State == AVAILABLE {
 		// we don't have the pack
-		return
+		return true
 	}
 
 	if pack.GetFileInfo(partyRequest.FileHash) == nil {
 		// we don't have the file
-		return
+		return true
 	}
 
 	// reuse the time field as expiry, set for 6 seconds
 	partyRequest.Time = now.Add(6 * time.Second)
 
 	party.WhiteBox.RequestChan <- partyRequest
+
+	return true
 }
 
 // Request a file from the party.
@@ -898,8 +1055,11 @@ func (party *PartyLine) SendRequest(packHash string, file *PackFileInfo) {
 		return
 	}
 
-	signedPartyRequest := sign.Sign(
-		[]byte(jsonPartyRequest), party.WhiteBox.Self.SignPrv)
+	signedPartyRequest, err := party.signPayload("request", jsonPartyRequest)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
 	party.sendToNeighbors("request", signedPartyRequest)
 }
@@ -919,17 +1079,13 @@ func (party *PartyLine) SendRequests(packHash string, pack *Pack) {
 
 	if complete {
 		pack.State = COMPLETE
+		party.WhiteBox.removePendingPack(party.Id, pack)
 		log.Println("(dbg) pack complete")
 	}
 }
 
 // Send a fulfillment for a request.
 func (party *PartyLine) SendFulfillment(request *PartyRequest, block *Block) {
-	env := Envelope{
-		Type: "party",
-		From: party.WhiteBox.PeerSelf.Id(),
-		To:   request.PeerId}
-
 	partyEnv := PartyEnvelope{
 		Type:    "fulfillment",
 		From:    party.WhiteBox.PeerSelf.Id(),
@@ -942,73 +1098,68 @@ func (party *PartyLine) SendFulfillment(request *PartyRequest, block *Block) {
 		PartyId:  party.Id,
 		Block:    *block}
 
-	jsonPartyFulfillment, err := json.Marshal(partyFulfillment)
+	// blocks are most of our traffic, send them binary when we can
+	binary := party.WhiteBox.peerDecodesBinary(request.PeerId)
+	encodedPartyFulfillment, err := marshalPartyFulfillment(
+		&partyFulfillment, binary)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	signedPartyFulfillment :=
-		sign.Sign([]byte(jsonPartyFulfillment), party.WhiteBox.Self.SignPrv)
-
-	partyEnv.Data = signedPartyFulfillment
-
-	jsonPartyEnv, err := json.Marshal(partyEnv)
+	signedPartyFulfillment, err := party.WhiteBox.signPayload(
+		"fulfillment", request.PeerId, party.Id, encodedPartyFulfillment)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	min, err := party.WhiteBox.IdToMin(request.PeerId)
+	partyEnv.Data = signedPartyFulfillment
+
+	env, err := party.sealFor(
+		request.PeerId, &partyEnv, make(map[string][]byte))
 	if err != nil {
 		party.WhiteBox.setStatus(err.Error())
 		return
 	}
 
-	closed := box.EasySeal(
-		[]byte(jsonPartyEnv), min.EncPub, party.WhiteBox.Self.EncPrv)
-	env.Data = closed
-
-	jsonEnv, err := json.Marshal(env)
-	if err == nil {
-		log.Printf("Size of fulfillment: %d", len(jsonEnv)+1)
-	}
+	log.Printf("Size of fulfillment: %d (binary %t, %s)",
+		len(env.Data), binary, env.Type)
 
-	log.Println(string(jsonEnv))
-
-	party.WhiteBox.route(&env)
+	party.WhiteBox.routeBulk(env, "fulfillment")
 }
 
 // Process a fulfillment for a block.
-func (party *PartyLine) ProcessFulfillment(partyEnv *PartyEnvelope) {
+func (party *PartyLine) ProcessFulfillment(partyEnv *PartyEnvelope) bool {
 	log.Println("(dbg) got fulfillment")
-	signedPartyFulfillment := partyEnv.Data
-	jsonPartyFulfillment := signedPartyFulfillment[sign.SignatureSize:]
-
-	partyFulfillment := new(PartyFulfillment)
-	err := json.Unmarshal(jsonPartyFulfillment, partyFulfillment)
+	header, encodedPartyFulfillment, err :=
+		party.openPayload(partyEnv, "party:fulfillment")
 	if err != nil {
-		log.Println(err)
-		party.WhiteBox.setStatus("error invalid json (party:fulfillment)")
-		return
+		party.WhiteBox.setStatus(err.Error())
+		return false
 	}
 
-	min, err := party.WhiteBox.IdToMin(partyFulfillment.PeerId)
+	partyFulfillment, err := unmarshalPartyFulfillment(encodedPartyFulfillment)
 	if err != nil {
-		party.WhiteBox.setStatus("error bad id (party:fulfillment)")
-		return
+		log.Println(err)
+		party.WhiteBox.setStatus("error invalid encoding (party:fulfillment)")
+		return false
 	}
 
-	verified := sign.Verify(signedPartyFulfillment, min.SignPub)
-	if !verified {
+	if partyFulfillment.PeerId != header.From {
 		party.WhiteBox.setStatus(
-			"error questionable message integrity (party:fulfillment)")
-		return
+			"error peer is not the signer (party:fulfillment)")
+		return false
 	}
 
 	if partyFulfillment.PartyId != party.Id {
 		// wrong party ??!?
-		return
+		return false
+	}
+
+	if !party.WhiteBox.freshBulkMessage(header.From, partyEnv.Data,
+		header.Time, "party:fulfillment") {
+		return false
 	}
 
 	party.PacksLock.Lock()
@@ -1020,14 +1171,14 @@ func (party *PartyLine) ProcessFulfillment(partyEnv *PartyEnvelope) {
 	if !ok || pack.State != ACTIVE {
 		// we aren't downloading the pack
 		lockingPack.Mutex.Unlock()
-		return
+		return true
 	}
 
 	packFileInfo := pack.GetFileInfo(partyFulfillment.FileHash)
 	lockingPack.Mutex.Unlock()
 	if packFileInfo == nil {
 		// we don't have the file
-		return
+		return true
 	}
 
 	block := partyFulfillment.Block
@@ -1035,7 +1186,7 @@ func (party *PartyLine) ProcessFulfillment(partyEnv *PartyEnvelope) {
 	dataHash := sha256Bytes(block.Data)
 	if dataHash != block.DataHash {
 		// invalid data hash
-		return
+		return false
 	}
 
 	blockHash := sha256Block(&block)
@@ -1043,49 +1194,27 @@ func (party *PartyLine) ProcessFulfillment(partyEnv *PartyEnvelope) {
 	// verify block hash
 	if block.Index == 0 {
 		if blockHash != packFileInfo.FirstBlockHash {
-			return
+			return false
 		}
 	} else {
-		checkBlockHash := ""
-
-		prevIndex := block.Index - 1
-		prevBlockHash, ok := packFileInfo.BlockLookup[prevIndex]
-		if ok {
-			prevParentBlock, ok := packFileInfo.BlockMap[prevBlockHash]
-			if ok {
-				checkBlockHash = prevParentBlock.NextBlockHash
-			}
-		}
-
-		treeIndex := treeParent(block.Index)
-		treeBlockHash, ok := packFileInfo.BlockLookup[treeIndex]
-		if ok {
-			treeParentBlock, ok := packFileInfo.BlockMap[treeBlockHash]
-			if ok {
-				childBlockHash := ""
-				if block.Index%2 == 1 {
-					childBlockHash = treeParentBlock.LeftBlockHash
-				} else {
-					childBlockHash = treeParentBlock.RightBlockHash
-				}
-
-				if checkBlockHash != "" && checkBlockHash != childBlockHash {
-					// disagreement between prev and tree parents
-					return
-				}
+		// the writer fills in the parents as their blocks land
+		lockingPack.Mutex.Lock()
+		checkBlockHash, agree := parentBlockHash(packFileInfo, block.Index)
+		lockingPack.Mutex.Unlock()
 
-				checkBlockHash = childBlockHash
-			}
+		if !agree {
+			// disagreement between prev and tree parents
+			return false
 		}
 
 		if checkBlockHash == "" {
 			// cannot verify
-			return
+			return true
 		}
 
 		if checkBlockHash != blockHash {
 			// invalid block hash
-			return
+			return false
 		}
 	} // verified
 
@@ -1097,8 +1226,12 @@ func (party *PartyLine) ProcessFulfillment(partyEnv *PartyEnvelope) {
 		log.Println("(dbg) block lookup nil")
 	}
 	verifiedBlock.Hash = blockHash
+	verifiedBlock.Party = party
+	verifiedBlock.PackHash = partyFulfillment.PackHash
 
 	party.WhiteBox.VerifiedBlockChan <- verifiedBlock
+
+	return true
 }
 
 // Randomly select a block from the blocks that a peer needs.
@@ -1232,7 +1365,7 @@ func (wb *WhiteBox) FileRequester() {
 			party.PacksLock.Unlock()
 		}
 		wb.Parties.Mutex.Unlock()
-		time.Sleep(5 * time.Second)
+		time.Sleep(wb.Config.FileRequestInterval)
 	}
 }
 
@@ -1285,10 +1418,48 @@ func (wb *WhiteBox) RequestSender() {
 
 		// we sleep a little to let other stuff get the party lock
 		// 10kb * 500/s = 5MB/s
-		time.Sleep(2 * time.Millisecond)
+		time.Sleep(wb.Config.RequestThrottle)
 	}
 }
 
+// Hash the block at index should have, from the written blocks before it and
+// above it in the tree, empty when neither is written. false when they
+// disagree. Callers hold the pack's lock.
+func parentBlockHash(packFileInfo *PackFileInfo, index uint64) (string, bool) {
+	checkBlockHash := ""
+
+	prevIndex := index - 1
+	prevBlockHash, ok := packFileInfo.BlockLookup[prevIndex]
+	if ok {
+		prevParentBlock, ok := packFileInfo.BlockMap[prevBlockHash]
+		if ok {
+			checkBlockHash = prevParentBlock.NextBlockHash
+		}
+	}
+
+	treeIndex := treeParent(index)
+	treeBlockHash, ok := packFileInfo.BlockLookup[treeIndex]
+	if ok {
+		treeParentBlock, ok := packFileInfo.BlockMap[treeBlockHash]
+		if ok {
+			childBlockHash := ""
+			if index%2 == 1 {
+				childBlockHash = treeParentBlock.LeftBlockHash
+			} else {
+				childBlockHash = treeParentBlock.RightBlockHash
+			}
+
+			if checkBlockHash != "" && checkBlockHash != childBlockHash {
+				return "", false
+			}
+
+			checkBlockHash = childBlockHash
+		}
+	}
+
+	return checkBlockHash, true
+}
+
 // Check if a coverage has a specific block index.
 func haveBlock(verifiedBlock *VerifiedBlock) bool {
 	block := verifiedBlock.Block
@@ -1316,55 +1487,112 @@ func setBlockWritten(verifiedBlock *VerifiedBlock) {
 	packFileInfo.BlockLookup[block.Index] = verifiedBlock.Hash
 }
 
-// Write verified blocks to disk.
+// Write verified blocks to disk, checkpointing progress periodically.
 func (wb *WhiteBox) VerifiedBlockWriter() {
-	for {
-		verifiedBlock := <-wb.VerifiedBlockChan
+	dirtyPacks := make(map[*PartyLine]map[string]bool)
+	checkpoint := time.NewTicker(wb.Config.PendingCheckpointInterval)
+	defer checkpoint.Stop()
 
-		if haveBlock(verifiedBlock) {
-			log.Println("(dbg) have block skipping")
-			continue
-		}
+	for {
+		select {
+		case verifiedBlock := <-wb.VerifiedBlockChan:
+			if !wb.writeVerifiedBlock(verifiedBlock) {
+				continue
+			}
 
-		mode := os.O_RDWR | os.O_CREATE
-		f, err := os.OpenFile(verifiedBlock.PackFileInfo.Path, mode, 0755)
-		if err != nil {
-			log.Println(err)
-			wb.setStatus("error opening file for block")
-			continue
-		}
+			party := verifiedBlock.Party
+			if party == nil {
+				continue
+			}
 
-		// seek block
-		offset := BUFFER_SIZE * verifiedBlock.Block.Index
-		pos, err := f.Seek(int64(offset), os.SEEK_SET)
-		if err != nil || pos != int64(offset) {
-			if err != nil {
-				log.Println(err)
+			if dirtyPacks[party] == nil {
+				dirtyPacks[party] = make(map[string]bool)
 			}
-			wb.setStatus("error seeking in file for block")
-			continue
+			dirtyPacks[party][verifiedBlock.PackHash] = true
+		case <-checkpoint.C:
+			for party, packHashes := range dirtyPacks {
+				for packHash, _ := range packHashes {
+					party.SavePendingPack(packHash)
+				}
+			}
+			dirtyPacks = make(map[*PartyLine]map[string]bool)
 		}
+	}
+}
 
-		// write block
-		count, err := f.Write(verifiedBlock.Block.Data)
-		if err != nil || count != len(verifiedBlock.Block.Data) {
-			if err != nil {
-				log.Println(err)
-			}
-			wb.setStatus("error writing to file for block")
-			continue
+// Lock of the pack a verified block is for. Coverage and the block maps are
+// only written here, but checkpoints and fulfillments read them elsewhere.
+func (verifiedBlock *VerifiedBlock) packMutex() *sync.Mutex {
+	party := verifiedBlock.Party
+	if party == nil {
+		return new(sync.Mutex)
+	}
+
+	party.PacksLock.Lock()
+	lockingPack, ok := party.Packs[verifiedBlock.PackHash]
+	party.PacksLock.Unlock()
+
+	if !ok || lockingPack.Mutex == nil {
+		return new(sync.Mutex)
+	}
+
+	return lockingPack.Mutex
+}
+
+// Write a single verified block to disk, returns true if it was written.
+func (wb *WhiteBox) writeVerifiedBlock(verifiedBlock *VerifiedBlock) bool {
+	mutex := verifiedBlock.packMutex()
+	mutex.Lock()
+	have := haveBlock(verifiedBlock)
+	mutex.Unlock()
+
+	if have {
+		log.Println("(dbg) have block skipping")
+		return false
+	}
+
+	mode := os.O_RDWR | os.O_CREATE
+	f, err := os.OpenFile(verifiedBlock.PackFileInfo.Path, mode, 0755)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error opening file for block")
+		return false
+	}
+
+	// seek block
+	offset := BUFFER_SIZE * verifiedBlock.Block.Index
+	pos, err := f.Seek(int64(offset), os.SEEK_SET)
+	if err != nil || pos != int64(offset) {
+		if err != nil {
+			log.Println(err)
 		}
+		wb.setStatus("error seeking in file for block")
+		return false
+	}
 
-		err = f.Close()
+	// write block
+	count, err := f.Write(verifiedBlock.Block.Data)
+	if err != nil || count != len(verifiedBlock.Block.Data) {
 		if err != nil {
 			log.Println(err)
-			wb.setStatus("error closing file for block")
-			continue
 		}
+		wb.setStatus("error writing to file for block")
+		return false
+	}
 
-		setBlockWritten(verifiedBlock)
-		log.Printf("(dbg) wrote block %d\n", verifiedBlock.Block.Index)
+	err = f.Close()
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error closing file for block")
+		return false
 	}
+
+	mutex.Lock()
+	setBlockWritten(verifiedBlock)
+	mutex.Unlock()
+
+	log.Printf("(dbg) wrote block %d\n", verifiedBlock.Block.Index)
+	return true
 }
 
 // Write a dummy file to disk.
@@ -1430,8 +1658,14 @@ func (wb *WhiteBox) advertiseAll() {
 	wb.Parties.Mutex.Unlock()
 }
 
-// Disconnect from all parties (application exit).
+// Disconnect from all parties (application exit). Parties are saved first
+// and rejoined on the next start.
 func (wb *WhiteBox) DisconnectParties() {
+	wb.SaveState()
+	wb.State.Mutex.Lock()
+	wb.State.Frozen = true
+	wb.State.Mutex.Unlock()
+
 	wb.Parties.Mutex.Lock()
 	for _, party := range wb.Parties.Map {
 		party.SendDisconnect()
@@ -1468,7 +1702,10 @@ func (wb *WhiteBox) PartyStart(name string) string {
 
 	party.MinList.Map = make(map[string]int)
 	party.MinList.Mutex = new(sync.Mutex)
-	party.SeenChats = make(map[string]bool)
+	party.SeenChats = NewDedupCache(DEDUP_SIZE, DEDUP_TTL)
+	party.LastChats = make(map[string]time.Time)
+	party.SeenWatermarks = make(map[string]time.Time)
+	party.ChatLock = new(sync.Mutex)
 	party.Packs = make(map[string]LockingPack)
 	party.PacksLock = new(sync.Mutex)
 	party.WhiteBox = wb
@@ -1478,6 +1715,7 @@ func (wb *WhiteBox) PartyStart(name string) string {
 	wb.Parties.Mutex.Lock()
 	wb.Parties.Map[party.Id] = party
 	wb.Parties.Mutex.Unlock()
+	wb.stateChanged()
 
 	return party.Id
 }
@@ -1486,6 +1724,6 @@ func (wb *WhiteBox) PartyStart(name string) string {
 func (wb *WhiteBox) Advertise() {
 	for {
 		wb.advertiseAll()
-		time.Sleep(60 * time.Second)
+		time.Sleep(wb.Config.AdvertiseInterval)
 	}
 }
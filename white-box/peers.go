@@ -0,0 +1,225 @@
+package whitebox
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Most peers kept on disk, least recently seen are dropped first.
+const MAX_SAVED_PEERS = 64
+
+// Known peers bootstrapped at once before waiting for a verify.
+const BOOTSTRAP_BATCH = 4
+
+// A seed node given as ip/port/hexid, the same format /bs takes.
+type BootstrapNode struct {
+	Address string
+	Id      string
+}
+
+func ParseBootstrap(info string) (BootstrapNode, error) {
+	var node BootstrapNode
+	toks := strings.Split(strings.TrimSpace(info), "/")
+	if len(toks) != 3 {
+		return node, errors.New("error bootstrap info is not ip/port/id")
+	}
+
+	if toks[0] == "" {
+		return node, errors.New("error invalid ip in bootstrap info")
+	}
+
+	port, err := strconv.ParseUint(toks[1], 10, 16)
+	if err != nil || port == 0 {
+		return node, errors.New("error invalid port in bootstrap info")
+	}
+
+	idBytes, err := hex.DecodeString(toks[2])
+	if err != nil || len(idBytes) != 32 {
+		return node, errors.New("error invalid id in bootstrap info")
+	}
+
+	node.Address = net.JoinHostPort(toks[0], toks[1])
+	node.Id = toks[2]
+	return node, nil
+}
+
+func (wb *WhiteBox) isSelf(node BootstrapNode) bool {
+	return node.Id == wb.PeerSelf.ShortId() ||
+		node.Address == wb.PeerSelf.Address
+}
+
+// Disk format for a peer table entry.
+type SavedPeer struct {
+	Peer Peer
+	Seen time.Time
+}
+
+func (wb *WhiteBox) peersPath() string {
+	return filepath.Join(
+		wb.SharedDir, "state", wb.PeerSelf.ShortId()+".peers")
+}
+
+// Read saved peers, most recently seen first.
+func (wb *WhiteBox) loadPeers() []SavedPeer {
+	peers := make([]SavedPeer, 0)
+	contents, err := ioutil.ReadFile(wb.peersPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+			wb.setStatus("error could not read known peers")
+		}
+		return peers
+	}
+
+	err = json.Unmarshal(contents, &peers)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not unmarshal known peers")
+		return make([]SavedPeer, 0)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Seen.After(peers[j].Seen)
+	})
+
+	return peers
+}
+
+// Merge the peer table into the known peers on disk.
+func (wb *WhiteBox) SavePeers() {
+	known := make(map[string]SavedPeer)
+	for _, saved := range wb.loadPeers() {
+		known[saved.Peer.Id()] = saved
+	}
+
+	selfId := wb.PeerSelf.Id()
+	wb.PeerTable.Mutex.Lock()
+	for i := 0; i < BUCKET_COUNT; i++ {
+		for _, entry := range wb.PeerTable.Buckets[i].Entries {
+			if entry.Peer == nil || entry.Peer.Id() == selfId {
+				continue
+			}
+
+			saved, ok := known[entry.Peer.Id()]
+			if ok && saved.Seen.After(entry.Seen) {
+				continue
+			}
+
+			saved.Peer = *entry.Peer
+			saved.Peer.Conn = nil
+			saved.Seen = entry.Seen.UTC()
+			known[entry.Peer.Id()] = saved
+		}
+	}
+	wb.PeerTable.Mutex.Unlock()
+
+	if len(known) == 0 {
+		return
+	}
+
+	peers := make([]SavedPeer, 0, len(known))
+	for _, saved := range known {
+		peers = append(peers, saved)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Seen.After(peers[j].Seen)
+	})
+
+	if len(peers) > MAX_SAVED_PEERS {
+		peers = peers[:MAX_SAVED_PEERS]
+	}
+
+	jsonPeers, err := json.Marshal(peers)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not marshal known peers")
+		return
+	}
+
+	path := wb.peersPath()
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not create state dir")
+		return
+	}
+
+	err = writeFileAtomic(path, jsonPeers, 0600)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not write known peers")
+	}
+}
+
+// Flag that a verifybs came in without blocking the receiver.
+func (wb *WhiteBox) bootstrapVerified() {
+	select {
+	case wb.BootstrapChan <- true:
+	default:
+	}
+}
+
+func (wb *WhiteBox) waitVerify(timeout time.Duration) bool {
+	select {
+	case <-wb.BootstrapChan:
+		return true
+	case <-time.After(timeout):
+		return wb.havePeers()
+	}
+}
+
+// Bootstrap from the most recently seen known peers a batch at a time until
+// one verifies, then try each seed node in order.
+func (wb *WhiteBox) Bootstrap(nodes []BootstrapNode) {
+	peers := wb.loadPeers()
+	for i := 0; i < len(peers); i += BOOTSTRAP_BATCH {
+		if wb.havePeers() {
+			return
+		}
+
+		end := i + BOOTSTRAP_BATCH
+		if end > len(peers) {
+			end = len(peers)
+		}
+
+		for _, saved := range peers[i:end] {
+			wb.SendBootstrap(saved.Peer.Address, saved.Peer.Id())
+		}
+
+		if wb.waitVerify(wb.Config.BootstrapWait) {
+			return
+		}
+	}
+
+	tried := false
+	for _, node := range nodes {
+		if wb.havePeers() {
+			return
+		}
+
+		if wb.isSelf(node) {
+			continue
+		}
+
+		tried = true
+		wb.SendBootstrap(node.Address, node.Id)
+		if wb.waitVerify(wb.Config.BootstrapWait) {
+			return
+		}
+	}
+
+	if !wb.havePeers() && (tried || len(peers) > 0) {
+		wb.chatStatus("no bootstrap node answered, bootstrap some new ones")
+	}
+}
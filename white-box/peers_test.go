@@ -0,0 +1,85 @@
+package whitebox
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPeersRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.peers")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+
+	var otherSelf Self
+	other := New(dir, "127.0.0.1", "3500", otherSelf, DefaultConfig())
+	peer := other.PeerSelf
+	wb.addPeer(&peer, time.Now().UTC())
+
+	wb.SavePeers()
+
+	peers := wb.loadPeers()
+	if len(peers) != 1 {
+		t.Fatalf("Unexpected number of saved peers: %d", len(peers))
+	}
+
+	if peers[0].Peer.Id() != peer.Id() {
+		t.Errorf("Saved peer does not match:")
+		t.Errorf("Got: %s", peers[0].Peer.Id())
+		t.Errorf("Expecting: %s", peer.Id())
+	}
+
+	if peers[0].Peer.Address != peer.Address {
+		t.Errorf("Saved address does not match:")
+		t.Errorf("Got: %s", peers[0].Peer.Address)
+		t.Errorf("Expecting: %s", peer.Address)
+	}
+
+	// peers gone from the table are still remembered
+	wb.removePeer(peer.ShortId())
+	wb.SavePeers()
+
+	peers = wb.loadPeers()
+	if len(peers) != 1 {
+		t.Errorf("Known peer dropped after leaving the table.")
+	}
+}
+
+func TestParseBootstrap(t *testing.T) {
+	id := "3ce244e4426fd2cb1c41c5954c879ce0a3c19bf1452fb66be84de03825bc6f30"
+	tables := []struct {
+		in   string
+		addr string
+		ok   bool
+	}{
+		{"138.197.201.244/3499/" + id, "138.197.201.244:3499", true},
+		{"::1/3499/" + id, "[::1]:3499", true},
+		{"seed.example.com/3499/" + id, "seed.example.com:3499", true},
+		{"138.197.201.244:3499/" + id, "", false},
+		{"138.197.201.244/port/" + id, "", false},
+		{"138.197.201.244/3499/" + id[:62], "", false},
+		{"/3499/" + id, "", false},
+	}
+
+	for _, table := range tables {
+		node, err := ParseBootstrap(table.in)
+		if (err == nil) != table.ok {
+			t.Errorf("Unexpected result for ParseBootstrap(%s):", table.in)
+			t.Errorf("Got: %v", err)
+			t.Errorf("Expecting ok: %v", table.ok)
+			continue
+		}
+
+		if table.ok && node.Address != table.addr {
+			t.Errorf("Address does not match for ParseBootstrap(%s):", table.in)
+			t.Errorf("Got: %s", node.Address)
+			t.Errorf("Expecting: %s", table.addr)
+		}
+	}
+}
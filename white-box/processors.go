@@ -6,35 +6,47 @@ import (
 	"fmt"
 	"github.com/kevinburke/nacl/sign"
 	"log"
-	"net"
 	"time"
 )
 
-func (wb *WhiteBox) processMessage(strMsg string) {
-	env := new(Envelope)
-	err := json.Unmarshal([]byte(strMsg), env)
+func (wb *WhiteBox) processMessage(source string, version int, payload []byte) {
+	env, err := unmarshalEnvelope(payload, version)
 	if err != nil {
 		log.Println(err)
-		log.Println(strMsg)
-		wb.setStatus("invalid json message received")
+		wb.setStatus("invalid message received")
 		return
 	}
 
-	if !env.Time.IsZero() && env.To != wb.PeerSelf.Id() {
-		_, seen := wb.NoReroute[env.Time]
-		if !seen {
+	// before signatures are checked or anything is forwarded
+	if !wb.allowEnvelope(source, env) {
+		log.Println("rate limited", env.Type, "from", source)
+		return
+	}
+
+	// routed envelopes have a time, forward the ones for someone else once
+	// and drop extra copies of ours. Check before they go in the dedup cache
+	// so junk can't push real envelopes out of it.
+	if !env.Time.IsZero() {
+		if env.To != wb.PeerSelf.Id() && !wb.forwardable(env) {
+			log.Println("not forwarding", env.Type, "from", env.From)
 			return
 		}
 
-		wb.NoReroute[env.Time] = true
+		if wb.Routed.Seen(routeId(env)) {
+			return
+		}
 
-		wb.route(env)
-		return
+		if env.To != wb.PeerSelf.Id() {
+			wb.forward(env)
+			return
+		}
 	}
 
 	log.Println("got ", env.Type)
 
 	switch env.Type {
+	case "ack":
+		wb.processAck(env)
 	case "announce":
 		wb.processAnnounce(env)
 	case "bootstrap":
@@ -47,6 +59,10 @@ func (wb *WhiteBox) processMessage(strMsg string) {
 		wb.processSuggestionRequest(env)
 	case "suggestions":
 		wb.processSuggestions(env)
+	case "findnode":
+		wb.processFindNode(env)
+	case "nodes":
+		wb.processNodes(env)
 	case "ping":
 		wb.processPing(env)
 	case "pulse":
@@ -55,44 +71,165 @@ func (wb *WhiteBox) processMessage(strMsg string) {
 		wb.processVerify(env)
 	case "party":
 		wb.processParty(env)
+	case "group":
+		wb.processGroup(env)
 	case "invite":
 		wb.processInvite(env)
 	default:
+		// newer peers may send types we don't know yet
+		protocol, _, known := wb.PeerProtocol(env.From)
+		if known && protocol > PROTOCOL_VERSION {
+			log.Println("ignoring", env.Type, "from newer peer", env.From)
+			return
+		}
+
 		wb.chatStatus("unknown msg type: " + env.Type) // TODO: chat status
 	}
 
 	// chatStatus(fmt.Sprintf("got %s", env.Type))
 }
 
-// TODO: lib candidate
-func (wb *WhiteBox) verifyEnvelope(env *Envelope, caller string) ([]byte, error) {
+// Check an envelope's data is signed by its sender for it, within the
+// sender's rate and fresh, see openPayload, allowSender and freshMessage.
+// Failures are reported here. Returns the json under the signed header.
+func (wb *WhiteBox) verifyEnvelope(env *Envelope, caller string) ([]byte, bool) {
+	header, jsonData, err := wb.openEnvelope(env, caller)
+	if err != nil {
+		wb.setStatus(err.Error())
+		return nil, false
+	}
+
+	if !wb.allowSender(env) {
+		log.Println("rate limited", env.Type, "from", env.From)
+		return nil, false
+	}
+
+	if !wb.freshMessage(env.From, env.Data, header.Time, caller) {
+		return nil, false
+	}
+
+	wb.noteSender(env)
+
+	log.Println("json", string(jsonData))
+	return jsonData, true
+}
+
+// Check an envelope's data is signed by its sender for it, without asking if
+// it's fresh.
+func (wb *WhiteBox) openEnvelope(
+	env *Envelope, caller string) (*SignedHeader, []byte, error) {
 	min, err := wb.IdToMin(env.From)
 	if err != nil {
 		log.Println(err)
-		return nil, errors.New(fmt.Sprintf("error bad id (%s:from)", caller))
+		return nil, nil, errors.New(
+			fmt.Sprintf("error bad id (%s:from)", caller))
 	}
 
-	data := env.Data
-	verified := sign.Verify(data, min.SignPub)
-	if !verified {
-		return nil, errors.New(
-			fmt.Sprintf("questionable message integrity discarding (%s)", caller))
+	return wb.openPayload(env.Data, min, env.Type, env.To, "", caller)
+}
+
+// A signed and fresh envelope says what its sender can decode and that it's
+// around to take keys it missed. Stale or replayed ones say neither.
+func (wb *WhiteBox) noteSender(env *Envelope) {
+	wb.notePeerVersion(env.From, env.Version)
+	wb.offerLostKeys(env.From)
+}
+
+// Whether a message was sent within Config.MessageWindow of now.
+func (wb *WhiteBox) recentMessage(sent time.Time, caller string) bool {
+	window := wb.Config.MessageWindow
+	age := time.Since(sent)
+	if age > window || age < -window {
+		wb.setStatus(fmt.Sprintf("error stale message (%s)", caller))
+		return false
 	}
 
-	jsonData := data[sign.SignatureSize:]
-	log.Println("json", string(jsonData))
-	return jsonData, nil
+	return true
 }
 
-func (wb *WhiteBox) processChat(env *Envelope) {
-	jsonData, err := wb.verifyEnvelope(env, "chat")
+// Whether a signed message is recent and new. Anything sent further than
+// Config.MessageWindow from now is stale, and a signature already seen from
+// the sender inside the window is a replay. Floods bring copies of the same
+// message in through every neighbour, so replays are only logged.
+func (wb *WhiteBox) freshMessage(
+	from string, signed []byte, sent time.Time, caller string) bool {
+	if !wb.recentMessage(sent, caller) || len(signed) < sign.SignatureSize {
+		return false
+	}
+
+	// signatures stay until they're out of the window, a sender over
+	// REPLAY_SIZE in that time is dropped rather than forgotten early
+	err := wb.replayCache(from).Add(string(signed[:sign.SignatureSize]))
+	if err == errDedupSeen {
+		log.Println("dropping replayed message", caller, "from", from)
+		return false
+	}
+
 	if err != nil {
-		wb.setStatus(err.Error())
+		log.Println("dropping message over replay limit", caller, "from", from)
+		return false
+	}
+
+	return true
+}
+
+// Whether a block sent in a pack transfer is recent and new, see
+// freshMessage. Transfers send far more than REPLAY_SIZE blocks in a window
+// and a block we already have is dropped anyway, so their signatures are kept
+// apart and the oldest forgotten instead of turning new blocks away.
+func (wb *WhiteBox) freshBulkMessage(
+	from string, signed []byte, sent time.Time, caller string) bool {
+	if !wb.recentMessage(sent, caller) || len(signed) < sign.SignatureSize {
+		return false
+	}
+
+	cache := wb.replayCache(from + "/bulk")
+	if cache.Seen(string(signed[:sign.SignatureSize])) {
+		log.Println("dropping replayed message", caller, "from", from)
+		return false
+	}
+
+	return true
+}
+
+// Signatures seen from a sender, a message stays fresh for a window either
+// side of its time.
+func (wb *WhiteBox) replayCache(key string) *DedupCache {
+	wb.Replays.Mutex.Lock()
+	defer wb.Replays.Mutex.Unlock()
+
+	wb.sweepReplays()
+	cache, exists := wb.Replays.Map[key]
+	if !exists {
+		cache = NewDedupCache(REPLAY_SIZE, 2*wb.Config.MessageWindow)
+		wb.Replays.Map[key] = cache
+	}
+
+	return cache
+}
+
+// Forget senders with nothing left to remember. Caller holds the replay lock.
+func (wb *WhiteBox) sweepReplays() {
+	if time.Since(wb.Replays.Swept) < REPLAY_SWEEP_INTERVAL {
+		return
+	}
+	wb.Replays.Swept = time.Now()
+
+	for from, cache := range wb.Replays.Map {
+		if cache.Expire() == 0 {
+			delete(wb.Replays.Map, from)
+		}
+	}
+}
+
+func (wb *WhiteBox) processChat(env *Envelope) {
+	jsonData, ok := wb.verifyEnvelope(env, "chat")
+	if !ok {
 		return
 	}
 
 	var msgChat MessageChat
-	err = json.Unmarshal(jsonData, &msgChat)
+	err := json.Unmarshal(jsonData, &msgChat)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("error invalid json (chat)")
@@ -105,8 +242,7 @@ func (wb *WhiteBox) processChat(env *Envelope) {
 	}
 
 	uniqueId := env.From + "." + msgChat.Time.String()
-	_, seen := wb.SeenChats[uniqueId]
-	if !seen {
+	if !wb.SeenChats.Seen(uniqueId) {
 		chat := Chat{
 			Time:    time.Now(),
 			Id:      env.From,
@@ -115,21 +251,19 @@ func (wb *WhiteBox) processChat(env *Envelope) {
 
 		wb.addChat(chat)
 		wb.flood(env)
-		wb.SeenChats[uniqueId] = true
 	}
 
 	wb.cacheMin(msgChat.Min)
 }
 
 func (wb *WhiteBox) processBootstrap(env *Envelope) {
-	jsonData, err := wb.verifyEnvelope(env, "bs")
-	if err != nil {
-		wb.setStatus(err.Error())
+	jsonData, ok := wb.verifyEnvelope(env, "bs")
+	if !ok {
 		return
 	}
 
 	timePeer := new(MessageTimePeer)
-	err = json.Unmarshal(jsonData, timePeer)
+	err := json.Unmarshal(jsonData, timePeer)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("error invalid json (bs)")
@@ -144,7 +278,9 @@ func (wb *WhiteBox) processBootstrap(env *Envelope) {
 		return
 	}
 
-	peerConn, err := net.Dial("udp", peer.Address)
+	wb.recordProtocol(peer.Id(), timePeer)
+
+	peerConn, err := DialUDP(peer.Address)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("could not connect to peer (bs)")
@@ -163,14 +299,13 @@ func (wb *WhiteBox) processBootstrap(env *Envelope) {
 }
 
 func (wb *WhiteBox) processVerify(env *Envelope) {
-	jsonData, err := wb.verifyEnvelope(env, "bsverify")
-	if err != nil {
-		wb.setStatus(err.Error())
+	jsonData, ok := wb.verifyEnvelope(env, "bsverify")
+	if !ok {
 		return
 	}
 
 	timePeer := new(MessageTimePeer)
-	err = json.Unmarshal(jsonData, timePeer)
+	err := json.Unmarshal(jsonData, timePeer)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("error invalid json (bsverify)")
@@ -185,7 +320,9 @@ func (wb *WhiteBox) processVerify(env *Envelope) {
 		return
 	}
 
-	peerConn, err := net.Dial("udp", peer.Address)
+	wb.recordProtocol(peer.Id(), timePeer)
+
+	peerConn, err := DialUDP(peer.Address)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("could not connect to peer (bsverify)")
@@ -201,19 +338,20 @@ func (wb *WhiteBox) processVerify(env *Envelope) {
 	}
 
 	wb.setStatus("verified")
+	wb.bootstrapVerified()
 	wb.sendAnnounce(peer)
 	wb.sendSuggestionRequest(peer)
+	go wb.fillBuckets()
 }
 
 func (wb *WhiteBox) processAnnounce(env *Envelope) {
-	jsonData, err := wb.verifyEnvelope(env, "announce")
-	if err != nil {
-		wb.setStatus(err.Error())
+	jsonData, ok := wb.verifyEnvelope(env, "announce")
+	if !ok {
 		return
 	}
 
 	announce := new(MessageTimePeer)
-	err = json.Unmarshal(jsonData, announce)
+	err := json.Unmarshal(jsonData, announce)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("error invalid json (announce)")
@@ -227,10 +365,17 @@ func (wb *WhiteBox) processAnnounce(env *Envelope) {
 		return
 	}
 
+	if env.From != peer.Id() {
+		wb.setStatus("id does not match from (announce)")
+		return
+	}
+
+	wb.recordProtocol(peer.Id(), announce)
+
 	cache, seen := wb.PeerCache.Get(peer.Id())
 	reconnecting := cache.Disconnected && announce.Time.After(cache.Time)
 	if !seen || !cache.Added || reconnecting {
-		peerConn, err := net.Dial("udp", peer.Address)
+		peerConn, err := DialUDP(peer.Address)
 		if err != nil {
 			log.Println(err)
 			wb.setStatus("could not connect to peer (bsverify)")
@@ -250,14 +395,13 @@ func (wb *WhiteBox) processAnnounce(env *Envelope) {
 }
 
 func (wb *WhiteBox) processSuggestionRequest(env *Envelope) {
-	jsonData, err := wb.verifyEnvelope(env, "request")
-	if err != nil {
-		wb.setStatus(err.Error())
+	jsonData, ok := wb.verifyEnvelope(env, "request")
+	if !ok {
 		return
 	}
 
 	var request MessageSuggestionRequest
-	err = json.Unmarshal(jsonData, &request)
+	err := json.Unmarshal(jsonData, &request)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("error invalid json (request)")
@@ -271,7 +415,7 @@ func (wb *WhiteBox) processSuggestionRequest(env *Envelope) {
 	peer := new(Peer)
 	*peer = request.Peer
 
-	peerConn, err := net.Dial("udp", peer.Address)
+	peerConn, err := DialUDP(peer.Address)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("could not connect to peer (request)")
@@ -290,23 +434,30 @@ func (wb *WhiteBox) processSuggestionRequest(env *Envelope) {
 }
 
 func (wb *WhiteBox) processSuggestions(env *Envelope) {
-	jsonData, err := wb.verifyEnvelope(env, "suggestions")
-	if err != nil {
-		wb.setStatus(err.Error())
+	jsonData, ok := wb.verifyEnvelope(env, "suggestions")
+	if !ok {
 		return
 	}
 
 	var suggestions MessageSuggestions
-	err = json.Unmarshal(jsonData, &suggestions)
+	err := json.Unmarshal(jsonData, &suggestions)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("error invalid json (suggestions)")
 		return
 	}
 
+	// has to be a request we sent the suggester
 	requestData := suggestions.RequestData
-	verified := sign.Verify(requestData, wb.Self.SignPub)
-	if !verified {
+	request, _, err := splitPayload(requestData)
+	if err == errSignedLegacy && !wb.Config.StrictSignatures {
+		// sent while the suggester was known not to check headers
+		request = &SignedHeader{Type: "request", To: env.From}
+		err = nil
+	}
+
+	verified := err == nil && sign.Verify(requestData, wb.Self.SignPub)
+	if !verified || request.Type != "request" || request.To != env.From {
 		wb.setStatus("error originating req not signed self (suggestions)")
 		return
 	}
@@ -317,7 +468,7 @@ func (wb *WhiteBox) processSuggestions(env *Envelope) {
 	cache, seen := wb.PeerCache.Get(peer.Id())
 	reconnecting := cache.Disconnected && suggestions.Time.After(cache.Time)
 	if !seen || !cache.Added || reconnecting {
-		peerConn, err := net.Dial("udp", peer.Address)
+		peerConn, err := DialUDP(peer.Address)
 		if err != nil {
 			log.Println(err)
 			wb.setStatus("could not connect to peer (suggestions)")
@@ -331,7 +482,7 @@ func (wb *WhiteBox) processSuggestions(env *Envelope) {
 	for _, newPeer := range suggestions.SuggestedPeers {
 		cache, seen := wb.PeerCache.Get(newPeer.Id())
 		if !seen && !cache.Added && wb.wouldAddPeer(&newPeer) {
-			peerConn, err := net.Dial("udp", newPeer.Address)
+			peerConn, err := DialUDP(newPeer.Address)
 			if err != nil {
 				log.Println(err)
 				wb.setStatus("could not connect to new peer (suggestions)")
@@ -345,14 +496,13 @@ func (wb *WhiteBox) processSuggestions(env *Envelope) {
 }
 
 func (wb *WhiteBox) processDisconnect(env *Envelope) {
-	jsonData, err := wb.verifyEnvelope(env, "disconnect")
-	if err != nil {
-		wb.setStatus(err.Error())
+	jsonData, ok := wb.verifyEnvelope(env, "disconnect")
+	if !ok {
 		return
 	}
 
 	var messageTime MessageTime
-	err = json.Unmarshal(jsonData, &messageTime)
+	err := json.Unmarshal(jsonData, &messageTime)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("error invalid json (disconnect)")
@@ -382,14 +532,13 @@ func (wb *WhiteBox) processDisconnect(env *Envelope) {
 }
 
 func (wb *WhiteBox) processPing(env *Envelope) {
-	jsonData, err := wb.verifyEnvelope(env, "ping")
-	if err != nil {
-		wb.setStatus(err.Error())
+	jsonData, ok := wb.verifyEnvelope(env, "ping")
+	if !ok {
 		return
 	}
 
 	var messagePing MessagePing
-	err = json.Unmarshal(jsonData, &messagePing)
+	err := json.Unmarshal(jsonData, &messagePing)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("error invalid json (ping)")
@@ -406,14 +555,13 @@ func (wb *WhiteBox) processPing(env *Envelope) {
 }
 
 func (wb *WhiteBox) processPulse(env *Envelope) {
-	jsonData, err := wb.verifyEnvelope(env, "pulse")
-	if err != nil {
-		wb.setStatus(err.Error())
+	jsonData, ok := wb.verifyEnvelope(env, "pulse")
+	if !ok {
 		return
 	}
 
 	var messageTime MessageTime
-	err = json.Unmarshal(jsonData, &messageTime)
+	err := json.Unmarshal(jsonData, &messageTime)
 	if err != nil {
 		log.Println(err)
 		wb.setStatus("error invalid json (pulse)")
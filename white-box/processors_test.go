@@ -0,0 +1,302 @@
+package whitebox
+
+import (
+	"encoding/json"
+	"github.com/kevinburke/nacl/box"
+	"github.com/kevinburke/nacl/sign"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// A pulse signed by self, sent at the given time.
+func signedPulse(t *testing.T, self Self, sent time.Time) []byte {
+	jsonTime, err := json.Marshal(MessageTime{MessageType: 1, Time: sent})
+	if err != nil {
+		t.Fatalf("Error marshalling message: %v", err)
+	}
+
+	return sign.Sign(jsonTime, self.SignPrv)
+}
+
+func TestFreshMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.processors")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	drainStatus(wb)
+
+	sender, err := GenerateSelf()
+	if err != nil {
+		t.Fatalf("Error generating keys: %v", err)
+	}
+
+	now := time.Now().UTC()
+	window := wb.Config.MessageWindow
+	fresh := signedPulse(t, sender, now)
+	if !wb.freshMessage("sender", fresh, now, "pulse") {
+		t.Errorf("Fresh message rejected.")
+	}
+
+	if wb.freshMessage("sender", fresh, now, "pulse") {
+		t.Errorf("Replayed message accepted.")
+	}
+
+	// replays are expected from floods, only stale messages get a status
+	statuses := drainStatus(wb)
+	if len(statuses) != 0 {
+		t.Errorf("Replay set a status: %v", statuses)
+	}
+
+	tables := []struct {
+		sent   time.Time
+		status string
+	}{
+		{now.Add(-window - time.Second), "error stale message (pulse)"},
+		{now.Add(window + time.Second), "error stale message (pulse)"},
+	}
+
+	for _, table := range tables {
+		signed := signedPulse(t, sender, table.sent)
+		if wb.freshMessage("sender", signed, table.sent, "pulse") {
+			t.Errorf("Message sent at %v accepted.", table.sent)
+		}
+
+		statuses = drainStatus(wb)
+		if len(statuses) != 1 || statuses[0] != table.status {
+			t.Errorf("Stale message status does not match:")
+			t.Errorf("Got: %v", statuses)
+			t.Errorf("Expecting: [%s]", table.status)
+		}
+	}
+
+	// senders are forgotten once their signatures expire
+	wb.Replays.Mutex.Lock()
+	wb.Replays.Map["sender"].TTL = 0
+	wb.Replays.Swept = time.Time{}
+	wb.Replays.Mutex.Unlock()
+
+	later := now.Add(time.Second)
+	if !wb.freshMessage("other", signedPulse(t, sender, later), later, "pulse") {
+		t.Errorf("Fresh message from another sender rejected.")
+	}
+
+	_, remembered := wb.Replays.Map["sender"]
+	if remembered || len(wb.Replays.Map) != 1 {
+		t.Errorf("Sweep did not forget the expired sender.")
+	}
+}
+
+func TestReplayCacheFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.processors")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	drainStatus(wb)
+
+	sender, err := GenerateSelf()
+	if err != nil {
+		t.Fatalf("Error generating keys: %v", err)
+	}
+
+	now := time.Now().UTC()
+	first := signedPulse(t, sender, now)
+	if !wb.freshMessage("sender", first, now, "pulse") {
+		t.Fatalf("Fresh message rejected.")
+	}
+
+	accepted := 0
+	for i := 1; i <= REPLAY_SIZE+1; i++ {
+		sent := now.Add(time.Duration(i) * time.Millisecond)
+		signed := signedPulse(t, sender, sent)
+		if wb.freshMessage("sender", signed, sent, "pulse") {
+			accepted++
+		}
+	}
+
+	// a full cache turns new messages away rather than forgetting old ones
+	if accepted != REPLAY_SIZE-1 {
+		t.Errorf("Messages accepted past the replay cache:")
+		t.Errorf("Got: %d", accepted)
+		t.Errorf("Expecting: %d", REPLAY_SIZE-1)
+	}
+
+	if wb.freshMessage("sender", first, now, "pulse") {
+		t.Errorf("Message replayed after %d newer ones.", REPLAY_SIZE+1)
+	}
+}
+
+func TestStaleEnvelopeIgnored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.processors")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self, senderSelf Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	sender := New(dir, "127.0.0.1", "3500", senderSelf, DefaultConfig())
+	drainStatus(wb)
+
+	pulse := func(sent time.Time) *Envelope {
+		return &Envelope{
+			Type:    "pulse",
+			From:    sender.PeerSelf.Id(),
+			To:      wb.PeerSelf.Id(),
+			Version: WIRE_VERSION_BINARY,
+			Data:    signedPulse(t, sender.Self, sent)}
+	}
+
+	// a stale envelope says nothing about what its sender decodes
+	stale := time.Now().UTC().Add(-2 * wb.Config.MessageWindow)
+	_, ok := wb.verifyEnvelope(pulse(stale), "pulse")
+	if ok || wb.peerVersion(sender.PeerSelf.Id()) != WIRE_VERSION_LEGACY {
+		t.Errorf("Stale envelope was taken:")
+		t.Errorf("Got: version %d", wb.peerVersion(sender.PeerSelf.Id()))
+		t.Errorf("Expecting: version %d", WIRE_VERSION_LEGACY)
+	}
+
+	fresh := pulse(time.Now().UTC())
+	_, ok = wb.verifyEnvelope(fresh, "pulse")
+	if !ok || wb.peerVersion(sender.PeerSelf.Id()) != WIRE_VERSION_BINARY {
+		t.Errorf("Fresh envelope was not taken:")
+		t.Errorf("Got: version %d", wb.peerVersion(sender.PeerSelf.Id()))
+		t.Errorf("Expecting: version %d", WIRE_VERSION_BINARY)
+	}
+
+	wb.notePeerVersion(sender.PeerSelf.Id(), WIRE_VERSION_JSON)
+	_, ok = wb.verifyEnvelope(fresh, "pulse")
+	if ok || wb.peerVersion(sender.PeerSelf.Id()) != WIRE_VERSION_JSON {
+		t.Errorf("Replayed envelope was taken.")
+	}
+}
+
+func TestFreshBulkMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.processors")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	drainStatus(wb)
+
+	sender, err := GenerateSelf()
+	if err != nil {
+		t.Fatalf("Error generating keys: %v", err)
+	}
+
+	// transfers go past the replay limit without being turned away
+	now := time.Now().UTC()
+	first := signedPulse(t, sender, now)
+	for i := 0; i <= REPLAY_SIZE; i++ {
+		sent := now.Add(time.Duration(i) * time.Millisecond)
+		signed := first
+		if i > 0 {
+			signed = signedPulse(t, sender, sent)
+		}
+
+		if !wb.freshBulkMessage("sender", signed, sent, "bulk") {
+			t.Fatalf("Bulk message %d rejected.", i)
+		}
+	}
+
+	last := signedPulse(t, sender, now)
+	wb.freshBulkMessage("sender", last, now, "bulk")
+	if wb.freshBulkMessage("sender", last, now, "bulk") {
+		t.Errorf("Replayed bulk message accepted.")
+	}
+
+	// and don't take room from other messages
+	if !wb.freshMessage("sender", first, now, "pulse") {
+		t.Errorf("Bulk messages spent the replay cache.")
+	}
+
+	stale := now.Add(-2 * wb.Config.MessageWindow)
+	if wb.freshBulkMessage("sender", signedPulse(t, sender, stale), stale, "bulk") {
+		t.Errorf("Stale bulk message accepted.")
+	}
+}
+
+func TestSignedInvite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.processors")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self, hostSelf Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	host := New(dir, "127.0.0.1", "3500", hostSelf, DefaultConfig())
+	drainStatus(wb)
+
+	partyId := "coolparty0123456789abcdef0123456"
+	signed, err := host.signHeader("invite", wb.PeerSelf.Id(), "",
+		[]byte(`{"Id":"`+partyId+`"}`))
+	if err != nil {
+		t.Fatalf("Error signing invite: %v", err)
+	}
+
+	invite := func(id string) *Envelope {
+		return &Envelope{
+			Type: "invite",
+			From: host.PeerSelf.Id(),
+			To:   wb.PeerSelf.Id(),
+			Id:   id,
+			Data: box.EasySeal(signed, wb.Self.EncPub, host.Self.EncPrv)}
+	}
+
+	wb.processInvite(invite("first"))
+	if _, ok := wb.PendingInvites.Map[partyId]; !ok {
+		t.Fatalf("Signed invite was not taken.")
+	}
+
+	// the same signature under a new envelope id is a replay
+	delete(wb.PendingInvites.Map, partyId)
+	wb.processInvite(invite("second"))
+	if _, ok := wb.PendingInvites.Map[partyId]; ok {
+		t.Errorf("Replayed invite was taken.")
+	}
+}
+
+func TestSendAnnounceEnvelopes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.processors")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self, self0, self1 Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	drainStatus(wb)
+
+	partyId := wb.PartyStart("coolname")
+	party := wb.Parties.Map[partyId]
+	for _, memberSelf := range []Self{self0, self1} {
+		member := New(dir, "127.0.0.1", "3500", memberSelf, DefaultConfig())
+
+		// members that don't ack get the envelope routed as is
+		timePeer := MessageTimePeer{Peer: member.PeerSelf}
+		wb.recordProtocol(member.PeerSelf.Id(), &timePeer)
+		party.addMember(member.PeerSelf.Id())
+	}
+
+	// each member's envelope is ours, so echoes of any of them are dropped
+	routed := wb.Routed.Len()
+	party.SendAnnounce()
+	if wb.Routed.Len()-routed != 2 {
+		t.Errorf("Announce envelopes not registered as routed:")
+		t.Errorf("Got: %d", wb.Routed.Len()-routed)
+		t.Errorf("Expecting: %d", 2)
+	}
+}
@@ -0,0 +1,125 @@
+package whitebox
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Version of the peer protocol this client speaks. Peers exchange it with
+// their capabilities in bootstrap, verifybs and announce so new features can
+// roll out without every node updating at once.
+const PROTOCOL_VERSION = 1
+
+// Optional features a peer can advertise.
+const (
+	CAP_BINARY   = "binary"
+	CAP_FRAGMENT = "fragment"
+	CAP_ACK      = "ack"
+	CAP_STREAM   = "stream"
+	CAP_FIND     = "findnode"
+	CAP_GROUP    = "group"
+	CAP_SIGNED   = "signed"
+)
+
+// What this client advertises. CAP_STREAM is only sent while we listen for
+// streams.
+var CAPABILITIES = []string{
+	CAP_ACK, CAP_BINARY, CAP_FIND, CAP_FRAGMENT, CAP_GROUP, CAP_SIGNED,
+	CAP_STREAM}
+
+type Capabilities map[string]bool
+
+func NewCapabilities(names []string) Capabilities {
+	caps := make(Capabilities)
+	for _, name := range names {
+		caps[name] = true
+	}
+
+	return caps
+}
+
+func (caps Capabilities) Has(name string) bool {
+	return caps[name]
+}
+
+func (caps Capabilities) List() []string {
+	names := make([]string, 0, len(caps))
+	for name, _ := range caps {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Self description sent in bootstrap, verifybs and announce.
+func (wb *WhiteBox) newTimePeer() MessageTimePeer {
+	return MessageTimePeer{
+		Peer:         wb.PeerSelf,
+		Time:         time.Now().UTC(),
+		Protocol:     PROTOCOL_VERSION,
+		Capabilities: wb.capabilities()}
+}
+
+func (wb *WhiteBox) capabilities() []string {
+	caps := make([]string, 0, len(CAPABILITIES))
+	for _, capability := range CAPABILITIES {
+		if capability == CAP_STREAM && wb.StreamListener == nil {
+			continue
+		}
+		caps = append(caps, capability)
+	}
+
+	return caps
+}
+
+// Remember what a peer supports, from a signed bootstrap, verifybs or
+// announce. Peers from before versioning show up as protocol 0.
+func (wb *WhiteBox) recordProtocol(peerId string, timePeer *MessageTimePeer) {
+	caps := NewCapabilities(timePeer.Capabilities)
+
+	cache, _ := wb.PeerCache.Get(peerId)
+	cache.Protocol = timePeer.Protocol
+	cache.Capabilities = caps
+	wb.PeerCache.Set(peerId, cache)
+
+	entry := wb.tableEntry(peerId)
+	if entry != nil {
+		wb.PeerTable.Mutex.Lock()
+		entry.Protocol = timePeer.Protocol
+		entry.Capabilities = caps
+		wb.PeerTable.Mutex.Unlock()
+	}
+
+	if caps.Has(CAP_BINARY) {
+		wb.notePeerVersion(peerId, WIRE_VERSION_BINARY)
+	}
+
+	if timePeer.Protocol > PROTOCOL_VERSION {
+		wb.setStatus(fmt.Sprintf(
+			"peer %s speaks protocol v%d, we speak v%d, consider updating",
+			timePeer.Peer.ShortId(), timePeer.Protocol, PROTOCOL_VERSION))
+	}
+}
+
+func (wb *WhiteBox) peerHas(peerId, capability string) bool {
+	_, caps, known := wb.PeerProtocol(peerId)
+	return known && caps.Has(capability)
+}
+
+// Whether a peer has told us what it supports, and it isn't capability.
+func (wb *WhiteBox) peerLacks(peerId, capability string) bool {
+	_, caps, known := wb.PeerProtocol(peerId)
+	return known && !caps.Has(capability)
+}
+
+// Protocol version and capabilities a peer last advertised.
+func (wb *WhiteBox) PeerProtocol(peerId string) (int, Capabilities, bool) {
+	cache, seen := wb.PeerCache.Get(peerId)
+	if !seen || cache.Capabilities == nil {
+		return 0, nil, false
+	}
+
+	return cache.Protocol, cache.Capabilities, true
+}
@@ -0,0 +1,65 @@
+package whitebox
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordProtocol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.protocol")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+
+	var otherSelf Self
+	other := New(dir, "127.0.0.1", "3500", otherSelf, DefaultConfig())
+	timePeer := other.newTimePeer()
+	peer := timePeer.Peer
+
+	_, _, known := wb.PeerProtocol(peer.Id())
+	if known {
+		t.Errorf("Protocol known before any hello.")
+	}
+
+	// recorded before the peer is in the table, like processBootstrap
+	wb.recordProtocol(peer.Id(), &timePeer)
+	wb.addPeer(&peer, timePeer.Time)
+
+	protocol, caps, known := wb.PeerProtocol(peer.Id())
+	if !known || protocol != PROTOCOL_VERSION {
+		t.Errorf("Recorded protocol does not match:")
+		t.Errorf("Got: %d (%t)", protocol, known)
+		t.Errorf("Expecting: %d", PROTOCOL_VERSION)
+	}
+
+	if !reflect.DeepEqual(caps.List(), other.capabilities()) {
+		t.Errorf("Recorded capabilities do not match:")
+		t.Errorf("Got: %v", caps.List())
+		t.Errorf("Expecting: %v", other.capabilities())
+	}
+
+	entry := wb.findClosest(peer.SignPub)
+	if entry == nil || !entry.Capabilities.Has(CAP_BINARY) {
+		t.Errorf("Peer table entry is missing capabilities.")
+	}
+
+	if !wb.peerDecodesBinary(peer.Id()) {
+		t.Errorf("Binary capability did not enable the binary codec.")
+	}
+
+	// an older client re-announcing clears what was advertised
+	oldTimePeer := MessageTimePeer{Peer: peer, Time: time.Now().UTC()}
+	wb.recordProtocol(peer.Id(), &oldTimePeer)
+
+	entry = wb.findClosest(peer.SignPub)
+	if entry == nil || entry.Protocol != 0 || entry.Capabilities.Has(CAP_BINARY) {
+		t.Errorf("Peer table entry not updated for an older client.")
+	}
+}
@@ -0,0 +1,330 @@
+package whitebox
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rate limits on the receive path. Every datagram takes a token from its
+// source address before it's unframed, and every envelope takes one from its
+// address's budget for that type before its signature is checked. Once the
+// sender is checked the envelope takes another from the sender's budget for
+// the type, so an identity spread over many addresses gets one budget.
+// Addresses that go over Config.BanStrikes times in a RATE_STRIKE_WINDOW are
+// dropped for Config.BanDuration.
+const (
+	RATE_STRIKE_WINDOW  = time.Minute
+	RATE_SWEEP_INTERVAL = time.Minute
+	// buckets kept for each of addresses, address types and sender types
+	RATE_MAX_BUCKETS = 65536
+)
+
+// Messages per second and the burst allowed on top.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// Budget per envelope type from one address, and from one sender. Pack transfers and their acks
+// travel as party and group messages so those get the most room.
+var RATE_LIMITS = map[string]RateLimit{
+	"ack":         {1000, 2000},
+	"announce":    {2, 10},
+	"bootstrap":   {1, 5},
+	"chat":        {5, 20},
+	"disconnect":  {1, 5},
+	"findnode":    {10, 30},
+	"group":       {1000, 2000},
+	"invite":      {2, 10},
+	"nodes":       {10, 30},
+	"party":       {1000, 2000},
+	"ping":        {2, 10},
+	"pulse":       {2, 10},
+	"request":     {2, 10},
+	"suggestions": {2, 10},
+	"verifybs":    {1, 5},
+}
+
+// types we don't know, from newer peers
+var DEFAULT_RATE_LIMIT = RateLimit{10, 20}
+
+// Counters for messages dropped by the rate limits, read with
+// atomic.LoadUint64.
+type RateStats struct {
+	// datagrams over their address's rate
+	Limited uint64
+	// envelopes over their address's rate for the type
+	TypeLimited uint64
+	// verified envelopes over their sender's rate for the type
+	SenderLimited uint64
+	Bans          uint64
+	// datagrams dropped from banned addresses
+	BannedDrops uint64
+}
+
+type tokenBucket struct {
+	Tokens float64
+	Last   time.Time
+}
+
+// Spend a token if there is one, new buckets start full.
+func (bucket *tokenBucket) take(limit RateLimit, now time.Time) bool {
+	bucket.refill(limit, now)
+	if bucket.Tokens < 1 {
+		return false
+	}
+
+	bucket.Tokens--
+	return true
+}
+
+func (bucket *tokenBucket) refill(limit RateLimit, now time.Time) {
+	if bucket.Last.IsZero() {
+		bucket.Tokens = limit.Burst
+	} else {
+		bucket.Tokens += now.Sub(bucket.Last).Seconds() * limit.Rate
+		if bucket.Tokens > limit.Burst {
+			bucket.Tokens = limit.Burst
+		}
+	}
+
+	bucket.Last = now
+}
+
+// Whether a bucket has sat idle long enough to refill, so dropping it
+// changes nothing.
+func (bucket *tokenBucket) idle(limit RateLimit, now time.Time) bool {
+	idle := now.Sub(bucket.Last).Seconds()
+	return bucket.Tokens+idle*limit.Rate >= limit.Burst
+}
+
+type rateSource struct {
+	Bucket      tokenBucket
+	Strikes     int
+	StrikeStart time.Time
+	BannedUntil time.Time
+}
+
+// Buckets by source host, by host and type and by sender and type.
+type LockingRateLimits struct {
+	Sources map[string]*rateSource
+	Types   map[string]*tokenBucket
+	Senders map[string]*tokenBucket
+	Swept   time.Time
+	Mutex   *sync.Mutex
+}
+
+// Host of a udp address or stream, ports change between sockets.
+func sourceHost(source string) string {
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		return source
+	}
+
+	return host
+}
+
+// Budget and bucket name for a type, unknown types share one so they can't
+// be made up to get fresh buckets.
+func rateLimit(msgType string) (RateLimit, string) {
+	limit, exists := RATE_LIMITS[msgType]
+	if !exists {
+		return DEFAULT_RATE_LIMIT, "?"
+	}
+
+	return limit, msgType
+}
+
+func (wb *WhiteBox) addressLimit() RateLimit {
+	return RateLimit{
+		Rate:  float64(wb.Config.AddressRate),
+		Burst: float64(wb.Config.AddressBurst)}
+}
+
+// Whether to take a datagram from source, checked before anything else.
+func (wb *WhiteBox) allowSource(source string) bool {
+	host := sourceHost(source)
+	now := time.Now()
+
+	wb.RateLimits.Mutex.Lock()
+	defer wb.RateLimits.Mutex.Unlock()
+
+	wb.sweepRateLimits(now)
+
+	state := wb.rateSource(host, now)
+	if now.Before(state.BannedUntil) {
+		atomic.AddUint64(&wb.RateStats.BannedDrops, 1)
+		return false
+	}
+
+	if !state.Bucket.take(wb.addressLimit(), now) {
+		atomic.AddUint64(&wb.RateStats.Limited, 1)
+		wb.strike(host, state, now)
+		return false
+	}
+
+	return true
+}
+
+// Whether to process an envelope, by the budget for its type from the
+// address it came from. From isn't verified yet and costs nothing to change,
+// so it has no say in which bucket pays.
+func (wb *WhiteBox) allowEnvelope(source string, env *Envelope) bool {
+	host := sourceHost(source)
+	limit, name := rateLimit(env.Type)
+	key := host + "/" + name
+	now := time.Now()
+
+	wb.RateLimits.Mutex.Lock()
+	defer wb.RateLimits.Mutex.Unlock()
+
+	bucket := wb.rateBucket(wb.RateLimits.Types, key, now)
+	if !bucket.take(limit, now) {
+		atomic.AddUint64(&wb.RateStats.TypeLimited, 1)
+		wb.strike(host, wb.rateSource(host, now), now)
+		return false
+	}
+
+	return true
+}
+
+// Whether to process an envelope whose sender has been checked, by the
+// sender's budget for its type. The address already paid in allowEnvelope,
+// this catches one sender using many.
+func (wb *WhiteBox) allowSender(env *Envelope) bool {
+	limit, name := rateLimit(env.Type)
+	key := env.From + "/" + name
+	now := time.Now()
+
+	wb.RateLimits.Mutex.Lock()
+	defer wb.RateLimits.Mutex.Unlock()
+
+	bucket := wb.rateBucket(wb.RateLimits.Senders, key, now)
+	if !bucket.take(limit, now) {
+		atomic.AddUint64(&wb.RateStats.SenderLimited, 1)
+		return false
+	}
+
+	return true
+}
+
+// Bucket for key, made if there isn't one. Caller holds the rate limit lock.
+func (wb *WhiteBox) rateBucket(buckets map[string]*tokenBucket, key string,
+	now time.Time) *tokenBucket {
+	bucket, exists := buckets[key]
+	if exists {
+		return bucket
+	}
+
+	if len(buckets) >= RATE_MAX_BUCKETS {
+		wb.sweepFull(now)
+	}
+
+	// map order is random enough to pick one to drop
+	for other, _ := range buckets {
+		if len(buckets) < RATE_MAX_BUCKETS {
+			break
+		}
+		delete(buckets, other)
+	}
+
+	bucket = new(tokenBucket)
+	buckets[key] = bucket
+	return bucket
+}
+
+// Caller holds the rate limit lock.
+func (wb *WhiteBox) rateSource(host string, now time.Time) *rateSource {
+	state, exists := wb.RateLimits.Sources[host]
+	if !exists {
+		if len(wb.RateLimits.Sources) >= RATE_MAX_BUCKETS {
+			wb.sweepFull(now)
+		}
+
+		// drop one that isn't banned, bans are worth more than the memory.
+		// If every source is banned the ban closest to running out goes.
+		oldest := ""
+		for other, otherState := range wb.RateLimits.Sources {
+			if len(wb.RateLimits.Sources) < RATE_MAX_BUCKETS {
+				break
+			}
+
+			if !now.Before(otherState.BannedUntil) {
+				delete(wb.RateLimits.Sources, other)
+			} else if oldest == "" || otherState.BannedUntil.Before(
+				wb.RateLimits.Sources[oldest].BannedUntil) {
+				oldest = other
+			}
+		}
+
+		if len(wb.RateLimits.Sources) >= RATE_MAX_BUCKETS {
+			delete(wb.RateLimits.Sources, oldest)
+		}
+
+		state = new(rateSource)
+		wb.RateLimits.Sources[host] = state
+	}
+
+	return state
+}
+
+// Sweep ahead of the interval when a bucket map fills up, at most once a
+// second. Caller holds the rate limit lock.
+func (wb *WhiteBox) sweepFull(now time.Time) {
+	if now.Sub(wb.RateLimits.Swept) < time.Second {
+		return
+	}
+
+	wb.RateLimits.Swept = time.Time{}
+	wb.sweepRateLimits(now)
+}
+
+// Count a drop against a host, banning it after too many. Caller holds the
+// rate limit lock.
+func (wb *WhiteBox) strike(host string, state *rateSource, now time.Time) {
+	if now.Sub(state.StrikeStart) > RATE_STRIKE_WINDOW {
+		state.Strikes = 0
+		state.StrikeStart = now
+	}
+
+	state.Strikes++
+	if state.Strikes < wb.Config.BanStrikes {
+		return
+	}
+
+	state.Strikes = 0
+	state.BannedUntil = now.Add(wb.Config.BanDuration)
+	atomic.AddUint64(&wb.RateStats.Bans, 1)
+	log.Println("banning", host, "for", wb.Config.BanDuration)
+}
+
+// Forget buckets that have refilled and bans that are over. Caller holds the
+// rate limit lock.
+func (wb *WhiteBox) sweepRateLimits(now time.Time) {
+	if now.Sub(wb.RateLimits.Swept) < RATE_SWEEP_INTERVAL {
+		return
+	}
+	wb.RateLimits.Swept = now
+
+	limit := wb.addressLimit()
+	for host, state := range wb.RateLimits.Sources {
+		if now.After(state.BannedUntil) &&
+			now.Sub(state.StrikeStart) > RATE_STRIKE_WINDOW &&
+			state.Bucket.idle(limit, now) {
+			delete(wb.RateLimits.Sources, host)
+		}
+	}
+
+	// every budget refills in well under a sweep interval
+	for _, buckets := range []map[string]*tokenBucket{
+		wb.RateLimits.Types, wb.RateLimits.Senders} {
+		for key, bucket := range buckets {
+			if now.Sub(bucket.Last) > RATE_SWEEP_INTERVAL {
+				delete(buckets, key)
+			}
+		}
+	}
+}
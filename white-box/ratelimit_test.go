@@ -0,0 +1,265 @@
+package whitebox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limit := RateLimit{Rate: 10, Burst: 5}
+	now := time.Now()
+
+	var bucket tokenBucket
+	taken := 0
+	for i := 0; i < 10; i++ {
+		if bucket.take(limit, now) {
+			taken++
+		}
+	}
+
+	if taken != 5 {
+		t.Errorf("New bucket did not allow its burst:")
+		t.Errorf("Got: %d", taken)
+		t.Errorf("Expecting: %d", 5)
+	}
+
+	// a tenth of a second buys one token at 10/s
+	if !bucket.take(limit, now.Add(100*time.Millisecond)) {
+		t.Errorf("Bucket did not refill.")
+	}
+
+	if bucket.take(limit, now.Add(100*time.Millisecond)) {
+		t.Errorf("Bucket refilled more than its rate.")
+	}
+
+	if !bucket.idle(limit, now.Add(time.Second)) {
+		t.Errorf("Bucket not idle after refilling.")
+	}
+}
+
+func rateTestBox(t *testing.T, config Config) (*WhiteBox, func()) {
+	dir, err := ioutil.TempDir("", "partytest.ratelimit")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, config)
+	return wb, func() { os.RemoveAll(dir) }
+}
+
+func TestEnvelopeLimits(t *testing.T) {
+	wb, cleanup := rateTestBox(t, DefaultConfig())
+	defer cleanup()
+
+	chat := &Envelope{Type: "chat", From: "flooder"}
+	burst := int(RATE_LIMITS["chat"].Burst)
+	for i := 0; i < burst; i++ {
+		if !wb.allowEnvelope("203.0.113.7:3499", chat) {
+			t.Fatalf("Chat dropped inside its burst at %d.", i)
+		}
+	}
+
+	if wb.allowEnvelope("203.0.113.7:4000", chat) {
+		t.Errorf("Chat over its budget was allowed from another port.")
+	}
+
+	// other types and senders have their own budgets
+	ping := &Envelope{Type: "ping", From: "flooder"}
+	if !wb.allowEnvelope("203.0.113.7:3499", ping) {
+		t.Errorf("Ping dropped for a chat flood.")
+	}
+
+	other := &Envelope{Type: "chat", From: "bystander"}
+	if !wb.allowEnvelope("198.51.100.7:3499", other) {
+		t.Errorf("Chat from another peer dropped.")
+	}
+
+	if wb.RateStats.TypeLimited != 1 {
+		t.Errorf("Type limited count does not match:")
+		t.Errorf("Got: %d", wb.RateStats.TypeLimited)
+		t.Errorf("Expecting: %d", 1)
+	}
+}
+
+func TestSenderLimits(t *testing.T) {
+	wb, cleanup := rateTestBox(t, DefaultConfig())
+	defer cleanup()
+
+	// one sender spread over many addresses shares a budget
+	chat := &Envelope{Type: "chat", From: "roamer"}
+	burst := int(RATE_LIMITS["chat"].Burst)
+	allowed := 0
+	for i := 0; i <= burst; i++ {
+		source := fmt.Sprintf("203.0.113.%d:3499", i)
+		if !wb.allowEnvelope(source, chat) {
+			t.Fatalf("Chat from a fresh address %s dropped.", source)
+		}
+
+		if wb.allowSender(chat) {
+			allowed++
+		}
+	}
+
+	if allowed != burst {
+		t.Errorf("Sender got a budget per address:")
+		t.Errorf("Got: %d allowed", allowed)
+		t.Errorf("Expecting: %d allowed", burst)
+	}
+
+	other := &Envelope{Type: "chat", From: "bystander"}
+	ping := &Envelope{Type: "ping", From: "roamer"}
+	if !wb.allowSender(other) || !wb.allowSender(ping) {
+		t.Errorf("Other senders and types dropped for a chat flood.")
+	}
+
+	if wb.RateStats.SenderLimited != 1 || wb.RateStats.TypeLimited != 0 {
+		t.Errorf("Limited counts do not match:")
+		t.Errorf("Got: %d sender, %d type", wb.RateStats.SenderLimited,
+			wb.RateStats.TypeLimited)
+		t.Errorf("Expecting: 1 sender, 0 type")
+	}
+}
+
+func TestSpoofedFrom(t *testing.T) {
+	wb, cleanup := rateTestBox(t, DefaultConfig())
+	defer cleanup()
+
+	// neither a new From nor a made up type gets a fresh budget
+	tables := []struct {
+		env   func(int) *Envelope
+		burst float64
+	}{
+		{func(i int) *Envelope {
+			return &Envelope{Type: "chat", From: fmt.Sprintf("forged%d", i)}
+		}, RATE_LIMITS["chat"].Burst},
+		{func(i int) *Envelope {
+			return &Envelope{Type: fmt.Sprintf("type%d", i), From: "forged"}
+		}, DEFAULT_RATE_LIMIT.Burst},
+	}
+
+	for _, table := range tables {
+		allowed := 0
+		for i := 0; i < 1000; i++ {
+			if wb.allowEnvelope("203.0.113.7:3499", table.env(i)) {
+				allowed++
+			}
+		}
+
+		if allowed != int(table.burst) {
+			t.Errorf("Spoofed envelopes got past the limit:")
+			t.Errorf("Got: %d allowed", allowed)
+			t.Errorf("Expecting: %d allowed", int(table.burst))
+		}
+	}
+
+	if len(wb.RateLimits.Types) != 2 {
+		t.Errorf("Spoofed envelopes made new buckets:")
+		t.Errorf("Got: %d", len(wb.RateLimits.Types))
+		t.Errorf("Expecting: %d", 2)
+	}
+
+	// spoofed addresses can't grow the maps past their bound
+	for i := 0; i < RATE_MAX_BUCKETS+100; i++ {
+		source := fmt.Sprintf("10.%d.%d.%d:3499", i>>16, (i>>8)&0xff, i&0xff)
+		wb.allowSource(source)
+		wb.allowEnvelope(source, &Envelope{Type: "chat", From: "forged"})
+		wb.allowSender(&Envelope{Type: "chat", From: source})
+	}
+
+	if len(wb.RateLimits.Sources) > RATE_MAX_BUCKETS ||
+		len(wb.RateLimits.Types) > RATE_MAX_BUCKETS ||
+		len(wb.RateLimits.Senders) > RATE_MAX_BUCKETS {
+		t.Errorf("Rate limit maps grew past their bound:")
+		t.Errorf("Got: %d sources, %d type buckets, %d sender buckets",
+			len(wb.RateLimits.Sources), len(wb.RateLimits.Types),
+			len(wb.RateLimits.Senders))
+		t.Errorf("Expecting: at most %d", RATE_MAX_BUCKETS)
+	}
+}
+
+func TestBan(t *testing.T) {
+	config := DefaultConfig()
+	config.AddressRate = 1
+	config.AddressBurst = 10
+	config.BanStrikes = 5
+	wb, cleanup := rateTestBox(t, config)
+	defer cleanup()
+
+	source := "203.0.113.7:3499"
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		if wb.allowSource(source) {
+			allowed++
+		}
+	}
+
+	if allowed != 10 || wb.RateStats.Bans != 1 {
+		t.Errorf("Flooding address was not banned:")
+		t.Errorf("Got: %d allowed, %d bans", allowed, wb.RateStats.Bans)
+		t.Errorf("Expecting: 10 allowed, 1 bans")
+	}
+
+	if wb.RateStats.Limited != 5 || wb.RateStats.BannedDrops != 5 {
+		t.Errorf("Drop counts do not match:")
+		t.Errorf("Got: %d limited, %d banned",
+			wb.RateStats.Limited, wb.RateStats.BannedDrops)
+		t.Errorf("Expecting: 5 limited, 5 banned")
+	}
+
+	if !wb.allowSource("198.51.100.7:3499") {
+		t.Errorf("Ban reached another address.")
+	}
+
+	// bans run out and swept sources start over
+	wb.RateLimits.Mutex.Lock()
+	state := wb.RateLimits.Sources["203.0.113.7"]
+	state.BannedUntil = time.Now().Add(-time.Second)
+	state.StrikeStart = time.Now().Add(-2 * RATE_STRIKE_WINDOW)
+	state.Bucket.Last = time.Now().Add(-time.Minute)
+	wb.RateLimits.Swept = time.Time{}
+	wb.RateLimits.Mutex.Unlock()
+
+	if !wb.allowSource(source) {
+		t.Errorf("Address still dropped after its ban.")
+	}
+
+	if wb.RateLimits.Sources["203.0.113.7"] == state {
+		t.Errorf("Sweep did not forget the old source state.")
+	}
+}
+
+func TestBannedSourcesBounded(t *testing.T) {
+	wb, cleanup := rateTestBox(t, DefaultConfig())
+	defer cleanup()
+
+	// a full map of bans, the first one runs out soonest
+	now := time.Now()
+	wb.RateLimits.Mutex.Lock()
+	wb.RateLimits.Swept = now
+	for i := 0; i < RATE_MAX_BUCKETS; i++ {
+		host := fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&0xff, i&0xff)
+		wb.RateLimits.Sources[host] = &rateSource{
+			BannedUntil: now.Add(time.Hour + time.Duration(i)*time.Second)}
+	}
+	wb.RateLimits.Mutex.Unlock()
+
+	wb.allowSource("203.0.113.7:3499")
+
+	if len(wb.RateLimits.Sources) > RATE_MAX_BUCKETS {
+		t.Errorf("Banned sources grew past their bound:")
+		t.Errorf("Got: %d", len(wb.RateLimits.Sources))
+		t.Errorf("Expecting: at most %d", RATE_MAX_BUCKETS)
+	}
+
+	if _, ok := wb.RateLimits.Sources["10.0.0.0"]; ok {
+		t.Errorf("Ban closest to running out was kept.")
+	}
+
+	if _, ok := wb.RateLimits.Sources["10.0.0.1"]; !ok {
+		t.Errorf("More than one ban was dropped.")
+	}
+}
@@ -2,73 +2,113 @@ package whitebox
 
 import (
 	"bytes"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/kevinburke/nacl/sign"
 	"log"
-	"math/big"
-	"net"
 	"time"
 )
 
+// Max forwards for a routed envelope.
+const HOP_LIMIT = 16
+
 func (wb *WhiteBox) route(env *Envelope) {
 	if env.Time.IsZero() {
 		env.Time = time.Now().UTC()
 	}
 
-	jsonEnv, err := json.Marshal(env)
-	if err != nil {
-		log.Println(err)
-		return
+	// no hops yet means we're sending it, don't forward it if it comes back
+	if env.Hops == 0 {
+		env.Hops = HOP_LIMIT
+		wb.Routed.Seen(routeId(env))
 	}
 
-	shortId, err := wb.IdFront(env.To)
-	if err != nil {
-		log.Println(err)
-		return
-	}
+	enc := wb.newEncoder(env)
 
-	bytesId, err := hex.DecodeString(shortId)
+	min, err := wb.IdToMin(env.To)
 	if err != nil {
 		log.Println(err)
+		wb.setStatus(err.Error())
 		return
 	}
 
-	idInt := new(big.Int)
-	idInt.SetBytes(bytesId)
+	selfDist := xorDistance(wb.PeerSelf.SignPub, min.SignPub)
 
-	selfDist := new(big.Int)
-	selfDist.SetBytes(wb.PeerSelf.SignPub)
-	selfDist.Xor(selfDist, idInt)
-
-	closest := wb.findClosestN(bytesId, 3)
+	closest := wb.findClosestN(min.SignPub, 3)
 	for _, peerEntry := range closest {
 		peer := peerEntry.Peer
 		if peer != nil {
-			peerDist := new(big.Int)
-			peerDist.SetBytes(peer.SignPub)
-			peerDist.Xor(peerDist, idInt)
-
-			if peerDist.Cmp(selfDist) < 0 {
-				peer.Conn.Write([]byte(fmt.Sprintf("%s\n", string(jsonEnv))))
+			peerDist := xorDistance(peer.SignPub, min.SignPub)
+			if peerDist.Less(selfDist) {
+				enc.sendTo(peer)
 			}
 		}
 	}
 }
 
-func (wb *WhiteBox) flood(env *Envelope) {
-	jsonEnv, err := json.Marshal(env)
-	if err != nil {
-		log.Println(err)
+// Pass along a routed envelope for someone else, until its hops run out.
+// Envelopes from peers that predate the hop limit start with a full count.
+func (wb *WhiteBox) forward(env *Envelope) {
+	if env.Hops <= 0 || env.Hops > HOP_LIMIT {
+		env.Hops = HOP_LIMIT
+	}
+
+	env.Hops--
+	if env.Hops == 0 {
+		log.Println("hop limit reached", env.Type, env.To)
 		return
 	}
 
+	wb.route(env)
+}
+
+// Whether a routed envelope for someone else is worth passing along. Signed
+// envelopes are checked the way their recipient will, their signature and
+// that it was made for this type, sender and recipient. Party, group and
+// invite data is boxed for the recipient, relays can only check those have
+// real ids and a recent time.
+func (wb *WhiteBox) forwardable(env *Envelope) bool {
+	window := wb.Config.MessageWindow
+	age := time.Since(env.Time)
+	if age > window || age < -window || len(env.Data) == 0 {
+		return false
+	}
+
+	min, err := wb.IdToMin(env.From)
+	if err != nil {
+		return false
+	}
+
+	_, err = wb.IdToMin(env.To)
+	if err != nil {
+		return false
+	}
+
+	switch env.Type {
+	case "party", "group", "invite":
+		return true
+	}
+
+	header, _, err := splitPayload(env.Data)
+	if err == errSignedLegacy && wb.acceptsLegacy(env.From, env.To) {
+		return sign.Verify(env.Data, min.SignPub)
+	}
+
+	if err != nil || !sign.Verify(env.Data, min.SignPub) {
+		return false
+	}
+
+	return header.Type == env.Type && header.From == env.From &&
+		header.To == env.To
+}
+
+func (wb *WhiteBox) flood(env *Envelope) {
+	enc := wb.newEncoder(env)
+
 	sentPeers := make(map[string]bool)
 	wb.PeerTable.Mutex.Lock()
-	for _, list := range wb.PeerTable.Table {
-		for curr := list.Front(); curr != nil; curr = curr.Next() {
-			currEntry := curr.Value.(*PeerEntry)
+	for i := 0; i < BUCKET_COUNT; i++ {
+		for _, currEntry := range wb.PeerTable.Buckets[i].Entries {
 			currPeer := currEntry.Peer
 
 			if currPeer == nil {
@@ -78,8 +118,7 @@ func (wb *WhiteBox) flood(env *Envelope) {
 			_, sent := sentPeers[currPeer.Id()]
 			if !sent {
 				if currPeer.Conn != nil {
-					currPeer.Conn.Write(
-						[]byte(fmt.Sprintf("%s\n", string(jsonEnv))))
+					enc.sendTo(currPeer)
 				} else {
 					wb.chatStatus(fmt.Sprintf(
 						"currPeer conn nil %s", currPeer.Id()))
@@ -110,15 +149,13 @@ func (wb *WhiteBox) sendSuggestionRequest(peer *Peer) {
 		return
 	}
 
-	env.Data = sign.Sign([]byte(jsonReq), wb.Self.SignPrv)
-
-	jsonEnv, err := json.Marshal(env)
+	env.Data, err = wb.signPayload(env.Type, env.To, "", jsonReq)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	peer.Conn.Write([]byte(fmt.Sprintf("%s\n", string(jsonEnv))))
+	wb.sendEnvelope(peer, &env)
 	wb.setStatus("suggestion request sent")
 }
 
@@ -128,15 +165,12 @@ func (wb *WhiteBox) sendSuggestions(peer *Peer, requestData []byte) {
 		From: wb.PeerSelf.Id(),
 		To:   peer.Id()}
 
-	// calculate ideal for id
-	peerIdealTable := calculateIdealTable(peer.SignPub)
-
-	// find closest for each and make a unique list
+	// find closest to each of the peer's ideal ids and make a unique list
 	peerSetHelper := make(map[string]bool)
 	peerSet := make([]Peer, 0)
 	peerSet = append(peerSet)
-	for _, idInt := range peerIdealTable {
-		closestPeerEntry := wb.findClosest(idInt.Bytes())
+	for idx := 0; idx < BUCKET_COUNT; idx++ {
+		closestPeerEntry := wb.findClosest(idealId(peer.SignPub, idx))
 		if closestPeerEntry == nil {
 			continue
 		}
@@ -174,15 +208,13 @@ func (wb *WhiteBox) sendSuggestions(peer *Peer, requestData []byte) {
 		return
 	}
 
-	env.Data = sign.Sign([]byte(jsonSuggestions), wb.Self.SignPrv)
-
-	jsonEnv, err := json.Marshal(env)
+	env.Data, err = wb.signPayload(env.Type, env.To, "", jsonSuggestions)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	peer.Conn.Write([]byte(fmt.Sprintf("%s\n", string(jsonEnv))))
+	wb.sendEnvelope(peer, &env)
 }
 
 func (wb *WhiteBox) SendBootstrap(addr, peerId string) {
@@ -191,9 +223,7 @@ func (wb *WhiteBox) SendBootstrap(addr, peerId string) {
 		From: wb.PeerSelf.Id(),
 		To:   peerId}
 
-	timePeer := MessageTimePeer{
-		Peer: wb.PeerSelf,
-		Time: time.Now().UTC()}
+	timePeer := wb.newTimePeer()
 
 	jsonBs, err := json.Marshal(timePeer)
 	if err != nil {
@@ -201,21 +231,24 @@ func (wb *WhiteBox) SendBootstrap(addr, peerId string) {
 		return
 	}
 
-	env.Data = sign.Sign([]byte(jsonBs), wb.Self.SignPrv)
-
-	jsonEnv, err := json.Marshal(env)
+	// the node at addr is only known by what was typed in, so the bootstrap
+	// is signed for whoever answers
+	env.Data, err = wb.signPayload(env.Type, "", "", jsonBs)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	conn, err := net.Dial("udp", addr)
+	conn, err := DialUDP(addr)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	conn.Write([]byte(fmt.Sprintf("%s\n", string(jsonEnv))))
+	// nothing is known about the peer yet, bare json is always understood
+	wb.newEncoder(&env).send(
+		conn, envelopeEncoding{Version: WIRE_VERSION_LEGACY})
+	conn.Close()
 	wb.setStatus("bs sent")
 }
 
@@ -225,9 +258,7 @@ func (wb *WhiteBox) sendVerify(peer *Peer) {
 		From: wb.PeerSelf.Id(),
 		To:   peer.Id()}
 
-	timePeer := MessageTimePeer{
-		Peer: wb.PeerSelf,
-		Time: time.Now().UTC()}
+	timePeer := wb.newTimePeer()
 
 	jsonBs, err := json.Marshal(timePeer)
 	if err != nil {
@@ -235,15 +266,13 @@ func (wb *WhiteBox) sendVerify(peer *Peer) {
 		return
 	}
 
-	env.Data = sign.Sign([]byte(jsonBs), wb.Self.SignPrv)
-
-	jsonEnv, err := json.Marshal(env)
+	env.Data, err = wb.signPayload(env.Type, env.To, "", jsonBs)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	peer.Conn.Write([]byte(fmt.Sprintf("%s\n", string(jsonEnv))))
+	wb.sendEnvelope(peer, &env)
 	wb.setStatus("verify sent")
 }
 
@@ -266,14 +295,13 @@ func (wb *WhiteBox) SendChat(msg string) {
 
 	sendPeers := make(map[string]*Peer)
 	wb.PeerTable.Mutex.Lock()
-	for _, list := range wb.PeerTable.Table {
-		curr := list.Front()
-		if curr == nil {
+	for i := 0; i < BUCKET_COUNT; i++ {
+		entries := wb.PeerTable.Buckets[i].Entries
+		if len(entries) == 0 {
 			continue
 		}
 
-		currEntry := curr.Value.(*PeerEntry)
-		currPeer := currEntry.Peer
+		currPeer := entries[0].Peer
 
 		sendPeers[currPeer.Id()] = currPeer
 	}
@@ -284,17 +312,16 @@ func (wb *WhiteBox) SendChat(msg string) {
 		return
 	}
 
-	env.Data = sign.Sign([]byte(jsonChat), wb.Self.SignPrv)
-	jsonEnv, err := json.Marshal(env)
+	env.Data, err = wb.signPayload(env.Type, env.To, "", jsonChat)
 	if err != nil {
 		log.Println(err)
-		wb.setStatus("error marshalling env to json")
 		return
 	}
+	enc := wb.newEncoder(&env)
 
 	for _, peer := range sendPeers {
 		// closed := box.EasySeal([]byte(jsonChat), peer.EncPub, wb.Self.EncPrv)
-		peer.Conn.Write([]byte(fmt.Sprintf("%s\n", string(jsonEnv))))
+		enc.sendTo(peer)
 	}
 	wb.setStatus("chat sent")
 }
@@ -305,9 +332,7 @@ func (wb *WhiteBox) sendAnnounce(peer *Peer) {
 		From: wb.PeerSelf.Id(),
 		To:   ""}
 
-	timePeer := MessageTimePeer{
-		Peer: wb.PeerSelf,
-		Time: time.Now().UTC()}
+	timePeer := wb.newTimePeer()
 
 	jsonAnnounce, err := json.Marshal(timePeer)
 	if err != nil {
@@ -315,15 +340,13 @@ func (wb *WhiteBox) sendAnnounce(peer *Peer) {
 		return
 	}
 
-	env.Data = sign.Sign([]byte(jsonAnnounce), wb.Self.SignPrv)
-
-	jsonEnv, err := json.Marshal(env)
+	env.Data, err = wb.signPayload(env.Type, env.To, "", jsonAnnounce)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	peer.Conn.Write([]byte(fmt.Sprintf("%s\n", string(jsonEnv))))
+	wb.sendEnvelope(peer, &env)
 	wb.setStatus("announce sent")
 }
 
@@ -343,14 +366,18 @@ func (wb *WhiteBox) SendDisconnect() {
 		return
 	}
 
-	env.Data = sign.Sign([]byte(jsonDisconnect), wb.Self.SignPrv)
+	env.Data, err = wb.signPayload(env.Type, env.To, "", jsonDisconnect)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	wb.flood(&env)
 	wb.setStatus("disconnect sent")
 }
 
 func (wb *WhiteBox) SendPings() {
 	for {
-		time.Sleep(time.Second * 30)
+		time.Sleep(wb.Config.PingInterval)
 		wb.removeStalePeers()
 		env := Envelope{
 			Type: "ping",
@@ -368,27 +395,24 @@ func (wb *WhiteBox) SendPings() {
 			return
 		}
 
-		env.Data = sign.Sign([]byte(jsonPing), wb.Self.SignPrv)
-
-		jsonEnv, err := json.Marshal(env)
+		env.Data, err = wb.signPayload(env.Type, env.To, "", jsonPing)
 		if err != nil {
 			log.Println(err)
 			return
 		}
 
+		enc := wb.newEncoder(&env)
+
 		peerSeen := make(map[string]bool)
 		wb.PeerTable.Mutex.Lock()
-		for i := 0; i < 256; i++ {
-			bucketList := wb.PeerTable.Table[i]
-			for curr := bucketList.Front(); curr != nil; curr = curr.Next() {
-				entry := curr.Value.(*PeerEntry)
+		for i := 0; i < BUCKET_COUNT; i++ {
+			for _, entry := range wb.PeerTable.Buckets[i].Entries {
 				if entry.Peer != nil {
 					log.Println("ping peer found", entry.Peer.Id()[:6])
 					_, seen := peerSeen[entry.Peer.Id()]
 					if !seen {
 						log.Println("pinging", entry.Peer.Id()[:6], "at", i)
-						entry.Peer.Conn.Write(
-							[]byte(fmt.Sprintf("%s\n", string(jsonEnv))))
+						enc.sendTo(entry.Peer)
 						peerSeen[entry.Peer.Id()] = true
 					}
 				} else {
@@ -416,7 +440,11 @@ func (wb *WhiteBox) sendPulse(min MinPeer) {
 		return
 	}
 
-	env.Data = sign.Sign([]byte(jsonPulse), wb.Self.SignPrv)
+	env.Data, err = wb.signPayload(env.Type, env.To, "", jsonPulse)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
 	wb.route(&env)
 }
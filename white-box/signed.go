@@ -0,0 +1,319 @@
+package whitebox
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kevinburke/nacl/sign"
+	"math"
+	"time"
+)
+
+// Signatures commit to what a payload is for, not just who made it. The
+// signed bytes start with a header naming the message type, sender,
+// recipient, party and send time, so a signature made for one message can't
+// be passed off as another, a pulse as a disconnect or a block sent to one
+// peer as one sent to someone else.
+//
+//	signature | marker | header length (2 bytes) | header json | body
+//
+// Bodies are json or binary, whatever the message used before. Peers that
+// don't advertise CAP_SIGNED only check a signature over the body, so until
+// Config.StrictSignatures is set they're sent that, and payloads signed that
+// way are taken with a header filled in from the envelope and the body. A
+// peer that advertises CAP_SIGNED signs everything it sends us directly with
+// a header, so a headerless payload addressed to us from one is refused.
+
+// Marks a payload with a header, never the start of a json or binary body.
+const SIGNED_HEADER_MARKER = 0x02
+
+type SignedHeader struct {
+	Type string
+	From string
+	// empty for floods and party wide messages
+	To    string `json:",omitempty"`
+	Party string `json:",omitempty"`
+	Time  time.Time
+}
+
+var errSignedShort = errors.New("error signed payload too short")
+var errSignedHeaderSize = errors.New("error signed header too large")
+var errSignedLegacy = errors.New("error payload signed without a header")
+
+// Sign body as a message of msgType from us to to, sent now. Only peers
+// known not to advertise CAP_SIGNED get a bare body. Floods and bootstraps
+// can reach anyone, so they get a header once every peer in the table
+// advertises CAP_SIGNED.
+func (wb *WhiteBox) signPayload(
+	msgType, to, partyId string, body []byte) ([]byte, error) {
+	legacy := false
+	if to == "" {
+		legacy = !wb.tableSigned()
+	} else {
+		legacy = wb.peerLacks(to, CAP_SIGNED)
+	}
+
+	if legacy && !wb.Config.StrictSignatures {
+		return sign.Sign(body, wb.Self.SignPrv), nil
+	}
+
+	return wb.signHeader(msgType, to, partyId, body)
+}
+
+// Whether the table has peers and every one of them advertises CAP_SIGNED.
+func (wb *WhiteBox) tableSigned() bool {
+	wb.PeerTable.Mutex.Lock()
+	defer wb.PeerTable.Mutex.Unlock()
+
+	count := 0
+	for i := 0; i < BUCKET_COUNT; i++ {
+		for _, entry := range wb.PeerTable.Buckets[i].Entries {
+			if !entry.Capabilities.Has(CAP_SIGNED) {
+				return false
+			}
+			count++
+		}
+	}
+
+	return count > 0
+}
+
+func (wb *WhiteBox) signHeader(
+	msgType, to, partyId string, body []byte) ([]byte, error) {
+	header := SignedHeader{
+		Type:  msgType,
+		From:  wb.PeerSelf.Id(),
+		To:    to,
+		Party: partyId,
+		Time:  time.Now().UTC()}
+
+	jsonHeader, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(jsonHeader) > math.MaxUint16 {
+		return nil, errSignedHeaderSize
+	}
+
+	payload := make([]byte, 3, 3+len(jsonHeader)+len(body))
+	payload[0] = SIGNED_HEADER_MARKER
+	binary.BigEndian.PutUint16(payload[1:], uint16(len(jsonHeader)))
+	payload = append(payload, jsonHeader...)
+	payload = append(payload, body...)
+	return sign.Sign(payload, wb.Self.SignPrv), nil
+}
+
+// Sign a party wide message, with a header once every member can check one.
+func (party *PartyLine) signPayload(
+	msgType string, body []byte) ([]byte, error) {
+	wb := party.WhiteBox
+	if wb.Config.StrictSignatures {
+		return wb.signHeader(msgType, "", party.Id, body)
+	}
+
+	party.MinList.Mutex.Lock()
+	members := make([]string, 0, len(party.MinList.Map))
+	for member, _ := range party.MinList.Map {
+		members = append(members, member)
+	}
+	party.MinList.Mutex.Unlock()
+
+	for _, member := range members {
+		if member != wb.PeerSelf.Id() && !wb.peerHas(member, CAP_SIGNED) {
+			return sign.Sign(body, wb.Self.SignPrv), nil
+		}
+	}
+
+	return wb.signHeader(msgType, "", party.Id, body)
+}
+
+// Header and body of a signed payload, without checking the signature.
+// Returns errSignedLegacy for a payload signed without a header.
+func splitPayload(signed []byte) (*SignedHeader, []byte, error) {
+	if len(signed) < sign.SignatureSize+1 {
+		return nil, nil, errSignedShort
+	}
+
+	payload := signed[sign.SignatureSize:]
+	if payload[0] != SIGNED_HEADER_MARKER {
+		return nil, nil, errSignedLegacy
+	}
+
+	if len(payload) < 3 {
+		return nil, nil, errSignedShort
+	}
+
+	length := int(binary.BigEndian.Uint16(payload[1:]))
+	if len(payload) < 3+length {
+		return nil, nil, errSignedShort
+	}
+
+	header := new(SignedHeader)
+	err := json.Unmarshal(payload[3:3+length], header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return header, payload[3+length:], nil
+}
+
+// Check a payload is signed by signer for a msgType message to us, in
+// partyId or outside any party when empty. to is who the message was sent
+// to, empty for floods and party wide messages. Returns the header and the
+// body.
+func (wb *WhiteBox) openPayload(signed []byte, signer *MinPeer,
+	msgType, to, partyId, caller string) (*SignedHeader, []byte, error) {
+	header, body, err := splitPayload(signed)
+	if err == errSignedLegacy {
+		return wb.openLegacy(signed, signer, msgType, to, partyId, caller)
+	}
+
+	if err != nil {
+		return nil, nil, errors.New(
+			fmt.Sprintf("error invalid signed header (%s)", caller))
+	}
+
+	if !sign.Verify(signed, signer.SignPub) {
+		return nil, nil, errors.New(
+			fmt.Sprintf("questionable message integrity discarding (%s)", caller))
+	}
+
+	if header.From != signer.Id() {
+		return nil, nil, errors.New(
+			fmt.Sprintf("error signed for another sender (%s)", caller))
+	}
+
+	if header.Type != msgType || header.Party != partyId {
+		return nil, nil, errors.New(
+			fmt.Sprintf("error signed for another message (%s)", caller))
+	}
+
+	if header.To != "" && header.To != wb.PeerSelf.Id() {
+		return nil, nil, errors.New(
+			fmt.Sprintf("error signed for another peer (%s)", caller))
+	}
+
+	return header, body, nil
+}
+
+// Check a party message is signed by the peer its header names, for this
+// party. Party messages are passed along by members other than their sender.
+func (party *PartyLine) openPayload(
+	partyEnv *PartyEnvelope, caller string) (*SignedHeader, []byte, error) {
+	from := ""
+	header, _, err := splitPayload(partyEnv.Data)
+	if err == errSignedLegacy {
+		from = legacySigner(partyEnv.Data[sign.SignatureSize:])
+	} else if err != nil {
+		return nil, nil, errors.New(
+			fmt.Sprintf("error invalid signed header (%s)", caller))
+	} else {
+		from = header.From
+	}
+
+	min, err := party.WhiteBox.IdToMin(from)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("error bad id (%s)", caller))
+	}
+
+	// fulfillments and keys are sent to one member, the rest to everyone
+	to := ""
+	if partyEnv.Type == "fulfillment" || partyEnv.Type == "key" {
+		to = party.WhiteBox.PeerSelf.Id()
+	}
+
+	return party.WhiteBox.openPayload(
+		partyEnv.Data, min, partyEnv.Type, to, party.Id, caller)
+}
+
+// Whether to take a payload signed without a header from peerId, sent to
+// to. Floods and party wide messages go out bare while the sender still has
+// version 1 peers or members, anything sent to us alone from a peer that
+// advertises CAP_SIGNED has a header.
+func (wb *WhiteBox) acceptsLegacy(peerId, to string) bool {
+	if wb.Config.StrictSignatures {
+		return false
+	}
+
+	return to == "" || !wb.peerHas(peerId, CAP_SIGNED)
+}
+
+// Open a payload signed without a header, from a peer that doesn't advertise
+// CAP_SIGNED. Only the body is signed, so the header is what we expected and
+// the send time the body carries.
+func (wb *WhiteBox) openLegacy(signed []byte, signer *MinPeer,
+	msgType, to, partyId, caller string) (*SignedHeader, []byte, error) {
+	if !wb.acceptsLegacy(signer.Id(), to) {
+		return nil, nil, errors.New(
+			fmt.Sprintf("error signed without a header (%s)", caller))
+	}
+
+	if !sign.Verify(signed, signer.SignPub) {
+		return nil, nil, errors.New(
+			fmt.Sprintf("questionable message integrity discarding (%s)", caller))
+	}
+
+	body := signed[sign.SignatureSize:]
+	sent, timed := legacyTime(body)
+	if !timed {
+		// fulfillments carry no time, they answer our own requests
+		// and are checked against the pack
+		if msgType != "fulfillment" {
+			return nil, nil, errors.New(
+				fmt.Sprintf("error signed without a time (%s)", caller))
+		}
+		sent = time.Now().UTC()
+	}
+
+	header := &SignedHeader{
+		Type:  msgType,
+		From:  signer.Id(),
+		To:    to,
+		Party: partyId,
+		Time:  sent}
+	return header, body, nil
+}
+
+// Send time of a body signed without a header, false when it has none.
+// Binary bodies never do, json ones carry it in Time or, for nodes, in
+// TimePeer.
+func legacyTime(body []byte) (time.Time, bool) {
+	if len(body) > 0 && body[0] == BINARY_MARKER {
+		return time.Time{}, false
+	}
+
+	var timed struct {
+		Time     time.Time
+		TimePeer struct {
+			Time time.Time
+		}
+	}
+
+	json.Unmarshal(body, &timed)
+	if timed.Time.IsZero() {
+		timed.Time = timed.TimePeer.Time
+	}
+
+	return timed.Time, !timed.Time.IsZero()
+}
+
+// Who signed a party body without a header, every party message names its
+// sender.
+func legacySigner(body []byte) string {
+	if len(body) > 0 && body[0] == BINARY_MARKER {
+		partyFulfillment, err := unmarshalPartyFulfillment(body)
+		if err != nil {
+			return ""
+		}
+		return partyFulfillment.PeerId
+	}
+
+	var named struct {
+		PeerId string
+	}
+
+	json.Unmarshal(body, &named)
+	return named.PeerId
+}
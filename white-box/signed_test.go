@@ -0,0 +1,305 @@
+package whitebox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/kevinburke/nacl/sign"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignedPayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.signed")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	strict := DefaultConfig()
+	strict.StrictSignatures = true
+
+	var self0, self1 Self
+	wb0 := New(dir, "127.0.0.1", "3499", self0, strict)
+	wb1 := New(dir, "127.0.0.1", "4919", self1, strict)
+
+	body := []byte(`{"MessageType":1}`)
+	signed, err := wb0.signPayload("pulse", wb1.PeerSelf.Id(), "", body)
+	if err != nil {
+		t.Fatalf("Error signing payload: %v", err)
+	}
+
+	signer := wb0.PeerSelf.Min()
+	header, opened, err := wb1.openPayload(
+		signed, &signer, "pulse", wb1.PeerSelf.Id(), "", "test")
+	if err != nil {
+		t.Fatalf("Error opening payload: %v", err)
+	}
+
+	if !bytes.Equal(opened, body) || header.From != wb0.PeerSelf.Id() {
+		t.Errorf("Opened payload does not match:")
+		t.Errorf("Got: %s from %s", opened, header.From)
+		t.Errorf("Expecting: %s from %s", body, wb0.PeerSelf.Id())
+	}
+
+	party, err := wb0.signPayload("chat", "", "coolparty", body)
+	if err != nil {
+		t.Fatalf("Error signing payload: %v", err)
+	}
+
+	tampered := append([]byte{}, signed...)
+	tampered[len(tampered)-2] ^= 1
+
+	other := wb1.PeerSelf.Min()
+	tables := []struct {
+		signed  []byte
+		signer  *MinPeer
+		opener  *WhiteBox
+		msgType string
+		partyId string
+		err     string
+	}{
+		{signed, &signer, wb1, "disconnect", "", "another message"},
+		{signed, &signer, wb0, "pulse", "", "another peer"},
+		{signed, &other, wb1, "pulse", "", "integrity"},
+		{tampered, &signer, wb1, "pulse", "", "integrity"},
+		{signed[:70], &signer, wb1, "pulse", "", "signed header"},
+		{party, &signer, wb1, "chat", "", "another message"},
+		{party, &signer, wb1, "chat", "otherparty", "another message"},
+	}
+
+	for _, table := range tables {
+		_, _, err := table.opener.openPayload(
+			table.signed, table.signer, table.msgType, "", table.partyId, "test")
+		if err == nil || !strings.Contains(err.Error(), table.err) {
+			t.Errorf("Payload for %s opened wrong:", table.msgType)
+			t.Errorf("Got: %v", err)
+			t.Errorf("Expecting: error with %q", table.err)
+		}
+	}
+
+	_, _, err = wb1.openPayload(party, &signer, "chat", "", "coolparty", "test")
+	if err != nil {
+		t.Errorf("Party payload did not open: %v", err)
+	}
+
+	// a pulse's signature doesn't make a disconnect
+	env := &Envelope{
+		Type: "disconnect",
+		From: wb0.PeerSelf.Id(),
+		To:   wb1.PeerSelf.Id(),
+		Data: signed}
+	_, _, err = wb1.openEnvelope(env, "disconnect")
+	if err == nil {
+		t.Errorf("Pulse verified as a disconnect.")
+	}
+}
+
+func TestSignedInterop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.interop")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	strict := DefaultConfig()
+	strict.StrictSignatures = true
+
+	var self0, self1, self2 Self
+	wb := New(dir, "127.0.0.1", "3499", self0, DefaultConfig())
+	old := New(dir, "127.0.0.1", "4919", self1, DefaultConfig())
+	wbStrict := New(dir, "127.0.0.1", "5003", self2, strict)
+	id := wb.PeerSelf.Id()
+	idOld := old.PeerSelf.Id()
+
+	// version 1 peers check a signature over the body and read it as is
+	versionOne := MessageTimePeer{Peer: old.PeerSelf}
+	wb.recordProtocol(idOld, &versionOne)
+	body := []byte(`{"MessageType":1}`)
+	signed, err := wb.signPayload("pulse", idOld, "", body)
+	if err != nil {
+		t.Fatalf("Error signing payload: %v", err)
+	}
+
+	if !sign.Verify(signed, wb.Self.SignPub) ||
+		!bytes.Equal(signed[sign.SignatureSize:], body) {
+		t.Errorf("Payload for a version 1 peer does not match:")
+		t.Errorf("Got: %q", signed[sign.SignatureSize:])
+		t.Errorf("Expecting: %q", body)
+	}
+
+	// and sign bodies the same way
+	sent := time.Now().UTC().Round(time.Second)
+	ping := fmt.Sprintf(`{"Time":"%s"}`, sent.Format(time.RFC3339))
+	legacy := sign.Sign([]byte(ping), old.Self.SignPrv)
+	env := &Envelope{Type: "ping", From: idOld, To: id, Data: legacy}
+	header, opened, err := wb.openEnvelope(env, "ping")
+	if err != nil || string(opened) != ping {
+		t.Fatalf("Version 1 payload did not open: %v", err)
+	}
+
+	if header.From != idOld || header.Type != "ping" ||
+		!header.Time.Equal(sent) {
+		t.Errorf("Version 1 header does not match:")
+		t.Errorf("Got: %+v", header)
+		t.Errorf("Expecting: ping from %s at %v", idOld, sent)
+	}
+
+	_, _, err = wbStrict.openEnvelope(env, "ping")
+	if err == nil || !strings.Contains(err.Error(), "without a header") {
+		t.Errorf("Version 1 payload opened while strict:")
+		t.Errorf("Got: %v", err)
+		t.Errorf("Expecting: error signed without a header")
+	}
+
+	// floods go out bare until every peer in the table checks headers
+	wb.addPeer(&old.PeerSelf, time.Now().UTC())
+	signed, err = wb.signPayload("bootstrap", "", "", body)
+	if err != nil || !bytes.Equal(signed[sign.SignatureSize:], body) {
+		t.Errorf("Flood signed with a header: %v", err)
+	}
+
+	// peers that advertise headers get them, as do peers we know nothing of
+	timePeer := old.newTimePeer()
+	wb.recordProtocol(idOld, &timePeer)
+	for _, to := range []string{idOld, wbStrict.PeerSelf.Id()} {
+		signed, err = wb.signPayload("pulse", to, "", body)
+		if err != nil {
+			t.Fatalf("Error signing payload: %v", err)
+		}
+
+		header, _, err = splitPayload(signed)
+		if err != nil || header.To != to {
+			t.Errorf("Payload for %s has no header: %v", to[:6], err)
+		}
+	}
+
+	signed, err = wb.signPayload("bootstrap", "", "", body)
+	_, _, splitErr := splitPayload(signed)
+	if err != nil || splitErr != nil {
+		t.Errorf("Flood has no header once the table checks them: %v, %v",
+			err, splitErr)
+	}
+
+	// and don't get to send us anything directly without one
+	_, _, err = wb.openEnvelope(env, "ping")
+	if err == nil || !strings.Contains(err.Error(), "without a header") {
+		t.Errorf("Headerless payload opened from a version 2 peer:")
+		t.Errorf("Got: %v", err)
+		t.Errorf("Expecting: error signed without a header")
+	}
+
+	env.To = ""
+	_, _, err = wb.openEnvelope(env, "ping")
+	if err != nil {
+		t.Errorf("Headerless flood from a version 2 peer did not open: %v", err)
+	}
+
+	// party messages get headers once every member can check them
+	party := new(PartyLine)
+	party.Id = "coolparty"
+	party.WhiteBox = wb
+	party.MinList.Map = map[string]int{id: 0, idOld: 0}
+	party.MinList.Mutex = new(sync.Mutex)
+
+	signed, err = party.signPayload("chat", body)
+	_, _, splitErr = splitPayload(signed)
+	if err != nil || splitErr != nil {
+		t.Errorf("Party payload has no header: %v, %v", err, splitErr)
+	}
+
+	party.MinList.Map[wbStrict.PeerSelf.Id()] = 0
+	signed, err = party.signPayload("chat", body)
+	_, _, splitErr = splitPayload(signed)
+	if err != nil || splitErr != errSignedLegacy {
+		t.Errorf("Party payload with a version 1 member has a header:")
+		t.Errorf("Got: %v", splitErr)
+		t.Errorf("Expecting: %v", errSignedLegacy)
+	}
+
+	// version 1 party messages are from the member they name
+	partyChat := PartyChat{
+		PeerId:  idOld,
+		PartyId: party.Id,
+		Message: "hello",
+		Time:    sent}
+	jsonPartyChat, err := json.Marshal(partyChat)
+	if err != nil {
+		t.Fatalf("Error marshalling chat: %v", err)
+	}
+
+	partyEnv := &PartyEnvelope{
+		Type:    "chat",
+		From:    id,
+		PartyId: party.Id,
+		Data:    sign.Sign(jsonPartyChat, old.Self.SignPrv)}
+	header, _, err = party.openPayload(partyEnv, "test")
+	if err != nil || header.From != idOld || header.Party != party.Id {
+		t.Errorf("Version 1 party payload does not match:")
+		t.Errorf("Got: %+v (%v)", header, err)
+		t.Errorf("Expecting: from %s in %s", idOld, party.Id)
+	}
+
+	partyChat.PeerId = id
+	jsonPartyChat, _ = json.Marshal(partyChat)
+	partyEnv.Data = sign.Sign(jsonPartyChat, old.Self.SignPrv)
+	_, _, err = party.openPayload(partyEnv, "test")
+	if err == nil {
+		t.Errorf("Version 1 party payload opened for another member.")
+	}
+}
+
+func TestLegacyTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.legacy")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self0, self1 Self
+	wb := New(dir, "127.0.0.1", "3499", self0, DefaultConfig())
+	old := New(dir, "127.0.0.1", "4919", self1, DefaultConfig())
+	signer := old.PeerSelf.Min()
+
+	sent := time.Now().UTC().Round(time.Second)
+	timed := fmt.Sprintf(`{"Time":"%s"}`, sent.Format(time.RFC3339))
+	nodes := fmt.Sprintf(`{"TimePeer":{"Time":"%s"}}`, sent.Format(time.RFC3339))
+	binary := []byte{BINARY_MARKER, 0, 1, 2}
+
+	tables := []struct {
+		name    string
+		body    []byte
+		msgType string
+		err     string
+	}{
+		{"timed", []byte(timed), "ping", ""},
+		{"nodes", []byte(nodes), "nodes", ""},
+		{"untimed", []byte(`{}`), "ping", "without a time"},
+		{"binary", binary, "ping", "without a time"},
+		{"binary fulfillment", binary, "fulfillment", ""},
+	}
+
+	for _, table := range tables {
+		signed := sign.Sign(table.body, old.Self.SignPrv)
+		header, _, err := wb.openPayload(
+			signed, &signer, table.msgType, "", "", "test")
+		if table.err != "" {
+			if err == nil || !strings.Contains(err.Error(), table.err) {
+				t.Errorf("Legacy %s payload opened wrong:", table.name)
+				t.Errorf("Got: %v", err)
+				t.Errorf("Expecting: error with %q", table.err)
+			}
+			continue
+		}
+
+		if err != nil || header.Time.IsZero() {
+			t.Errorf("Legacy %s payload has no time:", table.name)
+			t.Errorf("Got: %+v (%v)", header, err)
+			t.Errorf("Expecting: a send time")
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package whitebox
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// How long to let suggestions fill the peer table before rejoining parties.
+const REJOIN_DELAY = 5 * time.Second
+
+// Disk format for a party or pending invite.
+type SavedParty struct {
+	Id      string
+	MinList []string
+	// Newest party chat time seen from each member, their older chats are
+	// dropped after a restart.
+	SeenWatermarks map[string]time.Time `json:",omitempty"`
+}
+
+// Disk format for all the parties of one identity.
+type SavedState struct {
+	SelfId         string
+	Parties        []SavedParty
+	PendingInvites []SavedParty
+}
+
+// Lock and flags for the on disk party state.
+type LockingState struct {
+	// Set after the final save on exit so leaving parties isn't persisted.
+	Frozen bool
+	Mutex  *sync.Mutex
+}
+
+func (party *PartyLine) toSavedParty() SavedParty {
+	var saved SavedParty
+	saved.Id = party.Id
+
+	party.MinList.Mutex.Lock()
+	saved.MinList = make([]string, 0, len(party.MinList.Map))
+	for id, _ := range party.MinList.Map {
+		saved.MinList = append(saved.MinList, id)
+	}
+	party.MinList.Mutex.Unlock()
+
+	party.ChatLock.Lock()
+	saved.SeenWatermarks = make(map[string]time.Time)
+	for id, watermark := range party.SeenWatermarks {
+		saved.SeenWatermarks[id] = watermark
+	}
+	for id, lastChat := range party.LastChats {
+		if lastChat.After(saved.SeenWatermarks[id]) {
+			saved.SeenWatermarks[id] = lastChat
+		}
+	}
+	party.ChatLock.Unlock()
+
+	return saved
+}
+
+func (wb *WhiteBox) restoreParty(saved SavedParty) (*PartyLine, error) {
+	match, err := regexp.MatchString("^[a-zA-Z0-9]{32}$", saved.Id)
+	if err != nil || !match {
+		return nil, errors.New("invalid party id")
+	}
+
+	party := new(PartyLine)
+	party.Id = saved.Id
+	party.MinList.Map = make(map[string]int)
+	party.MinList.Mutex = new(sync.Mutex)
+	party.SeenChats = NewDedupCache(DEDUP_SIZE, DEDUP_TTL)
+	party.LastChats = make(map[string]time.Time)
+	party.SeenWatermarks = make(map[string]time.Time)
+	for id, watermark := range saved.SeenWatermarks {
+		party.SeenWatermarks[id] = watermark
+	}
+	party.ChatLock = new(sync.Mutex)
+	party.Packs = make(map[string]LockingPack)
+	party.PacksLock = new(sync.Mutex)
+	party.WhiteBox = wb
+
+	for _, id := range saved.MinList {
+		_, err := wb.IdToMin(id)
+		if err != nil {
+			continue
+		}
+		party.MinList.Set(id, 0)
+	}
+
+	return party, nil
+}
+
+func (wb *WhiteBox) statePath() string {
+	return filepath.Join(
+		wb.SharedDir, "state", wb.PeerSelf.ShortId()+".parties")
+}
+
+// Read parties and pending invites saved by a previous run of this identity.
+func (wb *WhiteBox) LoadState() {
+	contents, err := ioutil.ReadFile(wb.statePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println(err)
+			wb.setStatus("error could not read party state")
+		}
+		return
+	}
+
+	state := new(SavedState)
+	err = json.Unmarshal(contents, state)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not unmarshal party state")
+		return
+	}
+
+	if state.SelfId != wb.PeerSelf.Id() {
+		wb.setStatus("error party state belongs to a different id")
+		return
+	}
+
+	wb.Parties.Mutex.Lock()
+	for _, saved := range state.Parties {
+		party, err := wb.restoreParty(saved)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		party.MinList.Set(wb.PeerSelf.Id(), 0)
+		wb.Parties.Map[party.Id] = party
+	}
+	wb.Parties.Mutex.Unlock()
+
+	wb.PendingInvites.Mutex.Lock()
+	for _, saved := range state.PendingInvites {
+		party, err := wb.restoreParty(saved)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		wb.PendingInvites.Map[party.Id] = party
+	}
+	wb.PendingInvites.Mutex.Unlock()
+
+	if len(state.Parties) > 0 || len(state.PendingInvites) > 0 {
+		wb.chatStatus("restored parties, rejoining once bootstrapped")
+	}
+}
+
+// Write parties and pending invites to disk.
+func (wb *WhiteBox) SaveState() {
+	wb.State.Mutex.Lock()
+	defer wb.State.Mutex.Unlock()
+	if wb.State.Frozen {
+		return
+	}
+
+	state := new(SavedState)
+	state.SelfId = wb.PeerSelf.Id()
+	state.Parties = make([]SavedParty, 0)
+	state.PendingInvites = make([]SavedParty, 0)
+
+	wb.Parties.Mutex.Lock()
+	for _, party := range wb.Parties.Map {
+		state.Parties = append(state.Parties, party.toSavedParty())
+	}
+	wb.Parties.Mutex.Unlock()
+
+	wb.PendingInvites.Mutex.Lock()
+	for _, party := range wb.PendingInvites.Map {
+		state.PendingInvites = append(state.PendingInvites, party.toSavedParty())
+	}
+	wb.PendingInvites.Mutex.Unlock()
+
+	path := wb.statePath()
+	empty := len(state.Parties) == 0 && len(state.PendingInvites) == 0
+	exists, _ := pathExists(path)
+	if empty && !exists {
+		// don't litter state files for throwaway ids
+		return
+	}
+
+	jsonState, err := json.Marshal(state)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not marshal party state")
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not create state dir")
+		return
+	}
+
+	err = writeFileAtomic(path, jsonState, 0600)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not write party state")
+	}
+}
+
+// Flag the party state for saving without blocking the caller. Safe to call
+// while holding the party locks.
+func (wb *WhiteBox) stateChanged() {
+	select {
+	case wb.StateChan <- true:
+	default:
+	}
+}
+
+// Save party state when it changes, and party state and known peers every
+// Config.StateSaveInterval.
+func (wb *WhiteBox) StateSaver() {
+	ticker := time.NewTicker(wb.Config.StateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wb.StateChan:
+		case <-ticker.C:
+			wb.SavePeers()
+		}
+		wb.SaveState()
+	}
+}
+
+// Announce to every party after the peer table goes from empty to bootstrapped.
+func (wb *WhiteBox) rejoinParties() {
+	time.Sleep(REJOIN_DELAY)
+
+	wb.Parties.Mutex.Lock()
+	parties := make([]*PartyLine, 0, len(wb.Parties.Map))
+	for _, party := range wb.Parties.Map {
+		parties = append(parties, party)
+	}
+	wb.Parties.Mutex.Unlock()
+
+	for _, party := range parties {
+		party.SendAnnounce()
+	}
+
+	if len(parties) > 0 {
+		wb.setStatus("rejoined parties")
+	}
+}
+
+func pathExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return true, err
+}
@@ -0,0 +1,122 @@
+package whitebox
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.state")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb0 := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	partyId := wb0.PartyStart("coolname")
+
+	wb0.Parties.Mutex.Lock()
+	party0 := wb0.Parties.Map[partyId]
+	wb0.Parties.Mutex.Unlock()
+
+	friendId := wb0.PeerSelf.Id()[:64] + "." + wb0.PeerSelf.Id()[:64]
+	party0.MinList.Set(friendId, 0)
+	lastChat := time.Now().UTC()
+	party0.LastChats[friendId] = lastChat
+
+	wb0.SaveState()
+
+	wb1 := New(dir, "127.0.0.1", "3499", wb0.Self, DefaultConfig())
+	wb1.Parties.Mutex.Lock()
+	party1, ok := wb1.Parties.Map[partyId]
+	wb1.Parties.Mutex.Unlock()
+	if !ok {
+		t.Fatalf("Party %s not restored.", partyId)
+	}
+
+	if party1.MinList.Len() != 2 {
+		t.Errorf("Restored min list has unexpected length:")
+		t.Errorf("Got: %d", party1.MinList.Len())
+		t.Errorf("Expecting: 2")
+	}
+
+	_, ok = party1.MinList.Get(friendId)
+	if !ok {
+		t.Errorf("Restored min list is missing %s", friendId)
+	}
+
+	if !party1.SeenWatermarks[friendId].Equal(lastChat) {
+		t.Errorf("Restored watermark does not match:")
+		t.Errorf("Got: %s", party1.SeenWatermarks[friendId])
+		t.Errorf("Expecting: %s", lastChat)
+	}
+
+	var other Self
+	wb2 := New(dir, "127.0.0.1", "3499", other, DefaultConfig())
+	if wb2.Parties.Len() != 0 {
+		t.Errorf("Parties restored for a different id.")
+	}
+}
+
+func TestChatWatermark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.watermark")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb0 := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	partyId := wb0.PartyStart("coolname")
+
+	wb0.Parties.Mutex.Lock()
+	party0 := wb0.Parties.Map[partyId]
+	wb0.Parties.Mutex.Unlock()
+
+	now := time.Now().UTC()
+	if !party0.newChat("liar", now.Add(time.Hour)) {
+		t.Errorf("Future dated chat not shown.")
+	}
+
+	if !party0.newChat("friend", now) {
+		t.Errorf("Chat not shown.")
+	}
+
+	if party0.newChat("friend", now) {
+		t.Errorf("Chat shown twice.")
+	}
+
+	latest := time.Now().UTC().Add(wb0.Config.MessageWindow)
+	if party0.LastChats["liar"].After(latest) {
+		t.Errorf("Future dated chat moved the watermark past the clock skew.")
+	}
+
+	wb0.SaveState()
+
+	wb1 := New(dir, "127.0.0.1", "3499", wb0.Self, DefaultConfig())
+	wb1.Parties.Mutex.Lock()
+	party1 := wb1.Parties.Map[partyId]
+	wb1.Parties.Mutex.Unlock()
+
+	tables := []struct {
+		peerId string
+		sent   time.Time
+		shown  bool
+	}{
+		{"friend", now, false},
+		{"friend", now.Add(time.Second), true},
+		{"other", now.Add(-time.Minute), true},
+	}
+
+	for _, table := range tables {
+		shown := party1.newChat(table.peerId, table.sent)
+		if shown != table.shown {
+			t.Errorf("Chat from %s after reload shown wrong:", table.peerId)
+			t.Errorf("Got: %t", shown)
+			t.Errorf("Expecting: %t", table.shown)
+		}
+	}
+}
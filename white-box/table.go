@@ -0,0 +1,125 @@
+package whitebox
+
+import (
+	"bytes"
+	"github.com/kevinburke/nacl/sign"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// Ids in the table are signing public keys, one bucket per bit of them.
+const (
+	ID_SIZE      = sign.PublicKeySize
+	BUCKET_COUNT = ID_SIZE * 8
+)
+
+// Xor of two ids. Compares like the big endian number it is.
+type Distance [ID_SIZE]byte
+
+// Byte i of an id right aligned to ID_SIZE, short ids are zero padded.
+func idByte(id []byte, i int) byte {
+	offset := len(id) - ID_SIZE
+	if i+offset < 0 {
+		return 0
+	}
+
+	return id[i+offset]
+}
+
+func xorDistance(a, b []byte) Distance {
+	var dist Distance
+	for i := 0; i < ID_SIZE; i++ {
+		dist[i] = idByte(a, i) ^ idByte(b, i)
+	}
+
+	return dist
+}
+
+func (dist Distance) Less(other Distance) bool {
+	return bytes.Compare(dist[:], other[:]) < 0
+}
+
+// Bucket for an id this far from us, the highest bit set counting from the
+// low end. The far half of the id space is the last bucket, ids sharing all
+// but the last bit with us are bucket 0, and so is our own.
+func (dist Distance) Bucket() int {
+	for i, b := range dist {
+		if b != 0 {
+			return (ID_SIZE-1-i)*8 + bits.Len8(b) - 1
+		}
+	}
+
+	return 0
+}
+
+// The id that differs from id only at bit idx, the ideal peer for bucket idx.
+func idealId(id []byte, idx int) []byte {
+	ideal := make([]byte, ID_SIZE)
+	for i := range ideal {
+		ideal[i] = idByte(id, i)
+	}
+
+	ideal[ID_SIZE-1-idx/8] ^= 1 << uint(idx%8)
+	return ideal
+}
+
+// Peers whose distance from us has the same highest bit, nearest first, and
+// recently seen peers waiting for room, newest first.
+type Bucket struct {
+	Entries      []*PeerEntry
+	Replacements []*PeerEntry
+	// last time the bucket got a new peer or a refresh
+	Touched time.Time
+}
+
+// The rest of these are called with the table lock held.
+
+func (table *LockingPeerTable) entry(id []byte) *PeerEntry {
+	idx, exists := table.Index[string(id)]
+	if !exists {
+		return nil
+	}
+
+	for _, entry := range table.Buckets[idx].Entries {
+		if bytes.Equal(entry.Id, id) {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// Insert an entry in distance order.
+func (table *LockingPeerTable) insert(idx int, entry *PeerEntry) {
+	bucket := &table.Buckets[idx]
+	pos := sort.Search(len(bucket.Entries), func(i int) bool {
+		return entry.Distance.Less(bucket.Entries[i].Distance)
+	})
+
+	bucket.Entries = append(bucket.Entries, nil)
+	copy(bucket.Entries[pos+1:], bucket.Entries[pos:])
+	bucket.Entries[pos] = entry
+	table.Index[string(entry.Id)] = idx
+}
+
+// Take an entry out of the table, nil if it wasn't there.
+func (table *LockingPeerTable) remove(id []byte) *PeerEntry {
+	idx, exists := table.Index[string(id)]
+	if !exists {
+		return nil
+	}
+
+	delete(table.Index, string(id))
+	bucket := &table.Buckets[idx]
+	for pos, entry := range bucket.Entries {
+		if bytes.Equal(entry.Id, id) {
+			copy(bucket.Entries[pos:], bucket.Entries[pos+1:])
+			bucket.Entries[len(bucket.Entries)-1] = nil
+			bucket.Entries = bucket.Entries[:len(bucket.Entries)-1]
+			return entry
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,306 @@
+package whitebox
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stream transport limits. Streams carry the same frames as UDP, back to
+// back, over TCP on the node's port number. A stream has to send its first
+// frame quickly and one host only gets a few of the inbound slots, so idle
+// connections can't tie them all up.
+const (
+	STREAM_DIAL_TIMEOUT        = 3 * time.Second
+	STREAM_WRITE_TIMEOUT       = 10 * time.Second
+	STREAM_FIRST_FRAME_TIMEOUT = 5 * time.Second
+	STREAM_IDLE_TIMEOUT        = 2 * time.Minute
+	MAX_INBOUND_STREAMS        = 64
+	MAX_HOST_STREAMS           = 4
+)
+
+var errStreamFrame = errors.New("error stream frame")
+
+// Sends frames to one peer. Every peer has a UDP transport in Peer.Conn,
+// peers advertising CAP_STREAM can also get a stream for bulk transfers.
+type Transport interface {
+	Send(datagram []byte) error
+	Close() error
+}
+
+type UDPTransport struct {
+	Conn net.Conn
+}
+
+func DialUDP(address string) (*UDPTransport, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UDPTransport{Conn: conn}, nil
+}
+
+func (transport *UDPTransport) Send(datagram []byte) error {
+	_, err := transport.Conn.Write(datagram)
+	return err
+}
+
+func (transport *UDPTransport) Close() error {
+	return transport.Conn.Close()
+}
+
+// TCP gives bulk transfers flow control and congestion handling.
+type StreamTransport struct {
+	Conn  net.Conn
+	Mutex *sync.Mutex
+}
+
+func DialStream(address string) (*StreamTransport, error) {
+	conn, err := net.DialTimeout("tcp", address, STREAM_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamTransport{Conn: conn, Mutex: new(sync.Mutex)}, nil
+}
+
+func (transport *StreamTransport) Send(datagram []byte) error {
+	transport.Mutex.Lock()
+	defer transport.Mutex.Unlock()
+
+	transport.Conn.SetWriteDeadline(time.Now().Add(STREAM_WRITE_TIMEOUT))
+	_, err := transport.Conn.Write(datagram)
+	return err
+}
+
+func (transport *StreamTransport) Close() error {
+	return transport.Conn.Close()
+}
+
+// Outbound streams by peer id.
+type LockingStreams struct {
+	Map   map[string]*StreamTransport
+	Mutex *sync.Mutex
+}
+
+// Inbound streams by remote host.
+type streamHosts struct {
+	Map   map[string]int
+	Mutex *sync.Mutex
+}
+
+func (hosts *streamHosts) take(host string) bool {
+	hosts.Mutex.Lock()
+	defer hosts.Mutex.Unlock()
+	if hosts.Map[host] >= MAX_HOST_STREAMS {
+		return false
+	}
+
+	hosts.Map[host]++
+	return true
+}
+
+func (hosts *streamHosts) release(host string) {
+	hosts.Mutex.Lock()
+	defer hosts.Mutex.Unlock()
+	hosts.Map[host]--
+	if hosts.Map[host] <= 0 {
+		delete(hosts.Map, host)
+	}
+}
+
+// Listen for streams on the UDP port number. Streams are optional, nil means
+// we don't take them.
+func (wb *WhiteBox) ListenStream(address string, port uint16) net.Listener {
+	addr := net.TCPAddr{
+		Port: int(port),
+		IP:   net.ParseIP(address),
+	}
+
+	listener, err := net.ListenTCP("tcp", &addr)
+	if err != nil {
+		log.Println(err)
+		wb.setStatus("error could not listen for streams, bulk transfers over udp")
+		return nil
+	}
+
+	return listener
+}
+
+func (wb *WhiteBox) RecvStreams(listener net.Listener) {
+	if listener == nil {
+		return
+	}
+	defer listener.Close()
+
+	slots := make(chan bool, MAX_INBOUND_STREAMS)
+	hosts := streamHosts{Map: make(map[string]int), Mutex: new(sync.Mutex)}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println(err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			host = conn.RemoteAddr().String()
+		}
+
+		if !hosts.take(host) {
+			log.Println("too many streams from host, closing", host)
+			conn.Close()
+			continue
+		}
+
+		select {
+		case slots <- true:
+			go func() {
+				wb.recvStream(conn)
+				hosts.release(host)
+				<-slots
+			}()
+		default:
+			hosts.release(host)
+			log.Println("too many streams, closing", conn.RemoteAddr())
+			conn.Close()
+		}
+	}
+}
+
+// Read frames off a stream until it errors or goes idle.
+func (wb *WhiteBox) recvStream(conn net.Conn) {
+	defer conn.Close()
+
+	source := conn.RemoteAddr().String()
+	header := make([]byte, FRAME_HEADER_SIZE)
+	timeout := STREAM_FIRST_FRAME_TIMEOUT
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			if err != io.EOF {
+				log.Println(err)
+			}
+			return
+		}
+
+		length := binary.BigEndian.Uint32(header[4:8])
+		if string(header[:2]) != FRAME_MAGIC || length > MAX_PAYLOAD_SIZE {
+			atomic.AddUint64(&wb.TransportStats.Malformed, 1)
+			wb.setStatus(errStreamFrame.Error())
+			return
+		}
+
+		datagram := make([]byte, FRAME_HEADER_SIZE+int(length))
+		copy(datagram, header)
+		_, err = io.ReadFull(conn, datagram[FRAME_HEADER_SIZE:])
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		wb.handleDatagram(source, datagram)
+		timeout = STREAM_IDLE_TIMEOUT
+	}
+}
+
+// A peer we talk to directly.
+func (wb *WhiteBox) tablePeer(peerId string) *Peer {
+	entry := wb.tableEntry(peerId)
+	if entry == nil {
+		return nil
+	}
+
+	return entry.Peer
+}
+
+// Stream to a direct peer that takes them, dialing one if needed. Nil when
+// the peer is not in the table, doesn't stream or can't be reached.
+func (wb *WhiteBox) streamTo(peerId string) *StreamTransport {
+	if !wb.peerHas(peerId, CAP_STREAM) {
+		return nil
+	}
+
+	wb.Streams.Mutex.Lock()
+	stream, exists := wb.Streams.Map[peerId]
+	wb.Streams.Mutex.Unlock()
+	if exists {
+		return stream
+	}
+
+	peer := wb.tablePeer(peerId)
+	if peer == nil {
+		return nil
+	}
+
+	stream, err := DialStream(peer.Address)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	wb.Streams.Mutex.Lock()
+	defer wb.Streams.Mutex.Unlock()
+	existing, exists := wb.Streams.Map[peerId]
+	if exists {
+		stream.Close()
+		return existing
+	}
+
+	wb.Streams.Map[peerId] = stream
+	return stream
+}
+
+func (wb *WhiteBox) dropStream(peerId string) {
+	wb.Streams.Mutex.Lock()
+	stream, exists := wb.Streams.Map[peerId]
+	delete(wb.Streams.Map, peerId)
+	wb.Streams.Mutex.Unlock()
+
+	if exists {
+		stream.Close()
+	}
+}
+
+// Send a large directed envelope over a stream when the recipient is a direct
+// peer that takes them, otherwise route it reliably over udp.
+func (wb *WhiteBox) routeBulk(env *Envelope, label string) {
+	stream := wb.streamTo(env.To)
+	if stream == nil {
+		wb.routeReliable(env, label, true)
+		return
+	}
+
+	encoding := envelopeEncoding{
+		Version:  WIRE_VERSION_JSON,
+		Fragment: wb.peerHas(env.To, CAP_FRAGMENT)}
+	if wb.peerDecodesBinary(env.To) {
+		encoding.Version = WIRE_VERSION_BINARY
+	}
+
+	datagrams := wb.newEncoder(env).datagrams(encoding)
+	if datagrams == nil {
+		return
+	}
+
+	for _, datagram := range datagrams {
+		err := stream.Send(datagram)
+		if err != nil {
+			log.Println(err)
+			atomic.AddUint64(&wb.TransportStats.SendErrors, 1)
+			wb.dropStream(env.To)
+			wb.routeReliable(env, label, true)
+			return
+		}
+	}
+}
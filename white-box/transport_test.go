@@ -0,0 +1,136 @@
+package whitebox
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitCount(counter *uint64, want uint64) bool {
+	for tries := 0; tries < 100; tries++ {
+		if atomic.LoadUint64(counter) >= want {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestStreamTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.stream")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	wb.StreamListener = wb.ListenStream("127.0.0.1", 0)
+	if wb.StreamListener == nil {
+		t.Fatalf("Could not listen for streams.")
+	}
+	defer wb.StreamListener.Close()
+	go wb.RecvStreams(wb.StreamListener)
+
+	if len(wb.capabilities()) != len(CAPABILITIES) {
+		t.Errorf("Stream capability not advertised while listening.")
+	}
+
+	stream, err := DialStream(wb.StreamListener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing stream: %v", err)
+	}
+	defer stream.Close()
+
+	env := Envelope{Type: "nothing", From: wb.PeerSelf.Id()}
+	datagrams, err := wb.encodeEnvelope(&env, WIRE_VERSION_BINARY, false)
+	if err != nil {
+		t.Fatalf("Error encoding envelope: %v", err)
+	}
+
+	// frames arrive back to back on one stream
+	for idx := 0; idx < 2; idx++ {
+		err = stream.Send(datagrams[0])
+		if err != nil {
+			t.Fatalf("Error sending on stream: %v", err)
+		}
+	}
+
+	if !waitCount(&wb.TransportStats.Received, 2) {
+		t.Errorf("Frames not received over stream:")
+		t.Errorf("Got: %d", atomic.LoadUint64(&wb.TransportStats.Received))
+		t.Errorf("Expecting: %d", 2)
+	}
+
+	stream.Send([]byte("GET / HTTP/1.0\r\n\r\n"))
+	if !waitCount(&wb.TransportStats.Malformed, 1) {
+		t.Errorf("Garbage on a stream was not rejected.")
+	}
+
+	// no stream to peers that didn't advertise one
+	if wb.streamTo(wb.PeerSelf.Id()) != nil {
+		t.Errorf("Stream opened to a peer without the capability.")
+	}
+}
+
+func TestStreamHostLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partytest.stream")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var self Self
+	wb := New(dir, "127.0.0.1", "3499", self, DefaultConfig())
+	listener := wb.ListenStream("127.0.0.1", 0)
+	if listener == nil {
+		t.Fatalf("Could not listen for streams.")
+	}
+	defer listener.Close()
+	go wb.RecvStreams(listener)
+
+	address := listener.Addr().String()
+	conns := make([]net.Conn, 0)
+	for idx := 0; idx <= MAX_HOST_STREAMS; idx++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Error dialing stream: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	// the last one is over the host's share and gets closed
+	buf := make([]byte, 1)
+	for idx, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := conn.Read(buf)
+		closed := err == io.EOF
+		if closed != (idx == MAX_HOST_STREAMS) {
+			t.Errorf("Unexpected state for stream %d:", idx)
+			t.Errorf("Got: %v", err)
+			t.Errorf("Expecting: closed %v", idx == MAX_HOST_STREAMS)
+		}
+	}
+
+	// a slot frees up once a stream closes
+	conns[0].Close()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Error dialing stream: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = conn.Read(buf)
+	if err == io.EOF {
+		t.Errorf("Stream refused after a slot was freed.")
+	}
+}
@@ -1,8 +1,6 @@
 package whitebox
 
 import (
-	"bufio"
-	"container/list"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
@@ -11,10 +9,10 @@ import (
 	"github.com/kevinburke/nacl/box"
 	"github.com/kevinburke/nacl/sign"
 	"log"
-	"math/big"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,7 +33,9 @@ func (lpm LockingPartyMap) Len() int {
 }
 
 type LockingPeerTable struct {
-	Table [256]*list.List
+	Buckets [BUCKET_COUNT]Bucket
+	// bucket of every entry by signing key
+	Index map[string]int
 	Mutex *sync.Mutex
 }
 
@@ -46,9 +46,8 @@ type WhiteBox struct {
 	Self              Self
 	PeerSelf          Peer
 	PeerTable         LockingPeerTable
-	IdealPeerIds      [256]*big.Int
 	EmptyList         bool
-	SeenChats         map[string]bool
+	SeenChats         *DedupCache
 	Parties           LockingPartyMap
 	PendingInvites    LockingPartyMap
 	PeerCache         LockingPeerCacheMap
@@ -56,30 +55,79 @@ type WhiteBox struct {
 	FreshRequests     map[string]*Since
 	RequestChan       chan *PartyRequest
 	VerifiedBlockChan chan *VerifiedBlock
-	NoReroute         map[time.Time]bool
+	Routed            *DedupCache
+	Replays           LockingReplays
+	GroupKeys         LockingGroupKeys
+	State             LockingState
+	StateChan         chan bool
+	BootstrapChan     chan bool
+	Config            Config
+	TransportStats    *TransportStats
+	RateStats         *RateStats
+	RateLimits        LockingRateLimits
+	PeerVersions      LockingVersionMap
+	Fragments         LockingFragments
+	Acks              LockingAcks
+	SeenAcks          LockingSeenAcks
+	Streams           LockingStreams
+	StreamListener    net.Listener
+	Lookups           LockingLookups
+	// set while fillBuckets runs
+	Filling int32
+	// one message is processed at a time, whichever socket it came in on
+	ProcessLock *sync.Mutex
 }
 
 func (wb *WhiteBox) Run(port uint16) {
-	go wb.Recv("", port)
+	// resume downloads from a previous run
+	wb.RescanPacks()
+
+	// listen before returning so bootstraps sent right after Run get replies
+	wb.StreamListener = wb.ListenStream("", port)
+	go wb.Recv(wb.Listen("", port))
+	go wb.RecvStreams(wb.StreamListener)
 	go wb.SendPings()
+	go wb.MaintainTable()
 	go wb.FileRequester()
 	go wb.RequestSender()
 	go wb.VerifiedBlockWriter()
 	go wb.Advertise()
+	go wb.StateSaver()
+	go wb.AckRetrier()
 }
 
-func New(dir, addr, port string, self Self) *WhiteBox {
+func New(dir, addr, port string, self Self, config Config) *WhiteBox {
 	wb := new(WhiteBox)
+	wb.Config = config.withDefaults()
+	wb.TransportStats = new(TransportStats)
+	wb.RateStats = new(RateStats)
+	wb.RateLimits.Sources = make(map[string]*rateSource)
+	wb.RateLimits.Types = make(map[string]*tokenBucket)
+	wb.RateLimits.Senders = make(map[string]*tokenBucket)
+	wb.RateLimits.Mutex = new(sync.Mutex)
+	wb.PeerVersions.Map = make(map[string]int)
+	wb.PeerVersions.Mutex = new(sync.Mutex)
+	wb.Fragments.Map = make(map[string]*PartialMessage)
+	wb.Fragments.Sources = make(map[string]*FragmentSource)
+	wb.Fragments.Mutex = new(sync.Mutex)
+	wb.Acks.Map = make(map[string]*PendingAck)
+	wb.Acks.Mutex = new(sync.Mutex)
+	wb.SeenAcks.Map = make(map[string]time.Time)
+	wb.SeenAcks.Mutex = new(sync.Mutex)
+	wb.Streams.Map = make(map[string]*StreamTransport)
+	wb.Streams.Mutex = new(sync.Mutex)
+	wb.Lookups.Map = make(map[string]*PendingLookup)
+	wb.Lookups.Mutex = new(sync.Mutex)
+	wb.ProcessLock = new(sync.Mutex)
 	wb.ChatChannel = make(chan Chat, 100)
 	wb.StatusChannel = make(chan Status, 100)
-	wb.SeenChats = make(map[string]bool)
+	wb.SeenChats = NewDedupCache(DEDUP_SIZE, DEDUP_TTL)
 	wb.PeerTable.Mutex = new(sync.Mutex)
 
 	wb.Self = self
 	wb.InitFiles(dir)
 	wb.GetKeys(addr + ":" + port)
-	wb.CalculateIdealTableSelf(wb.Self.SignPub)
-	wb.InitTable(wb.Self.SignPub)
+	wb.InitTable()
 
 	wb.BsId = fmt.Sprintf("%s/%s/%s", addr, port, wb.PeerSelf.ShortId())
 	wb.EmptyList = true
@@ -95,7 +143,18 @@ func New(dir, addr, port string, self Self) *WhiteBox {
 	wb.FreshRequests = make(map[string]*Since)
 	wb.RequestChan = make(chan *PartyRequest, 100)
 	wb.VerifiedBlockChan = make(chan *VerifiedBlock, 100)
-	wb.NoReroute = make(map[time.Time]bool)
+	wb.Routed = NewDedupCache(DEDUP_SIZE, DEDUP_TTL)
+	wb.Replays.Map = make(map[string]*DedupCache)
+	wb.Replays.Mutex = new(sync.Mutex)
+	wb.GroupKeys.Parties = make(map[string]*PartyKeys)
+	wb.GroupKeys.Keys = make(map[string]*GroupKey)
+	wb.GroupKeys.Lost = make(map[string]bool)
+	wb.GroupKeys.Mutex = new(sync.Mutex)
+
+	wb.State.Mutex = new(sync.Mutex)
+	wb.StateChan = make(chan bool, 1)
+	wb.BootstrapChan = make(chan bool, 1)
+	wb.LoadState()
 
 	log.Println(wb.BsId)
 	wb.chatStatus(wb.BsId)
@@ -131,7 +190,7 @@ type Peer struct {
 	EncPub  nacl.Key
 	SignPub sign.PublicKey
 	Address string
-	Conn    net.Conn `json:"-"`
+	Conn    Transport `json:"-"`
 }
 
 func (peer *Peer) Id() string {
@@ -169,6 +228,12 @@ type Envelope struct {
 	To   string
 	Data []byte
 	Time time.Time
+	// highest wire version the sender decodes, 0 for json only peers
+	Version int `json:",omitempty"`
+	// set when the sender wants an ack from the recipient
+	Id string `json:",omitempty"`
+	// forwards left for a routed envelope
+	Hops int `json:",omitempty"`
 }
 
 type MessageSuggestions struct {
@@ -202,8 +267,10 @@ type MessagePing struct {
 }
 
 type MessageTimePeer struct {
-	Peer Peer
-	Time time.Time
+	Peer         Peer
+	Time         time.Time
+	Protocol     int      `json:",omitempty"`
+	Capabilities []string `json:",omitempty"`
 }
 
 func (wb *WhiteBox) IdFront(id string) (string, error) {
@@ -235,13 +302,13 @@ func (wb *WhiteBox) IdToMin(id string) (*MinPeer, error) {
 
 	signHex := pubs[0]
 	signBytes, err := hex.DecodeString(signHex)
-	if err != nil {
+	if err != nil || len(signBytes) != sign.PublicKeySize {
 		return nil, errors.New("error invalid id (min)")
 	}
 
 	encHex := pubs[1]
 	encBytes, err := hex.DecodeString(encHex)
-	if err != nil {
+	if err != nil || len(encBytes) != nacl.KeySize {
 		return nil, errors.New("error invalid id (min)")
 	}
 
@@ -249,7 +316,7 @@ func (wb *WhiteBox) IdToMin(id string) (*MinPeer, error) {
 	min.SignPub = sign.PublicKey(signBytes)
 
 	var encFixed [nacl.KeySize]byte
-	copy(encFixed[:], encBytes[:nacl.KeySize])
+	copy(encFixed[:], encBytes)
 	min.EncPub = nacl.Key(&encFixed)
 
 	return min, nil
@@ -268,34 +335,45 @@ func selfZero(self Self) bool {
 		self.EncPub == nil || self.SignPrv == nil
 }
 
-func (wb *WhiteBox) GetKeys(address string) {
-	wb.Self.Address = address
+// Generate fresh signing and encryption keys.
+func GenerateSelf() (Self, error) {
+	var self Self
+	r := rand.Reader
+	signPub, signPrv, err := sign.Keypair(r)
+	if err != nil {
+		return self, err
+	}
 
-	if selfZero(wb.Self) {
-		r := rand.Reader
-		signPub, signPrv, err := sign.Keypair(r)
-		if err != nil {
-			log.Fatal(err)
-		}
+	encPub, encPrv, err := box.GenerateKey(r)
+	if err != nil {
+		return self, err
+	}
+
+	self.SignPub = signPub
+	self.SignPrv = signPrv
+	self.EncPub = encPub
+	self.EncPrv = encPrv
+	return self, nil
+}
 
-		encPub, encPrv, err := box.GenerateKey(r)
+func (wb *WhiteBox) GetKeys(address string) {
+	if selfZero(wb.Self) {
+		self, err := GenerateSelfWork(wb.Config.IdWork)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		wb.Self.SignPub = signPub
-		wb.Self.SignPrv = signPrv
-		wb.Self.EncPub = encPub
-		wb.Self.EncPrv = encPrv
+		wb.Self = self
 	}
 
+	wb.Self.Address = address
+
 	wb.PeerSelf.SignPub = wb.Self.SignPub
 	wb.PeerSelf.EncPub = wb.Self.EncPub
 	wb.PeerSelf.Address = wb.Self.Address
 	log.Println(wb.PeerSelf.Id())
 }
 
-func (wb *WhiteBox) Recv(address string, port uint16) {
+func (wb *WhiteBox) Listen(address string, port uint16) *net.UDPConn {
 	addr := net.UDPAddr{
 		Port: int(port),
 		IP:   net.ParseIP(address),
@@ -306,21 +384,71 @@ func (wb *WhiteBox) Recv(address string, port uint16) {
 		log.Fatal(err)
 	}
 
-	defer conn.Close()
 	log.Println("listening...")
+	return conn
+}
 
-	reader := bufio.NewReaderSize(conn, 2*65536)
+// Read one envelope or fragment per datagram. Bad datagrams are counted in
+// TransportStats and dropped.
+func (wb *WhiteBox) Recv(conn *net.UDPConn) {
+	defer conn.Close()
+
+	// one byte over the limit so oversized datagrams show up as such
+	buf := make([]byte, MAX_DATAGRAM_SIZE+1)
 	for {
-		line, err := reader.ReadString('\n')
+		n, addr, err := conn.ReadFromUDP(buf)
 		if err != nil {
+			atomic.AddUint64(&wb.TransportStats.ReadErrors, 1)
 			wb.setStatus("error reading")
+			log.Println(err)
+			continue
 		}
 
-		log.Println("got", line)
+		wb.handleDatagram(addr.String(), buf[:n])
+	}
+}
 
-		wb.processMessage(line)
+// Unframe, reassemble and process one datagram from source, a udp address
+// or a stream.
+func (wb *WhiteBox) handleDatagram(source string, datagram []byte) {
+	if !wb.allowSource(source) {
+		return
 	}
 
+	header, payload, err := unframe(datagram)
+	if err != nil {
+		if err == errFrameTooLarge {
+			atomic.AddUint64(&wb.TransportStats.Oversized, 1)
+		} else {
+			atomic.AddUint64(&wb.TransportStats.Malformed, 1)
+		}
+		wb.setStatus(err.Error())
+		return
+	}
+
+	atomic.AddUint64(&wb.TransportStats.Received, 1)
+
+	if header.Flags&FRAME_FLAG_FRAGMENT != 0 {
+		atomic.AddUint64(&wb.TransportStats.Fragments, 1)
+		payload, err = wb.reassemble(source, header.Version, payload)
+		if err != nil {
+			atomic.AddUint64(&wb.TransportStats.Malformed, 1)
+			wb.setStatus(err.Error())
+			return
+		}
+
+		if payload == nil {
+			return
+		}
+
+		atomic.AddUint64(&wb.TransportStats.Reassembled, 1)
+	}
+
+	log.Println("got", len(payload), "bytes, version", header.Version)
+
+	wb.ProcessLock.Lock()
+	defer wb.ProcessLock.Unlock()
+	wb.processMessage(source, header.Version, payload)
 }
 
 func (wb *WhiteBox) setStatus(message string) {